@@ -0,0 +1,348 @@
+package dlog
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	fb "github.com/google/flatbuffers/go"
+	"github.com/netbrain/dlog/keystore"
+	"github.com/netbrain/dlog/model"
+)
+
+//DefaultBlockSize is the default size in bytes of the entries of a block
+//before it is compressed and written
+const DefaultBlockSize = 64 << 10
+
+//DefaultFlushInterval is the default time the first entry of a block waits
+//for the block to fill up before it is written
+const DefaultFlushInterval = 100 * time.Millisecond
+
+/*
+A segment is written in blocks of many entries, which are compressed by the
+codec recorded in the header of the segment:
+	|---------------------------------------------------------------|
+	| Magic (64) | Codec (8)                                        |
+	|---------------------------------------------------------------|
+	| BlockLength (32) | CRC-32C (32) | Compressed block            |
+	|---------------------------------------------------------------|
+A block holds the uvarint framed entries of the segment, and is written once
+it grows to the block size or its first entry has waited the flush
+interval. Segments written before blocks existed are a single deflate
+stream. The BlockLength counts the CRC-32C (Castagnoli) checksum of the
+compressed block along with the block.
+*/
+var blockSegmentMagic = []byte("dlog.blk")
+
+var blockChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+//errBlockChecksum is returned for a block which does not match its checksum
+var errBlockChecksum = errors.New("block does not match its checksum")
+
+//segmentFormat is how new segments are written
+type segmentFormat struct {
+	keys      keystore.KeyProvider
+	codec     Codec
+	blockSize int
+}
+
+//segmentWriter writes the frames written to it to a segment in blocks,
+//encrypts the blocks if it has a sealer, and records the blocks in the
+//index of the segment, see blockIndexRecordSize
+type segmentWriter struct {
+	w         io.Writer
+	out       *countingWriter
+	sealer    *sealingWriter
+	index     io.Writer
+	codec     Codec
+	blockSize int
+	block     []byte
+	encoded   []byte
+	//first is the offset of the first entry of the block, if it has any,
+	//and started when it was added
+	first   uint64
+	started time.Time
+	entries bool
+}
+
+//newSegmentWriter writes the headers of a new segment of the base offset,
+//and returns a writer of its blocks which records them in the index, if it
+//is not nil
+func newSegmentWriter(w io.Writer, index io.Writer, format segmentFormat, base uint64) (*segmentWriter, error) {
+	writer := &segmentWriter{
+		out:       &countingWriter{w: w},
+		index:     index,
+		codec:     format.codec,
+		blockSize: format.blockSize,
+	}
+	writer.w = writer.out
+	if writer.codec == nil {
+		writer.codec = NewFlateCodec(flate.DefaultCompression)
+	}
+	if writer.blockSize <= 0 {
+		writer.blockSize = DefaultBlockSize
+	}
+	if format.keys != nil {
+		sealer, err := newSealingWriter(writer.out, format.keys, base)
+		if err != nil {
+			return nil, err
+		}
+		writer.w = sealer
+		writer.sealer = sealer
+	}
+
+	header := append(append([]byte(nil), blockSegmentMagic...), writer.codec.ID())
+	if _, err := writer.w.Write(header); err != nil {
+		return nil, err
+	}
+	if writer.sealer != nil {
+		if err := writer.sealer.flush(); err != nil {
+			return nil, err
+		}
+	}
+	return writer, nil
+}
+
+//appendSegmentWriter returns a writer appending blocks to the existing
+//segment file of the base offset, in the codec and the key it was written
+//with. A torn block or chunk at the end of the file is truncated, as is the
+//final chunk of a sealed segment. The index of the segment is written
+//afresh to index, if it is not nil.
+func appendSegmentWriter(file *os.File, w io.Writer, index io.Writer, format segmentFormat, base uint64) (*segmentWriter, error) {
+	rFile, err := os.Open(file.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer rFile.Close()
+
+	reader := bufio.NewReader(rFile)
+	source, ok, err := readSegmentHeaders(reader, format.keys, base)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("segment %s is not written in blocks", file.Name())
+	}
+
+	size := source.size
+	seq := source.chunks
+	for ; ; seq++ {
+		unit, err := readUnit(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		var block []byte
+		final := false
+		if err == nil {
+			block, final, err = source.block(unit, seq)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err == io.ErrUnexpectedEOF || final {
+			if err := file.Truncate(size); err != nil {
+				return nil, err
+			}
+			break
+		}
+		if first, ok := blockFirstOffset(block); ok && index != nil {
+			if _, err := index.Write(encodeBlockIndexEntry(blockIndexEntry{first, size})); err != nil {
+				return nil, err
+			}
+		}
+		size += int64(fb.SizeUint32 + len(unit))
+	}
+
+	writer := &segmentWriter{
+		out:       &countingWriter{w: w, n: size},
+		index:     index,
+		codec:     source.codec,
+		blockSize: format.blockSize,
+	}
+	writer.w = writer.out
+	if writer.blockSize <= 0 {
+		writer.blockSize = DefaultBlockSize
+	}
+	if source.cipher != nil {
+		writer.sealer = &sealingWriter{w: writer.out, cipher: source.cipher, seq: seq}
+		writer.w = writer.sealer
+	}
+	return writer, nil
+}
+
+//readBlockHeader reads the header of a segment written in blocks, the
+//second return value is false for a segment written before blocks existed
+func readBlockHeader(reader *bufio.Reader) (Codec, bool, error) {
+	magic, err := reader.Peek(len(blockSegmentMagic) + 1)
+	if err != nil || !bytes.Equal(magic[:len(blockSegmentMagic)], blockSegmentMagic) {
+		return nil, false, nil
+	}
+	codec, err := codecOf(magic[len(blockSegmentMagic)])
+	if err != nil {
+		return nil, false, err
+	}
+	reader.Discard(len(magic))
+	return codec, true, nil
+}
+
+func (w *segmentWriter) Write(p []byte) (int, error) {
+	w.block = append(w.block, p...)
+	if len(w.block) >= w.blockSize {
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+//writeEntry adds the entry at the offset to the current block
+func (w *segmentWriter) writeEntry(offset uint64, entry model.LogEntry) error {
+	if !w.entries {
+		w.first = offset
+		w.started = time.Now()
+		w.entries = true
+	}
+	_, err := w.Write(encodeSegmentEntry(offset, entry))
+	return err
+}
+
+//buffered returns the size of the entries of the current block
+func (w *segmentWriter) buffered() int {
+	return len(w.block)
+}
+
+//Flush compresses and writes the current block, and records it in the index
+func (w *segmentWriter) Flush() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	position := w.out.n
+	encoded, err := w.codec.Encode(w.encoded[:0], w.block)
+	if err != nil {
+		return err
+	}
+	w.encoded = encoded
+
+	header := make([]byte, fb.SizeUint32*2)
+	fb.WriteUint32(header, uint32(fb.SizeUint32+len(encoded)))
+	fb.WriteUint32(header[fb.SizeUint32:], crc32.Checksum(encoded, blockChecksumTable))
+	if _, err := w.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(encoded); err != nil {
+		return err
+	}
+	w.block = w.block[:0]
+	if w.sealer != nil {
+		if err := w.sealer.flush(); err != nil {
+			return err
+		}
+	}
+
+	if w.entries && w.index != nil {
+		if _, err := w.index.Write(encodeBlockIndexEntry(blockIndexEntry{w.first, position})); err != nil {
+			return err
+		}
+	}
+	w.entries = false
+	return nil
+}
+
+//seal writes the current block, and the final chunk of an encrypted
+//segment, after which no block may be written
+func (w *segmentWriter) seal() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if w.sealer == nil {
+		return nil
+	}
+	return w.sealer.finish()
+}
+
+//openSegment returns a reader of the frames of the segment file of the
+//base offset
+func openSegment(r io.Reader, keys keystore.KeyProvider, base uint64) (io.Reader, error) {
+	reader, err := decryptSegment(bufio.NewReader(r), keys, base)
+	if err != nil {
+		return nil, err
+	}
+	codec, ok, err := readBlockHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return flate.NewReader(reader), nil
+	}
+	return &blockReader{r: reader, codec: codec}, nil
+}
+
+//readUnit reads a block or a chunk prefixed by its length. A torn one at
+//the end reads as io.ErrUnexpectedEOF.
+func readUnit(reader *bufio.Reader) ([]byte, error) {
+	lengthBytes := make([]byte, fb.SizeUint32)
+	if _, err := io.ReadFull(reader, lengthBytes); err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	//a corrupt length may be up to 4 GiB, so beyond maxUnitAllocation the
+	//unit only grows with what is actually read
+	length := int64(fb.GetUint32(lengthBytes))
+	allocation := length
+	if allocation > maxUnitAllocation {
+		allocation = maxUnitAllocation
+	}
+	unit := bytes.NewBuffer(make([]byte, 0, allocation))
+	if _, err := io.CopyN(unit, reader, length); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return unit.Bytes(), nil
+}
+
+//maxUnitAllocation is the most that is allocated up front for a block or
+//a chunk by readUnit
+const maxUnitAllocation = 1 << 20
+
+//blockReader reads the decompressed blocks of a segment
+type blockReader struct {
+	r     *bufio.Reader
+	codec Codec
+	buf   []byte
+}
+
+func (b *blockReader) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		block, err := readUnit(b.r)
+		if err != nil {
+			return 0, err
+		}
+		if b.buf, err = decodeBlock(b.codec, block); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+//decodeBlock checks the block the unit holds against its checksum, and
+//decompresses it
+func decodeBlock(codec Codec, unit []byte) ([]byte, error) {
+	if len(unit) < fb.SizeUint32 {
+		return nil, fmt.Errorf("block of %d bytes is shorter than its checksum", len(unit))
+	}
+	if crc32.Checksum(unit[fb.SizeUint32:], blockChecksumTable) != fb.GetUint32(unit) {
+		return nil, errBlockChecksum
+	}
+	return codec.Decode(unit[fb.SizeUint32:])
+}
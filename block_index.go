@@ -0,0 +1,233 @@
+package dlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	fb "github.com/google/flatbuffers/go"
+	"github.com/netbrain/dlog/keystore"
+)
+
+/*
+Every segment written in blocks has an index next to it, with a record for
+every block that holds entries:
+	|---------------------------------------------------------------|
+	| FirstOffset (64) | Position (64)                              |
+	|---------------------------------------------------------------|
+Position is where the block, or the chunk holding it if the segment is
+encrypted, starts in the segment file, and FirstOffset is the offset of the
+first entry in it. Reading from an offset starts at the last block whose
+first entry is not after it, so that only the entries of that block before
+the offset are decompressed in vain. A record which does not match the
+block at its position is ignored, and the segment is read from its start.
+*/
+var blockIndexRecordSize = 2 * fb.SizeUint64
+
+//blockIndexEntry is a record of the index of a segment
+type blockIndexEntry struct {
+	first    uint64
+	position int64
+}
+
+//indexPath returns the path of the index of the segment file
+func indexPath(segmentPath string) string {
+	return strings.TrimSuffix(segmentPath, ".bin") + ".idx"
+}
+
+func encodeBlockIndexEntry(entry blockIndexEntry) []byte {
+	record := make([]byte, blockIndexRecordSize)
+	fb.WriteUint64(record, entry.first)
+	fb.WriteInt64(record[fb.SizeUint64:], entry.position)
+	return record
+}
+
+//readBlockIndex reads the index of the segment, a torn record at the end
+//is left out
+func readBlockIndex(path string) ([]blockIndexEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	index := make([]blockIndexEntry, 0, len(data)/blockIndexRecordSize)
+	for ; len(data) >= blockIndexRecordSize; data = data[blockIndexRecordSize:] {
+		index = append(index, blockIndexEntry{
+			first:    fb.GetUint64(data),
+			position: fb.GetInt64(data[fb.SizeUint64:]),
+		})
+	}
+	return index, nil
+}
+
+//blockSource decodes the blocks of a segment from the units they are
+//written in, which are chunks holding them if the segment is encrypted
+type blockSource struct {
+	cipher *segmentCipher
+	codec  Codec
+	//size is the size of the headers in the segment file, and chunks the
+	//number of chunks they are sealed in
+	size   int64
+	chunks uint64
+}
+
+//readSegmentHeaders reads the headers of the segment of the base offset,
+//the reader is left at its first unit. The second return value is false for
+//a segment written before blocks existed.
+func readSegmentHeaders(reader *bufio.Reader, keys keystore.KeyProvider, base uint64) (blockSource, bool, error) {
+	var source blockSource
+	id, header, encrypted, err := readEncryptionHeader(reader)
+	if err != nil {
+		return source, false, err
+	}
+	plain := reader
+	if encrypted {
+		aead, err := segmentAEAD(id, keys)
+		if err != nil {
+			return source, false, err
+		}
+		source.cipher = &segmentCipher{aead, header, base}
+
+		//the block header is sealed in a chunk of its own
+		chunk, err := readUnit(reader)
+		if err == io.EOF {
+			return source, false, nil
+		}
+		if err != nil {
+			return source, false, err
+		}
+		opened, final, err := source.cipher.open(chunk, 0)
+		if err == nil && final {
+			err = fmt.Errorf("encrypted segment holds no block header")
+		}
+		if err != nil {
+			return source, false, err
+		}
+		plain = bufio.NewReader(bytes.NewReader(opened))
+		source.size = int64(len(header) + fb.SizeUint32 + len(chunk))
+		source.chunks = 1
+	}
+
+	codec, ok, err := readBlockHeader(plain)
+	source.codec = codec
+	if ok && !encrypted {
+		source.size = int64(len(blockSegmentMagic) + 1)
+	}
+	return source, ok, err
+}
+
+//block returns the decompressed block the unit holds, which is the chunk of
+//the sequence number if the segment is encrypted. It returns true rather
+//than a block for the final chunk of an encrypted segment.
+func (s blockSource) block(unit []byte, seq uint64) ([]byte, bool, error) {
+	if s.cipher != nil {
+		plain, final, err := s.cipher.open(unit, seq)
+		if err != nil || final {
+			return nil, final, err
+		}
+		if len(plain) < fb.SizeUint32 || int(fb.GetUint32(plain)) != len(plain)-fb.SizeUint32 {
+			return nil, false, fmt.Errorf("invalid block of encrypted segment")
+		}
+		unit = plain[fb.SizeUint32:]
+	}
+	block, err := decodeBlock(s.codec, unit)
+	return block, false, err
+}
+
+//reader returns a reader of the blocks of the units read from r, starting
+//at the chunk of the sequence number if the segment is encrypted
+func (s blockSource) reader(r *bufio.Reader, seq uint64) io.Reader {
+	if s.cipher != nil {
+		r = bufio.NewReader(&openingReader{r: r, cipher: s.cipher, seq: seq})
+	}
+	return &blockReader{r: r, codec: s.codec}
+}
+
+//blockFirstOffset returns the offset of the first entry of the block,
+//false if it holds none
+func blockFirstOffset(block []byte) (uint64, bool) {
+	for marker := true; len(block) > 0; marker = false {
+		length, n := binary.Uvarint(block)
+		if n <= 0 || uint64(len(block)-n) < length {
+			return 0, false
+		}
+		frame := block[n : n+int(length)]
+		if marker && bytes.Equal(frame, offsetsMarker) {
+			block = block[n+int(length):]
+			continue
+		}
+		if len(frame) < fb.SizeUint64 {
+			return 0, false
+		}
+		return fb.GetUint64(frame), true
+	}
+	return 0, false
+}
+
+//openAt returns a reader of the frames of the segment from the block
+//holding the offset, along with true if a block after the first one was
+//found for it by the index of the segment
+func (seg segment) openAt(offset uint64) (io.ReadCloser, bool, error) {
+	if offset > seg.base {
+		if index, err := seg.blockIndex(); err == nil {
+			i := sort.Search(len(index), func(i int) bool {
+				return index[i].first > offset
+			}) - 1
+			if i > 0 {
+				if reader, ok := seg.openBlock(index[i]); ok {
+					return reader, true, nil
+				}
+			}
+		}
+	}
+	reader, err := seg.open()
+	return reader, false, err
+}
+
+//openBlock returns a reader of the frames of the segment from the block of
+//the index entry, false if the entry does not match the segment
+func (seg segment) openBlock(entry blockIndexEntry) (io.ReadCloser, bool) {
+	file, err := seg.openFile()
+	if err != nil {
+		return nil, false
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, false
+	}
+	source, ok, err := readSegmentHeaders(bufio.NewReader(file), seg.format.keys, seg.base)
+	if err != nil || !ok || entry.position+int64(fb.SizeUint32) > info.Size() {
+		file.Close()
+		return nil, false
+	}
+
+	if _, err := file.Seek(entry.position, io.SeekStart); err != nil {
+		file.Close()
+		return nil, false
+	}
+	reader := bufio.NewReader(file)
+	lengthBytes, err := reader.Peek(fb.SizeUint32)
+	if err != nil || entry.position+int64(fb.SizeUint32)+int64(fb.GetUint32(lengthBytes)) > info.Size() {
+		file.Close()
+		return nil, false
+	}
+	unit, err := readUnit(reader)
+	if err != nil {
+		file.Close()
+		return nil, false
+	}
+	//the chunk is authenticated along with the sequence number it claims,
+	//the chunks after it must follow it
+	seq := chunkSequence(unit)
+	block, final, err := source.block(unit, seq)
+	if first, ok := blockFirstOffset(block); err != nil || final || !ok || first != entry.first {
+		file.Close()
+		return nil, false
+	}
+	return &segmentReader{io.MultiReader(bytes.NewReader(block), source.reader(reader, seq+1)), file}, true
+}
@@ -0,0 +1,113 @@
+package dlog
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/netbrain/dlog/keystore"
+	"github.com/netbrain/dlog/model"
+	. "github.com/netbrain/dlog/testdata"
+)
+
+//countingCodec counts the blocks it decodes
+type countingCodec struct {
+	Codec
+	decoded int32
+}
+
+func (c *countingCodec) ID() byte { return 200 }
+
+func (c *countingCodec) Decode(compressed []byte) ([]byte, error) {
+	atomic.AddInt32(&c.decoded, 1)
+	return c.Codec.Decode(compressed)
+}
+
+//readOne reads the entry at the offset
+func readOne(t *testing.T, logger *Logger, offset uint64) model.LogEntry {
+	var read model.LogEntry
+	err := logger.read(offset, func(_ uint64, entry model.LogEntry) bool {
+		read = entry
+		return false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return read
+}
+
+func TestLoggerReadsFromOffsetInOneBlock(t *testing.T) {
+	codec := &countingCodec{Codec: LZCodec}
+	RegisterCodec(codec)
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "segment.keys")
+	ioutil.WriteFile(keyFile, []byte("k1:"+strings.Repeat("01", 32)+"\n"), 0600)
+
+	for _, options := range []LoggerOptions{
+		{Codec: codec, BlockSize: 1},
+		{Codec: codec, BlockSize: 1, SegmentKeys: keystore.NewFileKeyProvider(keyFile)},
+	} {
+		os.RemoveAll(filepath.Join(dir, "log"))
+		logger, _ := NewLoggerWithOptions(filepath.Join(dir, "log"), options)
+		for x := 0; x < 100; x++ {
+			logger.Write(NewLogEntryTestData().WithPayload([]byte(fmt.Sprint(x))).Build())
+		}
+		logger.Sync()
+
+		index, err := readBlockIndex(indexPath(segmentPath(logger.directory, 0)))
+		if err != nil || len(index) != 100 {
+			t.Fatalf("expected a block per entry in the index, got %d: %v", len(index), err)
+		}
+
+		atomic.StoreInt32(&codec.decoded, 0)
+		if entry := readOne(t, logger, 57); string(entry.Payload()) != "57" {
+			t.Fatalf("expected entry 57, got %q", entry.Payload())
+		}
+		if decoded := atomic.LoadInt32(&codec.decoded); decoded != 1 {
+			t.Fatalf("expected a single block to be decoded, got %d", decoded)
+		}
+		logger.Close()
+
+		//the index of the active segment is written afresh when it is opened
+		ioutil.WriteFile(indexPath(segmentPath(logger.directory, 0)), nil, 0644)
+		logger, _ = NewLoggerWithOptions(logger.directory, options)
+		if index, _ := readBlockIndex(indexPath(segmentPath(logger.directory, 0))); len(index) != 100 {
+			t.Fatalf("expected the index to be rebuilt, got %d records", len(index))
+		}
+		if entry := readOne(t, logger, 99); string(entry.Payload()) != "99" {
+			t.Fatalf("expected entry 99, got %q", entry.Payload())
+		}
+		logger.Close()
+	}
+}
+
+func TestLoggerIgnoresStaleBlockIndex(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+
+	logger, _ := NewLoggerWithOptions(dir, LoggerOptions{BlockSize: 1})
+	defer logger.Close()
+	for x := 0; x < 10; x++ {
+		logger.Write(NewLogEntryTestData().WithPayload([]byte(fmt.Sprint(x))).Build())
+	}
+	logger.Sync()
+
+	//records of blocks which are not where the index has them
+	var stale bytes.Buffer
+	stale.Write(encodeBlockIndexEntry(blockIndexEntry{0, 0}))
+	stale.Write(encodeBlockIndexEntry(blockIndexEntry{3, 20}))
+	stale.Write(encodeBlockIndexEntry(blockIndexEntry{6, 1 << 40}))
+	ioutil.WriteFile(indexPath(segmentPath(dir, 0)), stale.Bytes(), 0644)
+
+	for _, offset := range []uint64{4, 7} {
+		if entry := readOne(t, logger, offset); string(entry.Payload()) != fmt.Sprint(offset) {
+			t.Fatalf("expected entry %d, got %q", offset, entry.Payload())
+		}
+	}
+}
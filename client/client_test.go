@@ -1,14 +1,23 @@
 package client
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/netbrain/dlog"
+	"github.com/netbrain/dlog/keystore"
 	"github.com/netbrain/dlog/model"
 )
 
@@ -102,7 +111,7 @@ func TestClientCanWriteAndReplay(t *testing.T) {
 			defer client.Close()
 			defer wg.Done()
 			for b := range readChan {
-				client.write([]byte{b})
+				client.write(nil, []byte{b})
 			}
 		}(client)
 	}
@@ -118,3 +127,574 @@ func TestClientCanWriteAndReplay(t *testing.T) {
 	}
 
 }
+
+func TestConnDetectsDeadServer(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		//accept but never answer any pings
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	netConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := newConn(listener.Addr().String(), netConn, time.Millisecond*10, time.Millisecond*100)
+	defer conn.Close()
+	session, err := conn.session(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-session.done:
+	case <-time.After(time.Millisecond * 500):
+		t.Fatal("dead server was not detected")
+	}
+}
+
+func TestConnStaysAliveWithHeartbeats(t *testing.T) {
+	s := createAndStartServer()
+	defer s.server.Stop()
+
+	netConn, err := net.Dial("tcp", s.server.Address().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := newConn(s.server.Address().String(), netConn, time.Millisecond*10, time.Millisecond*100)
+	defer conn.Close()
+	session, err := conn.session(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-session.done:
+		t.Fatal("live server was considered dead")
+	case <-time.After(time.Millisecond * 300):
+	}
+}
+
+func restartServer(t *testing.T, s *serverTest) {
+	_, port, _ := net.SplitHostPort(s.server.Address().String())
+	s.server.Stop()
+
+	p, _ := strconv.Atoi(port)
+	s.server = dlog.NewServer(s.logger, p)
+	go s.server.Start()
+}
+
+func TestClientSurvivesServerRestart(t *testing.T) {
+	s := createAndStartServer()
+	addresses := []string{s.server.Address().String()}
+
+	writeClient := NewWriteClient(addresses)
+	readClient := NewReadClient(addresses)
+	defer readClient.Close()
+	subscription := readClient.Subscribe()
+
+	receive := func(expected byte) {
+		select {
+		case logEntry := <-subscription:
+			if logEntry.Payload()[0] != expected {
+				t.Fatalf("%v != %v", logEntry.Payload()[0], expected)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("timed out waiting for %v", expected)
+		}
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	writeClient.Write([]byte{1})
+	receive(1)
+
+	restartServer(t, s)
+	writeClient.Write([]byte{2})
+	writeClient.Write([]byte{3})
+	receive(2)
+	receive(3)
+	writeClient.Close()
+	defer s.server.Stop()
+
+	if offset := s.logger.Offset(); offset != 3 {
+		t.Fatalf("expected 3 entries, got %d", offset)
+	}
+}
+
+func TestWriteContextWaitsForAck(t *testing.T) {
+	s := createAndStartServer()
+	defer s.server.Stop()
+
+	writeClient, err := NewWriteClientContext(context.Background(), []string{s.server.Address().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writeClient.Close()
+
+	if err := writeClient.WriteContext(context.Background(), []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if offset := s.logger.Offset(); offset != 1 {
+		t.Fatalf("expected the write to be logged, got offset %d", offset)
+	}
+}
+
+func TestWriteContextWaitsForQuorumPastItsTimeout(t *testing.T) {
+	logger, _ := dlog.NewLogger("")
+	leader := dlog.NewServer(logger, 0)
+	leader.Quorum = 2
+	leader.QuorumTimeout = time.Millisecond * 200
+	go leader.Start()
+	defer leader.Stop()
+
+	writeClient, err := NewWriteClientContext(context.Background(), []string{leader.Address().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writeClient.Close()
+
+	follower := createAndStartServer()
+	defer follower.server.Stop()
+	time.AfterFunc(time.Millisecond*500, func() {
+		follower.server.Follow(leader.Address().String())
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	if err := writeClient.WriteContext(ctx, []byte{1}); err != nil {
+		t.Fatalf("expected the write to be acknowledged once the quorum has it, got %v", err)
+	}
+}
+
+func TestWriteContextTimesOut(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		//accept but never acknowledge anything
+		if conn, err := listener.Accept(); err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	writeClient, err := NewWriteClientContext(context.Background(), []string{listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	if err := writeClient.WriteContext(ctx, []byte{1}); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	if err := writeClient.CloseContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestNewWriteClientContextFailsToConnect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	if _, err := NewWriteClientContext(ctx, []string{"localhost:1"}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestCancelSubscribeContextClosesChannel(t *testing.T) {
+	s := createAndStartServer()
+	defer s.server.Stop()
+
+	readClient := NewReadClient([]string{s.server.Address().String()})
+	defer readClient.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	subscription := readClient.SubscribeContext(ctx)
+	cancel()
+
+	select {
+	case _, open := <-subscription:
+		if open {
+			t.Fatal("expected no entries")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscription was not closed")
+	}
+}
+
+func TestCancelReplayContextClosesChannel(t *testing.T) {
+	s := createAndStartServer()
+	defer s.server.Stop()
+	addresses := []string{s.server.Address().String()}
+
+	writeClient := NewWriteClient(addresses)
+	for x := 0; x < 100; x++ {
+		writeClient.Write([]byte{byte(x)})
+	}
+	writeClient.Close()
+
+	readClient := NewReadClient(addresses)
+	defer readClient.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	replay := readClient.ReplayContext(ctx)
+	<-replay
+	cancel()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, open := <-replay:
+			if !open {
+				return
+			}
+		case <-timeout:
+			t.Fatal("replay was not closed")
+		}
+	}
+}
+
+func TestWriteKeyKeepsKeyOnOnePartition(t *testing.T) {
+	numServers := 3
+	addresses := make([]string, numServers)
+	servers := make([]*serverTest, numServers)
+	for x := 0; x < numServers; x++ {
+		servers[x] = createAndStartServer()
+		addresses[x] = servers[x].server.Address().String()
+		defer servers[x].server.Stop()
+	}
+
+	writeClient := NewWriteClient(addresses)
+	for x := 0; x < 30; x++ {
+		key := []byte(fmt.Sprintf("order-%d", x%3))
+		if err := writeClient.WriteKeyContext(context.Background(), key, []byte{byte(x)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeClient.Close()
+
+	readClient := NewReadClient(addresses)
+	defer readClient.Close()
+
+	var payloads []byte
+	for payload := range readClient.ReplayKey([]byte("order-1")) {
+		payloads = append(payloads, payload[0])
+	}
+
+	expected := []byte{1, 4, 7, 10, 13, 16, 19, 22, 25, 28}
+	if !reflect.DeepEqual(payloads, expected) {
+		t.Fatalf("%v != %v", payloads, expected)
+	}
+
+	partition := newHashRing(numServers).partition([]byte("order-1"))
+	p, partitions, ok := servers[partition].logger.Partition()
+	if !ok || p != partition || partitions != uint32(numServers) {
+		t.Fatalf("expected partition %d/%d to be recorded, got %d/%d", partition, numServers, p, partitions)
+	}
+}
+
+func TestLeaderConnectionPoolFollowsNewLeader(t *testing.T) {
+	servers := make([]*serverTest, 3)
+	addresses := make([]string, len(servers))
+	for i := range servers {
+		servers[i] = createAndStartServer()
+		servers[i].server.ElectionTimeout = time.Millisecond * 100
+		_, port, _ := net.SplitHostPort(servers[i].server.Address().String())
+		addresses[i] = net.JoinHostPort("127.0.0.1", port)
+	}
+	for i, s := range servers {
+		defer s.server.Stop()
+		if err := s.server.JoinCluster(addresses[i], addresses...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//leader waits until the running servers agree on a leader
+	stopped := -1
+	leader := func() int {
+		for start := time.Now(); time.Since(start) < time.Second*5; time.Sleep(time.Millisecond * 10) {
+			for i, s := range servers {
+				if s.server.Leader() != addresses[i] {
+					continue
+				}
+				agreed := true
+				for j, other := range servers {
+					agreed = agreed && (j == stopped || other.server.Leader() == addresses[i])
+				}
+				if agreed {
+					return i
+				}
+			}
+		}
+		t.Fatal("timed out waiting for a leader")
+		return -1
+	}
+
+	first := leader()
+	pool, err := NewLeaderConnectionPoolContext(context.Background(), []string{addresses[(first+1)%3]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata := pool.Metadata(); metadata.Leader != addresses[first] || len(metadata.Members) != 3 {
+		t.Fatalf("unexpected metadata %v", metadata)
+	}
+	writeClient := NewWriteClientWithPool(pool)
+	defer writeClient.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := writeClient.WriteContext(ctx, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	servers[first].server.Stop()
+	stopped = first
+	if err := writeClient.WriteContext(ctx, []byte{2}); err != nil {
+		t.Fatal(err)
+	}
+	next := leader()
+	if next == first {
+		t.Fatal("expected a new leader")
+	}
+	if offset := servers[next].logger.Offset(); offset != 2 {
+		t.Fatalf("expected 2 entries on the new leader, got %d", offset)
+	}
+}
+
+func TestFetchMetadataOfStandaloneServer(t *testing.T) {
+	s := createAndStartServer()
+	defer s.server.Stop()
+	s.logger.WriteKey([]byte("order-1"), 1, 4, model.NewLogEntry(model.NewMetaData(model.NewUUID(), 1, model.NewUUID()), nil))
+
+	metadata, err := FetchMetadata(context.Background(), s.server.Address().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Leader == "" || len(metadata.Members) != 1 || metadata.Members[0] != metadata.Leader {
+		t.Fatalf("expected the server to be its own leader, got %v", metadata)
+	}
+	if metadata.Offset != 1 || metadata.Partitions != 4 {
+		t.Fatalf("expected offset 1 and 4 partitions, got %v", metadata)
+	}
+}
+
+func TestReadClientWithTokenReadsOwnWrites(t *testing.T) {
+	leader := createAndStartServer()
+	defer leader.server.Stop()
+	follower := createAndStartServer()
+	defer follower.server.Stop()
+	follower.server.Follow(leader.server.Address().String())
+
+	writeClient := NewWriteClient([]string{leader.server.Address().String()})
+	defer writeClient.Close()
+	readClient := NewReadClient([]string{follower.server.Address().String()})
+	defer readClient.Close()
+
+	for x := 0; x < 10; x++ {
+		if err := writeClient.WriteContext(context.Background(), []byte{byte(x)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token := writeClient.Token()
+	if !reflect.DeepEqual(token, ConsistencyToken{10}) {
+		t.Fatalf("unexpected token %v", token)
+	}
+
+	i := 0
+	for data := range readClient.WithToken(token).Replay() {
+		if data[0] != byte(i) {
+			t.Fatalf("%v != %v", data[0], i)
+		}
+		i++
+	}
+	if i != 10 {
+		t.Fatalf("expected to read the 10 writes, read %d", i)
+	}
+}
+
+func TestReadClientWithTokenFailsIfServerLags(t *testing.T) {
+	s := createAndStartServer()
+	defer s.server.Stop()
+	s.server.ConsistencyTimeout = time.Millisecond * 100
+
+	readClient := NewReadClient([]string{s.server.Address().String()})
+	defer readClient.Close()
+
+	start := time.Now()
+	for range readClient.WithToken(ConsistencyToken{1}).Replay() {
+		t.Fatal("expected nothing to be replayed")
+	}
+	if time.Since(start) < s.server.ConsistencyTimeout {
+		t.Fatal("expected the replay to wait for the server")
+	}
+}
+
+func TestConsistencyTokensMerge(t *testing.T) {
+	merged := ConsistencyToken{1, 5}.Merge(ConsistencyToken{3, 2, 7})
+	if !reflect.DeepEqual(merged, ConsistencyToken{3, 5, 7}) {
+		t.Fatalf("unexpected token %v", merged)
+	}
+}
+
+func TestReplayFromExpiredOffsetFails(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	logger, _ := dlog.NewLoggerWithOptions(dir, dlog.LoggerOptions{
+		SegmentSize: 1,
+		BlockSize:   1,
+		Retention:   dlog.RetentionPolicy{MaxEntries: 2},
+	})
+	server := dlog.NewServer(logger, 0)
+	go server.Start()
+	defer server.Stop()
+	for x := 0; x < 5; x++ {
+		logger.Write(model.NewLogEntry(model.NewMetaData(model.NewUUID(), uint64(x+1), model.NewUUID()), []byte{byte(x)}))
+	}
+	logger.Sync()
+	logger.Expire()
+
+	readClient := NewReadClient([]string{server.Address().String()})
+	defer readClient.Close()
+	if _, err := readClient.ReplayFromContext(context.Background(), []uint64{0}); !errors.Is(err, ErrOffsetOutOfRange) {
+		t.Fatalf("expected offset out of range, got %v", err)
+	}
+
+	replay, err := readClient.ReplayFromContext(context.Background(), []uint64{4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payloads []byte
+	for data := range replay {
+		payloads = append(payloads, data[0])
+	}
+	if !reflect.DeepEqual(payloads, []byte{4}) {
+		t.Fatalf("unexpected entries %v", payloads)
+	}
+}
+
+func TestWriteClientErasesKey(t *testing.T) {
+	s := createAndStartServer()
+	defer s.server.Stop()
+
+	writeClient := NewWriteClient([]string{s.server.Address().String()})
+	defer writeClient.Close()
+	for _, key := range []string{"a", "b", "a"} {
+		if err := writeClient.WriteKeyContext(context.Background(), []byte(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	erased, err := writeClient.EraseKeyContext(context.Background(), []byte("a"))
+	if err != nil || erased != 2 {
+		t.Fatalf("expected 2 entries to be erased, got %d: %v", erased, err)
+	}
+	if erased, err := writeClient.EraseContext(context.Background(), 0, 0, 1); err != nil || erased != 1 {
+		t.Fatalf("expected the remaining entry to be erased, got %d: %v", erased, err)
+	}
+
+	readClient := NewReadClient([]string{s.server.Address().String()})
+	defer readClient.Close()
+	for data := range readClient.Replay() {
+		t.Fatalf("expected every entry to be erased, replayed %q", data)
+	}
+}
+
+func TestClientEncryptsPayloadsOfKeys(t *testing.T) {
+	s := createAndStartServer()
+	defer s.server.Stop()
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	store, _ := keystore.NewFileKeyStore(filepath.Join(dir, "datakeys"))
+	defer store.Close()
+
+	writeClient := NewWriteClient([]string{s.server.Address().String()})
+	defer writeClient.Close()
+	writeClient.KeyStore = store
+	if err := writeClient.WriteKeyContext(context.Background(), []byte("a"), []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	for logEntry := range s.logger.Read() {
+		if bytes.Equal(logEntry.Payload(), []byte("secret")) {
+			t.Fatal("expected the server to store the payload encrypted")
+		}
+	}
+
+	readClient := NewReadClient([]string{s.server.Address().String()})
+	defer readClient.Close()
+	readClient.KeyStore = store
+	for data := range readClient.ReplayKey([]byte("a")) {
+		if !bytes.Equal(data, []byte("secret")) {
+			t.Fatalf("expected the decrypted payload, got %q", data)
+		}
+	}
+
+	store.Delete([]byte("a"))
+	for data := range readClient.ReplayKey([]byte("a")) {
+		t.Fatalf("expected the entry to be shredded, replayed %q", data)
+	}
+}
+
+func TestWriteClientShredsKeyOfServer(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	store, _ := keystore.NewFileKeyStore(filepath.Join(dir, "datakeys"))
+	defer store.Close()
+	logger, _ := dlog.NewLoggerWithOptions(dir, dlog.LoggerOptions{KeyStore: store})
+	server := dlog.NewServer(logger, 0)
+	go server.Start()
+	defer server.Stop()
+
+	writeClient := NewWriteClient([]string{server.Address().String()})
+	defer writeClient.Close()
+	if err := writeClient.WriteKeyContext(context.Background(), []byte("a"), []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeClient.ShredKeyContext(context.Background(), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	readClient := NewReadClient([]string{server.Address().String()})
+	defer readClient.Close()
+	for data := range readClient.ReplayKey([]byte("a")) {
+		t.Fatalf("expected the entry to be shredded, replayed %q", data)
+	}
+}
+
+func TestReplayEntriesFromOffsetKeepsMetaData(t *testing.T) {
+	s := createAndStartServer()
+	defer s.server.Stop()
+	clientID := model.NewUUID()
+	for x := 0; x < 5; x++ {
+		s.logger.Write(model.NewLogEntry(model.NewMetaData(clientID, uint64(x+1), model.NewUUID()), []byte{byte(x)}))
+	}
+
+	readClient := NewReadClient([]string{s.server.Address().String()})
+	defer readClient.Close()
+	replay, err := readClient.ReplayEntriesFromContext(context.Background(), []uint64{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var numbers []uint64
+	for entry := range replay {
+		if entry.MetaData().ClientID() != clientID || entry.Payload()[0] != byte(entry.MetaData().ClientMessageNumber()-1) {
+			t.Fatalf("unexpected entry %v", entry)
+		}
+		numbers = append(numbers, entry.MetaData().ClientMessageNumber())
+	}
+	if !reflect.DeepEqual(numbers, []uint64{3, 4, 5}) {
+		t.Fatalf("unexpected entries %v", numbers)
+	}
+}
@@ -0,0 +1,519 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netbrain/dlog/encoder"
+	"github.com/netbrain/dlog/model"
+)
+
+const (
+	//DefaultHeartbeatInterval is how often a ping is sent to the server
+	DefaultHeartbeatInterval = time.Second
+	//DefaultHeartbeatTimeout is how long a server may stay silent before
+	//the connection is considered dead and reestablished
+	DefaultHeartbeatTimeout = 5 * time.Second
+	//MinReconnectBackoff is the delay before the first reconnection attempt
+	MinReconnectBackoff = 100 * time.Millisecond
+	//MaxReconnectBackoff caps the exponentially growing delay between
+	//reconnection attempts
+	MaxReconnectBackoff = 10 * time.Second
+)
+
+var errConnClosed = errors.New("connection closed")
+
+//Conn is a connection to a single dlog server. It keeps the connection
+//alive with heartbeats and redials the server with exponential backoff
+//whenever the connection is lost. Writes that have not yet been
+//acknowledged by the server are resent after reconnecting.
+type Conn struct {
+	address string
+	done    chan struct{}
+
+	//writeMutex keeps writes, including resends after a reconnect, in order
+	writeMutex sync.Mutex
+
+	mutex   sync.Mutex
+	changed *sync.Cond
+	current *session
+	//resolve, if set, finds the address to redial,
+	//such as that of the current leader of a cluster
+	resolve func(ctx context.Context) (string, error)
+	//observe, if set, is given the epoch of the cluster metadata of every pong
+	observe func(epoch model.Epoch)
+	pending []pendingWrite
+	closed  bool
+	//written is the offset following the last write acknowledged
+	written uint64
+
+	interval time.Duration
+	timeout  time.Duration
+}
+
+type pendingWrite struct {
+	clientMessageNumber uint64
+	frame               []byte
+	acked               chan struct{}
+}
+
+//session is a single network connection of a Conn,
+//every reconnect creates a new session
+type session struct {
+	conn      net.Conn
+	frames    chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	mutex     sync.Mutex
+	lastSeen  int64
+	timeout   time.Duration
+}
+
+//dial connects to the server, the context only bounds the initial dial
+//and not the lifetime of the connection
+func dial(ctx context.Context, address string) (*Conn, error) {
+	conn, err := dialTCP(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(address, conn, DefaultHeartbeatInterval, DefaultHeartbeatTimeout), nil
+}
+
+func dialTCP(ctx context.Context, address string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if tcpcon, ok := conn.(*net.TCPConn); ok {
+		tcpcon.SetKeepAlive(true)
+	}
+	return conn, nil
+}
+
+func newConn(address string, conn net.Conn, interval, timeout time.Duration) *Conn {
+	c := &Conn{
+		address:  address,
+		done:     make(chan struct{}),
+		interval: interval,
+		timeout:  timeout,
+	}
+	c.changed = sync.NewCond(&c.mutex)
+	c.current = c.newSession(conn)
+	go c.reconnectRoutine()
+	return c
+}
+
+//Write writes data to the server, waiting for the connection to be
+//reestablished if it is currently lost. It is safe for concurrent use.
+func (c *Conn) Write(data []byte) (int, error) {
+	s, err := c.session(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	if err := s.write(data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+//writeAcked writes a write request which is kept until the server
+//acknowledges it and resent should the connection be lost before that.
+//The returned channel is closed once the server acknowledges the write.
+func (c *Conn) writeAcked(clientMessageNumber uint64, frame []byte) (<-chan struct{}, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil, errConnClosed
+	}
+	acked := make(chan struct{})
+	c.pending = append(c.pending, pendingWrite{clientMessageNumber, frame, acked})
+	s := c.current
+	c.mutex.Unlock()
+
+	//a failed write is resent once reconnected
+	s.write(frame)
+	return acked, nil
+}
+
+func (c *Conn) acknowledge(clientMessageNumber uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	i := 0
+	for i < len(c.pending) && c.pending[i].clientMessageNumber <= clientMessageNumber {
+		close(c.pending[i].acked)
+		i++
+	}
+	c.pending = c.pending[i:]
+	c.changed.Broadcast()
+}
+
+//wrote records that a write was acknowledged at the offset
+func (c *Conn) wrote(offset uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if offset+1 > c.written {
+		c.written = offset + 1
+	}
+}
+
+//writtenOffset returns the offset following the last write acknowledged,
+//which a read must have caught up to in order to see every write
+func (c *Conn) writtenOffset() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.written
+}
+
+//drain waits until every write has been acknowledged, the connection is
+//closed or the context is done
+func (c *Conn) drain(ctx context.Context) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.wait(ctx, func() bool {
+		return len(c.pending) == 0 || c.closed
+	})
+}
+
+//wait waits until the condition is met or the context is done,
+//c.mutex must be held
+func (c *Conn) wait(ctx context.Context, condition func() bool) error {
+	stop := context.AfterFunc(ctx, func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.changed.Broadcast()
+	})
+	defer stop()
+
+	for !condition() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c.changed.Wait()
+	}
+	return nil
+}
+
+//outstanding returns the number of writes waiting to be acknowledged
+func (c *Conn) outstanding() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.pending)
+}
+
+//alive returns true if the connection is currently established
+func (c *Conn) alive() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return !c.closed && !c.current.dead()
+}
+
+//Close closes the connection for good
+func (c *Conn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+
+	c.closed = true
+	close(c.done)
+	c.changed.Broadcast()
+	return c.current.close()
+}
+
+//Closed returns a channel which is closed once the connection is closed
+func (c *Conn) Closed() <-chan struct{} {
+	return c.done
+}
+
+//RemoteAddr returns the address of the server
+func (c *Conn) RemoteAddr() net.Addr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.current.conn.RemoteAddr()
+}
+
+//session returns the current session, waiting for the connection to be
+//reestablished if it is lost
+func (c *Conn) session(ctx context.Context) (*session, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	err := c.wait(ctx, func() bool {
+		return c.closed || !c.current.dead()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if c.closed {
+		return nil, errConnClosed
+	}
+	return c.current, nil
+}
+
+func (c *Conn) reconnectRoutine() {
+	for {
+		c.mutex.Lock()
+		s := c.current
+		c.mutex.Unlock()
+
+		select {
+		case <-s.done:
+		case <-c.done:
+			return
+		}
+
+		conn, err := c.redial()
+		if err != nil {
+			return
+		}
+
+		c.writeMutex.Lock()
+		s = c.newSession(conn)
+		c.mutex.Lock()
+		pending := append([]pendingWrite(nil), c.pending...)
+		c.mutex.Unlock()
+
+		for _, p := range pending {
+			s.write(p.frame)
+		}
+
+		c.mutex.Lock()
+		closed := c.closed
+		if closed {
+			s.close()
+		} else {
+			c.current = s
+			c.changed.Broadcast()
+		}
+		c.mutex.Unlock()
+		c.writeMutex.Unlock()
+
+		if closed {
+			return
+		}
+	}
+}
+
+//redial dials the server until it succeeds or the connection is closed
+func (c *Conn) redial() (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-time.After(backoff(attempt)):
+		case <-c.done:
+			return nil, errConnClosed
+		}
+
+		address, err := c.redialAddress()
+		if err != nil {
+			log.Printf("err reconnecting: %s", err)
+			continue
+		}
+
+		conn, err := dialTCP(context.Background(), address)
+		if err == nil {
+			log.Printf("reconnected to '%s'", address)
+			c.mutex.Lock()
+			c.address = address
+			c.mutex.Unlock()
+			return conn, nil
+		}
+		log.Printf("err reconnecting to '%s': %s", address, err)
+	}
+}
+
+//redialAddress returns the address to redial, resolving it anew if the
+//connection has a resolver
+func (c *Conn) redialAddress() (string, error) {
+	c.mutex.Lock()
+	resolve := c.resolve
+	c.mutex.Unlock()
+
+	if resolve == nil {
+		return c.address, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return resolve(ctx)
+}
+
+//currentAddress returns the address of the server last connected to
+func (c *Conn) currentAddress() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.address
+}
+
+//reconnect drops the current session, so that the server is redialed
+func (c *Conn) reconnect() {
+	c.mutex.Lock()
+	s := c.current
+	c.mutex.Unlock()
+	s.close()
+}
+
+//pong passes the epoch of a pong on to the observer, if there is one
+func (c *Conn) pong(request model.Request) {
+	c.mutex.Lock()
+	observe := c.observe
+	c.mutex.Unlock()
+
+	if epoch, ok := request.Epoch(); ok && observe != nil {
+		observe(epoch)
+	}
+}
+
+//backoff returns the exponential delay before the given reconnection
+//attempt, with jitter so clients do not reconnect in lockstep
+func backoff(attempt int) time.Duration {
+	d := MaxReconnectBackoff
+	if attempt < 32 && MinReconnectBackoff<<uint(attempt) < MaxReconnectBackoff {
+		d = MinReconnectBackoff << uint(attempt)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (c *Conn) newSession(conn net.Conn) *session {
+	s := &session{
+		conn:    conn,
+		frames:  make(chan []byte, 100),
+		done:    make(chan struct{}),
+		timeout: c.timeout,
+	}
+	s.seen()
+	go s.readRoutine(c)
+	go s.heartbeatRoutine(c.interval)
+	return s
+}
+
+func (s *session) write(data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	if _, err := s.conn.Write(data); err != nil {
+		s.close()
+		return err
+	}
+	return nil
+}
+
+func (s *session) close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.conn.Close()
+	})
+	return err
+}
+
+func (s *session) dead() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+//next returns the next frame sent from the server, an empty frame
+//signals EOT. Should the context be done before a frame arrives the
+//session is closed, as the rest of the response would otherwise be
+//mistaken for the response to the next request.
+func (s *session) next(ctx context.Context) ([]byte, error) {
+	select {
+	case frame, open := <-s.frames:
+		if !open {
+			return nil, errConnClosed
+		}
+		return frame, nil
+	case <-ctx.Done():
+		s.close()
+		return nil, ctx.Err()
+	}
+}
+
+func (s *session) seen() {
+	atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+}
+
+func (s *session) silence() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastSeen)))
+}
+
+func (s *session) readRoutine(c *Conn) {
+	defer close(s.frames)
+	defer s.close()
+
+	scanner := bufio.NewScanner(s.conn)
+	scanner.Split(encoder.ScanFrameSplitFunc)
+
+	for scanner.Scan() {
+		s.seen()
+		request := model.Request(scanner.Bytes())
+		if model.IsControl(request) {
+			switch request.Type() {
+			case model.TypePongRequest:
+				c.pong(request)
+				continue
+			case model.TypeAckRequest:
+				n, _ := request.ClientMessageNumber()
+				if offset, ok := request.Offset(); ok {
+					c.wrote(offset)
+				}
+				c.acknowledge(n)
+				continue
+			}
+		}
+		frame := make([]byte, len(scanner.Bytes()))
+		copy(frame, scanner.Bytes())
+		select {
+		case s.frames <- frame:
+		case <-s.done:
+			return
+		}
+	}
+
+	if !s.dead() && scanner.Err() != nil {
+		log.Println(scanner.Err())
+	}
+}
+
+func (s *session) heartbeatRoutine(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ping := encoder.EncodePayload(model.NewPingRequest())
+	for {
+		select {
+		case <-ticker.C:
+			if s.silence() > s.timeout {
+				log.Printf("no heartbeat from %s in %s, closing connection", s.conn.RemoteAddr(), s.timeout)
+				s.close()
+				return
+			}
+			if err := s.write(ping); err != nil {
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
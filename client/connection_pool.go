@@ -1,69 +1,119 @@
 package client
 
 import (
+	"context"
+	"fmt"
 	"log"
-	"math"
-	"net"
+	"sync/atomic"
 )
 
-//RoundRobinConnectionPool holds a number of connections and data needed for round robin mechanics
-type RoundRobinConnectionPool struct {
-	connections []net.Conn
-	numClients  uint8
-	current     uint8
-	max         uint8
+//ConnectionPool holds connections to a number of servers and decides which
+//of them a request is sent on. WriteClient and ReadClient accept any
+//ConnectionPool implementation.
+//
+//The pools of this package are created with a NewXConnectionPool function,
+//which exits should it fail to connect, or with NewXConnectionPoolContext,
+//whose context bounds connecting to the servers. Once connected the context
+//has no effect on the pool.
+type ConnectionPool interface {
+	//Connection returns the connection the next request should be sent on
+	Connection() *Conn
+	//AllConnections returns all connections in the pool
+	AllConnections() []*Conn
+	//Close closes all connections in the pool
+	Close()
+	//Len returns the number of connections in the pool
+	Len() int
 }
 
-//NewRoundRobinConnectionPool creates a connection pool which retrieves connections in a round robin fashion
-func NewRoundRobinConnectionPool(servers []string) *RoundRobinConnectionPool {
-	connections := make([]net.Conn, len(servers))
-	for i, s := range servers {
-		conn, err := net.Dial("tcp", s)
-		if err != nil {
-			log.Fatalf("err connecting to '%s': %s", s, err)
-		}
-		if tcpcon, ok := conn.(*net.TCPConn); ok {
-			tcpcon.SetKeepAlive(true)
-		}
-		connections[i] = conn
+//KeyedConnectionPool is a ConnectionPool which also decides which
+//connection the requests for a key, such as an aggregate, are sent on.
+//Clients send the writes, replays and erasures of a key on the connection
+//the pool picks, rather than on the one the key hashes to.
+type KeyedConnectionPool interface {
+	ConnectionPool
+	//KeyConnection returns the connection the requests for the key should
+	//be sent on, and its partition, the index of it among AllConnections
+	KeyConnection(key []byte) (*Conn, uint32)
+}
 
+//keyConnection returns the connection the requests for the key are sent
+//on, and its partition. A KeyedConnectionPool picks it, for any other pool
+//it is the connection the key hashes to on the ring.
+func keyConnection(pool ConnectionPool, ring *hashRing, key []byte) (*Conn, uint32) {
+	if keyed, ok := pool.(KeyedConnectionPool); ok {
+		return keyed.KeyConnection(key)
 	}
-	numClients := uint8(len(connections))
-	pool := &RoundRobinConnectionPool{
-		connections: connections,
-		numClients:  numClients,
-		max:         math.MaxUint8 / numClients * numClients,
-	}
-
-	return pool
+	partition := ring.partition(key)
+	return pool.AllConnections()[partition], partition
 }
 
-func (r *RoundRobinConnectionPool) incrementCurrent() {
-	r.current++
-	if r.current > r.max {
-		r.current = 0
+//connections implements the parts of a ConnectionPool
+//which are common to every strategy
+type connections []*Conn
+
+//dialAll connects to every server, closing the connections already made
+//should one of them fail
+func dialAll(ctx context.Context, servers []string) (connections, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no servers to connect to")
 	}
-}
 
-//Connection returns the next connection in the round robin order
-func (r *RoundRobinConnectionPool) Connection() net.Conn {
-	defer r.incrementCurrent()
-	return r.connections[r.current%r.numClients]
+	conns := make(connections, len(servers))
+	for i, s := range servers {
+		conn, err := dial(ctx, s)
+		if err != nil {
+			conns[:i].Close()
+			return nil, fmt.Errorf("err connecting to '%s': %s", s, err)
+		}
+		conns[i] = conn
+	}
+	return conns, nil
 }
 
 //AllConnections returns all connections in this pool
-func (r *RoundRobinConnectionPool) AllConnections() []net.Conn {
-	return r.connections
+func (c connections) AllConnections() []*Conn {
+	return c
 }
 
 //Close closes all connections in this pool
-func (r *RoundRobinConnectionPool) Close() {
-	for _, conn := range r.connections {
+func (c connections) Close() {
+	for _, conn := range c {
 		conn.Close()
 	}
 }
 
 //Len returns the number of connections in this pool
-func (r *RoundRobinConnectionPool) Len() int {
-	return len(r.connections)
+func (c connections) Len() int {
+	return len(c)
+}
+
+//RoundRobinConnectionPool holds a number of connections and data needed for round robin mechanics
+type RoundRobinConnectionPool struct {
+	connections
+	current uint64
+}
+
+//NewRoundRobinConnectionPool creates a connection pool which retrieves connections in a round robin fashion
+func NewRoundRobinConnectionPool(servers []string) *RoundRobinConnectionPool {
+	pool, err := NewRoundRobinConnectionPoolContext(context.Background(), servers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return pool
+}
+
+//NewRoundRobinConnectionPoolContext creates a connection pool which retrieves connections in a round robin fashion
+func NewRoundRobinConnectionPoolContext(ctx context.Context, servers []string) (*RoundRobinConnectionPool, error) {
+	conns, err := dialAll(ctx, servers)
+	if err != nil {
+		return nil, err
+	}
+	return &RoundRobinConnectionPool{connections: conns}, nil
+}
+
+//Connection returns the next connection in the round robin order
+func (r *RoundRobinConnectionPool) Connection() *Conn {
+	next := atomic.AddUint64(&r.current, 1) - 1
+	return r.connections[next%uint64(len(r.connections))]
 }
@@ -0,0 +1,147 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func testConnections(n int) connections {
+	conns := make(connections, n)
+	for i := range conns {
+		conns[i] = &Conn{current: &session{done: make(chan struct{})}}
+	}
+	return conns
+}
+
+func TestRoundRobinConnectionPoolCyclesBeyond255Servers(t *testing.T) {
+	conns := testConnections(300)
+	pool := &RoundRobinConnectionPool{connections: conns}
+
+	for round := 0; round < 3; round++ {
+		for i, expected := range conns {
+			if conn := pool.Connection(); conn != expected {
+				t.Fatalf("round %d: expected connection %d", round, i)
+			}
+		}
+	}
+}
+
+func TestKeyHashConnectionPoolHasAffinity(t *testing.T) {
+	pool := newKeyHashConnectionPool(testConnections(5))
+
+	for _, key := range []string{"order-1", "order-2", "customer-42"} {
+		expected, partition := pool.KeyConnection([]byte(key))
+		if pool.AllConnections()[partition] != expected {
+			t.Fatalf("key %s is not on the connection of its partition %d", key, partition)
+		}
+		for x := 0; x < 10; x++ {
+			if conn, _ := pool.KeyConnection([]byte(key)); conn != expected {
+				t.Fatalf("key %s moved to another connection", key)
+			}
+		}
+	}
+
+	if pool.Connection() == pool.Connection() {
+		t.Fatal("expected requests without a key to be spread")
+	}
+}
+
+func TestLeastOutstandingConnectionPoolPicksIdlest(t *testing.T) {
+	conns := testConnections(3)
+	conns[0].pending = make([]pendingWrite, 2)
+	conns[1].pending = make([]pendingWrite, 1)
+	conns[2].pending = make([]pendingWrite, 3)
+	pool := &LeastOutstandingConnectionPool{conns}
+
+	if pool.Connection() != conns[1] {
+		t.Fatal("expected the connection with the fewest outstanding writes")
+	}
+}
+
+func TestFailoverConnectionPoolPrefersPrimary(t *testing.T) {
+	conns := testConnections(3)
+	pool := &FailoverConnectionPool{conns}
+
+	if pool.Connection() != conns[0] {
+		t.Fatal("expected the primary")
+	}
+
+	close(conns[0].current.done)
+	if pool.Connection() != conns[1] {
+		t.Fatal("expected to fail over to the second connection")
+	}
+
+	close(conns[1].current.done)
+	close(conns[2].current.done)
+	if pool.Connection() != conns[0] {
+		t.Fatal("expected the primary when no connection is reachable")
+	}
+}
+
+func TestWriteClientFailsOverWithPool(t *testing.T) {
+	primary := createAndStartServer()
+	secondary := createAndStartServer()
+	defer secondary.server.Stop()
+
+	pool, err := NewFailoverConnectionPoolContext(context.Background(), []string{
+		primary.server.Address().String(),
+		secondary.server.Address().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeClient := NewWriteClientWithPool(pool)
+	defer writeClient.Close()
+
+	primary.server.Stop()
+	for start := time.Now(); pool.AllConnections()[0].alive(); {
+		if time.Since(start) > time.Second {
+			t.Fatal("primary was not detected as down")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if err := writeClient.WriteContext(context.Background(), []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if offset := secondary.logger.Offset(); offset != 1 {
+		t.Fatalf("expected the write on the secondary, got offset %d", offset)
+	}
+}
+
+//lastServerPool sends the requests of every key to the last server
+type lastServerPool struct {
+	*RoundRobinConnectionPool
+}
+
+func (p lastServerPool) KeyConnection(key []byte) (*Conn, uint32) {
+	last := p.Len() - 1
+	return p.AllConnections()[last], uint32(last)
+}
+
+func TestWriteClientSendsKeysWhereKeyedPoolPicks(t *testing.T) {
+	first := createAndStartServer()
+	defer first.server.Stop()
+	last := createAndStartServer()
+	defer last.server.Stop()
+
+	pool, err := NewRoundRobinConnectionPoolContext(context.Background(), []string{
+		first.server.Address().String(),
+		last.server.Address().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeClient := NewWriteClientWithPool(lastServerPool{pool})
+	defer writeClient.Close()
+
+	for _, key := range []string{"order-1", "order-2", "customer-42"} {
+		if err := writeClient.WriteKeyContext(context.Background(), []byte(key), []byte{1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if first.logger.Offset() != 0 || last.logger.Offset() != 3 {
+		t.Fatalf("expected every key on the last server, got %d and %d entries", first.logger.Offset(), last.logger.Offset())
+	}
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/netbrain/dlog/encoder"
+	"github.com/netbrain/dlog/model"
+)
+
+//ConsistencyToken holds, for every partition of a pool, the offset a server
+//must have caught up to before a read sees the writes the token was taken
+//after. Partitions are numbered by their connection's position in the pool.
+type ConsistencyToken []uint64
+
+//Merge returns a token which is caught up to both tokens
+func (t ConsistencyToken) Merge(other ConsistencyToken) ConsistencyToken {
+	merged := append(ConsistencyToken(nil), t...)
+	for i, offset := range other {
+		if i >= len(merged) {
+			merged = append(merged, offset)
+		} else if offset > merged[i] {
+			merged[i] = offset
+		}
+	}
+	return merged
+}
+
+//offset returns the offset the partition must have caught up to
+func (t ConsistencyToken) offset(partition int) uint64 {
+	if partition >= len(t) {
+		return 0
+	}
+	return t[partition]
+}
+
+//Token returns a token of every write acknowledged so far, reads given the
+//token see these writes
+func (w *WriteClient) Token() ConsistencyToken {
+	conns := w.connectionPool.AllConnections()
+	token := make(ConsistencyToken, len(conns))
+	for i, conn := range conns {
+		token[i] = conn.writtenOffset()
+	}
+	return token
+}
+
+//awaitOffset asks the server of the session to wait until it has caught up
+//to the offset, and fails if it has not done so within its timeout
+func awaitOffset(ctx context.Context, session *session, offset uint64) error {
+	if offset == 0 {
+		return nil
+	}
+	if err := session.write(encoder.EncodePayload(model.NewAwaitRequest(offset))); err != nil {
+		return err
+	}
+
+	for {
+		frame, err := session.next(ctx)
+		if err != nil {
+			return err
+		}
+		if !model.IsControl(frame) {
+			continue
+		}
+		current, ok := model.Request(frame).Offset()
+		if !ok {
+			continue
+		}
+		if current < offset {
+			return fmt.Errorf("server at '%s' has not caught up to offset %d, it is at %d", session.conn.RemoteAddr(), offset, current)
+		}
+		return nil
+	}
+}
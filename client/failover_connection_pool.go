@@ -0,0 +1,42 @@
+package client
+
+import (
+	"context"
+	"log"
+)
+
+//FailoverConnectionPool sends every request to the primary server, the
+//first one it was given, for as long as it is reachable. While it is not,
+//requests fail over to the next reachable server in order.
+type FailoverConnectionPool struct {
+	connections
+}
+
+//NewFailoverConnectionPool creates a connection pool which prefers the first server and fails over to the others
+func NewFailoverConnectionPool(servers []string) *FailoverConnectionPool {
+	pool, err := NewFailoverConnectionPoolContext(context.Background(), servers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return pool
+}
+
+//NewFailoverConnectionPoolContext creates a connection pool which prefers the first server and fails over to the others
+func NewFailoverConnectionPoolContext(ctx context.Context, servers []string) (*FailoverConnectionPool, error) {
+	conns, err := dialAll(ctx, servers)
+	if err != nil {
+		return nil, err
+	}
+	return &FailoverConnectionPool{conns}, nil
+}
+
+//Connection returns the first reachable connection, or the primary if
+//none are reachable, so the request is sent once it comes back
+func (f *FailoverConnectionPool) Connection() *Conn {
+	for _, conn := range f.connections {
+		if conn.alive() {
+			return conn
+		}
+	}
+	return f.connections[0]
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+)
+
+//virtualNodes is the number of points every partition has on the hash ring,
+//more points spread the keys more evenly between the partitions
+const virtualNodes = 64
+
+//hashRing maps keys to partitions with consistent hashing, so that
+//changing the number of partitions moves as few keys as possible
+type hashRing struct {
+	points     []uint64
+	partitions map[uint64]uint32
+}
+
+func newHashRing(partitions int) *hashRing {
+	h := &hashRing{
+		points:     make([]uint64, 0, partitions*virtualNodes),
+		partitions: make(map[uint64]uint32, partitions*virtualNodes),
+	}
+
+	buf := make([]byte, 8)
+	for p := 0; p < partitions; p++ {
+		for v := 0; v < virtualNodes; v++ {
+			binary.BigEndian.PutUint32(buf, uint32(p))
+			binary.BigEndian.PutUint32(buf[4:], uint32(v))
+			point := hash(buf)
+			if _, taken := h.partitions[point]; taken {
+				continue
+			}
+			h.points = append(h.points, point)
+			h.partitions[point] = uint32(p)
+		}
+	}
+	sort.Slice(h.points, func(i, j int) bool { return h.points[i] < h.points[j] })
+	return h
+}
+
+//partition returns the partition owning the first point on the ring
+//at or after the hash of the key
+func (h *hashRing) partition(key []byte) uint32 {
+	k := hash(key)
+	i := sort.Search(len(h.points), func(i int) bool { return h.points[i] >= k })
+	if i == len(h.points) {
+		i = 0
+	}
+	return h.partitions[h.points[i]]
+}
+
+//hash is FNV-1a followed by a finalizer, as FNV alone spreads
+//short and similar inputs poorly around the ring
+func hash(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashRingSpreadsKeys(t *testing.T) {
+	ring := newHashRing(4)
+	counts := make([]int, 4)
+	for x := 0; x < 4000; x++ {
+		counts[ring.partition([]byte(fmt.Sprintf("key-%d", x)))]++
+	}
+
+	for partition, count := range counts {
+		if count < 500 || count > 1500 {
+			t.Fatalf("partition %d got %d of 4000 keys: %v", partition, count, counts)
+		}
+	}
+}
+
+func TestHashRingMovesFewKeysWhenGrowing(t *testing.T) {
+	before := newHashRing(4)
+	after := newHashRing(5)
+
+	moved := 0
+	for x := 0; x < 4000; x++ {
+		key := []byte(fmt.Sprintf("key-%d", x))
+		if p := after.partition(key); p != before.partition(key) {
+			if p != 4 {
+				t.Fatalf("key %s moved between existing partitions", key)
+			}
+			moved++
+		}
+	}
+
+	if moved > 1500 {
+		t.Fatalf("%d of 4000 keys moved", moved)
+	}
+}
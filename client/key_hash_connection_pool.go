@@ -0,0 +1,46 @@
+package client
+
+import (
+	"context"
+	"log"
+)
+
+//KeyHashConnectionPool sends every request with the same key to the same
+//server, so that all entries of one aggregate end up on one server. Keys
+//are mapped to servers with the same consistent hashing WriteKey uses.
+//Requests without a key are spread in a round robin fashion.
+type KeyHashConnectionPool struct {
+	RoundRobinConnectionPool
+	ring *hashRing
+}
+
+//NewKeyHashConnectionPool creates a connection pool which picks connections by hashing the request key
+func NewKeyHashConnectionPool(servers []string) *KeyHashConnectionPool {
+	pool, err := NewKeyHashConnectionPoolContext(context.Background(), servers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return pool
+}
+
+//NewKeyHashConnectionPoolContext creates a connection pool which picks connections by hashing the request key
+func NewKeyHashConnectionPoolContext(ctx context.Context, servers []string) (*KeyHashConnectionPool, error) {
+	conns, err := dialAll(ctx, servers)
+	if err != nil {
+		return nil, err
+	}
+	return newKeyHashConnectionPool(conns), nil
+}
+
+func newKeyHashConnectionPool(conns connections) *KeyHashConnectionPool {
+	return &KeyHashConnectionPool{
+		RoundRobinConnectionPool: RoundRobinConnectionPool{connections: conns},
+		ring:                     newHashRing(len(conns)),
+	}
+}
+
+//KeyConnection returns the connection the key hashes to
+func (k *KeyHashConnectionPool) KeyConnection(key []byte) (*Conn, uint32) {
+	partition := k.ring.partition(key)
+	return k.connections[partition], partition
+}
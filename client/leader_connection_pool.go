@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/netbrain/dlog/model"
+)
+
+//LeaderConnectionPool sends every request to the leader of a cluster. It
+//bootstraps from seed servers, a single member of the cluster will do, and
+//from then on keeps the ClusterMetadata up to date. The metadata is
+//refreshed from any known member whenever the connection to the leader is
+//lost, and whenever the servers' pongs tell it has changed, in which case
+//the pool moves on to the new leader. Unacknowledged writes are resent to it.
+type LeaderConnectionPool struct {
+	connections
+	seeds      []string
+	refreshing int32
+
+	mutex    sync.Mutex
+	metadata model.ClusterMetadata
+}
+
+//NewLeaderConnectionPool creates a connection pool which connects to the leader of the cluster the seeds are members of
+func NewLeaderConnectionPool(seeds []string) *LeaderConnectionPool {
+	pool, err := NewLeaderConnectionPoolContext(context.Background(), seeds)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return pool
+}
+
+//NewLeaderConnectionPoolContext creates a connection pool which connects to the leader of the cluster the seeds are members of.
+//The context also bounds finding the leader.
+func NewLeaderConnectionPoolContext(ctx context.Context, seeds []string) (*LeaderConnectionPool, error) {
+	if len(seeds) == 0 {
+		return nil, errors.New("no servers to connect to")
+	}
+
+	l := &LeaderConnectionPool{seeds: seeds}
+	leader, err := l.leader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dial(ctx, leader)
+	if err != nil {
+		return nil, fmt.Errorf("err connecting to '%s': %s", leader, err)
+	}
+
+	conn.mutex.Lock()
+	conn.resolve = l.leader
+	conn.observe = l.observe
+	conn.mutex.Unlock()
+	l.connections = connections{conn}
+	return l, nil
+}
+
+//Connection returns the connection to the leader
+func (l *LeaderConnectionPool) Connection() *Conn {
+	return l.connections[0]
+}
+
+//Metadata returns the last known ClusterMetadata
+func (l *LeaderConnectionPool) Metadata() model.ClusterMetadata {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	metadata := l.metadata
+	metadata.Members = append([]string(nil), l.metadata.Members...)
+	return metadata
+}
+
+//leader refreshes the metadata and returns the address of the leader
+func (l *LeaderConnectionPool) leader(ctx context.Context) (string, error) {
+	metadata, err := l.refresh(ctx)
+	if err != nil {
+		return "", err
+	}
+	return metadata.Leader, nil
+}
+
+//refresh fetches the metadata from the known members, and from the seeds
+//should none of them answer, until it finds one that knows the leader
+func (l *LeaderConnectionPool) refresh(ctx context.Context) (model.ClusterMetadata, error) {
+	l.mutex.Lock()
+	servers := append(append([]string(nil), l.metadata.Members...), l.seeds...)
+	l.mutex.Unlock()
+
+	err := errors.New("no member knows the leader")
+	tried := make(map[string]bool)
+	for _, server := range servers {
+		if tried[server] {
+			continue
+		}
+		tried[server] = true
+
+		metadata, fetchErr := FetchMetadata(ctx, server)
+		if fetchErr != nil {
+			err = fetchErr
+			continue
+		}
+		if metadata.Leader == "" {
+			continue
+		}
+
+		l.mutex.Lock()
+		l.metadata = metadata
+		l.mutex.Unlock()
+		return metadata, nil
+	}
+	return model.ClusterMetadata{}, fmt.Errorf("err fetching cluster metadata: %s", err)
+}
+
+//observe refreshes the metadata in the background if the epoch is later
+//than that of the known metadata, and reconnects if the leader has changed
+func (l *LeaderConnectionPool) observe(epoch model.Epoch) {
+	l.mutex.Lock()
+	current := l.metadata.Epoch()
+	l.mutex.Unlock()
+	if !epoch.After(current) || !atomic.CompareAndSwapInt32(&l.refreshing, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&l.refreshing, 0)
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultHeartbeatTimeout)
+		defer cancel()
+
+		metadata, err := l.refresh(ctx)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if conn := l.connections[0]; metadata.Leader != conn.currentAddress() {
+			log.Printf("leader changed to '%s'", metadata.Leader)
+			conn.reconnect()
+		}
+	}()
+}
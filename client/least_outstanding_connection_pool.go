@@ -0,0 +1,44 @@
+package client
+
+import (
+	"context"
+	"log"
+)
+
+//LeastOutstandingConnectionPool sends every request to the server with
+//the fewest writes waiting to be acknowledged, steering load away from
+//slow or unreachable servers
+type LeastOutstandingConnectionPool struct {
+	connections
+}
+
+//NewLeastOutstandingConnectionPool creates a connection pool which picks the connection with the fewest outstanding requests
+func NewLeastOutstandingConnectionPool(servers []string) *LeastOutstandingConnectionPool {
+	pool, err := NewLeastOutstandingConnectionPoolContext(context.Background(), servers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return pool
+}
+
+//NewLeastOutstandingConnectionPoolContext creates a connection pool which picks the connection with the fewest outstanding requests
+func NewLeastOutstandingConnectionPoolContext(ctx context.Context, servers []string) (*LeastOutstandingConnectionPool, error) {
+	conns, err := dialAll(ctx, servers)
+	if err != nil {
+		return nil, err
+	}
+	return &LeastOutstandingConnectionPool{conns}, nil
+}
+
+//Connection returns the connection with the fewest outstanding requests,
+//the first one wins a tie
+func (l *LeastOutstandingConnectionPool) Connection() *Conn {
+	least := l.connections[0]
+	leastOutstanding := least.outstanding()
+	for _, conn := range l.connections[1:] {
+		if outstanding := conn.outstanding(); outstanding < leastOutstanding {
+			least, leastOutstanding = conn, outstanding
+		}
+	}
+	return least
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/netbrain/dlog/encoder"
+	"github.com/netbrain/dlog/model"
+)
+
+//FetchMetadata asks the server at the address for the ClusterMetadata
+//of the cluster it is a member of
+func FetchMetadata(ctx context.Context, address string) (model.ClusterMetadata, error) {
+	conn, err := dialTCP(ctx, address)
+	if err != nil {
+		return model.ClusterMetadata{}, err
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultHeartbeatTimeout)
+	}
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(encoder.EncodePayload(model.NewMetadataRequest())); err != nil {
+		return model.ClusterMetadata{}, err
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(encoder.ScanFrameSplitFunc)
+	if !scanner.Scan() {
+		if scanner.Err() != nil {
+			return model.ClusterMetadata{}, scanner.Err()
+		}
+		return model.ClusterMetadata{}, fmt.Errorf("'%s' closed the connection", address)
+	}
+	return model.Request(scanner.Bytes()).ClusterMetadata()
+}
@@ -1,64 +1,229 @@
 package client
 
 import (
-	"bufio"
+	"context"
 	"io"
 	"log"
-	"net"
+	"sync"
 
 	"github.com/netbrain/dlog/encoder"
+	"github.com/netbrain/dlog/keystore"
 	"github.com/netbrain/dlog/model"
 )
 
 //ReadClient is the logging client which handles correctlu replaying the log
 //and realtime subscribing to the log
 type ReadClient struct {
-	connectionPool *RoundRobinConnectionPool
+	connectionPool ConnectionPool
+	token          ConsistencyToken
+
+	//KeyStore, if set, holds the data keys the entries replayed by key are
+	//decrypted with, those of WriteClient.KeyStore. Entries whose data key
+	//has been deleted are skipped. Other replays and subscriptions, which do
+	//not know the keys of the entries, pass on encrypted payloads as is.
+	KeyStore keystore.KeyStore
 }
 
 //NewReadClient creates a new ReadClient instance
 func NewReadClient(servers []string) *ReadClient {
-	client := &ReadClient{
-		connectionPool: NewRoundRobinConnectionPool(servers),
+	client, err := NewReadClientContext(context.Background(), servers)
+	if err != nil {
+		log.Fatal(err)
 	}
-
 	return client
 }
 
+//NewReadClientContext creates a new ReadClient instance,
+//the context bounds connecting to the servers
+func NewReadClientContext(ctx context.Context, servers []string) (*ReadClient, error) {
+	pool, err := NewRoundRobinConnectionPoolContext(ctx, servers)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewReadClientWithPool(pool), nil
+}
+
+//NewReadClientWithPool creates a new ReadClient instance which reads from
+//every server in the given pool
+func NewReadClientWithPool(pool ConnectionPool) *ReadClient {
+	return &ReadClient{
+		connectionPool: pool,
+	}
+}
+
+//WithToken returns a client sharing the connections of this one, whose
+//replays only start once the servers have caught up to the token, such as
+//one taken from a WriteClient to read its own writes. Should a server not
+//catch up in time the replay fails.
+func (r *ReadClient) WithToken(token ConsistencyToken) *ReadClient {
+	return &ReadClient{
+		connectionPool: r.connectionPool,
+		token:          token,
+		KeyStore:       r.KeyStore,
+	}
+}
+
 //Replay replays the servers log entry by entry
 func (r *ReadClient) Replay() <-chan []byte {
+	return r.ReplayContext(context.Background())
+}
+
+//ReplayContext replays the servers log entry by entry until the log
+//is exhausted or the context is done, after which the channel is closed
+func (r *ReadClient) ReplayContext(ctx context.Context) <-chan []byte {
+	return r.replay(ctx, r.newReplayStreams(nil), nil)
+}
+
+//ReplayFromContext replays the log of every server from the offset at the
+//server's position in the pool, and the whole log of servers beyond the
+//offsets given. Should a server no longer have the entry at its offset,
+//as it has expired, ErrOffsetOutOfRange is returned.
+func (r *ReadClient) ReplayFromContext(ctx context.Context, offsets []uint64) (<-chan []byte, error) {
+	replayer := r.newReplayStreams(offsets)
+	entry, err := replayer.next(ctx)
+	if err != nil && err != io.EOF {
+		replayer.abort()
+		return nil, err
+	}
+	return r.replay(ctx, replayer, entry), nil
+}
+
+//ReplayEntriesFromContext is like ReplayFromContext, but replays the whole
+//entries along with their MetaData rather than their payloads
+func (r *ReadClient) ReplayEntriesFromContext(ctx context.Context, offsets []uint64) (<-chan model.LogEntry, error) {
+	replayer := r.newReplayStreams(offsets)
+	entry, err := replayer.next(ctx)
+	if err != nil && err != io.EOF {
+		replayer.abort()
+		return nil, err
+	}
+	return r.replayEntries(ctx, replayer, entry), nil
+}
+
+//replay sends the payload of the entry, if any, and of every entry after it
+//on the returned channel until the replay ends
+func (r *ReadClient) replay(ctx context.Context, replayer *replayStreams, entry model.LogEntry) <-chan []byte {
 	outChan := make(chan []byte, 100)
-	replayer := r.newReplayStreams()
 
 	go func(outChan chan<- []byte) {
 		defer close(outChan)
+		for entry := range r.replayEntries(ctx, replayer, entry) {
+			select {
+			case outChan <- entry.Payload():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}(outChan)
+	return outChan
+}
+
+//replayEntries sends the entry, if any, and every entry after it on the
+//returned channel until the replay ends
+func (r *ReadClient) replayEntries(ctx context.Context, replayer *replayStreams, entry model.LogEntry) <-chan model.LogEntry {
+	outChan := make(chan model.LogEntry, 100)
+
+	go func(outChan chan<- model.LogEntry) {
+		defer close(outChan)
+		defer replayer.abort()
 		for {
-			entry, err := replayer.next()
+			if entry != nil {
+				select {
+				case outChan <- entry:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			var err error
+			entry, err = replayer.next(ctx)
 			if err == io.EOF {
 				break
 			} else if err != nil {
-				log.Fatal(err)
+				if err != ctx.Err() {
+					log.Println(err)
+				}
+				break
 			}
-			outChan <- entry.Payload()
 		}
 	}(outChan)
 	return outChan
+}
 
+//ReplayKey replays the entries written with the key, from the one server
+//holding the partition the key hashes to
+func (r *ReadClient) ReplayKey(key []byte) <-chan []byte {
+	return r.ReplayKeyContext(context.Background(), key)
 }
 
-//Subscribe creates a subsciption on the log, which in realtime outputs all written log entries to the return channel from the time of subscription
-func (r *ReadClient) Subscribe() <-chan model.LogEntry {
-	subscribeChan := make(chan model.LogEntry)
+//ReplayKeyContext replays the entries written with the key until they
+//are exhausted or the context is done, after which the channel is closed
+func (r *ReadClient) ReplayKeyContext(ctx context.Context, key []byte) <-chan []byte {
+	outChan := make(chan []byte, 100)
+	conn, partition := keyConnection(r.connectionPool, newHashRing(r.connectionPool.Len()), key)
+	stream := newReplayStream(conn, model.NewReplayKeyRequest(key))
+	stream.await = r.token.offset(int(partition))
+	store := r.KeyStore
+
+	go func(outChan chan<- []byte) {
+		defer close(outChan)
+		defer stream.abort()
+		for {
+			entry, err := stream.next(ctx)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				if err != ctx.Err() {
+					log.Println(err)
+				}
+				break
+			}
+
+			payload := entry.Payload()
+			if store != nil && len(payload) > 0 {
+				if payload, err = keystore.Open(store, key, payload); err == keystore.ErrShredded {
+					continue
+				} else if err != nil {
+					log.Println(err)
+					continue
+				}
+			}
 
-	go func(chan<- model.LogEntry) {
-		for _, conn := range r.connectionPool.AllConnections() {
-			req := model.NewSubscribeRequest()
-			if _, err := conn.Write(encoder.EncodePayload(req)); err != nil {
-				log.Fatal(err)
+			select {
+			case outChan <- payload:
+			case <-ctx.Done():
+				return
 			}
-			go writeLogEntryToChan(subscribeChan, conn)
 		}
-	}(subscribeChan)
+	}(outChan)
+	return outChan
+}
+
+//Subscribe creates a subsciption on the log, which in realtime outputs all written log entries to the return channel from the time of subscription.
+//Should a connection be lost the subscription resumes from the last received entry once reconnected.
+func (r *ReadClient) Subscribe() <-chan model.LogEntry {
+	return r.SubscribeContext(context.Background())
+}
+
+//SubscribeContext is like Subscribe, but the subscription ends and the
+//channel is closed once the context is done
+func (r *ReadClient) SubscribeContext(ctx context.Context) <-chan model.LogEntry {
+	subscribeChan := make(chan model.LogEntry)
+	wg := &sync.WaitGroup{}
+
+	for _, conn := range r.connectionPool.AllConnections() {
+		wg.Add(1)
+		go func(conn *Conn) {
+			defer wg.Done()
+			subscribe(ctx, subscribeChan, conn)
+		}(conn)
+	}
+
+	go func() {
+		wg.Wait()
+		close(subscribeChan)
+	}()
 	return subscribeChan
 }
 
@@ -67,17 +232,58 @@ func (r *ReadClient) Close() {
 	r.connectionPool.Close()
 }
 
-func writeLogEntryToChan(ch chan<- model.LogEntry, conn net.Conn) {
-	defer close(ch)
+//subscribe sends a subscription request and forwards every log entry
+//received to the channel until the connection is closed or the context is
+//done. Every time the connection is reestablished it resubscribes from the
+//offset following the last received entry.
+func subscribe(ctx context.Context, ch chan<- model.LogEntry, conn *Conn) {
+	var next uint64
+	resume := false
 
-	scanner := bufio.NewScanner(conn)
-	scanner.Split(encoder.ScanPayloadSplitFunc)
+	for {
+		session, err := conn.session(ctx)
+		if err != nil {
+			return
+		}
 
-	for scanner.Scan() {
-		ch <- append(scanner.Bytes())
-	}
+		request := model.NewSubscribeRequest()
+		if resume {
+			request = model.NewSubscribeFromRequest(next)
+		}
+		if err := session.write(encoder.EncodePayload(request)); err != nil {
+			continue
+		}
 
-	if scanner.Err() != nil {
-		log.Fatal(scanner.Err())
+		for {
+			frame, err := session.next(ctx)
+			if err != nil {
+				break
+			}
+			if len(frame) == 0 {
+				continue
+			}
+			if model.IsControl(frame) {
+				if first, _, ok := model.Request(frame).OffsetRange(); ok {
+					log.Printf("%s, can not resume the subscription from offset %d, the log of '%s' starts at %d",
+						ErrOffsetOutOfRange, next, session.conn.RemoteAddr(), first)
+					return
+				}
+				if offset, ok := model.Request(frame).Offset(); ok {
+					next = offset
+					resume = true
+				}
+				continue
+			}
+
+			select {
+			case ch <- model.LogEntry(frame):
+				next++
+			case <-ctx.Done():
+				//the server keeps on notifying this session,
+				//so it can not be reused for other requests
+				session.close()
+				return
+			}
+		}
 	}
 }
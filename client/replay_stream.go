@@ -1,49 +1,80 @@
 package client
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
-	"net"
 	"sync"
 
 	"github.com/netbrain/dlog/encoder"
 	"github.com/netbrain/dlog/model"
 )
 
+//ErrOffsetOutOfRange is returned when reading from an offset which is not in
+//the log, such as an offset of entries which have expired
+var ErrOffsetOutOfRange = errors.New("offset out of range")
+
 type replayStream struct {
-	conn         net.Conn
-	responseChan chan model.LogEntry
-	once         *sync.Once
+	conn    *Conn
+	request model.Request
+	session *session
+	once    *sync.Once
+	err     error
+	//await is the offset the server must have caught up to before replaying
+	await uint64
 }
 
-func newReplayStream(conn net.Conn) *replayStream {
+func newReplayStream(conn *Conn, request model.Request) *replayStream {
 	r := &replayStream{
-		conn:         conn,
-		responseChan: make(chan model.LogEntry),
-		once:         &sync.Once{},
+		conn:    conn,
+		request: request,
+		once:    &sync.Once{},
 	}
 	return r
 }
 
-func (r *replayStream) next() (model.LogEntry, error) {
+func (r *replayStream) next(ctx context.Context) (model.LogEntry, error) {
 	r.once.Do(func() {
-		r.sendReplayRequest()
-		go r.readReplayResponse()
+		r.err = r.sendReplayRequest(ctx)
 	})
+	if r.err != nil {
+		return nil, r.err
+	}
 
-	response, open := <-r.responseChan
-	if !open {
+	frame, err := r.session.next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(frame) == 0 {
+		r.err = io.EOF
 		return nil, io.EOF
 	}
+	if first, _, ok := model.Request(frame).OffsetRange(); ok && model.IsControl(frame) {
+		r.err = fmt.Errorf("%w, the log of '%s' starts at offset %d", ErrOffsetOutOfRange, r.session.conn.RemoteAddr(), first)
+		return nil, r.err
+	}
 
-	return response, nil
+	return model.LogEntry(frame), nil
 }
 
-func (r *replayStream) sendReplayRequest() error {
-	request := model.NewReplayRequest()
-	_, err := r.conn.Write(encoder.EncodePayload(request))
-	return err
+//abort stops an unfinished replay by closing its session,
+//the server would otherwise keep on streaming the rest of the log
+func (r *replayStream) abort() {
+	if r.session != nil && r.err == nil {
+		r.session.close()
+	}
 }
 
-func (r *replayStream) readReplayResponse() {
-	writeLogEntryToChan(r.responseChan, r.conn)
+func (r *replayStream) sendReplayRequest(ctx context.Context) error {
+	session, err := r.conn.session(ctx)
+	if err != nil {
+		return err
+	}
+	r.session = session
+
+	if err := awaitOffset(ctx, session, r.await); err != nil {
+		return err
+	}
+	return session.write(encoder.EncodePayload(r.request))
 }
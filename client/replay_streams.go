@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"io"
 
 	"github.com/netbrain/dlog/model"
@@ -11,25 +12,33 @@ type replayStreams struct {
 	entries map[int]model.LogEntry
 }
 
-func (r *ReadClient) newReplayStreams() *replayStreams {
+//newReplayStreams creates a stream for every server of the pool, replaying
+//from the offset at the server's position among the offsets, or the whole
+//log of servers without an offset
+func (r *ReadClient) newReplayStreams(offsets []uint64) *replayStreams {
 	streams := make([]*replayStream, r.connectionPool.Len())
 	for i, conn := range r.connectionPool.AllConnections() {
-		streams[i] = newReplayStream(conn)
+		request := model.NewReplayRequest()
+		if i < len(offsets) {
+			request = model.NewReplayFromRequest(offsets[i])
+		}
+		streams[i] = newReplayStream(conn, request)
+		streams[i].await = r.token.offset(i)
 	}
 	return &replayStreams{
 		streams: streams,
 	}
 }
 
-func (r *replayStreams) next() (model.LogEntry, error) {
+func (r *replayStreams) next(ctx context.Context) (model.LogEntry, error) {
 	entryIndex := -1
 
 	if r.entries == nil {
 		r.entries = make(map[int]model.LogEntry)
 
 		for i, stream := range r.streams {
-			e, err := stream.next()
-			if err != nil {
+			e, err := stream.next(ctx)
+			if err != nil && err != io.EOF {
 				return nil, err
 			}
 
@@ -51,7 +60,7 @@ func (r *replayStreams) next() (model.LogEntry, error) {
 		return nil, io.EOF
 	}
 	stream := r.streams[entryIndex]
-	nextEntry, err := stream.next()
+	nextEntry, err := stream.next(ctx)
 	if err != nil && err != io.EOF {
 		return nil, err
 	}
@@ -62,3 +71,9 @@ func (r *replayStreams) next() (model.LogEntry, error) {
 	return entry, nil
 
 }
+
+func (r *replayStreams) abort() {
+	for _, stream := range r.streams {
+		stream.abort()
+	}
+}
@@ -1,40 +1,85 @@
 package client
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"sync"
 	"sync/atomic"
 
 	"github.com/netbrain/dlog/encoder"
+	"github.com/netbrain/dlog/keystore"
 	"github.com/netbrain/dlog/model"
 )
 
+var errKeyTooLarge = errors.New("key is too large")
+
 //WriteClient is the logging client which handles logwriting
 type WriteClient struct {
 	id             model.UUID
-	wChan          chan []byte
-	quitChan       chan bool
+	wChan          chan write
+	quitChan       chan context.Context
+	closed         chan error
+	mutex          sync.Mutex
 	msgCount       uint64
-	connectionPool *RoundRobinConnectionPool
+	connectionPool ConnectionPool
+	ring           *hashRing
+
+	//KeyStore, if set, holds the data keys the payloads written with a key
+	//are encrypted with before they are sent, so that the servers never see
+	//them. Deleting the data key of a key from the KeyStore makes its
+	//entries unreadable, see ReadClient.KeyStore.
+	KeyStore keystore.KeyStore
+}
+
+type write struct {
+	key  []byte
+	data []byte
 }
 
 //NewWriteClient creates a new WriteClient instance
 func NewWriteClient(servers []string) *WriteClient {
+	client, err := NewWriteClientContext(context.Background(), servers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return client
+}
+
+//NewWriteClientContext creates a new WriteClient instance,
+//the context bounds connecting to the servers
+func NewWriteClientContext(ctx context.Context, servers []string) (*WriteClient, error) {
+	pool, err := NewRoundRobinConnectionPoolContext(ctx, servers)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWriteClientWithPool(pool), nil
+}
+
+//NewWriteClientWithPool creates a new WriteClient instance which writes to
+//the servers of the given pool, using the pool's strategy to pick a server
+//for every write
+func NewWriteClientWithPool(pool ConnectionPool) *WriteClient {
 	client := &WriteClient{
 		id:             model.NewUUID(),
-		wChan:          make(chan []byte),
-		quitChan:       make(chan bool),
-		connectionPool: NewRoundRobinConnectionPool(servers),
+		wChan:          make(chan write),
+		quitChan:       make(chan context.Context),
+		closed:         make(chan error, 1),
+		connectionPool: pool,
+		ring:           newHashRing(pool.Len()),
 	}
 
 	go func(w *WriteClient) {
 		for {
 			select {
-			case data := <-w.wChan:
-				if err := w.write(data); err != nil {
-					log.Fatal(err)
+			case write := <-w.wChan:
+				if _, _, err := w.write(write.key, write.data); err != nil {
+					log.Println(err)
 				}
-			case <-w.quitChan:
-				w.close()
+			case ctx := <-w.quitChan:
+				w.closed <- w.close(ctx)
 				return
 			}
 		}
@@ -45,31 +90,184 @@ func NewWriteClient(servers []string) *WriteClient {
 
 //Write adds data to the write queue
 func (w *WriteClient) Write(data []byte) {
-	w.wChan <- data
+	w.wChan <- write{data: data}
 }
 
-func (w *WriteClient) write(data []byte) error {
+//WriteKey adds data to the write queue, to be written to the partition the
+//key hashes to. Entries with the same key always go to the same partition,
+//one per server in the pool, and are written there in the order given.
+func (w *WriteClient) WriteKey(key []byte, data []byte) {
+	w.wChan <- write{key: key, data: data}
+}
+
+//DeleteKey adds a tombstone for the key to the write queue, an entry without
+//a payload which marks the key as deleted. Servers compacting their logs
+//remove the entries of the key.
+func (w *WriteClient) DeleteKey(key []byte) {
+	w.WriteKey(key, nil)
+}
+
+//DeleteKeyContext writes a tombstone for the key like DeleteKey, and waits
+//for the server to acknowledge it like WriteContext
+func (w *WriteClient) DeleteKeyContext(ctx context.Context, key []byte) error {
+	return w.WriteKeyContext(ctx, key, nil)
+}
+
+//EraseKeyContext asks the server of the partition the key hashes to to
+//erase every entry written with the key, and returns the number of entries
+//erased. Unlike DeleteKey the entries are erased at once, replays skip them
+//and servers purge them from their log files. Writes of the key which have
+//not been acknowledged yet may not be erased.
+func (w *WriteClient) EraseKeyContext(ctx context.Context, key []byte) (uint64, error) {
+	if len(key) > model.MaxKeySize {
+		return 0, errKeyTooLarge
+	}
+	conn, _ := keyConnection(w.connectionPool, w.ring, key)
+	return erase(ctx, conn, model.NewEraseRequest(key, nil))
+}
+
+//ShredKeyContext asks the server of the partition the key hashes to to
+//delete the data key its log encrypts the entries of the key with, which
+//makes them unreadable without rewriting the log. The server fails the
+//request if its log has no key store.
+func (w *WriteClient) ShredKeyContext(ctx context.Context, key []byte) error {
+	if len(key) > model.MaxKeySize {
+		return errKeyTooLarge
+	}
+	conn, _ := keyConnection(w.connectionPool, w.ring, key)
+	_, err := roundTrip(ctx, conn, model.NewShredRequest(key), model.TypeShredResponse)
+	return err
+}
+
+//EraseContext asks the server of the partition to erase the entries at the
+//offsets, like EraseKeyContext. Partitions are numbered by their
+//connection's position in the pool.
+func (w *WriteClient) EraseContext(ctx context.Context, partition int, offsets ...uint64) (uint64, error) {
+	conns := w.connectionPool.AllConnections()
+	if partition < 0 || partition >= len(conns) {
+		return 0, fmt.Errorf("no partition %d among %d", partition, len(conns))
+	}
+	return erase(ctx, conns[partition], model.NewEraseRequest(nil, offsets))
+}
+
+//erase sends the erase request and waits for the answer
+func erase(ctx context.Context, conn *Conn, request model.Request) (uint64, error) {
+	response, err := roundTrip(ctx, conn, request, model.TypeEraseResponse)
+	if err != nil {
+		return 0, err
+	}
+	erased, _ := response.Erased()
+	return erased, nil
+}
+
+//roundTrip sends the request and waits for a control request of the
+//response type
+func roundTrip(ctx context.Context, conn *Conn, request model.Request, response byte) (model.Request, error) {
+	session, err := conn.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := session.write(encoder.EncodePayload(request)); err != nil {
+		return nil, err
+	}
+
+	for {
+		frame, err := session.next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(frame) > 0 && model.IsControl(frame) && frame[0] == response {
+			return model.Request(frame), nil
+		}
+	}
+}
+
+//WriteContext writes data and waits for a server to acknowledge it, which
+//the server does once the write is replicated to its quorum. Should the
+//context be done first its error is returned, the data may however still
+//be written, as the server keeps the write and a write which is not
+//acknowledged is resent should the connection be lost.
+func (w *WriteClient) WriteContext(ctx context.Context, data []byte) error {
+	return w.WriteKeyContext(ctx, nil, data)
+}
+
+//WriteKeyContext writes data to the partition the key hashes to, like
+//WriteKey, and waits for the server to acknowledge it like WriteContext
+func (w *WriteClient) WriteKeyContext(ctx context.Context, key []byte, data []byte) error {
+	conn, acked, err := w.write(key, data)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-acked:
+		return nil
+	case <-conn.Closed():
+		return errConnClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *WriteClient) write(key []byte, data []byte) (*Conn, <-chan struct{}, error) {
+	if len(key) > model.MaxKeySize {
+		return nil, nil, errKeyTooLarge
+	}
+
+	if key != nil && len(data) > 0 && w.KeyStore != nil {
+		sealed, err := keystore.Seal(w.KeyStore, key, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		data = sealed
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
 	msgCount := atomic.AddUint64(&w.msgCount, 1)
 
 	md := model.NewMetaData(w.id, msgCount, model.NewUUID()) //TODO  transactionid should be supplied
 	entry := model.NewLogEntry(md, data)
-	request := model.NewWriteRequest(entry)
 
-	conn := w.connectionPool.Connection()
-	if _, err := conn.Write(encoder.EncodePayload(request)); err != nil {
-		return err
+	var conn *Conn
+	var request model.Request
+	if key == nil {
+		conn = w.connectionPool.Connection()
+		request = model.NewWriteRequest(entry)
+	} else {
+		var partition uint32
+		conn, partition = keyConnection(w.connectionPool, w.ring, key)
+		request = model.NewWriteKeyRequest(partition, uint32(w.connectionPool.Len()), key, entry)
 	}
 
-	return nil
+	acked, err := conn.writeAcked(msgCount, encoder.EncodePayload(request))
+	return conn, acked, err
 }
 
-//Close closes the client for further writing
+//Close closes the client for further writing, waiting a while for
+//outstanding writes to be acknowledged by the servers
 func (w *WriteClient) Close() {
-	w.quitChan <- true
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultHeartbeatTimeout)
+	defer cancel()
+	w.CloseContext(ctx)
 }
 
-func (w *WriteClient) close() {
+//CloseContext closes the client for further writing, waiting for
+//outstanding writes to be acknowledged until the context is done
+func (w *WriteClient) CloseContext(ctx context.Context) error {
+	w.quitChan <- ctx
+	return <-w.closed
+}
+
+func (w *WriteClient) close(ctx context.Context) error {
+	var err error
 	close(w.wChan)
-	close(w.quitChan)
+	for _, conn := range w.connectionPool.AllConnections() {
+		if e := conn.drain(ctx); e != nil {
+			err = e
+		}
+	}
 	w.connectionPool.Close()
+	return err
 }
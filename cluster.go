@@ -0,0 +1,840 @@
+package dlog
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	fb "github.com/google/flatbuffers/go"
+	. "github.com/netbrain/dlog/encoder"
+	"github.com/netbrain/dlog/model"
+)
+
+//DefaultElectionTimeout is the default duration a member of a cluster waits
+//to hear from the leader before it starts an election
+const DefaultElectionTimeout = time.Second
+
+var errNotClustered = errors.New("server is not a member of a cluster")
+var errNoLeader = errors.New("cluster has no leader")
+
+type role int
+
+const (
+	followerRole role = iota
+	candidateRole
+	leaderRole
+)
+
+//cluster elects a leader among the members of a cluster using the Raft
+//consensus algorithm, and makes the server follow whichever member is
+//elected. The log itself is replicated by following the leader, so instead
+//of the term of its last entry a member is elected on the term in which it
+//last caught up with a leader, and then on the length of its log.
+//
+//The membership of the cluster is versioned by the leader and sent along
+//with every heartbeat, members only take part in elections while they are
+//a member themselves. Memberships are ordered by the term of the leader
+//they are from and then by version, so that the membership of a newly
+//elected leader replaces the ones of earlier leaders, whatever their
+//versions.
+type cluster struct {
+	server  *Server
+	address string
+	//statePath is empty if the log has no directory to persist the state in
+	statePath string
+	timeout   time.Duration
+	done      chan struct{}
+	stopOnce  sync.Once
+	reset     chan struct{}
+	beat      chan struct{}
+
+	//following serializes making the server follow the current leader
+	following sync.Mutex
+
+	mutex    sync.Mutex
+	role     role
+	term     uint64
+	votedFor string
+	logTerm  uint64
+	leader   string
+	//membershipTerm is the term of the leader the membership is from
+	membershipTerm uint64
+	version        uint64
+	members        []string
+	departed []string
+	heard    time.Time
+	peers    map[string]*peer
+}
+
+//JoinCluster makes the server a member of a cluster. The address is the
+//one other members and clients reach this server at, and members are the
+//addresses of the initial members, which may include the server itself.
+//Members persisted by an earlier run take precedence over the given ones.
+//A server that is not among the given members joins a running cluster, by
+//asking the members to add it. It takes no part in elections until added.
+func (s *Server) JoinCluster(address string, members ...string) error {
+	c := &cluster{
+		server:    s,
+		address:   address,
+		statePath: s.logger.path("dlog.cluster"),
+		timeout:   s.ElectionTimeout,
+		done:      make(chan struct{}),
+		reset:     make(chan struct{}, 1),
+		beat:      make(chan struct{}, 1),
+		peers:     make(map[string]*peer),
+	}
+	if err := c.load(); err != nil {
+		return err
+	}
+	joining := false
+	if c.version == 0 {
+		for _, member := range members {
+			c.add(member)
+		}
+		joining = !c.member(address)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.clustered() != nil {
+		return errors.New("server is already a member of a cluster")
+	}
+	s.cluster.Store(c)
+	go c.run()
+	if joining {
+		go c.join(members)
+	}
+	return nil
+}
+
+//clustered returns the cluster the server is a member of, if any
+func (s *Server) clustered() *cluster {
+	c, _ := s.cluster.Load().(*cluster)
+	return c
+}
+
+//AddMember adds a member to the cluster. A server that is not the leader
+//forwards the change to the leader.
+func (s *Server) AddMember(address string) error {
+	return s.changeMembership(true, address)
+}
+
+//RemoveMember removes a member from the cluster. A server that is not the
+//leader forwards the change to the leader.
+func (s *Server) RemoveMember(address string) error {
+	return s.changeMembership(false, address)
+}
+
+//Members returns the addresses of the members of the cluster
+func (s *Server) Members() []string {
+	c := s.clustered()
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.members...)
+}
+
+func (s *Server) changeMembership(add bool, address string) error {
+	c := s.clustered()
+	if c == nil {
+		return errNotClustered
+	}
+	changed, leader := c.changeMembership(add, address)
+	if changed {
+		return nil
+	}
+	return c.requestMembership(add, address, leader)
+}
+
+//vote answers a vote request of a candidate
+func (s *Server) vote(conn *serverConn, request model.Request) {
+	c := s.clustered()
+	if c == nil {
+		log.Printf("Ignoring vote request: %s", errNotClustered)
+		return
+	}
+	if err := conn.write(EncodePayload(c.vote(request))); err != nil {
+		log.Println(err)
+	}
+	c.follow()
+}
+
+//heartbeat answers a heartbeat of a leader
+func (s *Server) heartbeat(conn *serverConn, request model.Request) {
+	c := s.clustered()
+	if c == nil {
+		log.Printf("Ignoring heartbeat: %s", errNotClustered)
+		return
+	}
+	if err := conn.write(EncodePayload(c.heartbeat(request))); err != nil {
+		log.Println(err)
+	}
+	c.follow()
+}
+
+//metadata answers a client asking for the ClusterMetadata. A server
+//outside of a cluster is the only member of its own cluster, and it is its
+//own leader unless it follows one. The client already reaches it at the
+//local address of the connection.
+func (s *Server) metadata(conn *serverConn) {
+	metadata := model.ClusterMetadata{
+		Offset: s.logger.Offset(),
+	}
+	if _, partitions, ok := s.logger.Partition(); ok {
+		metadata.Partitions = partitions
+	}
+
+	if c := s.clustered(); c != nil {
+		c.mutex.Lock()
+		metadata.Leader = c.leader
+		metadata.Members = append(metadata.Members, c.members...)
+		metadata.Term = c.term
+		metadata.Version = c.version
+		c.mutex.Unlock()
+	} else {
+		self := conn.LocalAddr().String()
+		metadata.Members = []string{self}
+		if metadata.Leader = s.following(); metadata.Leader == "" {
+			metadata.Leader = self
+		}
+	}
+
+	if err := conn.write(EncodePayload(model.NewMetadataResponse(metadata))); err != nil {
+		log.Println(err)
+	}
+}
+
+//epoch returns the epoch of the ClusterMetadata of the server
+func (s *Server) epoch() model.Epoch {
+	c := s.clustered()
+	if c == nil {
+		return model.Epoch{}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return model.Epoch{Term: c.term, Version: c.version}
+}
+
+//membership answers a request to add or remove a member
+func (s *Server) membership(conn *serverConn, request model.Request) {
+	c := s.clustered()
+	if c == nil {
+		log.Printf("Ignoring membership request: %s", errNotClustered)
+		return
+	}
+	add, _ := request.Granted()
+	address, err := request.Address()
+	if err != nil || address == "" {
+		log.Printf("Invalid membership request: %v", err)
+		return
+	}
+	changed, leader := c.changeMembership(add, address)
+	if err := conn.write(EncodePayload(model.NewMembershipResponse(changed, leader))); err != nil {
+		log.Println(err)
+	}
+}
+
+//caughtUp is called by a follower once it has every entry its leader had
+//when it started following, from then on its log is as recent as the term
+//of that leader
+func (s *Server) caughtUp(leader string) {
+	if c := s.clustered(); c != nil {
+		c.caughtUp(leader)
+	}
+}
+
+//quorum returns the number of servers that must have a write before it is
+//acknowledged, which in a cluster is a majority of its members
+func (s *Server) quorum() int {
+	if c := s.clustered(); c != nil {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		return c.quorum()
+	}
+	return s.Quorum
+}
+
+func (c *cluster) run() {
+	for {
+		timer := time.NewTimer(c.timeout + time.Duration(rand.Int63n(int64(c.timeout))))
+		select {
+		case <-timer.C:
+			c.campaign()
+		case <-c.reset:
+			timer.Stop()
+		case <-c.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (c *cluster) stop() {
+	c.stopOnce.Do(func() {
+		close(c.done)
+	})
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.role = followerRole
+	c.leader = ""
+	for _, p := range c.peers {
+		p.close()
+	}
+}
+
+func (c *cluster) stopped() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+//campaign starts an election for the next term, which the member wins if
+//a majority of the members vote for it
+func (c *cluster) campaign() {
+	c.mutex.Lock()
+	if c.role == leaderRole || !c.member(c.address) {
+		c.mutex.Unlock()
+		return
+	}
+	c.term++
+	c.role = candidateRole
+	c.votedFor = c.address
+	c.leader = ""
+	c.persist()
+	term := c.term
+	request := model.NewVoteRequest(term, c.logTerm, c.server.logger.Offset(), c.address)
+	members := c.others()
+	quorum := c.quorum()
+	c.mutex.Unlock()
+
+	log.Printf("Starting election for term %d", term)
+	votes := 1
+	for _, response := range c.broadcast(members, request) {
+		if responseTerm, _ := response.Term(); c.observe(responseTerm) {
+			return
+		}
+		if granted, _ := response.Granted(); granted {
+			votes++
+		}
+	}
+	if votes < quorum {
+		return
+	}
+
+	c.mutex.Lock()
+	elected := c.role == candidateRole && c.term == term && !c.stopped()
+	if elected {
+		c.role = leaderRole
+		c.leader = c.address
+		c.logTerm = term
+		c.membershipTerm = term
+		c.persist()
+	}
+	c.mutex.Unlock()
+
+	if elected {
+		log.Printf("Elected leader of term %d with %d of %d votes", term, votes, len(members)+1)
+		c.follow()
+		go c.lead(term)
+	}
+}
+
+//lead sends heartbeats to the members for as long as the member is the
+//leader of the term. The leader steps down when a majority of the members
+//have not answered within the election timeout.
+func (c *cluster) lead(term uint64) {
+	ticker := time.NewTicker(c.timeout / 5)
+	defer ticker.Stop()
+
+	answered := time.Now()
+	for {
+		c.mutex.Lock()
+		if c.role != leaderRole || c.term != term {
+			c.mutex.Unlock()
+			return
+		}
+		request := model.NewHeartbeatRequest(term, c.version, c.address, c.members)
+		members := append(c.others(), c.departed...)
+		c.departed = nil
+		quorum := c.quorum()
+		member := c.member(c.address)
+		c.mutex.Unlock()
+
+		acks := 0
+		if member {
+			acks++
+		}
+		for _, response := range c.broadcast(members, request) {
+			if responseTerm, _ := response.Term(); c.observe(responseTerm) {
+				c.follow()
+				return
+			}
+			if accepted, _ := response.Granted(); accepted {
+				acks++
+			}
+		}
+		if acks >= quorum {
+			answered = time.Now()
+		}
+		if !member || time.Since(answered) > c.timeout {
+			log.Printf("Stepping down as leader of term %d", term)
+			c.stepDown(term)
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-c.beat:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *cluster) stepDown(term uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.role == leaderRole && c.term == term {
+		c.role = followerRole
+		c.leader = ""
+	}
+}
+
+//observe steps down to follower if the term is newer than the current one,
+//returning true if it was
+func (c *cluster) observe(term uint64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if term <= c.term {
+		return false
+	}
+	c.term = term
+	c.votedFor = ""
+	c.role = followerRole
+	c.leader = ""
+	c.persist()
+	return true
+}
+
+//vote grants the vote to a candidate whose log is at least as recent as
+//the local one, unless the member has already voted in the term. While
+//there is a leader which has been heard from no vote is granted, so that
+//servers that have been removed from the cluster can not disrupt it.
+func (c *cluster) vote(request model.Request) model.Request {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	term, _ := request.Term()
+	candidate, logTerm, offset, err := request.Candidate()
+	if err != nil {
+		log.Printf("Invalid vote request: %s", err)
+		return model.NewVoteResponse(c.term, false)
+	}
+	if term < c.term || c.role == leaderRole || (c.leader != "" && time.Since(c.heard) < c.timeout) {
+		return model.NewVoteResponse(c.term, false)
+	}
+	if term > c.term {
+		c.term = term
+		c.votedFor = ""
+		c.role = followerRole
+		c.leader = ""
+	}
+
+	recent := logTerm > c.logTerm || (logTerm == c.logTerm && offset >= c.server.logger.Offset())
+	granted := recent && (c.votedFor == "" || c.votedFor == candidate)
+	if granted {
+		c.votedFor = candidate
+		c.resetTimer()
+	}
+	c.persist()
+	return model.NewVoteResponse(c.term, granted)
+}
+
+//heartbeat accepts the leader of a term at least as new as the current one,
+//along with the membership it sends if that is newer than the local one,
+//which it is if the leader is of a later term than the local membership,
+//or of the same term and a later version
+func (c *cluster) heartbeat(request model.Request) model.Request {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	term, _ := request.Term()
+	leader, members, version, err := request.Membership()
+	if err != nil {
+		log.Printf("Invalid heartbeat: %s", err)
+		return model.NewHeartbeatResponse(c.term, false)
+	}
+	if term < c.term {
+		return model.NewHeartbeatResponse(c.term, false)
+	}
+
+	newer := term > c.membershipTerm || (term == c.membershipTerm && version > c.version)
+	changed := term > c.term || newer
+	if term > c.term {
+		c.term = term
+		c.votedFor = ""
+	}
+	if newer {
+		c.membershipTerm = term
+		c.version = version
+		c.members = members
+	}
+	c.role = followerRole
+	c.leader = leader
+	c.heard = time.Now()
+	c.resetTimer()
+	if changed {
+		c.persist()
+	}
+	return model.NewHeartbeatResponse(c.term, true)
+}
+
+//changeMembership adds or removes a member if this member is the leader,
+//otherwise it returns the address of the leader
+func (c *cluster) changeMembership(add bool, address string) (bool, string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.role != leaderRole {
+		return false, c.leader
+	}
+	if add == c.member(address) {
+		return true, c.address
+	}
+
+	if add {
+		c.add(address)
+	} else {
+		c.remove(address)
+		c.departed = append(c.departed, address)
+	}
+	c.version++
+	c.persist()
+	log.Printf("Membership version %d: %v", c.version, c.members)
+
+	select {
+	case c.beat <- struct{}{}:
+	default:
+	}
+	return true, c.address
+}
+
+//requestMembership asks the leader to add or remove a member. Should it
+//no longer be the leader, the request is passed on to the one it knows.
+func (c *cluster) requestMembership(add bool, address string, leader string) error {
+	request := model.NewMembershipRequest(add, address)
+	for hops := 0; hops < 3; hops++ {
+		if leader == "" {
+			return errNoLeader
+		}
+		response, err := c.peer(leader).call(request, c.timeout)
+		if err != nil {
+			return err
+		}
+		if changed, _ := response.Granted(); changed {
+			return nil
+		}
+		leader, _ = response.Address()
+	}
+	return fmt.Errorf("could not reach the leader to change the membership of '%s'", address)
+}
+
+//join asks the members to add this server to the cluster, until one of
+//them does
+func (c *cluster) join(members []string) {
+	for {
+		for _, member := range members {
+			err := c.requestMembership(true, c.address, member)
+			if err == nil {
+				log.Printf("Joined the cluster of %v", members)
+				return
+			}
+			log.Printf("err joining the cluster through '%s': %s", member, err)
+		}
+
+		select {
+		case <-time.After(c.timeout):
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *cluster) caughtUp(leader string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.leader == leader && c.logTerm < c.term {
+		c.logTerm = c.term
+		c.persist()
+	}
+}
+
+//follow makes the server follow the current leader, or stop following
+//anyone if it is the leader itself
+func (c *cluster) follow() {
+	c.following.Lock()
+	defer c.following.Unlock()
+
+	c.mutex.Lock()
+	leading, leader := c.role == leaderRole, c.leader
+	c.mutex.Unlock()
+
+	switch {
+	case c.stopped():
+	case leading:
+		c.server.Unfollow()
+	case leader != "" && leader != c.server.following():
+		c.server.Follow(leader)
+	}
+}
+
+//leading returns true if the member is the leader
+func (c *cluster) leading() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.role == leaderRole
+}
+
+func (c *cluster) resetTimer() {
+	select {
+	case c.reset <- struct{}{}:
+	default:
+	}
+}
+
+//broadcast sends the request to every member at once, returning the
+//responses of those that answered. c.mutex must not be held.
+func (c *cluster) broadcast(members []string, request model.Request) []model.Request {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var responses []model.Request
+	for _, member := range members {
+		wg.Add(1)
+		go func(p *peer) {
+			defer wg.Done()
+			response, err := p.call(request, c.timeout/2)
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			responses = append(responses, response)
+		}(c.peer(member))
+	}
+	wg.Wait()
+	return responses
+}
+
+func (c *cluster) peer(address string) *peer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	p, ok := c.peers[address]
+	if !ok {
+		p = &peer{address: address}
+		c.peers[address] = p
+	}
+	return p
+}
+
+//quorum returns the majority of the members, c.mutex must be held
+func (c *cluster) quorum() int {
+	return len(c.members)/2 + 1
+}
+
+//others returns every member but this one, c.mutex must be held
+func (c *cluster) others() []string {
+	var others []string
+	for _, member := range c.members {
+		if member != c.address {
+			others = append(others, member)
+		}
+	}
+	return others
+}
+
+//member returns true if the address is a member, c.mutex must be held
+func (c *cluster) member(address string) bool {
+	for _, member := range c.members {
+		if member == address {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cluster) add(address string) {
+	if !c.member(address) {
+		c.members = append(c.members, address)
+	}
+}
+
+func (c *cluster) remove(address string) {
+	members := make([]string, 0, len(c.members))
+	for _, member := range c.members {
+		if member != address {
+			members = append(members, member)
+		}
+	}
+	c.members = members
+}
+
+//persist writes the term, vote, log term and membership to the state file
+//before any of them is acted upon, c.mutex must be held. The state is
+//written as a frame of the terms, membership version and membership term
+//followed by frames of the address voted for and of every member.
+func (c *cluster) persist() {
+	if c.statePath == "" {
+		return
+	}
+	state := make([]byte, fb.SizeUint64*4)
+	fb.WriteUint64(state, c.term)
+	fb.WriteUint64(state[fb.SizeUint64:], c.logTerm)
+	fb.WriteUint64(state[fb.SizeUint64*2:], c.version)
+	fb.WriteUint64(state[fb.SizeUint64*3:], c.membershipTerm)
+	frames := [][]byte{state, []byte(c.votedFor)}
+	for _, member := range c.members {
+		frames = append(frames, []byte(member))
+	}
+
+	if err := writeFrames(c.statePath, frames); err != nil {
+		log.Printf("Could not persist cluster state: %s", err)
+	}
+}
+
+//load reads the state file written by persist, if there is one
+func (c *cluster) load() error {
+	if c.statePath == "" {
+		return nil
+	}
+	file, err := os.Open(c.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Split(ScanFrameSplitFunc)
+	var frames [][]byte
+	for scanner.Scan() {
+		frames = append(frames, append([]byte(nil), scanner.Bytes()...))
+	}
+	if scanner.Err() != nil {
+		return scanner.Err()
+	}
+	if len(frames) < 2 || len(frames[0]) != fb.SizeUint64*4 {
+		return fmt.Errorf("corrupt cluster state in %s", c.statePath)
+	}
+
+	c.term = fb.GetUint64(frames[0])
+	c.logTerm = fb.GetUint64(frames[0][fb.SizeUint64:])
+	c.version = fb.GetUint64(frames[0][fb.SizeUint64*2:])
+	c.membershipTerm = fb.GetUint64(frames[0][fb.SizeUint64*3:])
+	c.votedFor = string(frames[1])
+	for _, member := range frames[2:] {
+		c.members = append(c.members, string(member))
+	}
+	return nil
+}
+
+//writeFrames atomically replaces the file with the given frames
+func writeFrames(path string, frames [][]byte) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		if _, err = file.Write(EncodePayload(frame)); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+//peer is a connection to another member of the cluster,
+//over which requests are sent one at a time
+type peer struct {
+	address string
+	mutex   sync.Mutex
+	conn    *serverConn
+	scanner *bufio.Scanner
+}
+
+//call sends the request and waits for the response. A connection that
+//was idle long enough for the other member to close it is redialed once.
+func (p *peer) call(request model.Request, timeout time.Duration) (model.Request, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	reused := p.conn != nil
+	response, err := p.roundTrip(request, timeout)
+	if err != nil && reused {
+		response, err = p.roundTrip(request, timeout)
+	}
+	return response, err
+}
+
+func (p *peer) roundTrip(request model.Request, timeout time.Duration) (model.Request, error) {
+	if p.conn == nil {
+		conn, err := net.DialTimeout("tcp", p.address, timeout)
+		if err != nil {
+			return nil, err
+		}
+		p.conn = newServerConn(conn, timeout)
+		p.scanner = bufio.NewScanner(p.conn)
+		p.scanner.Split(ScanFrameSplitFunc)
+	}
+
+	p.conn.SetReadDeadline(time.Now().Add(timeout))
+	err := p.conn.write(EncodePayload(request))
+	if err == nil && p.scanner.Scan() && len(p.scanner.Bytes()) > 0 {
+		return append(model.Request(nil), p.scanner.Bytes()...), nil
+	}
+	if err == nil {
+		err = p.scanner.Err()
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	p.closeConn()
+	return nil, err
+}
+
+func (p *peer) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closeConn()
+}
+
+func (p *peer) closeConn() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
@@ -0,0 +1,178 @@
+package dlog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/netbrain/dlog/model"
+	. "github.com/netbrain/dlog/testdata"
+)
+
+func startClusterServer(t *testing.T) (*Server, string) {
+	s := newTestServer()
+	s.ElectionTimeout = time.Millisecond * 100
+	go s.Start()
+	return s, fmt.Sprintf("127.0.0.1:%d", s.Address().(*net.TCPAddr).Port)
+}
+
+func startCluster(t *testing.T, n int) ([]*Server, []string) {
+	servers := make([]*Server, n)
+	addresses := make([]string, n)
+	for i := range servers {
+		servers[i], addresses[i] = startClusterServer(t)
+	}
+	for i, s := range servers {
+		if err := s.JoinCluster(addresses[i], addresses...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return servers, addresses
+}
+
+//waitForLeader waits until every server agrees on a leader
+//and returns its index
+func waitForLeader(t *testing.T, servers []*Server, addresses []string) int {
+	for start := time.Now(); time.Since(start) < time.Second*5; time.Sleep(time.Millisecond * 10) {
+		leader := servers[0].Leader()
+		agreed := leader != ""
+		for _, s := range servers[1:] {
+			agreed = agreed && s.Leader() == leader
+		}
+		for i, address := range addresses {
+			if agreed && address == leader && servers[i].clustered().leading() {
+				return i
+			}
+		}
+	}
+	t.Fatal("timed out waiting for the cluster to elect a leader")
+	return -1
+}
+
+func TestClusterElectsLeader(t *testing.T) {
+	servers, addresses := startCluster(t, 3)
+	for _, s := range servers {
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, servers, addresses)
+
+	conn, _ := net.Dial("tcp", addresses[leader])
+	defer conn.Close()
+	if !writeAndAwaitAck(t, conn, NewRequestTestData().Build()) {
+		t.Fatal("write to the leader was not acknowledged")
+	}
+	for _, s := range servers {
+		waitForOffset(t, s.logger, 1)
+	}
+
+	follower, _ := net.Dial("tcp", addresses[(leader+1)%len(servers)])
+	defer follower.Close()
+	if writeAndAwaitAck(t, follower, NewRequestTestData().Build()) {
+		t.Fatal("follower acknowledged a write")
+	}
+}
+
+func TestClusterReelectsLeader(t *testing.T) {
+	servers, addresses := startCluster(t, 3)
+	for _, s := range servers {
+		defer s.Stop()
+	}
+	leader := waitForLeader(t, servers, addresses)
+
+	conn, _ := net.Dial("tcp", addresses[leader])
+	if !writeAndAwaitAck(t, conn, NewRequestTestData().Build()) {
+		t.Fatal("write to the leader was not acknowledged")
+	}
+	conn.Close()
+	servers[leader].Stop()
+
+	remaining := append(append([]*Server(nil), servers[:leader]...), servers[leader+1:]...)
+	remainingAddresses := append(append([]string(nil), addresses[:leader]...), addresses[leader+1:]...)
+	next := waitForLeader(t, remaining, remainingAddresses)
+	if remaining[next].logger.Offset() != 1 {
+		t.Fatal("expected the new leader to have the acknowledged write")
+	}
+}
+
+func TestClusterMembershipChanges(t *testing.T) {
+	servers, addresses := startCluster(t, 1)
+	defer servers[0].Stop()
+	waitForLeader(t, servers, addresses)
+
+	joining, address := startClusterServer(t)
+	defer joining.Stop()
+	if err := joining.JoinCluster(address, addresses[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	servers, addresses = append(servers, joining), append(addresses, address)
+	waitForLeader(t, servers, addresses)
+	for _, s := range servers {
+		if len(s.Members()) != 2 {
+			t.Fatalf("expected 2 members, got %v", s.Members())
+		}
+	}
+
+	if err := joining.RemoveMember(address); err != nil {
+		t.Fatal(err)
+	}
+	if len(servers[0].Members()) != 1 {
+		t.Fatalf("expected 1 member, got %v", servers[0].Members())
+	}
+}
+
+func TestClusterOrdersMembershipsByTermAndVersion(t *testing.T) {
+	c := &cluster{
+		reset:          make(chan struct{}, 1),
+		term:           1,
+		membershipTerm: 1,
+		version:        5,
+		members:        []string{"a", "b", "c"},
+	}
+
+	heartbeats := []struct {
+		term, version uint64
+		members       []string
+		accepted      bool
+	}{
+		{2, 4, []string{"a", "b"}, true},
+		{2, 3, []string{"a"}, false},
+		{2, 5, []string{"a", "b", "d"}, true},
+		{3, 1, []string{"a", "d"}, true},
+	}
+	for _, heartbeat := range heartbeats {
+		before := c.members
+		c.heartbeat(model.NewHeartbeatRequest(heartbeat.term, heartbeat.version, "a", heartbeat.members))
+		if accepted := fmt.Sprint(c.members) == fmt.Sprint(heartbeat.members); accepted != heartbeat.accepted {
+			t.Fatalf("membership %d of term %d accepted %t, expected %t: %v before, %v after",
+				heartbeat.version, heartbeat.term, accepted, heartbeat.accepted, before, c.members)
+		}
+	}
+}
+
+func TestClusterStateIsPersisted(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	logger, _ := NewLogger(dir)
+	s := NewServer(logger, 0)
+	s.ElectionTimeout = time.Millisecond * 100
+	go s.Start()
+	address := fmt.Sprintf("127.0.0.1:%d", s.Address().(*net.TCPAddr).Port)
+	if err := s.JoinCluster(address, address); err != nil {
+		t.Fatal(err)
+	}
+	servers, addresses := []*Server{s}, []string{address}
+	waitForLeader(t, servers, addresses)
+	servers[0].Stop()
+
+	c := &cluster{statePath: servers[0].clustered().statePath}
+	if err := c.load(); err != nil {
+		t.Fatal(err)
+	}
+	if c.term == 0 || c.logTerm != c.term || c.votedFor != addresses[0] || len(c.members) != 1 {
+		t.Fatalf("unexpected state: term %d, log term %d, voted for '%s', members %v", c.term, c.logTerm, c.votedFor, c.members)
+	}
+}
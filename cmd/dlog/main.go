@@ -0,0 +1,465 @@
+/*
+Command dlog works with the files of logs offline, while no server has
+them open.
+
+Usage:
+	dlog <command> [flags]
+
+The commands are:
+	migrate    write a legacy dlog.bin file to a new log directory
+	snapshot   copy a snapshot of a log directory along with a manifest
+	restore    rebuild a log directory from a snapshot
+	verify     check the segments of a log directory, and repair them
+	dump       print the entries of a log directory or log file
+	export     write the entries of a log directory as JSON lines or an archive
+	import     write the entries of JSON lines or an archive to a log directory
+
+Migrating a legacy log file, which is left as it is:
+	./dlog migrate -from=/var/dlog/dlog.bin -dir=/var/dlog-migrated
+
+Restoring the log as it was at noon from a snapshot, which a running
+server takes on SIGUSR1 (see examples/server):
+	./dlog restore -from=/backup/dlog-20261019 -dir=/var/dlog -time=2026-10-19T12:00:00Z
+
+Checking a log, and truncating the segments at their corrupt ranges, which
+are kept in a quarantine directory:
+	./dlog verify -dir=/var/dlog -repair -quarantine=/var/dlog-quarantine
+
+Printing the entries of a client from a log file copied off a broken box,
+as JSON lines:
+	./dlog dump -path=/tmp/broken/dlog.bin -client=4515762589998146400 -json
+
+Moving the entries of a log to another environment in an archive, giving
+them the MetaData of the import:
+	./dlog export -dir=/var/dlog -format=archive -to=dlog.arc
+	./dlog import -from=dlog.arc -format=archive -dir=/var/dlog-staging -restamp
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/netbrain/dlog"
+	"github.com/netbrain/dlog/keystore"
+	"github.com/netbrain/dlog/model"
+)
+
+var commands = map[string]func(args []string) error{
+	"migrate":  migrate,
+	"snapshot": snapshot,
+	"restore":  restore,
+	"verify":   verify,
+	"dump":     dump,
+	"export":   export,
+	"import":   importEntries,
+}
+
+func main() {
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		usage()
+		os.Exit(2)
+	}
+	if err := commands[os.Args[1]](os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: dlog <command> [flags]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  migrate    write a legacy dlog.bin file to a new log directory")
+	fmt.Fprintln(os.Stderr, "  snapshot   copy a snapshot of a log directory along with a manifest")
+	fmt.Fprintln(os.Stderr, "  restore    rebuild a log directory from a snapshot")
+	fmt.Fprintln(os.Stderr, "  verify     check the segments of a log directory, and repair them")
+	fmt.Fprintln(os.Stderr, "  dump       print the entries of a log directory or log file")
+	fmt.Fprintln(os.Stderr, "  export     write the entries of a log directory as JSON lines or an archive")
+	fmt.Fprintln(os.Stderr, "  import     write the entries of JSON lines or an archive to a log directory")
+}
+
+//formatFlags adds the flags of the format of new segments to the set
+func formatFlags(flags *flag.FlagSet, options *dlog.LoggerOptions) func() error {
+	var codec string
+	flags.Int64Var(&options.SegmentSize, "segment-size", dlog.DefaultSegmentSize, "the size in bytes of a segment file before a new one is started")
+	flags.StringVar(&codec, "codec", "flate", "the codec to compress the blocks of new segments with, one of none, flate and lz")
+	flags.IntVar(&options.BlockSize, "block-size", dlog.DefaultBlockSize, "the size in bytes of the entries of a block before it is compressed")
+	return func() error {
+		switch codec {
+		case "none":
+			options.Codec = dlog.NoCodec
+		case "flate":
+			options.Codec = dlog.NewFlateCodec(flate.DefaultCompression)
+		case "lz":
+			options.Codec = dlog.LZCodec
+		default:
+			return fmt.Errorf("unknown codec '%s'", codec)
+		}
+		return nil
+	}
+}
+
+//segmentKeyFlags adds the flags of the keys of encrypted segments to the set
+func segmentKeyFlags(flags *flag.FlagSet) func() keystore.KeyProvider {
+	var segmentKeys, segmentKeysEnv string
+	flags.StringVar(&segmentKeys, "segment-keys", "", "the file of the keys of encrypted segments, one id:hexkey per line")
+	flags.StringVar(&segmentKeysEnv, "segment-keys-env", "", "the environment variable of the keys of encrypted segments, comma separated id:hexkey")
+	return func() keystore.KeyProvider {
+		if segmentKeys != "" {
+			return keystore.NewFileKeyProvider(segmentKeys)
+		} else if segmentKeysEnv != "" {
+			return keystore.NewEnvKeyProvider(segmentKeysEnv)
+		}
+		return nil
+	}
+}
+
+func migrate(args []string) error {
+	var from, dir string
+	var options dlog.LoggerOptions
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.StringVar(&from, "from", "dlog.bin", "the legacy log file to migrate")
+	flags.StringVar(&dir, "dir", "", "the directory to write the new log to, which must not hold a log")
+	parseFormat := formatFlags(flags, &options)
+	flags.Parse(args)
+
+	if dir == "" {
+		return fmt.Errorf("-dir is required")
+	}
+	if err := parseFormat(); err != nil {
+		return err
+	}
+	report, err := dlog.Migrate(from, dir, options)
+	if err != nil {
+		return err
+	}
+	fmt.Println(report)
+	if report.Corrupt != nil {
+		return fmt.Errorf("'%s' is damaged, only the entries before offset %d were migrated", from, report.Corrupt.Offset)
+	}
+	return nil
+}
+
+func snapshot(args []string) error {
+	var dir, to string
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	flags.StringVar(&dir, "dir", "", "the directory of the log")
+	flags.StringVar(&to, "to", "", "the directory to copy the snapshot to")
+	parseSegmentKeys := segmentKeyFlags(flags)
+	flags.Parse(args)
+
+	if dir == "" || to == "" {
+		return fmt.Errorf("-dir and -to are required")
+	}
+	logger, err := dlog.NewLoggerWithOptions(dir, dlog.LoggerOptions{SegmentKeys: parseSegmentKeys()})
+	if err != nil {
+		return err
+	}
+	defer logger.Close()
+	manifest, err := logger.Snapshot(to)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("snapshot of offsets %d up to %d in %d files written to '%s'\n",
+		manifest.FirstOffset, manifest.NextOffset, len(manifest.Files), to)
+	return nil
+}
+
+func restore(args []string) error {
+	var from, dir, at string
+	var options dlog.RestoreOptions
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.StringVar(&from, "from", "", "the directory of the snapshot")
+	flags.StringVar(&dir, "dir", "", "the directory to rebuild the log in, which must not hold a log")
+	flags.Uint64Var(&options.Offset, "offset", 0, "restore only the entries before this offset, zero restores them all")
+	flags.StringVar(&at, "time", "", "restore only the entries before the first whose transaction began after this RFC 3339 time")
+	parseSegmentKeys := segmentKeyFlags(flags)
+	flags.Parse(args)
+	options.Logger.SegmentKeys = parseSegmentKeys()
+
+	if from == "" || dir == "" {
+		return fmt.Errorf("-from and -dir are required")
+	}
+	if at != "" {
+		var err error
+		if options.Time, err = time.Parse(time.RFC3339, at); err != nil {
+			return err
+		}
+	}
+	next, err := dlog.Restore(from, dir, options)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored the entries up to offset %d from '%s' to '%s'\n", next, from, dir)
+	return nil
+}
+
+func verify(args []string) error {
+	var dir string
+	var options dlog.VerifyOptions
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.StringVar(&dir, "dir", "", "the directory of the log, which no server may have open")
+	flags.BoolVar(&options.Repair, "repair", false, "truncate the segments at their corrupt ranges and rewrite stale block indexes")
+	flags.StringVar(&options.QuarantineDirectory, "quarantine", "", "the directory to copy corrupt ranges to before they are truncated")
+	parseSegmentKeys := segmentKeyFlags(flags)
+	flags.Parse(args)
+
+	if dir == "" {
+		return fmt.Errorf("-dir is required")
+	}
+	options.SegmentKeys = parseSegmentKeys()
+	report, err := dlog.Verify(dir, options)
+	if err != nil {
+		return err
+	}
+	fmt.Println(report)
+	if !report.Ok() && !report.Repaired {
+		return fmt.Errorf("the log is damaged, -repair truncates the corrupt ranges")
+	}
+	return nil
+}
+
+//dumpedEntry is an entry as dump prints it
+type dumpedEntry struct {
+	Offset uint64
+	//ClientID and TransactionID are JSON strings, as JSON numbers lose the
+	//precision of 64 bit ones in most decoders
+	ClientID            model.UUID `json:",string"`
+	ClientMessageNumber uint64
+	TransactionID       model.UUID `json:",string"`
+	//Time is when the transaction of the entry began
+	Time    time.Time
+	Payload []byte
+}
+
+//line formats the entry as a line of text, with the payload formatted
+func (e dumpedEntry) line(payload string) string {
+	return fmt.Sprintf("offset=%d client=%d message=%d transaction=%d time=%s payload=%s",
+		e.Offset, e.ClientID, e.ClientMessageNumber, e.TransactionID, e.Time.Format(time.RFC3339), payload)
+}
+
+func dump(args []string) error {
+	var path, contains, since, until, payloadFormat, keyStore string
+	var clientID uint64
+	var limit int
+	var asJSON bool
+	var options dlog.DumpOptions
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	flags.StringVar(&path, "path", "", "the directory of the log, a segment file or a legacy log file, which no server may have open")
+	flags.Uint64Var(&options.From, "from", 0, "print only the entries from this offset")
+	flags.Uint64Var(&options.To, "to", 0, "print only the entries before this offset, zero prints up to the last one")
+	flags.Uint64Var(&clientID, "client", 0, "print only the entries of this ClientID")
+	flags.StringVar(&contains, "contains", "", "print only the entries whose payload contains this text")
+	flags.StringVar(&since, "since", "", "print only the entries whose transaction began at or after this RFC 3339 time")
+	flags.StringVar(&until, "until", "", "print only the entries whose transaction began before this RFC 3339 time")
+	flags.IntVar(&limit, "limit", 0, "stop once this many entries are printed, zero prints them all")
+	flags.BoolVar(&asJSON, "json", false, "print the entries as JSON lines, with base64 encoded payloads")
+	flags.StringVar(&payloadFormat, "payload", "text", "how payloads are printed without -json, one of text, hex and base64")
+	flags.StringVar(&keyStore, "keystore", "", "the file of the data keys the entries of every key are encrypted with, without it their payloads are printed encrypted")
+	parseSegmentKeys := segmentKeyFlags(flags)
+	flags.Parse(args)
+
+	if path == "" {
+		return fmt.Errorf("-path is required")
+	}
+	options.SegmentKeys = parseSegmentKeys()
+	if keyStore != "" {
+		store, err := keystore.NewFileKeyStore(keyStore)
+		if err != nil {
+			return err
+		}
+		options.KeyStore = store
+	}
+	var from, to time.Time
+	var err error
+	if since != "" {
+		if from, err = time.Parse(time.RFC3339, since); err != nil {
+			return err
+		}
+	}
+	if until != "" {
+		if to, err = time.Parse(time.RFC3339, until); err != nil {
+			return err
+		}
+	}
+	var formatPayload func(payload []byte) string
+	switch payloadFormat {
+	case "text":
+		formatPayload = func(payload []byte) string { return strconv.Quote(string(payload)) }
+	case "hex":
+		formatPayload = hex.EncodeToString
+	case "base64":
+		formatPayload = base64.StdEncoding.EncodeToString
+	default:
+		return fmt.Errorf("unknown payload format '%s'", payloadFormat)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	encoder := json.NewEncoder(out)
+	errLimit := errors.New("limit reached")
+	n := 0
+	corrupt, err := dlog.Dump(path, options, func(offset uint64, entry model.LogEntry) error {
+		metaData := entry.MetaData()
+		e := dumpedEntry{
+			Offset:              offset,
+			ClientID:            metaData.ClientID(),
+			ClientMessageNumber: metaData.ClientMessageNumber(),
+			TransactionID:       metaData.TransactionID(),
+			Time:                metaData.TransactionID().Time(),
+			Payload:             entry.Payload(),
+		}
+		if clientID != 0 && uint64(e.ClientID) != clientID ||
+			contains != "" && !bytes.Contains(e.Payload, []byte(contains)) ||
+			!from.IsZero() && e.Time.Before(from) ||
+			!to.IsZero() && !e.Time.Before(to) {
+			return nil
+		}
+		if asJSON {
+			if err := encoder.Encode(e); err != nil {
+				return err
+			}
+		} else if _, err := fmt.Fprintln(out, e.line(formatPayload(e.Payload))); err != nil {
+			return err
+		}
+		if n++; n == limit {
+			return errLimit
+		}
+		return nil
+	})
+	if err != nil && err != errLimit {
+		return err
+	}
+	if len(corrupt) > 0 {
+		out.Flush()
+		for _, c := range corrupt {
+			fmt.Fprintf(os.Stderr, "corrupt %s\n", c)
+		}
+		return fmt.Errorf("the log is damaged, the entries of its corrupt ranges are not printed")
+	}
+	return nil
+}
+
+//exportFlags adds the flags of the format of an export, and of the keys the
+//entries of the log are encrypted with, to the set
+func exportFlags(flags *flag.FlagSet, format *dlog.ExportFormat, options *dlog.LoggerOptions) func() error {
+	var name, keyStore string
+	flags.StringVar(&name, "format", "jsonl", "the format of the entries, one of jsonl and archive")
+	flags.StringVar(&keyStore, "keystore", "", "the file of the data keys the entries of every key are encrypted with")
+	parseSegmentKeys := segmentKeyFlags(flags)
+	return func() error {
+		switch name {
+		case "jsonl":
+			*format = dlog.JSONLines
+		case "archive":
+			*format = dlog.Archive
+		default:
+			return fmt.Errorf("unknown format '%s'", name)
+		}
+		if keyStore != "" {
+			store, err := keystore.NewFileKeyStore(keyStore)
+			if err != nil {
+				return err
+			}
+			options.KeyStore = store
+		}
+		options.SegmentKeys = parseSegmentKeys()
+		return nil
+	}
+}
+
+func export(args []string) error {
+	var dir, to string
+	var options dlog.ExportOptions
+	var loggerOptions dlog.LoggerOptions
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.StringVar(&dir, "dir", "", "the directory of the log, which no server may have open, and which is left untouched")
+	flags.StringVar(&to, "to", "-", "the file to write the entries to, - writes them to stdout")
+	flags.Uint64Var(&options.From, "from", 0, "export only the entries from this offset")
+	flags.Uint64Var(&options.To, "until", 0, "export only the entries before this offset, zero exports up to the last one")
+	parseExport := exportFlags(flags, &options.Format, &loggerOptions)
+	flags.Parse(args)
+
+	if dir == "" {
+		return fmt.Errorf("-dir is required")
+	}
+	if err := parseExport(); err != nil {
+		return err
+	}
+	dumpOptions := dlog.DumpOptions{SegmentKeys: loggerOptions.SegmentKeys, KeyStore: loggerOptions.KeyStore}
+
+	out := os.Stdout
+	if to != "-" {
+		var err error
+		if out, err = os.Create(to); err != nil {
+			return err
+		}
+	}
+	n, err := dlog.Export(dir, out, options, dumpOptions)
+	if to != "-" {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		//a failed export, even one missing only the corrupt ranges of the
+		//log, is not to be mistaken for a complete one
+		if err != nil {
+			os.Remove(to)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d entries from '%s'\n", n, dir)
+	return nil
+}
+
+func importEntries(args []string) error {
+	var from, dir string
+	var options dlog.ImportOptions
+	var loggerOptions dlog.LoggerOptions
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.StringVar(&from, "from", "-", "the file to read the entries from, - reads them from stdin")
+	flags.StringVar(&dir, "dir", "", "the directory of the log to write the entries to, which no server may have open")
+	flags.BoolVar(&options.Restamp, "restamp", false, "give the entries new MetaData rather than the MetaData they were exported with")
+	parseExport := exportFlags(flags, &options.Format, &loggerOptions)
+	parseFormat := formatFlags(flags, &loggerOptions)
+	flags.Parse(args)
+
+	if dir == "" {
+		return fmt.Errorf("-dir is required")
+	}
+	if err := parseExport(); err != nil {
+		return err
+	}
+	if err := parseFormat(); err != nil {
+		return err
+	}
+
+	in := os.Stdin
+	if from != "-" {
+		var err error
+		if in, err = os.Open(from); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	logger, err := dlog.NewLoggerWithOptions(dir, loggerOptions)
+	if err != nil {
+		return err
+	}
+	defer logger.Close()
+	first := logger.Offset()
+	n, err := logger.Import(in, options)
+	fmt.Printf("imported %d entries to '%s' from offset %d\n", n, dir, first)
+	return err
+}
@@ -0,0 +1,687 @@
+/*
+Command dlogctl inspects and writes to the log of running servers.
+
+Usage:
+	dlogctl <command> [flags]
+
+The commands are:
+	tail       print the entries written to the log from now on
+	replay     print the entries of the log, from an offset and filtered
+	write      write the lines read from stdin to the log
+	stat       count the entries of the log and their sizes
+	streams    list the log of every server
+	groups     list the clusters the servers are members of
+
+Every command connects to the comma separated -servers. The log has neither
+named streams nor consumer groups: streams lists the log of every server,
+which are the streams a replay merges entry by entry, and groups lists the
+servers grouped by the cluster they are members of.
+
+The entries tail and replay print are filtered by -contains, -client,
+-since and -until, and printed in the -format raw, hex, json or template.
+A template is a text/template of the fields of an entry, ClientID,
+ClientMessageNumber, TransactionID, Time, Key and Payload.
+
+Following the orders written to a cluster as JSON lines:
+	./dlogctl tail -servers=host1:1234,host2:1234 -contains=order -format=json
+
+Printing the entries of the last hour, from offset 1000 of the server:
+	./dlogctl replay -servers=host1:1234 -from=1000 -since=2026-10-19T11:00:00Z -format=template -template='{{.ClientMessageNumber}} {{printf "%s" .Payload}}'
+
+Writing every line of a file to the entries of a key:
+	./dlogctl write -servers=host1:1234 -key=order-1 < orders.txt
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/netbrain/dlog/client"
+	"github.com/netbrain/dlog/model"
+)
+
+var commands = map[string]func(args []string) error{
+	"tail":    tail,
+	"replay":  replay,
+	"write":   write,
+	"stat":    stat,
+	"streams": streams,
+	"groups":  groups,
+}
+
+func main() {
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		usage()
+		os.Exit(2)
+	}
+	if err := commands[os.Args[1]](os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: dlogctl <command> [flags]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  tail       print the entries written to the log from now on")
+	fmt.Fprintln(os.Stderr, "  replay     print the entries of the log, from an offset and filtered")
+	fmt.Fprintln(os.Stderr, "  write      write the lines read from stdin to the log")
+	fmt.Fprintln(os.Stderr, "  stat       count the entries of the log and their sizes")
+	fmt.Fprintln(os.Stderr, "  streams    list the log of every server")
+	fmt.Fprintln(os.Stderr, "  groups     list the clusters the servers are members of")
+}
+
+//record is an entry as it is printed. Entries replayed by key have only
+//their key and payload. The ids are printed as JSON strings, as JSON
+//numbers lose the precision of 64 bit ones in most decoders.
+type record struct {
+	ClientID            model.UUID `json:",omitempty,string"`
+	ClientMessageNumber uint64     `json:",omitempty"`
+	TransactionID       model.UUID `json:",omitempty,string"`
+	//Time is when the transaction of the entry began
+	Time    *time.Time `json:",omitempty"`
+	Key     string     `json:",omitempty"`
+	Payload []byte
+}
+
+func newRecord(entry model.LogEntry) record {
+	metaData := entry.MetaData()
+	created := metaData.TransactionID().Time()
+	return record{
+		ClientID:            metaData.ClientID(),
+		ClientMessageNumber: metaData.ClientMessageNumber(),
+		TransactionID:       metaData.TransactionID(),
+		Time:                &created,
+		Payload:             entry.Payload(),
+	}
+}
+
+//serverFlags adds the flags of the servers to connect to to the set
+func serverFlags(flags *flag.FlagSet) func() ([]string, error) {
+	var servers string
+	flags.StringVar(&servers, "servers", "localhost:1234", "comma separated list of the servers to connect to")
+	return func() ([]string, error) {
+		var list []string
+		for _, server := range strings.Split(servers, ",") {
+			if server = strings.TrimSpace(server); server != "" {
+				list = append(list, server)
+			}
+		}
+		if len(list) == 0 {
+			return nil, fmt.Errorf("-servers is required")
+		}
+		return list, nil
+	}
+}
+
+//outputFlags adds the flags of how entries are printed to the set
+func outputFlags(flags *flag.FlagSet) func() (func(record) error, error) {
+	var format, text string
+	flags.StringVar(&format, "format", "raw", "how entries are printed, one of raw, hex, json and template")
+	flags.StringVar(&text, "template", "", "the text/template entries are printed with, for -format=template")
+	return func() (func(record) error, error) {
+		out := bufio.NewWriter(os.Stdout)
+		var output func(record) error
+		switch format {
+		case "raw":
+			output = func(r record) error {
+				out.Write(r.Payload)
+				return out.WriteByte('\n')
+			}
+		case "hex":
+			output = func(r record) error {
+				out.WriteString(hex.EncodeToString(r.Payload))
+				return out.WriteByte('\n')
+			}
+		case "json":
+			encoder := json.NewEncoder(out)
+			output = func(r record) error {
+				return encoder.Encode(r)
+			}
+		case "template":
+			if text == "" {
+				return nil, fmt.Errorf("-template is required for -format=template")
+			}
+			tmpl, err := template.New("entry").Parse(text)
+			if err != nil {
+				return nil, err
+			}
+			output = func(r record) error {
+				if err := tmpl.Execute(out, r); err != nil {
+					return err
+				}
+				return out.WriteByte('\n')
+			}
+		default:
+			return nil, fmt.Errorf("unknown format '%s'", format)
+		}
+		return func(r record) error {
+			if err := output(r); err != nil {
+				return err
+			}
+			return out.Flush()
+		}, nil
+	}
+}
+
+//filterFlags adds the flags of which entries are printed to the set
+func filterFlags(flags *flag.FlagSet) func() (func(record) bool, error) {
+	var contains, since, until string
+	var clientID uint64
+	flags.StringVar(&contains, "contains", "", "only entries whose payload contains this text")
+	flags.Uint64Var(&clientID, "client", 0, "only entries of this ClientID")
+	flags.StringVar(&since, "since", "", "only entries whose transaction began at or after this RFC 3339 time")
+	flags.StringVar(&until, "until", "", "only entries whose transaction began before this RFC 3339 time")
+	return func() (func(record) bool, error) {
+		var from, to time.Time
+		var err error
+		if since != "" {
+			if from, err = time.Parse(time.RFC3339, since); err != nil {
+				return nil, err
+			}
+		}
+		if until != "" {
+			if to, err = time.Parse(time.RFC3339, until); err != nil {
+				return nil, err
+			}
+		}
+		return func(r record) bool {
+			if contains != "" && !bytes.Contains(r.Payload, []byte(contains)) {
+				return false
+			}
+			if clientID != 0 && uint64(r.ClientID) != clientID {
+				return false
+			}
+			if r.Time != nil && !from.IsZero() && r.Time.Before(from) {
+				return false
+			}
+			if r.Time != nil && !to.IsZero() && !r.Time.Before(to) {
+				return false
+			}
+			return true
+		}, nil
+	}
+}
+
+//interrupted returns a context which is done once the command is
+//interrupted
+func interrupted() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+func tail(args []string) error {
+	var limit int
+	flags := flag.NewFlagSet("tail", flag.ExitOnError)
+	parseServers := serverFlags(flags)
+	parseOutput := outputFlags(flags)
+	parseFilter := filterFlags(flags)
+	flags.IntVar(&limit, "limit", 0, "stop once this many entries are printed, zero follows the log until interrupted")
+	flags.Parse(args)
+
+	servers, err := parseServers()
+	if err != nil {
+		return err
+	}
+	output, err := parseOutput()
+	if err != nil {
+		return err
+	}
+	filter, err := parseFilter()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interrupted()
+	defer cancel()
+	readClient, err := client.NewReadClientContext(ctx, servers)
+	if err != nil {
+		return err
+	}
+	defer readClient.Close()
+
+	n := 0
+	for entry := range readClient.SubscribeContext(ctx) {
+		r := newRecord(entry)
+		if !filter(r) {
+			continue
+		}
+		if err := output(r); err != nil {
+			return err
+		}
+		if n++; n == limit {
+			break
+		}
+	}
+	return nil
+}
+
+//replayFlags adds the flags of which entries of the log are replayed to the
+//set, and returns the function replaying them
+func replayFlags(flags *flag.FlagSet) func(ctx context.Context, readClient *client.ReadClient, servers []string) (<-chan record, error) {
+	var from uint64
+	var key string
+	flags.Uint64Var(&from, "from", 0, "replay the log of every server from this offset, zero replays the whole log")
+	flags.StringVar(&key, "key", "", "replay only the entries written with this key")
+	return func(ctx context.Context, readClient *client.ReadClient, servers []string) (<-chan record, error) {
+		records := make(chan record, 100)
+		if key != "" {
+			if from > 0 {
+				return nil, fmt.Errorf("-from and -key can not be combined")
+			}
+			go func() {
+				defer close(records)
+				for payload := range readClient.ReplayKeyContext(ctx, []byte(key)) {
+					select {
+					case records <- record{Key: key, Payload: payload}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+			return records, nil
+		}
+
+		var offsets []uint64
+		if from > 0 {
+			for range servers {
+				offsets = append(offsets, from)
+			}
+		}
+		entries, err := readClient.ReplayEntriesFromContext(ctx, offsets)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			defer close(records)
+			for entry := range entries {
+				select {
+				case records <- newRecord(entry):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return records, nil
+	}
+}
+
+func replay(args []string) error {
+	var limit int
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	parseServers := serverFlags(flags)
+	parseOutput := outputFlags(flags)
+	parseFilter := filterFlags(flags)
+	replayEntries := replayFlags(flags)
+	flags.IntVar(&limit, "limit", 0, "stop once this many entries are printed, zero prints every entry")
+	flags.Parse(args)
+
+	servers, err := parseServers()
+	if err != nil {
+		return err
+	}
+	output, err := parseOutput()
+	if err != nil {
+		return err
+	}
+	filter, err := parseFilter()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interrupted()
+	defer cancel()
+	readClient, err := client.NewReadClientContext(ctx, servers)
+	if err != nil {
+		return err
+	}
+	defer readClient.Close()
+	records, err := replayEntries(ctx, readClient, servers)
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	for r := range records {
+		if !filter(r) {
+			continue
+		}
+		if err := output(r); err != nil {
+			return err
+		}
+		if n++; n == limit {
+			break
+		}
+	}
+	return nil
+}
+
+func write(args []string) error {
+	var key, decode string
+	var whole bool
+	var timeout time.Duration
+	flags := flag.NewFlagSet("write", flag.ExitOnError)
+	parseServers := serverFlags(flags)
+	flags.StringVar(&key, "key", "", "write the entries with this key")
+	flags.StringVar(&decode, "decode", "raw", "how the lines are decoded into payloads, one of raw, hex and base64")
+	flags.BoolVar(&whole, "whole", false, "write all of stdin as a single entry rather than an entry per line")
+	flags.DurationVar(&timeout, "timeout", 10*time.Second, "how long to wait for every write to be acknowledged")
+	flags.Parse(args)
+
+	servers, err := parseServers()
+	if err != nil {
+		return err
+	}
+	var decodePayload func(line []byte) ([]byte, error)
+	switch decode {
+	case "raw":
+		decodePayload = func(line []byte) ([]byte, error) { return line, nil }
+	case "hex":
+		decodePayload = func(line []byte) ([]byte, error) { return hex.DecodeString(string(line)) }
+	case "base64":
+		decodePayload = func(line []byte) ([]byte, error) { return base64.StdEncoding.DecodeString(string(line)) }
+	default:
+		return fmt.Errorf("unknown decoding '%s'", decode)
+	}
+
+	ctx, cancel := interrupted()
+	defer cancel()
+	writeClient, err := client.NewWriteClientContext(ctx, servers)
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	err = readPayloads(os.Stdin, whole, func(line []byte) error {
+		payload, err := decodePayload(line)
+		if err != nil {
+			return err
+		}
+		writeCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		if key != "" {
+			err = writeClient.WriteKeyContext(writeCtx, []byte(key), payload)
+		} else {
+			err = writeClient.WriteContext(writeCtx, payload)
+		}
+		if err == nil {
+			n++
+		}
+		return err
+	})
+	closeCtx, closeCancel := context.WithTimeout(context.Background(), timeout)
+	defer closeCancel()
+	if closeErr := writeClient.CloseContext(closeCtx); err == nil {
+		err = closeErr
+	}
+	fmt.Fprintf(os.Stderr, "%d entries written\n", n)
+	return err
+}
+
+//readPayloads calls fn with every line of r which is not empty, as an empty
+//payload written with a key deletes it, or with all of r if whole is set
+func readPayloads(r io.Reader, whole bool, fn func(payload []byte) error) error {
+	if whole {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return fn(data)
+	}
+
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) > 0 {
+			if err := fn(line); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+//stats are the counts and sizes of the entries replayed
+type stats struct {
+	Entries    int
+	Tombstones int
+	//PayloadBytes is the size of the payloads of the entries, and
+	//MinPayload and MaxPayload the size of the smallest and largest
+	PayloadBytes int64
+	MinPayload   int
+	MaxPayload   int
+	//First and Last are when the earliest and latest transaction of the
+	//entries began
+	First time.Time `json:",omitempty"`
+	Last  time.Time `json:",omitempty"`
+}
+
+func (s *stats) add(r record) {
+	size := len(r.Payload)
+	if s.Entries == 0 || size < s.MinPayload {
+		s.MinPayload = size
+	}
+	if size > s.MaxPayload {
+		s.MaxPayload = size
+	}
+	s.Entries++
+	s.PayloadBytes += int64(size)
+	if size == 0 {
+		s.Tombstones++
+	}
+	if r.Time != nil {
+		if s.First.IsZero() || r.Time.Before(s.First) {
+			s.First = *r.Time
+		}
+		if r.Time.After(s.Last) {
+			s.Last = *r.Time
+		}
+	}
+}
+
+func (s stats) String() string {
+	mean := 0.0
+	if s.Entries > 0 {
+		mean = float64(s.PayloadBytes) / float64(s.Entries)
+	}
+	text := fmt.Sprintf("entries     %d\ntombstones  %d\npayloads    %d bytes, min %d, max %d, mean %.1f",
+		s.Entries, s.Tombstones, s.PayloadBytes, s.MinPayload, s.MaxPayload, mean)
+	if !s.First.IsZero() {
+		text += fmt.Sprintf("\nfirst       %s\nlast        %s", s.First.Format(time.RFC3339), s.Last.Format(time.RFC3339))
+	}
+	return text
+}
+
+func stat(args []string) error {
+	var asJSON bool
+	flags := flag.NewFlagSet("stat", flag.ExitOnError)
+	parseServers := serverFlags(flags)
+	parseFilter := filterFlags(flags)
+	replayEntries := replayFlags(flags)
+	flags.BoolVar(&asJSON, "json", false, "print the counts as JSON")
+	flags.Parse(args)
+
+	servers, err := parseServers()
+	if err != nil {
+		return err
+	}
+	filter, err := parseFilter()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := interrupted()
+	defer cancel()
+	readClient, err := client.NewReadClientContext(ctx, servers)
+	if err != nil {
+		return err
+	}
+	defer readClient.Close()
+	records, err := replayEntries(ctx, readClient, servers)
+	if err != nil {
+		return err
+	}
+
+	var counted stats
+	for r := range records {
+		if filter(r) {
+			counted.add(r)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if asJSON {
+		return json.NewEncoder(os.Stdout).Encode(counted)
+	}
+	fmt.Println(counted)
+	return nil
+}
+
+//fetchMetadata adds the flags of fetching the ClusterMetadata of the
+//servers to the set, and returns the function fetching it
+func fetchMetadata(flags *flag.FlagSet) func() ([]string, []model.ClusterMetadata, error) {
+	var timeout time.Duration
+	parseServers := serverFlags(flags)
+	flags.DurationVar(&timeout, "timeout", 10*time.Second, "how long to wait for every server to answer")
+	return func() ([]string, []model.ClusterMetadata, error) {
+		servers, err := parseServers()
+		if err != nil {
+			return nil, nil, err
+		}
+		metadata := make([]model.ClusterMetadata, len(servers))
+		for i, server := range servers {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			metadata[i], err = client.FetchMetadata(ctx, server)
+			cancel()
+			if err != nil {
+				return nil, nil, fmt.Errorf("err fetching the metadata of '%s': %s", server, err)
+			}
+		}
+		return servers, metadata, nil
+	}
+}
+
+//stream is the log of a server
+type stream struct {
+	Server string
+	//Offset is the offset of the next entry the server writes
+	Offset     uint64
+	Partitions uint32
+	Leader     string
+}
+
+func streams(args []string) error {
+	var asJSON bool
+	flags := flag.NewFlagSet("streams", flag.ExitOnError)
+	fetch := fetchMetadata(flags)
+	flags.BoolVar(&asJSON, "json", false, "print the streams as JSON lines")
+	flags.Parse(args)
+
+	servers, metadata, err := fetch()
+	if err != nil {
+		return err
+	}
+	list := make([]stream, len(servers))
+	for i, server := range servers {
+		list[i] = stream{
+			Server:     server,
+			Offset:     metadata[i].Offset,
+			Partitions: metadata[i].Partitions,
+			Leader:     metadata[i].Leader,
+		}
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, s := range list {
+			if err := encoder.Encode(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tOFFSET\tPARTITIONS\tLEADER")
+	for _, s := range list {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", s.Server, s.Offset, s.Partitions, s.Leader)
+	}
+	return w.Flush()
+}
+
+//group is a cluster, along with the servers given which are members of it
+type group struct {
+	Leader  string
+	Term    uint64
+	Version uint64
+	Members []string
+	Servers []string
+}
+
+func groups(args []string) error {
+	var asJSON bool
+	flags := flag.NewFlagSet("groups", flag.ExitOnError)
+	fetch := fetchMetadata(flags)
+	flags.BoolVar(&asJSON, "json", false, "print the groups as JSON lines")
+	flags.Parse(args)
+
+	servers, metadata, err := fetch()
+	if err != nil {
+		return err
+	}
+	//the servers of a cluster agree on its members, though one lagging
+	//behind a change of membership is listed as a group of its own
+	var list []*group
+	byMembers := make(map[string]*group)
+	for i, server := range servers {
+		members := append([]string(nil), metadata[i].Members...)
+		sort.Strings(members)
+		id := strings.Join(members, ",")
+		g, ok := byMembers[id]
+		if !ok {
+			g = &group{Members: members}
+			byMembers[id] = g
+			list = append(list, g)
+		}
+		if epoch := metadata[i].Epoch(); !(model.Epoch{Term: g.Term, Version: g.Version}).After(epoch) {
+			g.Leader = metadata[i].Leader
+			g.Term, g.Version = epoch.Term, epoch.Version
+		}
+		g.Servers = append(g.Servers, server)
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, g := range list {
+			if err := encoder.Encode(g); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "LEADER\tTERM\tVERSION\tMEMBERS\tSERVERS")
+	for _, g := range list {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", g.Leader, g.Term, g.Version, strings.Join(g.Members, ","), strings.Join(g.Servers, ","))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,222 @@
+package dlog
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+//Codec compresses the blocks of entries segments are written in. The codec
+//of a segment is recorded in its header by its id, so that segments written
+//with different codecs can be read side by side.
+type Codec interface {
+	//ID identifies the codec in the headers of segments, it must be unique
+	//among the registered codecs
+	ID() byte
+	//Encode appends the compressed block to dst
+	Encode(dst, block []byte) ([]byte, error)
+	//Decode returns the decompressed block
+	Decode(compressed []byte) ([]byte, error)
+}
+
+//The ids of the codecs that come with the log
+const (
+	CodecNone byte = iota
+	CodecFlate
+	CodecLZ
+)
+
+var codecs = struct {
+	sync.RWMutex
+	byID map[byte]Codec
+}{byID: map[byte]Codec{
+	CodecNone:  NoCodec,
+	CodecFlate: NewFlateCodec(flate.DefaultCompression),
+	CodecLZ:    LZCodec,
+}}
+
+//RegisterCodec makes the codec available for reading segments written with
+//it, the codecs that come with the log are registered already
+func RegisterCodec(codec Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.byID[codec.ID()] = codec
+}
+
+func codecOf(id byte) (Codec, error) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	codec, ok := codecs.byID[id]
+	if !ok {
+		return nil, fmt.Errorf("no codec of id %d is registered", id)
+	}
+	return codec, nil
+}
+
+//NoCodec stores blocks as they are
+var NoCodec Codec = noCodec{}
+
+type noCodec struct{}
+
+func (noCodec) ID() byte { return CodecNone }
+
+func (noCodec) Encode(dst, block []byte) ([]byte, error) {
+	return append(dst, block...), nil
+}
+
+func (noCodec) Decode(compressed []byte) ([]byte, error) {
+	return compressed, nil
+}
+
+//NewFlateCodec creates a codec which deflates every block at the level,
+//as defined by compress/flate
+func NewFlateCodec(level int) Codec {
+	return flateCodec{level}
+}
+
+type flateCodec struct {
+	level int
+}
+
+func (flateCodec) ID() byte { return CodecFlate }
+
+func (c flateCodec) Encode(dst, block []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w, err := flate.NewWriter(buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(block); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decode(compressed []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(compressed))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+/*
+LZCodec is a fast codec in the style of snappy, which replaces repeated
+sequences of a block by copies of earlier ones. A compressed block is its
+uvarint length followed by literals and copies:
+	|---------------------------------------------------------------|
+	| 0 (8) | Length (uvarint) | Literal                            |
+	|---------------------------------------------------------------|
+	| 1 (8) | Length (uvarint) | Distance (uvarint)                 |
+	|---------------------------------------------------------------|
+*/
+var LZCodec Codec = lzCodec{}
+
+type lzCodec struct{}
+
+const (
+	lzLiteral = iota
+	lzCopy
+)
+
+const (
+	lzMinMatch  = 4
+	lzTableBits = 14
+)
+
+var errCorruptBlock = errors.New("corrupt block")
+
+func (lzCodec) ID() byte { return CodecLZ }
+
+func (lzCodec) Encode(dst, block []byte) ([]byte, error) {
+	dst = binary.AppendUvarint(dst, uint64(len(block)))
+
+	//positions of the last sequences of every hash, plus one
+	var table [1 << lzTableBits]int
+	literal := 0
+	for i := 0; i+lzMinMatch <= len(block); {
+		sequence := binary.LittleEndian.Uint32(block[i:])
+		hash := (sequence * 0x1e35a7bd) >> (32 - lzTableBits)
+		candidate := table[hash] - 1
+		table[hash] = i + 1
+		if candidate < 0 || binary.LittleEndian.Uint32(block[candidate:]) != sequence {
+			i++
+			continue
+		}
+
+		length := lzMinMatch
+		for i+length < len(block) && block[candidate+length] == block[i+length] {
+			length++
+		}
+		dst = appendLZLiteral(dst, block[literal:i])
+		dst = append(dst, lzCopy)
+		dst = binary.AppendUvarint(dst, uint64(length))
+		dst = binary.AppendUvarint(dst, uint64(i-candidate))
+		i += length
+		literal = i
+	}
+	return appendLZLiteral(dst, block[literal:]), nil
+}
+
+func appendLZLiteral(dst, literal []byte) []byte {
+	if len(literal) == 0 {
+		return dst
+	}
+	dst = append(dst, lzLiteral)
+	dst = binary.AppendUvarint(dst, uint64(len(literal)))
+	return append(dst, literal...)
+}
+
+func (lzCodec) Decode(compressed []byte) ([]byte, error) {
+	size, n := binary.Uvarint(compressed)
+	if n <= 0 {
+		return nil, errCorruptBlock
+	}
+	compressed = compressed[n:]
+	//the size is not trusted to allocate up front, the block grows instead
+	capacity := uint64(len(compressed)) * 4
+	if size < capacity {
+		capacity = size
+	}
+	block := make([]byte, 0, capacity)
+
+	for len(compressed) > 0 {
+		op := compressed[0]
+		length, n := binary.Uvarint(compressed[1:])
+		if n <= 0 || length > size-uint64(len(block)) {
+			return nil, errCorruptBlock
+		}
+		compressed = compressed[1+n:]
+
+		switch op {
+		case lzLiteral:
+			if length > uint64(len(compressed)) {
+				return nil, errCorruptBlock
+			}
+			block = append(block, compressed[:length]...)
+			compressed = compressed[length:]
+		case lzCopy:
+			distance, n := binary.Uvarint(compressed)
+			if n <= 0 || distance == 0 || distance > uint64(len(block)) {
+				return nil, errCorruptBlock
+			}
+			compressed = compressed[n:]
+			//copies may overlap what they produce, so copy byte by byte
+			from := len(block) - int(distance)
+			for j := 0; j < int(length); j++ {
+				block = append(block, block[from+j])
+			}
+		default:
+			return nil, errCorruptBlock
+		}
+	}
+	if uint64(len(block)) != size {
+		return nil, errCorruptBlock
+	}
+	return block, nil
+}
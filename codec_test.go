@@ -0,0 +1,87 @@
+package dlog
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/netbrain/dlog/testdata"
+)
+
+//segmentCodec returns the id of the codec the segment is written with
+func segmentCodec(t *testing.T, seg segment) byte {
+	file, err := os.Open(seg.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	codec, ok, err := readBlockHeader(bufio.NewReader(file))
+	if err != nil || !ok {
+		t.Fatalf("expected segment %s to be written in blocks: %v", seg.path, err)
+	}
+	return codec.ID()
+}
+
+func TestCodecsDecodeWhatTheyEncode(t *testing.T) {
+	block := bytes.Repeat([]byte("dlog entries compress well "), 100)
+	for _, codec := range []Codec{NoCodec, NewFlateCodec(flate.BestSpeed), LZCodec} {
+		encoded, err := codec.Encode(nil, block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := codec.Decode(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, block) {
+			t.Fatalf("expected codec %d to decode the block it encoded", codec.ID())
+		}
+		if codec != NoCodec && len(encoded) >= len(block)/4 {
+			t.Fatalf("expected codec %d to compress the block, got %d of %d bytes", codec.ID(), len(encoded), len(block))
+		}
+	}
+
+	if _, err := LZCodec.Decode([]byte{10, 1, 4, 9}); err == nil {
+		t.Fatal("expected a corrupt block not to decode")
+	}
+}
+
+func TestLoggerReadsSegmentsOfDifferentCodecs(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+
+	logger, _ := NewLoggerWithOptions(dir, LoggerOptions{SegmentSize: 1, BlockSize: 1})
+	logger.Write(NewLogEntryTestData().WithPayload([]byte("flate")).Build())
+	logger.Close()
+
+	//the active segment keeps its codec, segments rolled from then on use
+	//the new one
+	logger, _ = NewLoggerWithOptions(dir, LoggerOptions{SegmentSize: 1, BlockSize: 1, Codec: LZCodec})
+	defer logger.Close()
+	for x := 0; x < 2; x++ {
+		logger.Write(NewLogEntryTestData().WithPayload([]byte("lz")).Build())
+		logger.Sync()
+	}
+
+	list := segmentsOf(logger)
+	if id := segmentCodec(t, list[0]); id != CodecFlate {
+		t.Fatalf("expected the first segment to be deflated, got codec %d", id)
+	}
+	if id := segmentCodec(t, list[2]); id != CodecLZ {
+		t.Fatalf("expected the rolled segment to use the lz codec, got codec %d", id)
+	}
+
+	payloads := []string{"flate", "lz", "lz"}
+	read := entries(logger)
+	if len(read) != len(payloads) {
+		t.Fatalf("expected %d entries, got %d", len(payloads), len(read))
+	}
+	for i, entry := range read {
+		if string(entry.Payload()) != payloads[i] {
+			t.Fatalf("expected payload %q at offset %d, got %q", payloads[i], i, entry.Payload())
+		}
+	}
+}
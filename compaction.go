@@ -0,0 +1,146 @@
+package dlog
+
+import (
+	"log"
+	"time"
+
+	"github.com/netbrain/dlog/model"
+)
+
+const (
+	//DefaultCompactionInterval is the default duration between compactions
+	DefaultCompactionInterval = 10 * time.Minute
+	//DefaultTombstoneRetention is the default duration a tombstone is kept
+	//after it was written
+	DefaultTombstoneRetention = 24 * time.Hour
+)
+
+//CompactionPolicy decides whether and how often the sealed segments of the
+//log are compacted. Compaction keeps only the last entry of every key, and
+//entries written without a key. An entry without a payload written with a
+//key is a tombstone, which marks the key as deleted and is itself removed
+//once it is older than the TombstoneRetention.
+//
+//The remaining entries keep their offsets. Replicas compact their logs
+//independently, so a repair may fetch ranges again which were compacted
+//differently.
+type CompactionPolicy struct {
+	//Enabled turns compaction on, otherwise the Logger only purges erased
+	//entries every Interval
+	Enabled bool
+	//Interval is how often the Logger compacts the log,
+	//DefaultCompactionInterval if zero
+	Interval time.Duration
+	//TombstoneRetention is how long tombstones are kept, measured from the
+	//time of the transaction id of the tombstone.
+	//DefaultTombstoneRetention if zero.
+	TombstoneRetention time.Duration
+}
+
+//Compact rewrites the sealed segments keeping only the last entry of every
+//key, as described by CompactionPolicy, and returns the number of entries
+//removed. Erased entries are purged along. Writes carry on while segments
+//are rewritten. Logs kept in another Storage than a FileStorage are not
+//compacted.
+func (l *Logger) Compact() (uint64, error) {
+	files, ok := l.files()
+	if !ok {
+		return 0, nil
+	}
+	l.maintenance.Lock()
+	defer l.maintenance.Unlock()
+
+	tombstoneRetention := l.options.Compaction.TombstoneRetention
+	if tombstoneRetention <= 0 {
+		tombstoneRetention = DefaultTombstoneRetention
+	}
+
+	l.mutex.Lock()
+	latest := make(map[string]uint64, len(l.keys.keys))
+	for key, offsets := range l.keys.keys {
+		latest[key] = offsets[len(offsets)-1]
+	}
+	keyed := make(map[uint64]string, len(l.keys.byOffset))
+	for offset, record := range l.keys.byOffset {
+		keyed[offset] = string(record.key)
+	}
+	l.mutex.Unlock()
+
+	keep := func(offset uint64, entry model.LogEntry) bool {
+		if l.erasures.erased(offset) {
+			return false
+		}
+		key, ok := keyed[offset]
+		if !ok {
+			return true
+		}
+		if latest[key] != offset {
+			return false
+		}
+		return !entry.Tombstone() || time.Since(entry.MetaData().TransactionID().Time()) < tombstoneRetention
+	}
+
+	list := files.segments.snapshot()
+	removed := make(map[uint64]bool)
+	for i, seg := range list[:len(list)-1] {
+		superseded, err := seg.compact(keep)
+		if err != nil {
+			return l.forget(removed), err
+		}
+		l.erasures.purged(seg.base, list[i+1].base)
+		for _, offset := range superseded {
+			removed[offset] = true
+		}
+	}
+	return l.forget(removed), nil
+}
+
+//forget drops the removed offsets from the key index
+//and returns how many there were
+func (l *Logger) forget(removed map[uint64]bool) uint64 {
+	if len(removed) == 0 {
+		return 0
+	}
+	l.checksums.clear()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	err := l.keys.rewrite(func(offset uint64) bool {
+		return !removed[offset]
+	})
+	if err != nil {
+		log.Printf("err removing compacted entries from the key index: %s", err)
+	}
+	return uint64(len(removed))
+}
+
+//compactionRoutine periodically compacts the log, or only purges erased
+//entries if compaction is not enabled, until the Logger closes
+func (l *Logger) compactionRoutine() {
+	policy := l.options.Compaction
+	interval := policy.Interval
+	if interval <= 0 {
+		interval = DefaultCompactionInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !policy.Enabled {
+				if n, err := l.Purge(); err != nil {
+					log.Printf("err purging erased entries: %s", err)
+				} else if n > 0 {
+					log.Printf("Purged %d erased entries from the log", n)
+				}
+			} else if n, err := l.Compact(); err != nil {
+				log.Printf("err compacting the log: %s", err)
+			} else if n > 0 {
+				log.Printf("Compacted the log, removing %d entries", n)
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package dlog
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/netbrain/dlog/model"
+	. "github.com/netbrain/dlog/testdata"
+)
+
+//offsets returns the offsets of the entries in the log
+func offsets(logger *Logger) []uint64 {
+	logger.Sync()
+	var offsets []uint64
+	logger.read(0, func(offset uint64, _ model.LogEntry) bool {
+		offsets = append(offsets, offset)
+		return true
+	})
+	return offsets
+}
+
+func TestLoggerCompactsByKey(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+
+	logger, _ := NewLoggerWithOptions(dir, LoggerOptions{
+		SegmentSize: 1,
+		BlockSize:   1,
+		Compaction:  CompactionPolicy{Enabled: true, Interval: time.Hour},
+	})
+	writes := []struct {
+		key     string
+		payload []byte
+	}{{"a", []byte{1}}, {"b", []byte{2}}, {"", []byte{3}}, {"a", []byte{4}}, {"b", nil}, {"a", []byte{5}}}
+	for _, write := range writes {
+		logEntry := NewLogEntryTestData().WithPayload(write.payload).Build()
+		if write.key == "" {
+			logger.Write(logEntry)
+		} else {
+			logger.WriteKey([]byte(write.key), 0, 1, logEntry)
+		}
+	}
+	logger.Sync()
+
+	if removed, err := logger.Compact(); err != nil || removed != 3 {
+		t.Fatalf("expected 3 entries to be removed, got %d: %v", removed, err)
+	}
+	if expected := []uint64{2, 4, 5}; !reflect.DeepEqual(offsets(logger), expected) {
+		t.Fatalf("expected offsets %v, got %v", expected, offsets(logger))
+	}
+	var payloads []byte
+	for logEntry := range logger.ReadKey([]byte("a")) {
+		payloads = append(payloads, logEntry.Payload()[0])
+	}
+	if !reflect.DeepEqual(payloads, []byte{5}) {
+		t.Fatalf("expected the last entry of the key, got %v", payloads)
+	}
+	logger.Close()
+
+	logger, _ = NewLoggerWithOptions(dir, LoggerOptions{SegmentSize: 1, BlockSize: 1})
+	defer logger.Close()
+	if offset := logger.Write(NewLogEntryTestData().Build()); offset != 6 {
+		t.Fatalf("expected offset 6, got %d", offset)
+	}
+}
+
+func TestLoggerRemovesExpiredTombstones(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	logger, _ := NewLoggerWithOptions(dir, LoggerOptions{
+		SegmentSize: 1,
+		BlockSize:   1,
+		Compaction:  CompactionPolicy{TombstoneRetention: time.Nanosecond},
+	})
+	defer logger.Close()
+	logger.WriteKey([]byte("a"), 0, 1, NewLogEntryTestData().Build())
+	logger.WriteKey([]byte("a"), 0, 1, NewLogEntryTestData().WithPayload(nil).Build())
+	logger.Sync()
+
+	if removed, err := logger.Compact(); err != nil || removed != 2 {
+		t.Fatalf("expected the key and its tombstone to be removed, got %d: %v", removed, err)
+	}
+	if n := len(offsets(logger)); n != 0 {
+		t.Fatalf("expected an empty log, got %d entries", n)
+	}
+}
+
+func TestFollowerKeepsOffsetsOfCompactedLog(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	leaderLogger, _ := NewLoggerWithOptions(dir, LoggerOptions{SegmentSize: 1, BlockSize: 1})
+	leader := NewServer(leaderLogger, 0)
+	go leader.Start()
+	defer leader.Stop()
+	for x := 0; x < 3; x++ {
+		leaderLogger.WriteKey([]byte("a"), 0, 1, NewLogEntryTestData().Build())
+	}
+	leaderLogger.Write(NewLogEntryTestData().Build())
+	leaderLogger.Sync()
+	leaderLogger.Compact()
+
+	follower := startServer()
+	defer follower.Stop()
+	follower.Follow(leader.Address().String())
+	waitForOffset(t, follower.logger, 4)
+
+	if expected := offsets(leaderLogger); !reflect.DeepEqual(offsets(follower.logger), expected) {
+		t.Fatalf("expected offsets %v, got %v", expected, offsets(follower.logger))
+	}
+}
@@ -0,0 +1,39 @@
+package dlog
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+//serverConn wraps a client connection so that writes from several
+//goroutines, such as notifications and pongs, do not interleave
+type serverConn struct {
+	net.Conn
+	mutex        sync.Mutex
+	writeTimeout time.Duration
+}
+
+func newServerConn(conn net.Conn, writeTimeout time.Duration) *serverConn {
+	return &serverConn{
+		Conn:         conn,
+		writeTimeout: writeTimeout,
+	}
+}
+
+//write writes all frames to the connection as one unit, failing if
+//the client does not keep up within the write timeout
+func (c *serverConn) write(frames ...[]byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.writeTimeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	for _, frame := range frames {
+		if _, err := c.Conn.Write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
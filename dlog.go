@@ -1,61 +1,496 @@
 package dlog
 
 import (
-	"bufio"
-	"compress/flate"
-	"io"
-	"io/ioutil"
+	"hash/crc32"
 	"log"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
+	fb "github.com/google/flatbuffers/go"
 	. "github.com/netbrain/dlog/encoder"
+	"github.com/netbrain/dlog/keystore"
 	"github.com/netbrain/dlog/model"
 )
 
-//Logger handles reads and writes to the logfile
+//Logger handles reads and writes to the log, which is kept in its Storage
 type Logger struct {
-	wg    sync.WaitGroup
-	wChan chan model.LogEntry
-	wFile *os.File
+	wg        sync.WaitGroup
+	wChan     chan pendingEntry
+	storage   Storage
+	directory string
+	options   LoggerOptions
+	done      chan struct{}
+
+	//maintenance serializes the operations which rewrite or remove
+	//sealed segments
+	maintenance sync.Mutex
+
+	mutex    sync.Mutex
+	offset   uint64
+	written  *sync.Cond
+	flushed  uint64
+	keys     *keyIndex
+	erasures *erasures
+
+	checksums checksumCache
+}
+
+//pendingEntry is an entry queued for writing at the offset, or the offset
+//of the next entry if there is no entry
+type pendingEntry struct {
+	offset uint64
+	entry  model.LogEntry
 }
 
-//NewLogger creates a new Logger instance
+//LoggerOptions configures how a Logger stores the log
+type LoggerOptions struct {
+	//SegmentSize is the size in bytes a segment file grows to before a new
+	//one is started, zero keeps the whole log in one segment
+	SegmentSize int64
+	//Retention decides when sealed segments expire
+	Retention RetentionPolicy
+	//Compaction decides whether sealed segments are compacted by key
+	Compaction CompactionPolicy
+	//Codec compresses the blocks of new segments, a flate codec at the
+	//default level if nil
+	Codec Codec
+	//BlockSize is the size in bytes the entries of a block grow to before
+	//the block is compressed, DefaultBlockSize if zero
+	BlockSize int
+	//FlushInterval is how long the first entry of a block waits for the
+	//block to fill up before it is written, DefaultFlushInterval if zero.
+	//The entries of the block are read from memory meanwhile, and are lost
+	//should the process crash before it is written.
+	FlushInterval time.Duration
+	//KeyStore, if set, holds the data keys the payloads of entries written
+	//with a key are encrypted with, see Shred. It must be set from the
+	//start of the log, as entries written with a key before are unreadable.
+	KeyStore keystore.KeyStore
+	//SegmentKeys, if set, provides the keys segment files are encrypted
+	//with. New segments are encrypted with the current key, so rotating the
+	//key re-keys only the segments started afterwards.
+	SegmentKeys keystore.KeyProvider
+	//Tiering decides when sealed segments are offloaded to an object store
+	Tiering TieringPolicy
+	//Storage, if set, keeps the entries of the log instead of segment files
+	//in the directory, which then only holds the key index and erasures
+	Storage Storage
+}
+
+//NewLogger creates a new Logger instance with the default options
 func NewLogger(directory string) (*Logger, error) {
-	var err error
-	if directory == "" {
-		if directory, err = ioutil.TempDir("", "dlog"); err != nil {
+	return NewLoggerWithOptions(directory, LoggerOptions{
+		SegmentSize: DefaultSegmentSize,
+	})
+}
+
+//NewLoggerWithOptions creates a new Logger instance. If the directory is
+//empty the log is only kept in memory, in a MemoryStorage unless the
+//options have a Storage.
+func NewLoggerWithOptions(directory string, options LoggerOptions) (*Logger, error) {
+	keys, erasures := newMemoryKeyIndex(), newMemoryErasures()
+	if directory != "" {
+		var err error
+		if err = os.MkdirAll(directory, 0755); err != nil {
+			return nil, err
+		}
+		if keys, err = openKeyIndex(filepath.Join(directory, "dlog.keys")); err != nil {
+			return nil, err
+		}
+		if erasures, err = openErasures(filepath.Join(directory, "dlog.erasures")); err != nil {
+			keys.close()
 			return nil, err
 		}
 	}
-	os.MkdirAll(directory, 0755)
-	filePath := filepath.Join(directory, "dlog.bin")
 
-	wFile, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		log.Println(err)
+	storage := options.Storage
+	if storage == nil && directory == "" {
+		storage = NewMemoryStorage()
+	} else if storage == nil {
+		files, err := NewFileStorage(directory, options)
+		if err != nil {
+			keys.close()
+			erasures.close()
+			return nil, err
+		}
+		storage = files
 	}
-	w, _ := flate.NewWriter(wFile, flate.BestCompression)
 
 	l := &Logger{
-		wChan: make(chan model.LogEntry, 1000),
-		wFile: wFile,
+		wChan:     make(chan pendingEntry, 1000),
+		storage:   storage,
+		directory: directory,
+		options:   options,
+		done:      make(chan struct{}),
+		keys:      keys,
+		erasures:  erasures,
 	}
+	l.written = sync.NewCond(&sync.Mutex{})
+	_, l.offset = storage.Offsets()
+	l.flushed = l.offset
 
-	go l.writeRoutine(w)
+	go l.writeRoutine()
+	go l.retentionRoutine()
+	go l.compactionRoutine()
+	go l.tieringRoutine()
 
 	return l, nil
 }
 
-//Write writes a LogEntry to the log
-func (l *Logger) Write(logEntry model.LogEntry) {
+//path returns the path of the file of the name in the directory of the
+//log, or an empty path if the log has no directory
+func (l *Logger) path(name string) string {
+	if l.directory == "" {
+		return ""
+	}
+	return filepath.Join(l.directory, name)
+}
+
+//files returns the FileStorage of the log, false if the log is kept in
+//another Storage
+func (l *Logger) files() (*FileStorage, bool) {
+	files, ok := l.storage.(*FileStorage)
+	return files, ok
+}
+
+//Write writes a LogEntry to the log and returns the offset it was given.
+//Offsets start at zero and increase by one for every entry written.
+func (l *Logger) Write(logEntry model.LogEntry) uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if logEntry == nil {
+		return l.offset
+	}
+
+	offset := l.offset
+	l.offset++
+	l.wg.Add(1)
+	l.wChan <- pendingEntry{offset, logEntry}
+	return offset
+}
+
+//WriteKey writes a LogEntry to the log like Write, and records that it
+//was written with the key, which a client routed to the given partition
+//out of the given number of partitions. The payload is encrypted if the
+//Logger has a KeyStore.
+func (l *Logger) WriteKey(key []byte, partition, partitions uint32, logEntry model.LogEntry) uint64 {
+	if store := l.options.KeyStore; store != nil && len(logEntry) > model.MetaDataSize {
+		sealed, err := keystore.Seal(store, key, logEntry.Payload())
+		if err != nil {
+			log.Printf("err encrypting entry of key %q, it is not written: %s", key, err)
+			return l.Offset()
+		}
+		logEntry = model.NewLogEntry(logEntry.MetaData(), sealed)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if logEntry == nil {
+		return l.offset
+	}
+
+	offset := l.offset
+	if err := l.keys.add(offset, partition, partitions, key); err != nil {
+		log.Println(err)
+	}
+	l.offset++
+	l.wg.Add(1)
+	l.wChan <- pendingEntry{offset, logEntry}
+	return offset
+}
+
+//Skip makes the next LogEntry written be given the offset, if it is ahead
+//of the log. The log has no entries at the offsets skipped, like a log
+//which has been compacted, so that a replica keeps the offsets of the log
+//it replicates.
+func (l *Logger) Skip(offset uint64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if offset <= l.offset {
+		return
+	}
+	l.offset = offset
 	l.wg.Add(1)
-	l.wChan <- logEntry
+	l.wChan <- pendingEntry{offset: offset}
+}
+
+//ReadKey returns a channel which the logentries written with the key
+//are appended to in sequential order
+func (l *Logger) ReadKey(key []byte) <-chan model.LogEntry {
+	c := make(chan model.LogEntry)
+	l.mutex.Lock()
+	offsets := l.keys.offsets(key)
+	l.mutex.Unlock()
+
+	go func(c chan<- model.LogEntry) {
+		defer close(c)
+		if len(offsets) == 0 {
+			return
+		}
+		err := l.read(offsets[0], func(offset uint64, entry model.LogEntry) bool {
+			//entries may have been removed by compaction since
+			for len(offsets) > 0 && offsets[0] < offset {
+				offsets = offsets[1:]
+			}
+			if len(offsets) > 0 && offset == offsets[0] {
+				c <- entry
+				offsets = offsets[1:]
+			}
+			return len(offsets) > 0
+		})
+		if err != nil {
+			log.Println(err)
+		}
+	}(c)
+	return c
+}
+
+//Key returns the key the entry at the offset was written with, and the
+//partition it was routed to. The last return value is false if the entry
+//was written without a key.
+func (l *Logger) Key(offset uint64) (key []byte, partition, partitions uint32, ok bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	record, ok := l.keys.byOffset[offset]
+	return record.key, record.partition, record.partitions, ok
+}
+
+//Partition returns the partition, and the number of partitions, that
+//clients last routed a key written to this log to. The last return value
+//is false if no key has been written.
+func (l *Logger) Partition() (partition, partitions uint32, ok bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.keys.partition, l.keys.partitions, l.keys.partitioned
+}
+
+//FirstOffset returns the offset of the first LogEntry in the log, entries
+//before it have expired
+func (l *Logger) FirstOffset() uint64 {
+	first, _ := l.storage.Offsets()
+	return first
+}
+
+//Offset returns the offset the next written LogEntry will be given
+func (l *Logger) Offset() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.offset
+}
+
+//readable returns the offset following the last readable LogEntry
+func (l *Logger) readable() uint64 {
+	l.written.L.Lock()
+	defer l.written.L.Unlock()
+	return l.flushed
+}
+
+//Sync blocks until every LogEntry written before the call is readable
+func (l *Logger) Sync() {
+	target := l.Offset()
+
+	l.written.L.Lock()
+	defer l.written.L.Unlock()
+	for l.flushed < target {
+		l.written.Wait()
+	}
+}
+
+//Await blocks until every LogEntry before the offset is readable,
+//returning false if that does not happen within the timeout
+func (l *Logger) Await(offset uint64, timeout time.Duration) bool {
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		l.written.L.Lock()
+		defer l.written.L.Unlock()
+		expired = true
+		l.written.Broadcast()
+	})
+	defer timer.Stop()
+
+	l.written.L.Lock()
+	defer l.written.L.Unlock()
+	for l.flushed < offset {
+		if expired {
+			return false
+		}
+		l.written.Wait()
+	}
+	return true
+}
+
+//Truncate discards every LogEntry from the offset onwards, so that the next
+//LogEntry written is given the offset. Writes block while the storage
+//discards the entries. Discarding entries which have
+//expired empties the log, and the next LogEntry written starts it afresh.
+func (l *Logger) Truncate(offset uint64) error {
+	l.maintenance.Lock()
+	defer l.maintenance.Unlock()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if offset >= l.offset {
+		return nil
+	}
+
+	l.written.L.Lock()
+	for l.flushed < l.offset {
+		l.written.Wait()
+	}
+	l.written.L.Unlock()
+
+	if err := l.storage.Truncate(offset); err != nil {
+		return err
+	}
+
+	l.offset = offset
+	l.written.L.Lock()
+	l.flushed = offset
+	l.written.L.Unlock()
+	l.checksums.clear()
+	if err := l.erasures.truncate(offset); err != nil {
+		return err
+	}
+	return l.keys.rewrite(func(current uint64) bool {
+		return current < offset
+	})
+}
+
+//Checksums returns the CRC-32 checksums of consecutive ranges of rangeSize
+//offsets, up to the offset upTo or the end of the log, whichever comes
+//first. The checksum of a range covers the offsets and the entries in it.
+//The ranges are aligned to multiples of rangeSize, and start at the first
+//one from the offset from that has not expired. The last range is shorter
+//if it ends before rangeSize offsets. The offsets the ranges start and end
+//at are returned along. The checksums of ranges which are complete are
+//cached, so that comparing logs time and again only reads the entries
+//written since.
+func (l *Logger) Checksums(rangeSize, from, upTo uint64) (checksums []uint32, start, end uint64) {
+	next := l.Offset()
+	l.Sync()
+
+	first := l.FirstOffset()
+	if from < first {
+		from = first
+	}
+	l.checksums.expire(first)
+	start = (from + rangeSize - 1) / rangeSize * rangeSize
+	end = start
+	for current := start; current < upTo && current < next; current += rangeSize {
+		rangeEnd := current + rangeSize
+		complete := rangeEnd <= upTo && rangeEnd <= next
+		if !complete && upTo < rangeEnd {
+			rangeEnd = upTo
+		}
+		checksum := l.checksum(current, rangeEnd, complete)
+		checksums = append(checksums, checksum.checksum)
+		if checksum.end > end {
+			end = checksum.end
+		}
+	}
+	//ranges after the last entry are left out
+	if end == start {
+		return nil, start, end
+	}
+	return checksums[:(end-start+rangeSize-1)/rangeSize], start, end
+}
+
+//checksum returns the checksum of the entries from the offset from up to
+//the offset to, from the cache if it is a complete range
+func (l *Logger) checksum(from, to uint64, complete bool) rangeChecksum {
+	generation, cached, ok := l.checksums.get(from, to)
+	if ok {
+		return cached
+	}
+
+	hash := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	offsetBytes := make([]byte, fb.SizeUint64)
+	var end uint64
+	err := l.read(from, func(offset uint64, logEntry model.LogEntry) bool {
+		if offset >= to {
+			return false
+		}
+		fb.WriteUint64(offsetBytes, offset)
+		hash.Write(offsetBytes)
+		hash.Write(EncodePayload(logEntry))
+		end = offset + 1
+		return true
+	})
+	checksum := rangeChecksum{hash.Sum32(), end}
+	if err != nil {
+		log.Println(err)
+	} else if complete {
+		l.checksums.put(generation, from, to, checksum)
+	}
+	return checksum
+}
+
+//checksumCache holds the checksums of complete ranges, every offset of
+//which has been written, by the offsets they start and end at. Appends
+//leave them as they are, the cache is cleared whenever entries are changed
+//otherwise, such as when they are erased or compacted.
+type checksumCache struct {
+	sync.Mutex
+	//generation counts the times the cache has been cleared, so that a
+	//checksum computed before it was is not cached
+	generation uint64
+	ranges     map[[2]uint64]rangeChecksum
+}
+
+//rangeChecksum is the checksum of a range, along with the offset following
+//the last entry in it, or zero if it has no entries
+type rangeChecksum struct {
+	checksum uint32
+	end      uint64
+}
+
+func (c *checksumCache) get(from, to uint64) (uint64, rangeChecksum, bool) {
+	c.Lock()
+	defer c.Unlock()
+	checksum, ok := c.ranges[[2]uint64{from, to}]
+	return c.generation, checksum, ok
+}
+
+//put caches the checksum unless the cache has been cleared since the
+//generation
+func (c *checksumCache) put(generation, from, to uint64, checksum rangeChecksum) {
+	c.Lock()
+	defer c.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if c.ranges == nil {
+		c.ranges = make(map[[2]uint64]rangeChecksum)
+	}
+	c.ranges[[2]uint64{from, to}] = checksum
+}
+
+//expire drops the ranges which start before the first offset of the log
+func (c *checksumCache) expire(first uint64) {
+	c.Lock()
+	defer c.Unlock()
+	for r := range c.ranges {
+		if r[0] < first {
+			delete(c.ranges, r)
+		}
+	}
+}
+
+func (c *checksumCache) clear() {
+	c.Lock()
+	defer c.Unlock()
+	c.generation++
+	c.ranges = nil
 }
 
 //Close closes the log
 func (l *Logger) Close() {
+	close(l.done)
 	close(l.wChan)
 	l.wg.Wait()
 }
@@ -63,62 +498,131 @@ func (l *Logger) Close() {
 //Read returns a channel which logentries are appended to
 //in sequential order
 func (l *Logger) Read() <-chan model.LogEntry {
+	return l.ReadFrom(0)
+}
+
+//ReadFrom returns a channel which logentries, starting at the given offset,
+//are appended to in sequential order. A FileStorage finds the block holding
+//the offset by the index of its segment, so the entries before it are not
+//read.
+func (l *Logger) ReadFrom(offset uint64) <-chan model.LogEntry {
 	c := make(chan model.LogEntry)
 
 	go func(c chan<- model.LogEntry) {
 		defer close(c)
-		rFile, err := os.OpenFile(l.wFile.Name(), os.O_RDONLY, 0644)
+		err := l.read(offset, func(_ uint64, entry model.LogEntry) bool {
+			c <- entry
+			return true
+		})
 		if err != nil {
 			log.Println(err)
 		}
-		defer rFile.Close()
-
-		reader := flate.NewReader(rFile)
-		defer reader.Close()
+	}(c)
+	return c
+}
 
-		scanner := bufio.NewScanner(reader)
-		scanner.Split(ScanPayloadSplitFunc)
-		for scanner.Scan() {
-			entry := model.LogEntry(scanner.Bytes())
-			c <- entry
+//read calls fn with every LogEntry starting at the given offset, in
+//sequential order, until fn returns false or the log is exhausted. Reading
+//goes on at the first offset if the given one has expired, also while the
+//entries are read. Offsets which have no entry, such as those of entries
+//removed by compaction or erased, are skipped, as are entries which have
+//been shredded. Encrypted entries are decrypted.
+func (l *Logger) read(offset uint64, fn func(offset uint64, entry model.LogEntry) bool) error {
+	for {
+		err := l.readAt(offset, func(current uint64, entry model.LogEntry) bool {
+			offset = current + 1
+			return fn(current, entry)
+		})
+		if err != ErrOffsetOutOfRange {
+			return err
 		}
-		err = scanner.Err()
-		if err != nil && err != io.ErrUnexpectedEOF {
-			log.Println(err)
+		if first := l.FirstOffset(); first > offset {
+			offset = first
 		}
-	}(c)
-	return c
+	}
 }
 
-func (l *Logger) writeRoutine(w io.Writer) {
-	for entry := range l.wChan {
-		l.writeEntry(w, entry)
+//readAt is like read, but returns ErrOffsetOutOfRange should the given
+//offset have expired, or the entries expire before they are read
+func (l *Logger) readAt(offset uint64, fn func(offset uint64, entry model.LogEntry) bool) error {
+	next := fn
+	fn = func(offset uint64, entry model.LogEntry) bool {
+		if l.erasures.erased(offset) {
+			return true
+		}
+		entry, ok := l.decrypt(offset, entry)
+		return !ok || next(offset, entry)
 	}
+	return l.storage.ReadFrom(offset, fn)
+}
 
-	if closer, ok := w.(io.Closer); ok {
-		if err := closer.Close(); err != nil {
-			log.Println(err)
+//writeRoutine appends entries to the storage, which is only truncated
+//while every entry has been written and no more can be queued
+func (l *Logger) writeRoutine() {
+	//the block of a FileStorage is written once it has waited long enough
+	//for more entries
+	files, ok := l.files()
+	var stale <-chan time.Time
+	if ok {
+		ticker := time.NewTicker(files.flushInterval)
+		defer ticker.Stop()
+		stale = ticker.C
+	}
+
+	for done := false; !done; {
+		select {
+		case pending, open := <-l.wChan:
+			if !open {
+				done = true
+				break
+			}
+			l.writeEntry(pending)
+			//a full block has been written already
+			if len(l.wChan) == 0 || ok && files.written() {
+				l.flush(pending)
+			}
+			l.wg.Done()
+		case <-stale:
+			if err := files.flushStale(); err != nil {
+				log.Println(err)
+			}
 		}
 	}
 
-	if err := l.wFile.Close(); err != nil {
+	if err := l.storage.Close(); err != nil {
+		log.Println(err)
+	}
+	if err := l.keys.close(); err != nil {
+		log.Println(err)
+	}
+	if err := l.erasures.close(); err != nil {
 		log.Println(err)
 	}
 }
 
-func (l *Logger) writeEntry(w io.Writer, entry model.LogEntry) {
-	if entry == nil {
+//writeEntry appends the pending entry to the storage
+func (l *Logger) writeEntry(pending pendingEntry) {
+	if pending.entry == nil {
 		return
 	}
-	if _, err := w.Write(EncodePayload(entry)); err != nil {
+	if err := l.storage.Append(pending.offset, pending.entry); err != nil {
 		log.Println(err)
 	}
+}
 
-	if flusher, ok := w.(model.Flusher); ok {
-		if err := flusher.Flush(); err != nil {
-			log.Println(err)
-		}
+//flush syncs the storage, which makes every entry up to the pending one
+//readable
+func (l *Logger) flush(pending pendingEntry) {
+	next := pending.offset
+	if pending.entry != nil {
+		next++
+	}
+	if err := l.storage.Sync(next); err != nil {
+		log.Println(err)
 	}
 
-	l.wg.Done()
+	l.written.L.Lock()
+	l.flushed = next
+	l.written.Broadcast()
+	l.written.L.Unlock()
 }
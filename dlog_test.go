@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"reflect"
 
 	"testing"
@@ -139,3 +140,208 @@ func BenchmarkWriteWithBestZlibCompression(b *testing.B) {
 	fi, _ := file.Stat()
 	b.SetBytes(int64(int(fi.Size()) / 1024 / 1024))
 }
+
+func TestLoggerAssignsOffsets(t *testing.T) {
+	logger, _ := NewLogger("")
+	defer logger.Close()
+
+	for x := uint64(0); x < 10; x++ {
+		if offset := logger.Write(NewLogEntryTestData().Build()); offset != x {
+			t.Fatalf("expected offset %d, got %d", x, offset)
+		}
+	}
+
+	logger.Sync()
+	numElems := 0
+	for range logger.ReadFrom(7) {
+		numElems++
+	}
+	if numElems != 3 {
+		t.Fatalf("expected 3 entries but got %d", numElems)
+	}
+}
+
+func TestLoggerCanBeReopened(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+
+	logger, _ := NewLogger(dir)
+	logger.Write(NewLogEntryTestData().Build())
+	logger.Close()
+
+	logger, _ = NewLogger(dir)
+	if offset := logger.Write(NewLogEntryTestData().Build()); offset != 1 {
+		t.Fatalf("expected offset 1, got %d", offset)
+	}
+	logger.Close()
+
+	numElems := 0
+	for range logger.Read() {
+		numElems++
+	}
+	if numElems != 2 {
+		t.Fatalf("expected 2 entries but got %d", numElems)
+	}
+}
+
+func TestCanWriteAndReadKey(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+
+	logger, _ := NewLogger(dir)
+	for x := 0; x < 10; x++ {
+		key := []byte{byte(x % 2)}
+		logger.WriteKey(key, 1, 3, NewLogEntryTestData().WithPayload([]byte{byte(x)}).Build())
+	}
+	logger.Close()
+
+	logger, _ = NewLogger(dir)
+	defer logger.Close()
+
+	var payloads []byte
+	for entry := range logger.ReadKey([]byte{1}) {
+		payloads = append(payloads, entry.Payload()[0])
+	}
+	if expected := []byte{1, 3, 5, 7, 9}; !reflect.DeepEqual(payloads, expected) {
+		t.Fatalf("%v != %v", payloads, expected)
+	}
+
+	if partition, partitions, ok := logger.Partition(); !ok || partition != 1 || partitions != 3 {
+		t.Fatalf("expected partition 1/3, got %d/%d", partition, partitions)
+	}
+}
+
+func TestLoggerCanBeTruncated(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+
+	logger, _ := NewLogger(dir)
+	for x := 0; x < 5; x++ {
+		logger.WriteKey([]byte{byte(x % 2)}, 0, 1, NewLogEntryTestData().WithPayload([]byte{byte(x)}).Build())
+	}
+	if err := logger.Truncate(3); err != nil {
+		t.Fatal(err)
+	}
+	if offset := logger.Write(NewLogEntryTestData().WithPayload([]byte{5}).Build()); offset != 3 {
+		t.Fatalf("expected offset 3, got %d", offset)
+	}
+	if _, _, _, ok := logger.Key(3); ok {
+		t.Fatal("expected the key of the truncated entry to be gone")
+	}
+	logger.Close()
+
+	logger, _ = NewLogger(dir)
+	defer logger.Close()
+	var payloads []byte
+	for logEntry := range logger.Read() {
+		payloads = append(payloads, logEntry.Payload()[0])
+	}
+	if !reflect.DeepEqual(payloads, []byte{0, 1, 2, 5}) {
+		t.Fatalf("unexpected entries %v", payloads)
+	}
+	if n := len(logger.keys.offsets([]byte{0})); n != 2 {
+		t.Fatalf("expected 2 entries for key 0, got %d", n)
+	}
+}
+
+func TestLoggerChecksumsRanges(t *testing.T) {
+	a, _ := NewLogger("")
+	b, _ := NewLogger("")
+	for x := 0; x < 5; x++ {
+		logEntry := NewLogEntryTestData().Build()
+		a.Write(logEntry)
+		b.Write(logEntry)
+	}
+	b.Write(NewLogEntryTestData().Build())
+
+	checksums, _, covered := a.Checksums(2, 0, 10)
+	if len(checksums) != 3 || covered != 5 {
+		t.Fatalf("expected 3 checksums covering 5 entries, got %d covering %d", len(checksums), covered)
+	}
+	if other, _, _ := b.Checksums(2, 0, covered); !reflect.DeepEqual(checksums, other) {
+		t.Fatal("expected equal logs to have equal checksums")
+	}
+	if other, _, _ := b.Checksums(2, 0, 6); reflect.DeepEqual(checksums, other) {
+		t.Fatal("expected different logs to have different checksums")
+	}
+	if other, start, _ := b.Checksums(2, 1, covered); start != 2 || !reflect.DeepEqual(checksums[1:], other) {
+		t.Fatalf("expected the ranges to start at offset 2, got %d", start)
+	}
+}
+
+func TestLoggerCachesChecksumsUntilEntriesChange(t *testing.T) {
+	logger, _ := NewLogger("")
+	for x := 0; x < 5; x++ {
+		logger.Write(NewLogEntryTestData().Build())
+	}
+
+	checksums, _, _ := logger.Checksums(2, 0, 10)
+	if cached := len(logger.checksums.ranges); cached != 2 {
+		t.Fatalf("expected the 2 complete ranges to be cached, got %d", cached)
+	}
+	if again, _, _ := logger.Checksums(2, 0, 10); !reflect.DeepEqual(checksums, again) {
+		t.Fatal("expected the cached checksums to equal the ones computed")
+	}
+
+	logger.Erase(nil, 1)
+	if erased, _, _ := logger.Checksums(2, 0, 10); erased[0] == checksums[0] || erased[1] != checksums[1] {
+		t.Fatal("expected only the checksum of the range with the erased entry to change")
+	}
+}
+
+func TestLoggerRollsSegments(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+
+	logger, _ := NewLoggerWithOptions(dir, LoggerOptions{SegmentSize: 1, BlockSize: 1})
+	for x := 0; x < 5; x++ {
+		logger.Write(NewLogEntryTestData().WithPayload([]byte{byte(x)}).Build())
+	}
+	logger.Sync()
+	if n := len(segmentsOf(logger)); n != 6 {
+		t.Fatalf("expected a segment per entry and an empty active one, got %d", n)
+	}
+	if err := logger.Truncate(2); err != nil {
+		t.Fatal(err)
+	}
+	logger.Write(NewLogEntryTestData().WithPayload([]byte{5}).Build())
+	logger.Close()
+
+	logger, _ = NewLoggerWithOptions(dir, LoggerOptions{SegmentSize: 1, BlockSize: 1})
+	defer logger.Close()
+	var payloads []byte
+	for logEntry := range logger.ReadFrom(1) {
+		payloads = append(payloads, logEntry.Payload()[0])
+	}
+	if !reflect.DeepEqual(payloads, []byte{1, 5}) {
+		t.Fatalf("unexpected entries %v", payloads)
+	}
+	if offset := logger.Offset(); offset != 3 {
+		t.Fatalf("expected offset 3, got %d", offset)
+	}
+}
+
+func TestLoggerAdoptsLegacyLogFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+
+	logger, _ := NewLogger(dir)
+	logger.Write(NewLogEntryTestData().Build())
+	logger.Close()
+	os.Rename(segmentPath(dir, 0), filepath.Join(dir, legacyLogFile))
+
+	logger, _ = NewLogger(dir)
+	defer logger.Close()
+	if offset := logger.Offset(); offset != 1 {
+		t.Fatalf("expected the legacy entry to be kept, got offset %d", offset)
+	}
+	if _, err := os.Stat(segmentPath(dir, 0)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//segmentsOf returns the segments of the log, which is kept in files
+func segmentsOf(logger *Logger) []segment {
+	files, _ := logger.files()
+	return files.segments.snapshot()
+}
@@ -0,0 +1,121 @@
+package dlog
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/netbrain/dlog/keystore"
+	"github.com/netbrain/dlog/model"
+)
+
+//DumpOptions decides which entries Dump reads
+type DumpOptions struct {
+	//SegmentKeys provides the keys of the encrypted segments of the log
+	SegmentKeys keystore.KeyProvider
+	//KeyStore holds the data keys the payloads of entries written with a
+	//key are encrypted with. Without it their payloads are read as they
+	//were written, encrypted.
+	KeyStore keystore.KeyStore
+	//From and To, if To is not zero, are the offset of the first entry
+	//read and the offset following the last one
+	From uint64
+	To   uint64
+}
+
+//errDumped stops a dump once the entries up to its end have been read
+var errDumped = errors.New("dumped")
+
+//Dump calls fn with every entry which can be read of the log files at the
+//path, which is either the directory of a log, a single segment file or a
+//log file written before the log was split into segments, whatever its
+//name. The files are read as they are, so no Logger may have them open,
+//and are left untouched. Corrupt ranges are skipped and returned, as
+//Verify reports them. Should fn fail the dump stops with its error.
+//The entries of a log directory are read as the log would read them, so
+//erased entries are left out, as are entries whose key has been shredded
+//if the options have a KeyStore.
+func Dump(path string, options DumpOptions, fn func(offset uint64, entry model.LogEntry) error) ([]CorruptRange, error) {
+	return dump(path, options, func(offset uint64, entry model.LogEntry, _ *keyRecord) error {
+		return fn(offset, entry)
+	})
+}
+
+//dump is Dump, which calls fn with the record of the key the entry was
+//written with as well, nil if it has none
+func dump(path string, options DumpOptions, fn func(offset uint64, entry model.LogEntry, key *keyRecord) error) ([]CorruptRange, error) {
+	format := segmentFormat{keys: options.SegmentKeys}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := newMemoryKeyIndex()
+	erased := newMemoryErasures()
+	if info.IsDir() {
+		if keys, err = loadKeyIndex(filepath.Join(path, "dlog.keys")); err != nil {
+			return nil, err
+		}
+		if erased, err = loadErasures(filepath.Join(path, "dlog.erasures")); err != nil {
+			return nil, err
+		}
+	}
+	var list []segment
+	if !info.IsDir() {
+		base, _ := parseSegmentName(filepath.Base(path))
+		list = []segment{{base: base, path: path, format: format}}
+	} else if legacy := filepath.Join(path, legacyLogFile); fileExists(legacy) {
+		list = []segment{{path: legacy, format: format}}
+	} else if list, err = listSegments(path, format, nil); err != nil {
+		return nil, err
+	}
+
+	to := options.To
+	if to == 0 {
+		to = math.MaxUint64
+	}
+	var corrupt []CorruptRange
+	for i, seg := range list {
+		limit := uint64(math.MaxUint64)
+		if i+1 < len(list) {
+			limit = list[i+1].base
+		}
+		if limit <= options.From {
+			continue
+		}
+		check, err := checkSegment(seg, limit, func(offset uint64, entry model.LogEntry) error {
+			if offset >= to {
+				return errDumped
+			}
+			if offset < options.From || erased.erased(offset) {
+				return nil
+			}
+			record, ok := keys.byOffset[offset]
+			if !ok {
+				return fn(offset, entry, nil)
+			}
+			if options.KeyStore != nil && !entry.Tombstone() {
+				payload, err := keystore.Open(options.KeyStore, record.key, entry.Payload())
+				if err == keystore.ErrShredded {
+					return nil
+				}
+				if err != nil {
+					return fmt.Errorf("err decrypting entry at offset %d: %s", offset, err)
+				}
+				entry = model.NewLogEntry(entry.MetaData(), payload)
+			}
+			return fn(offset, entry, &record)
+		})
+		if err == errDumped {
+			break
+		}
+		if err != nil {
+			return corrupt, err
+		}
+		if check.corrupt != nil {
+			corrupt = append(corrupt, *check.corrupt)
+		}
+	}
+	return corrupt, nil
+}
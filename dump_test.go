@@ -0,0 +1,109 @@
+package dlog
+
+import (
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	. "github.com/netbrain/dlog/encoder"
+	"github.com/netbrain/dlog/keystore"
+	"github.com/netbrain/dlog/model"
+	. "github.com/netbrain/dlog/testdata"
+)
+
+func TestDumpReadsRangeOfSegments(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+
+	logger, _ := NewLoggerWithOptions(dir, LoggerOptions{SegmentSize: 128, BlockSize: 1})
+	for x := 0; x < 20; x++ {
+		logger.Write(NewLogEntryTestData().WithPayload([]byte(fmt.Sprint(x))).Build())
+	}
+	logger.Sync()
+	if len(segmentsOf(logger)) < 3 {
+		t.Fatal("expected the entries to span several segments")
+	}
+	logger.Close()
+
+	var offsets []uint64
+	corrupt, err := Dump(dir, DumpOptions{From: 5, To: 15}, func(offset uint64, entry model.LogEntry) error {
+		if string(entry.Payload()) != fmt.Sprint(offset) {
+			t.Fatalf("expected payload %d, got %q", offset, entry.Payload())
+		}
+		offsets = append(offsets, offset)
+		return nil
+	})
+	if err != nil || len(corrupt) != 0 {
+		t.Fatalf("expected the log to be dumped, got %v: %v", corrupt, err)
+	}
+	if len(offsets) != 10 || offsets[0] != 5 || offsets[9] != 14 {
+		t.Fatalf("expected offsets 5 up to 15, got %v", offsets)
+	}
+}
+
+func TestDumpReadsLegacyLogFileOfAnyName(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+
+	legacy := filepath.Join(dir, "copied-dlog.bin")
+	file, _ := os.Create(legacy)
+	w, _ := flate.NewWriter(file, flate.BestSpeed)
+	for x := 0; x < 3; x++ {
+		w.Write(EncodePayload(NewLogEntryTestData().WithPayload([]byte{byte(x)}).Build()))
+	}
+	//a legacy log file ends torn, as it was never closed
+	w.Flush()
+	file.Close()
+
+	var payloads []byte
+	corrupt, err := Dump(legacy, DumpOptions{}, func(offset uint64, entry model.LogEntry) error {
+		payloads = append(payloads, entry.Payload()[0])
+		return nil
+	})
+	if err != nil || len(corrupt) != 0 {
+		t.Fatalf("expected the log file to be dumped, got %v: %v", corrupt, err)
+	}
+	if !reflect.DeepEqual(payloads, []byte{0, 1, 2}) {
+		t.Fatalf("unexpected entries %v", payloads)
+	}
+	if _, err := os.Stat(indexPath(legacy)); !os.IsNotExist(err) {
+		t.Fatal("expected the log file to be left untouched")
+	}
+}
+
+func TestDumpDecryptsEntriesOfKeysAndLeavesOutErasedOnes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	store, _ := keystore.NewFileKeyStore(filepath.Join(dir, "datakeys"))
+	defer store.Close()
+
+	logger, _ := NewLoggerWithOptions(filepath.Join(dir, "log"), LoggerOptions{KeyStore: store, BlockSize: 1})
+	for x := 0; x < 4; x++ {
+		logger.WriteKey([]byte(fmt.Sprint(x%2)), 0, 1, NewLogEntryTestData().WithPayload([]byte(fmt.Sprint(x))).Build())
+	}
+	logger.Write(NewLogEntryTestData().WithPayload([]byte("4")).Build())
+	logger.Erase(nil, 2)
+	logger.Shred([]byte("1"))
+	logger.Close()
+
+	dump := func(options DumpOptions) map[uint64]string {
+		payloads := make(map[uint64]string)
+		if _, err := Dump(filepath.Join(dir, "log"), options, func(offset uint64, entry model.LogEntry) error {
+			payloads[offset] = string(entry.Payload())
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return payloads
+	}
+	if payloads, expected := dump(DumpOptions{KeyStore: store}), map[uint64]string{0: "0", 4: "4"}; !reflect.DeepEqual(payloads, expected) {
+		t.Fatalf("expected the entries which were neither erased nor shredded, decrypted, got %v", payloads)
+	}
+	if payloads := dump(DumpOptions{}); len(payloads) != 4 || payloads[0] == "0" || payloads[4] != "4" {
+		t.Fatalf("expected the entries which were not erased, encrypted, got %v", payloads)
+	}
+}
@@ -45,3 +45,29 @@ func ScanPayloadSplitFunc(data []byte, atEOF bool) (advance int, token []byte, e
 	offset := payloadLen + lenSize
 	return offset, data[lenSize:offset], nil
 }
+
+//ScanFrameSplitFunc is a function intendend for bufio.Scanner's Split function
+//on long lived connections. Unlike ScanPayloadSplitFunc it does not stop on
+//EOT but returns it as an empty token so the caller can keep on scanning.
+func ScanFrameSplitFunc(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	rawLen, lenSize := binary.Uvarint(data)
+	if lenSize <= 0 {
+		if atEOF {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+	payloadLen := int(rawLen)
+	if (len(data) - lenSize) < payloadLen {
+		if atEOF {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+	offset := payloadLen + lenSize
+	return offset, data[lenSize:offset], nil
+}
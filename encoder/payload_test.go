@@ -83,3 +83,29 @@ func TestScannerDecodeEOT(t *testing.T) {
 		log.Fatal(scanner.Err())
 	}
 }
+
+func TestFrameScannerReturnsEOT(t *testing.T) {
+	data := []byte{1, 2, 3}
+	buffer := &bytes.Buffer{}
+
+	buffer.Write(EncodePayload(data))
+	WriteEOT(buffer)
+	buffer.Write(EncodePayload(data))
+
+	scanner := bufio.NewScanner(buffer)
+	scanner.Split(ScanFrameSplitFunc)
+
+	var frames [][]byte
+	for scanner.Scan() {
+		frames = append(frames, append([]byte{}, scanner.Bytes()...))
+	}
+
+	if scanner.Err() != nil {
+		t.Fatal(scanner.Err())
+	}
+
+	expected := [][]byte{data, {}, data}
+	if !reflect.DeepEqual(frames, expected) {
+		t.Fatalf("%v != %v", frames, expected)
+	}
+}
@@ -0,0 +1,258 @@
+package dlog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	fb "github.com/google/flatbuffers/go"
+	"github.com/netbrain/dlog/keystore"
+)
+
+/*
+An encrypted segment starts with a header naming the key it is encrypted
+with, followed by the rest of the segment sealed with AES-GCM in chunks,
+one for the block header and one for every block, and an empty final chunk
+once the segment is sealed:
+	|---------------------------------------------------------------|
+	| Magic (64) | KeyIDLength (16) | KeyID                         |
+	|---------------------------------------------------------------|
+	| ChunkLength (32) | Sequence (64) | Final (8) | Nonce (96) |     |
+	| Ciphertext                                                    |
+	|---------------------------------------------------------------|
+Sequence numbers the chunks of the segment from 0, and Final is 1 for the
+final chunk. Every chunk is authenticated along with the header, the base
+offset of the segment, its sequence number and whether it is final, so that
+chunks which are reordered, spliced in from another segment or cut off the
+end of a sealed segment are detected. Segments without the header are not
+encrypted.
+*/
+var encryptedSegmentMagic = []byte("dlog.enc")
+
+//chunkHeaderSize is the size of the sequence number and the final flag of
+//a chunk
+var chunkHeaderSize = fb.SizeUint64 + 1
+
+func newSegmentAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//newSealingWriter writes the header of the segment of the base offset
+//encrypted with the current key of the keys, and returns a writer sealing
+//the rest of the segment
+func newSealingWriter(w io.Writer, keys keystore.KeyProvider, base uint64) (*sealingWriter, error) {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newSegmentAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	header := encodeEncryptionHeader(id)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &sealingWriter{w: w, cipher: &segmentCipher{aead, header, base}}, nil
+}
+
+func encodeEncryptionHeader(id string) []byte {
+	header := make([]byte, len(encryptedSegmentMagic)+fb.SizeUint16, len(encryptedSegmentMagic)+fb.SizeUint16+len(id))
+	copy(header, encryptedSegmentMagic)
+	fb.WriteUint16(header[len(encryptedSegmentMagic):], uint16(len(id)))
+	return append(header, id...)
+}
+
+//readEncryptionHeader reads the header of an encrypted segment, if the
+//segment has one
+func readEncryptionHeader(reader *bufio.Reader) (id string, header []byte, encrypted bool, err error) {
+	magic, err := reader.Peek(len(encryptedSegmentMagic))
+	if err != nil || !bytes.Equal(magic, encryptedSegmentMagic) {
+		return "", nil, false, nil
+	}
+
+	header = make([]byte, len(encryptedSegmentMagic)+fb.SizeUint16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", nil, false, err
+	}
+	idBytes := make([]byte, fb.GetUint16(header[len(encryptedSegmentMagic):]))
+	if _, err := io.ReadFull(reader, idBytes); err != nil {
+		return "", nil, false, err
+	}
+	return string(idBytes), append(header, idBytes...), true, nil
+}
+
+//decryptSegment returns a reader of the rest of the segment of the base
+//offset, which is decrypted if the segment is encrypted
+func decryptSegment(reader *bufio.Reader, keys keystore.KeyProvider, base uint64) (*bufio.Reader, error) {
+	id, header, encrypted, err := readEncryptionHeader(reader)
+	if err != nil || !encrypted {
+		return reader, err
+	}
+	aead, err := segmentAEAD(id, keys)
+	if err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(&openingReader{r: reader, cipher: &segmentCipher{aead, header, base}}), nil
+}
+
+//segmentAEAD returns the cipher of a segment encrypted with the key of the id
+func segmentAEAD(id string, keys keystore.KeyProvider) (cipher.AEAD, error) {
+	if keys == nil {
+		return nil, fmt.Errorf("segment is encrypted, and the log has no segment keys")
+	}
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	return newSegmentAEAD(key)
+}
+
+//segmentCipher seals and opens the chunks of an encrypted segment
+type segmentCipher struct {
+	aead   cipher.AEAD
+	header []byte
+	base   uint64
+}
+
+//additionalData returns what the chunk of the chunk header is
+//authenticated along with
+func (c *segmentCipher) additionalData(chunkHeader []byte) []byte {
+	data := make([]byte, len(c.header)+fb.SizeUint64, len(c.header)+fb.SizeUint64+len(chunkHeader))
+	copy(data, c.header)
+	fb.WriteUint64(data[len(c.header):], c.base)
+	return append(data, chunkHeader...)
+}
+
+//seal returns the chunk of the sequence number holding plain, prefixed by
+//its length
+func (c *segmentCipher) seal(seq uint64, final bool, plain []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	prefixSize := fb.SizeUint32 + chunkHeaderSize
+	chunk := make([]byte, prefixSize+nonceSize, prefixSize+nonceSize+len(plain)+c.aead.Overhead())
+	fb.WriteUint64(chunk[fb.SizeUint32:], seq)
+	if final {
+		chunk[prefixSize-1] = 1
+	}
+	if _, err := io.ReadFull(rand.Reader, chunk[prefixSize:]); err != nil {
+		return nil, err
+	}
+	chunk = c.aead.Seal(chunk, chunk[prefixSize:], plain, c.additionalData(chunk[fb.SizeUint32:prefixSize]))
+	fb.WriteUint32(chunk, uint32(len(chunk)-fb.SizeUint32))
+	return chunk, nil
+}
+
+//open decrypts the chunk, which must be the chunk of the sequence number,
+//and returns true if it is the final chunk
+func (c *segmentCipher) open(chunk []byte, seq uint64) ([]byte, bool, error) {
+	nonceSize := c.aead.NonceSize()
+	if len(chunk) < chunkHeaderSize+nonceSize {
+		return nil, false, fmt.Errorf("invalid chunk of encrypted segment")
+	}
+	if sequence := chunkSequence(chunk); sequence != seq {
+		return nil, false, fmt.Errorf("chunk %d of encrypted segment is out of order, expected chunk %d", sequence, seq)
+	}
+	nonce := chunk[chunkHeaderSize : chunkHeaderSize+nonceSize]
+	plain, err := c.aead.Open(nil, nonce, chunk[chunkHeaderSize+nonceSize:], c.additionalData(chunk[:chunkHeaderSize]))
+	if err != nil {
+		return nil, false, fmt.Errorf("chunk of encrypted segment fails authentication: %s", err)
+	}
+	return plain, chunk[chunkHeaderSize-1] == 1, nil
+}
+
+//chunkSequence returns the sequence number the chunk claims, which open
+//authenticates
+func chunkSequence(chunk []byte) uint64 {
+	if len(chunk) < fb.SizeUint64 {
+		return 0
+	}
+	return fb.GetUint64(chunk)
+}
+
+//sealingWriter buffers what is written until it is flushed as a chunk
+type sealingWriter struct {
+	w      io.Writer
+	cipher *segmentCipher
+	//seq is the sequence number of the next chunk
+	seq uint64
+	buf []byte
+}
+
+func (s *sealingWriter) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	return len(p), nil
+}
+
+func (s *sealingWriter) flush() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	if err := s.write(false); err != nil {
+		return err
+	}
+	s.buf = s.buf[:0]
+	return nil
+}
+
+//finish flushes what is buffered and writes the final chunk, after which
+//nothing may be written
+func (s *sealingWriter) finish() error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+	return s.write(true)
+}
+
+func (s *sealingWriter) write(final bool) error {
+	chunk, err := s.cipher.seal(s.seq, final, s.buf)
+	if err != nil {
+		return err
+	}
+	if _, err := s.w.Write(chunk); err != nil {
+		return err
+	}
+	s.seq++
+	return nil
+}
+
+//openingReader reads the decrypted chunks of an encrypted segment from the
+//chunk of the sequence number seq. A torn chunk at the end, or the end of
+//a segment which has not been sealed by its final chunk, reads as
+//io.ErrUnexpectedEOF, like a torn block.
+type openingReader struct {
+	r      *bufio.Reader
+	cipher *segmentCipher
+	seq    uint64
+	final  bool
+	buf    []byte
+}
+
+func (o *openingReader) Read(p []byte) (int, error) {
+	for len(o.buf) == 0 {
+		chunk, err := readUnit(o.r)
+		if err == io.EOF && !o.final {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		if o.final {
+			return 0, fmt.Errorf("chunk after the final chunk of encrypted segment")
+		}
+		if o.buf, o.final, err = o.cipher.open(chunk, o.seq); err != nil {
+			return 0, err
+		}
+		o.seq++
+	}
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,124 @@
+package dlog
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/netbrain/dlog/keystore"
+	. "github.com/netbrain/dlog/testdata"
+)
+
+//segmentKeyID returns the id of the key the segment is encrypted with
+func segmentKeyID(t *testing.T, seg segment) string {
+	file, err := os.Open(seg.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	id, _, encrypted, _ := readEncryptionHeader(bufio.NewReader(file))
+	if !encrypted {
+		t.Fatalf("expected segment %s to be encrypted", seg.path)
+	}
+	return id
+}
+
+func TestLoggerEncryptsSegmentsWithRotatedKeys(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "segment.keys")
+	ioutil.WriteFile(keyFile, []byte("k1:"+strings.Repeat("01", 32)+"\n"), 0600)
+	options := LoggerOptions{SegmentSize: 1, BlockSize: 1, SegmentKeys: keystore.NewFileKeyProvider(keyFile)}
+
+	logger, _ := NewLoggerWithOptions(dir, options)
+	logger.Write(NewLogEntryTestData().Build())
+	logger.Sync()
+	ioutil.WriteFile(keyFile, []byte("k1:"+strings.Repeat("01", 32)+"\nk2:"+strings.Repeat("02", 16)+"\n"), 0600)
+	logger.Write(NewLogEntryTestData().Build())
+	logger.Sync()
+
+	list := segmentsOf(logger)
+	if id := segmentKeyID(t, list[0]); id != "k1" {
+		t.Fatalf("expected the first segment to be encrypted with k1, got %s", id)
+	}
+	if id := segmentKeyID(t, list[len(list)-1]); id != "k2" {
+		t.Fatalf("expected the segment started after the rotation to be encrypted with k2, got %s", id)
+	}
+	logger.Close()
+
+	if _, err := NewLoggerWithOptions(dir, LoggerOptions{SegmentSize: 1, BlockSize: 1}); err == nil {
+		t.Fatal("expected an encrypted log not to open without its keys")
+	}
+	logger, _ = NewLoggerWithOptions(dir, options)
+	defer logger.Close()
+	if n := len(entries(logger)); n != 2 {
+		t.Fatalf("expected 2 entries, got %d", n)
+	}
+}
+
+func TestLoggerTruncatesTornChunkOfEncryptedSegment(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	os.Setenv("DLOG_TEST_SEGMENT_KEYS", "k1:"+strings.Repeat("01", 32))
+	defer os.Unsetenv("DLOG_TEST_SEGMENT_KEYS")
+	options := LoggerOptions{SegmentKeys: keystore.NewEnvKeyProvider("DLOG_TEST_SEGMENT_KEYS")}
+
+	logger, _ := NewLoggerWithOptions(dir, options)
+	payload := []byte("a payload long enough to be recognized")
+	logger.Write(NewLogEntryTestData().WithPayload(payload).Build())
+	logger.Close()
+
+	path := segmentPath(dir, 0)
+	data, _ := ioutil.ReadFile(path)
+	if bytes.Contains(data, payload) {
+		t.Fatal("expected the payload to be encrypted")
+	}
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{0, 0, 1, 0, 42})
+	file.Close()
+
+	logger, _ = NewLoggerWithOptions(dir, options)
+	defer logger.Close()
+	logger.Write(NewLogEntryTestData().WithPayload(payload).Build())
+	read := entries(logger)
+	if len(read) != 2 || !bytes.Equal(read[1].Payload(), payload) {
+		t.Fatalf("expected both entries to be read, got %d", len(read))
+	}
+}
+
+func TestVerifyDetectsTruncatedAndSplicedEncryptedSegments(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	keys := keystore.NewFileKeyProvider(filepath.Join(dir, "segment.keys"))
+	ioutil.WriteFile(filepath.Join(dir, "segment.keys"), []byte("k1:"+strings.Repeat("01", 32)+"\n"), 0600)
+	log := filepath.Join(dir, "log")
+
+	logger, _ := NewLoggerWithOptions(log, LoggerOptions{SegmentSize: 1, BlockSize: 1, SegmentKeys: keys})
+	for x := 0; x < 3; x++ {
+		logger.Write(NewLogEntryTestData().Build())
+		logger.Sync()
+	}
+	logger.Close()
+	if report, err := Verify(log, VerifyOptions{SegmentKeys: keys}); err != nil || !report.Ok() {
+		t.Fatalf("expected the log to verify, got %v: %v", report, err)
+	}
+
+	//the final chunk is the sequence number, the flag, the nonce and the tag
+	final := int64(4 + chunkHeaderSize + 12 + 16)
+	info, _ := os.Stat(segmentPath(log, 0))
+	os.Truncate(segmentPath(log, 0), info.Size()-final)
+	spliced, _ := ioutil.ReadFile(segmentPath(log, 2))
+	ioutil.WriteFile(segmentPath(log, 1), spliced, 0644)
+
+	report, err := Verify(log, VerifyOptions{SegmentKeys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Corrupt) != 2 || report.Corrupt[0].Segment != segmentPath(log, 0) || report.Corrupt[1].Segment != segmentPath(log, 1) {
+		t.Fatalf("expected the truncated and the spliced segment to be corrupt, got %v", report)
+	}
+}
@@ -0,0 +1,367 @@
+package dlog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	fb "github.com/google/flatbuffers/go"
+	. "github.com/netbrain/dlog/encoder"
+	"github.com/netbrain/dlog/model"
+)
+
+//Erasure is the audit record of an erasure of entries from the log
+type Erasure struct {
+	//Time is when the entries were erased
+	Time time.Time
+	//Key is the key whose entries were erased, if the erasure was by key
+	Key []byte
+	//Offsets are the offsets of the entries erased
+	Offsets []uint64
+}
+
+/*
+erasures records the offsets of erased entries, which are skipped when the
+log is read until they are purged from the segments. Every erasure is
+appended to a file, which is kept as the audit trail, as records of the
+following layout:
+	|---------------------------------------------------------------|
+	| Time (64) | KeyLength (16) | Key | [Offset (64) ...]          |
+	|---------------------------------------------------------------|
+The erasures of a log without a directory are only kept in memory.
+*/
+type erasures struct {
+	sync.RWMutex
+	file *os.File
+	//memory holds the erasures if there is no file
+	memory  []Erasure
+	offsets map[uint64]bool
+	//pending are the erased offsets which may still be in a segment
+	pending map[uint64]bool
+}
+
+var erasureHeaderSize = fb.SizeInt64 + fb.SizeUint16
+
+//newMemoryErasures returns erasures which are only kept in memory
+func newMemoryErasures() *erasures {
+	return &erasures{
+		offsets: make(map[uint64]bool),
+		pending: make(map[uint64]bool),
+	}
+}
+
+//openErasures loads the erasures from the file, truncating a torn record
+//left behind by a crash
+func openErasures(path string) (*erasures, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	e := newMemoryErasures()
+	e.file = file
+	size := e.scan(file)
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+//loadErasures loads the erasures from the file without changing it, a
+//missing file holds no erasure
+func loadErasures(path string) (*erasures, error) {
+	e := newMemoryErasures()
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return e, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	e.scan(file)
+	return e, nil
+}
+
+//scan loads the erasures read from r up to a torn one, and returns the
+//size of the erasures loaded
+func (e *erasures) scan(r io.Reader) int64 {
+	var size int64
+	scanner := bufio.NewScanner(r)
+	scanner.Split(ScanPayloadSplitFunc)
+	for scanner.Scan() {
+		erasure, ok := decodeErasure(scanner.Bytes())
+		if !ok {
+			break
+		}
+		e.load(erasure)
+		size += int64(len(EncodePayload(scanner.Bytes())))
+	}
+	return size
+}
+
+func (e *erasures) load(erasure Erasure) {
+	for _, offset := range erasure.Offsets {
+		e.offsets[offset] = true
+		e.pending[offset] = true
+	}
+}
+
+func encodeErasure(erasure Erasure) []byte {
+	record := make([]byte, erasureHeaderSize, erasureHeaderSize+len(erasure.Key)+fb.SizeUint64*len(erasure.Offsets))
+	fb.WriteInt64(record, erasure.Time.UnixNano())
+	fb.WriteUint16(record[fb.SizeInt64:], uint16(len(erasure.Key)))
+	record = append(record, erasure.Key...)
+	for _, offset := range erasure.Offsets {
+		offsetBytes := make([]byte, fb.SizeUint64)
+		fb.WriteUint64(offsetBytes, offset)
+		record = append(record, offsetBytes...)
+	}
+	return record
+}
+
+func decodeErasure(record []byte) (Erasure, bool) {
+	if len(record) < erasureHeaderSize {
+		return Erasure{}, false
+	}
+	keyLength := int(fb.GetUint16(record[fb.SizeInt64:]))
+	offsets := record[erasureHeaderSize:]
+	if len(offsets) < keyLength || (len(offsets)-keyLength)%fb.SizeUint64 != 0 {
+		return Erasure{}, false
+	}
+
+	erasure := Erasure{Time: time.Unix(0, fb.GetInt64(record))}
+	if keyLength > 0 {
+		erasure.Key = append([]byte(nil), offsets[:keyLength]...)
+	}
+	for offsets = offsets[keyLength:]; len(offsets) > 0; offsets = offsets[fb.SizeUint64:] {
+		erasure.Offsets = append(erasure.Offsets, fb.GetUint64(offsets))
+	}
+	return erasure, true
+}
+
+//add records the erasure, which is synced to disk before it is returned
+func (e *erasures) add(erasure Erasure) error {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.file == nil {
+		e.memory = append(e.memory, erasure)
+	} else if _, err := e.file.Write(EncodePayload(encodeErasure(erasure))); err != nil {
+		return err
+	} else if err := e.file.Sync(); err != nil {
+		return err
+	}
+	e.load(erasure)
+	return nil
+}
+
+//erased returns true if the entry at the offset has been erased
+func (e *erasures) erased(offset uint64) bool {
+	e.RLock()
+	defer e.RUnlock()
+	return e.offsets[offset]
+}
+
+//purged records that the segment from base up to next has been rewritten
+//without the erased entries
+func (e *erasures) purged(base, next uint64) {
+	e.Lock()
+	defer e.Unlock()
+	for offset := range e.pending {
+		if offset >= base && offset < next {
+			delete(e.pending, offset)
+		}
+	}
+}
+
+//pendingIn returns true if an erased entry may still be in the segment
+//from base up to next
+func (e *erasures) pendingIn(base, next uint64) bool {
+	e.RLock()
+	defer e.RUnlock()
+	for offset := range e.pending {
+		if offset >= base && offset < next {
+			return true
+		}
+	}
+	return false
+}
+
+//readErasures reads the records of the erasures file
+func readErasures(path string) ([]Erasure, error) {
+	rFile, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rFile.Close()
+
+	var records []Erasure
+	scanner := bufio.NewScanner(rFile)
+	scanner.Split(ScanPayloadSplitFunc)
+	for scanner.Scan() {
+		erasure, ok := decodeErasure(scanner.Bytes())
+		if !ok {
+			return records, fmt.Errorf("invalid erasure record")
+		}
+		records = append(records, erasure)
+	}
+	return records, scanner.Err()
+}
+
+//truncate forgets the erasures of the offsets from the given one onwards,
+//which are given to new entries once the log is truncated. The records are
+//kept without those offsets.
+func (e *erasures) truncate(offset uint64) error {
+	e.Lock()
+	defer e.Unlock()
+
+	truncated := false
+	for erased := range e.offsets {
+		if erased >= offset {
+			truncated = true
+			delete(e.offsets, erased)
+			delete(e.pending, erased)
+		}
+	}
+	if !truncated {
+		return nil
+	}
+
+	records, err := e.records()
+	if err != nil {
+		return err
+	}
+	frames := make([][]byte, len(records))
+	for i, erasure := range records {
+		var kept []uint64
+		for _, erased := range erasure.Offsets {
+			if erased < offset {
+				kept = append(kept, erased)
+			}
+		}
+		records[i].Offsets = kept
+		frames[i] = encodeErasure(records[i])
+	}
+	if e.file == nil {
+		e.memory = records
+		return nil
+	}
+
+	path := e.file.Name()
+	if err := writeFrames(path, frames); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	e.file.Close()
+	e.file = file
+	return nil
+}
+
+//records returns the records of every erasure, oldest first
+func (e *erasures) records() ([]Erasure, error) {
+	if e.file == nil {
+		return append([]Erasure(nil), e.memory...), nil
+	}
+	return readErasures(e.file.Name())
+}
+
+func (e *erasures) close() error {
+	if e.file == nil {
+		return nil
+	}
+	return e.file.Close()
+}
+
+//Erase erases the entries at the offsets, and every entry written with the
+//key if it is not nil, and returns the number of entries erased. Erased
+//entries are skipped when the log is read from then on, and purged from the
+//segment files by the next Purge or Compact which rewrites their segments.
+//An audit record of the erasure is kept, see Erasures.
+func (l *Logger) Erase(key []byte, offsets ...uint64) (uint64, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if key != nil {
+		offsets = append(offsets, l.keys.offsets(key)...)
+	}
+	erasure := Erasure{Time: time.Now(), Key: key}
+	seen := make(map[uint64]bool)
+	for _, offset := range offsets {
+		if offset < l.offset && !seen[offset] && !l.erasures.erased(offset) {
+			seen[offset] = true
+			erasure.Offsets = append(erasure.Offsets, offset)
+		}
+	}
+	if len(erasure.Offsets) == 0 {
+		return 0, nil
+	}
+
+	if err := l.erasures.add(erasure); err != nil {
+		return 0, err
+	}
+	l.checksums.clear()
+	return uint64(len(erasure.Offsets)), l.keys.rewrite(func(offset uint64) bool {
+		return !seen[offset]
+	})
+}
+
+//Erasures returns the audit records of every erasure, oldest first
+func (l *Logger) Erasures() ([]Erasure, error) {
+	l.erasures.RLock()
+	defer l.erasures.RUnlock()
+	return l.erasures.records()
+}
+
+//Purge rewrites the sealed segments which hold erased entries without them,
+//and returns the number of entries purged. Writes carry on while segments
+//are rewritten. Erased entries in the active segment are purged once it is
+//sealed. Logs kept in another Storage than a FileStorage keep erased
+//entries, which are skipped when the log is read all the same.
+func (l *Logger) Purge() (uint64, error) {
+	files, ok := l.files()
+	if !ok {
+		return 0, nil
+	}
+	l.maintenance.Lock()
+	defer l.maintenance.Unlock()
+
+	list := files.segments.snapshot()
+	var purged uint64
+	for i, seg := range list[:len(list)-1] {
+		n, err := l.purge(seg, list[i+1].base)
+		if err != nil {
+			return purged, err
+		}
+		purged += n
+	}
+	return purged, nil
+}
+
+//purge rewrites the sealed segment, which ends at next, without the erased
+//entries it may still hold, and returns the number of entries purged.
+//l.maintenance must be held.
+func (l *Logger) purge(seg segment, next uint64) (uint64, error) {
+	if !l.erasures.pendingIn(seg.base, next) {
+		return 0, nil
+	}
+	removed, err := seg.compact(func(offset uint64, _ model.LogEntry) bool {
+		return !l.erasures.erased(offset)
+	})
+	if err != nil {
+		return 0, err
+	}
+	l.erasures.purged(seg.base, next)
+	return uint64(len(removed)), nil
+}
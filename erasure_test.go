@@ -0,0 +1,134 @@
+package dlog
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/netbrain/dlog/encoder"
+	"github.com/netbrain/dlog/model"
+	. "github.com/netbrain/dlog/testdata"
+)
+
+func TestLoggerErasesEntries(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+
+	logger, _ := NewLoggerWithOptions(dir, LoggerOptions{SegmentSize: 1, BlockSize: 1})
+	logger.WriteKey([]byte("a"), 0, 1, NewLogEntryTestData().Build())
+	logger.WriteKey([]byte("a"), 0, 1, NewLogEntryTestData().Build())
+	logger.Write(NewLogEntryTestData().Build())
+	logger.WriteKey([]byte("b"), 0, 1, NewLogEntryTestData().Build())
+	logger.Write(NewLogEntryTestData().Build())
+	logger.Sync()
+
+	if erased, err := logger.Erase([]byte("a"), 2); err != nil || erased != 3 {
+		t.Fatalf("expected 3 entries to be erased, got %d: %v", erased, err)
+	}
+	if expected := []uint64{3, 4}; !reflect.DeepEqual(offsets(logger), expected) {
+		t.Fatalf("expected offsets %v, got %v", expected, offsets(logger))
+	}
+	for range logger.ReadKey([]byte("a")) {
+		t.Fatal("expected the entries of the key to be erased")
+	}
+
+	if purged, err := logger.Purge(); err != nil || purged != 3 {
+		t.Fatalf("expected 3 entries to be purged, got %d: %v", purged, err)
+	}
+	var stored []uint64
+	for _, seg := range segmentsOf(logger) {
+		seg.read(seg.base, func(offset uint64, _ model.LogEntry) bool {
+			stored = append(stored, offset)
+			return true
+		})
+	}
+	if expected := []uint64{3, 4}; !reflect.DeepEqual(stored, expected) {
+		t.Fatalf("expected the segments to hold offsets %v, got %v", expected, stored)
+	}
+	logger.Close()
+
+	logger, _ = NewLoggerWithOptions(dir, LoggerOptions{SegmentSize: 1, BlockSize: 1})
+	defer logger.Close()
+	erasures, err := logger.Erasures()
+	if err != nil || len(erasures) != 1 {
+		t.Fatalf("expected an audit record of the erasure, got %v: %v", erasures, err)
+	}
+	if string(erasures[0].Key) != "a" || !reflect.DeepEqual(erasures[0].Offsets, []uint64{2, 0, 1}) {
+		t.Fatalf("unexpected audit record %+v", erasures[0])
+	}
+	if erased, _ := logger.Erase(nil, 0, 1, 2); erased != 0 {
+		t.Fatalf("expected erased entries not to be erased again, got %d", erased)
+	}
+}
+
+func TestLoggerForgetsErasuresOfTruncatedEntries(t *testing.T) {
+	logger, _ := NewLogger("")
+	defer logger.Close()
+	for x := 0; x < 3; x++ {
+		logger.Write(NewLogEntryTestData().Build())
+	}
+	logger.Sync()
+	logger.Erase(nil, 0, 2)
+
+	if err := logger.Truncate(1); err != nil {
+		t.Fatal(err)
+	}
+	logger.Write(NewLogEntryTestData().Build())
+	logger.Write(NewLogEntryTestData().Build())
+	if expected := []uint64{1, 2}; !reflect.DeepEqual(offsets(logger), expected) {
+		t.Fatalf("expected offsets %v, got %v", expected, offsets(logger))
+	}
+}
+
+func TestFollowerErasesEntriesOfLeader(t *testing.T) {
+	leader := startServer()
+	defer leader.Stop()
+	follower := startServer()
+	defer follower.Stop()
+	follower.Follow(leader.Address().String())
+
+	for x := 0; x < 3; x++ {
+		leader.logger.WriteKey([]byte("a"), 0, 1, NewLogEntryTestData().Build())
+	}
+	waitForOffset(t, follower.logger, 3)
+
+	conn, _ := net.Dial("tcp", leader.Address().String())
+	defer conn.Close()
+	conn.Write(encoder.EncodePayload(model.NewEraseRequest([]byte("a"), nil)))
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(encoder.ScanPayloadSplitFunc)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if !scanner.Scan() {
+		t.Fatal(scanner.Err())
+	}
+	if erased, ok := model.Request(scanner.Bytes()).Erased(); !ok || erased != 3 {
+		t.Fatalf("expected 3 entries to be erased, got %d", erased)
+	}
+
+	for start := time.Now(); len(offsets(follower.logger)) > 0; {
+		if time.Since(start) > time.Second*2 {
+			t.Fatalf("expected the follower to erase the entries, has %v", offsets(follower.logger))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestServerWithoutKeyStoreErasesShreddedKey(t *testing.T) {
+	s := newTestServer()
+	defer s.logger.Close()
+	for x := 0; x < 3; x++ {
+		s.logger.WriteKey([]byte{byte(x % 2)}, 0, 1, NewLogEntryTestData().Build())
+	}
+	s.logger.Sync()
+
+	if err := s.erasePassedOn(model.NewShredRequest([]byte{0})); err != nil {
+		t.Fatal(err)
+	}
+	if kept := offsets(s.logger); !reflect.DeepEqual(kept, []uint64{1}) {
+		t.Fatalf("expected the entries of the shredded key to be erased, has %v", kept)
+	}
+}
@@ -3,6 +3,9 @@ Example of the dlog client in the form of a benchmarking test command line utili
 
 Usage:
 	./benchmark -hostsList=localhost:1234,localhost:1235 -numWrites=1000
+
+or, against a cluster, where the leader is found through any of its members
+	./benchmark -hosts=localhost:1234 -cluster -numWrites=1000
 */
 package main
 
@@ -18,11 +21,13 @@ import (
 
 var hostsList string
 var numWrites int
+var cluster bool
 var servers []string
 
 func init() {
 	flag.StringVar(&hostsList, "hosts", "localhost:1234", "comma separated list of hosts to connect to")
 	flag.IntVar(&numWrites, "numWrites", 10000, "how many writes to perform")
+	flag.BoolVar(&cluster, "cluster", false, "connect to the leader of the cluster the hosts are members of")
 }
 
 func main() {
@@ -37,11 +42,18 @@ func main() {
 
 }
 
+func pool() client.ConnectionPool {
+	if cluster {
+		return client.NewLeaderConnectionPool(servers)
+	}
+	return client.NewRoundRobinConnectionPool(servers)
+}
+
 func writeBench() {
 	payload := make([]byte, 1024)
 	rand.Read(payload)
 
-	c := client.NewWriteClient(servers)
+	c := client.NewWriteClientWithPool(pool())
 	defer c.Close()
 
 	fmt.Println("\n Starting write benchmark")
@@ -57,7 +69,7 @@ func writeBench() {
 }
 
 func readBench() {
-	c := client.NewReadClient(servers)
+	c := client.NewReadClientWithPool(pool())
 	defer c.Close()
 
 	fmt.Println("\n Starting read benchmark")
@@ -3,32 +3,175 @@ A simple command line utility to start a dlog server
 
 Example usage
 	./server -port=1234 -dir=/tmp
+
+To start a cluster of three servers, start each of them with
+	./server -port=1234 -address=host1:1234 -members=host1:1234,host2:1234,host3:1234
+
+and to add a fourth server to the running cluster, list any of the members
+	./server -port=1234 -address=host4:1234 -members=host1:1234
+
+To keep only the last week of the log, moving older segments to an archive
+	./server -port=1234 -dir=/tmp -retention-age=168h -archive=/tmp/archive
+
+To encrypt the entries of every key, so that they can be shredded
+	./server -port=1234 -dir=/tmp -keystore=/secure/dlog.datakeys
+
+To encrypt the segment files with the keys of the environment variable
+DLOG_SEGMENT_KEYS, such as DLOG_SEGMENT_KEYS=k1:<64 hex digits>
+	./server -port=1234 -dir=/tmp -segment-keys-env=DLOG_SEGMENT_KEYS
+
+To offload all but the latest 10 sealed segments to an S3 bucket, with the
+credentials of the environment variables AWS_ACCESS_KEY_ID and
+AWS_SECRET_ACCESS_KEY
+	./server -port=1234 -dir=/tmp -s3-endpoint=https://s3.eu-west-1.amazonaws.com -s3-bucket=logs -s3-region=eu-west-1 -local-segments=10
+
+To take a snapshot of the log in a new directory under /backup whenever the
+server receives SIGUSR1, while it keeps serving writes
+	./server -port=1234 -dir=/tmp -snapshot-dir=/backup
 */
 package main
 
 import (
+	"compress/flate"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/netbrain/dlog"
+	"github.com/netbrain/dlog/keystore"
 )
 
 var port int
 var dir string
+var address string
+var members string
+var segmentSize int64
+var retention dlog.RetentionPolicy
+var compaction dlog.CompactionPolicy
+var keyStore string
+var segmentKeys string
+var segmentKeysEnv string
+var codec string
+var blockSize int
+var tiering dlog.TieringPolicy
+var offloadDir string
+var s3Endpoint string
+var s3Bucket string
+var s3Region string
+var snapshotDir string
 
 func init() {
 	flag.IntVar(&port, "port", 1234, "port number to use for incoming tcp connections")
 	flag.StringVar(&dir, "dir", ".", "the directory to write log files to")
+	flag.StringVar(&address, "address", "", "the address other cluster members and clients reach this server at, enables clustering")
+	flag.StringVar(&members, "members", "", "comma separated list of the members of the cluster, which this server joins if it is not among them")
+	flag.Int64Var(&segmentSize, "segment-size", dlog.DefaultSegmentSize, "the size in bytes of a segment file before a new one is started")
+	flag.DurationVar(&retention.MaxAge, "retention-age", 0, "expire segments older than this, zero keeps them")
+	flag.Int64Var(&retention.MaxSize, "retention-size", 0, "expire the oldest segments while the log is larger than this many bytes, zero keeps them")
+	flag.StringVar(&retention.ArchiveDirectory, "archive", "", "the directory to move expired segments to rather than deleting them")
+	flag.DurationVar(&retention.Interval, "retention-interval", time.Minute, "how often to check for expired segments")
+	flag.BoolVar(&compaction.Enabled, "compact", false, "compact the log, keeping only the last entry of every key")
+	flag.DurationVar(&compaction.TombstoneRetention, "tombstone-retention", dlog.DefaultTombstoneRetention, "how long tombstones of deleted keys are kept")
+	flag.StringVar(&keyStore, "keystore", "", "the file to keep the data keys the entries of every key are encrypted with, enables encryption")
+	flag.StringVar(&segmentKeys, "segment-keys", "", "the file of the keys to encrypt segment files with, one id:hexkey per line, the last one current")
+	flag.StringVar(&segmentKeysEnv, "segment-keys-env", "", "the environment variable of the keys to encrypt segment files with, comma separated id:hexkey, the last one current")
+	flag.StringVar(&codec, "codec", "flate", "the codec to compress the blocks of new segments with, one of none, flate and lz")
+	flag.IntVar(&blockSize, "block-size", dlog.DefaultBlockSize, "the size in bytes of the entries of a block before it is compressed")
+	flag.StringVar(&offloadDir, "offload-dir", "", "the directory to offload sealed segments to, enables tiering")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "", "the url of the S3 compatible object store to offload sealed segments to, enables tiering")
+	flag.StringVar(&s3Bucket, "s3-bucket", "", "the bucket to offload sealed segments to")
+	flag.StringVar(&s3Region, "s3-region", "us-east-1", "the region of the bucket")
+	flag.IntVar(&tiering.LocalSegments, "local-segments", 0, "the number of the latest sealed segments to keep on local disk when tiering")
+	flag.IntVar(&tiering.CacheSegments, "cache-segments", dlog.DefaultCacheSegments, "the number of offloaded segments to cache once read")
+	flag.DurationVar(&tiering.Interval, "tiering-interval", time.Minute, "how often to check for segments to offload")
+	flag.StringVar(&snapshotDir, "snapshot-dir", "", "the directory to take snapshots of the log in on SIGUSR1")
 }
 
 func main() {
 	flag.PrintDefaults()
 	flag.Parse()
 
-	logger, err := dlog.NewLogger(".")
+	options := dlog.LoggerOptions{
+		SegmentSize: segmentSize,
+		Retention:   retention,
+		Compaction:  compaction,
+		BlockSize:   blockSize,
+	}
+	switch codec {
+	case "none":
+		options.Codec = dlog.NoCodec
+	case "flate":
+		options.Codec = dlog.NewFlateCodec(flate.DefaultCompression)
+	case "lz":
+		options.Codec = dlog.LZCodec
+	default:
+		log.Fatalf("unknown codec '%s'", codec)
+	}
+	if keyStore != "" {
+		store, err := keystore.NewFileKeyStore(keyStore)
+		if err != nil {
+			log.Fatal(err)
+		}
+		options.KeyStore = store
+	}
+	if segmentKeys != "" {
+		options.SegmentKeys = keystore.NewFileKeyProvider(segmentKeys)
+	} else if segmentKeysEnv != "" {
+		options.SegmentKeys = keystore.NewEnvKeyProvider(segmentKeysEnv)
+	}
+	if offloadDir != "" {
+		store, err := dlog.NewDirectoryObjectStore(offloadDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tiering.Store = store
+	} else if s3Endpoint != "" {
+		tiering.Store = dlog.NewS3ObjectStore(s3Endpoint, s3Bucket, s3Region, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	}
+	options.Tiering = tiering
+	logger, err := dlog.NewLoggerWithOptions(dir, options)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if snapshotDir != "" {
+		go snapshotOnSignal(logger)
+	}
 	s := dlog.NewServer(logger, port)
+	if address != "" {
+		if err := s.JoinCluster(address, split(members)...); err != nil {
+			log.Fatal(err)
+		}
+	}
 	s.Start()
 }
+
+//split splits a comma separated list, leaving out empty entries
+func split(list string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+//snapshotOnSignal takes a snapshot of the log whenever SIGUSR1 is received
+func snapshotOnSignal(logger *dlog.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	for range signals {
+		to := filepath.Join(snapshotDir, "dlog-"+time.Now().UTC().Format("20060102T150405Z"))
+		manifest, err := logger.Snapshot(to)
+		if err != nil {
+			log.Printf("err taking snapshot: %s", err)
+			continue
+		}
+		log.Printf("Snapshot of offsets %d up to %d written to %s", manifest.FirstOffset, manifest.NextOffset, to)
+	}
+}
@@ -0,0 +1,339 @@
+package dlog
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	fb "github.com/google/flatbuffers/go"
+	. "github.com/netbrain/dlog/encoder"
+	"github.com/netbrain/dlog/model"
+)
+
+//ExportFormat is the format entries are exported in, see Export
+type ExportFormat int
+
+const (
+	//JSONLines exports every entry as a line of a JSON object of an
+	//ExportedEntry, whose key and payload are base64 encoded
+	JSONLines ExportFormat = iota
+	//Archive exports the entries in a compact binary format, see
+	//archiveMagic
+	Archive
+)
+
+/*
+archiveMagic starts an archive, followed by a deflate stream of frames,
+each of them a length prefixed entry in the following sequence:
+	|---------------------------------------------------------------|
+	| Offset (64) | Partition (32) | Partitions (32) |                |
+	|---------------------------------------------------------------|
+	| KeyLength (uvarint) | Key | LogEntry                           |
+	|---------------------------------------------------------------|
+The deflate stream is closed once every entry is written, so a truncated
+archive fails to import.
+*/
+var archiveMagic = []byte("dlog.arc\x01")
+
+//ExportedEntry is an entry of the log as it is exported
+type ExportedEntry struct {
+	//Offset is the offset the entry had in the log it was exported from
+	Offset uint64
+	//ClientID and TransactionID are JSON strings, as JSON numbers lose the
+	//precision of 64 bit ones in most decoders
+	ClientID            model.UUID `json:",string"`
+	ClientMessageNumber uint64
+	TransactionID       model.UUID `json:",string"`
+	//Time is when the transaction of the entry began, it is not imported
+	Time time.Time
+	//Key is the key the entry was written with, if any, and Partition and
+	//Partitions the partition it was routed to
+	Key        []byte `json:",omitempty"`
+	Partition  uint32 `json:",omitempty"`
+	Partitions uint32 `json:",omitempty"`
+	Payload    []byte
+}
+
+//ExportOptions decides which entries are exported and how
+type ExportOptions struct {
+	Format ExportFormat
+	//From and To, if To is not zero, are the offset of the first entry
+	//exported and the offset following the last one
+	From uint64
+	To   uint64
+}
+
+//Export writes the entries of the log to w in the format of the options,
+//and returns the number of entries written. The entries are exported as
+//they are read, so erased and shredded entries are left out and the
+//payloads of encrypted entries are decrypted.
+func (l *Logger) Export(w io.Writer, options ExportOptions) (uint64, error) {
+	exporter, err := newExportWriter(w, options.Format)
+	if err != nil {
+		return 0, err
+	}
+	l.Sync()
+
+	var n uint64
+	var werr error
+	err = l.read(options.From, func(offset uint64, entry model.LogEntry) bool {
+		if options.To > 0 && offset >= options.To {
+			return false
+		}
+		exported := exportedEntry(offset, entry)
+		exported.Key, exported.Partition, exported.Partitions, _ = l.Key(offset)
+		if werr = exporter.write(exported); werr != nil {
+			return false
+		}
+		n++
+		return true
+	})
+	if err == nil {
+		err = werr
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, exporter.close()
+}
+
+//Export writes the entries of the log files at the path to w like
+//Logger.Export, reading them offline as Dump does with the keys of
+//dumpOptions, and returns the number of entries written. The path must be
+//the directory of a log, which no Logger may have open, and its files are
+//left untouched. Should the log have corrupt ranges, the entries which can
+//be read are exported and an error is returned.
+func Export(path string, w io.Writer, options ExportOptions, dumpOptions DumpOptions) (uint64, error) {
+	if !holdsLog(path) {
+		return 0, fmt.Errorf("'%s' holds no log", path)
+	}
+	exporter, err := newExportWriter(w, options.Format)
+	if err != nil {
+		return 0, err
+	}
+	dumpOptions.From = options.From
+	dumpOptions.To = options.To
+
+	var n uint64
+	corrupt, err := dump(path, dumpOptions, func(offset uint64, entry model.LogEntry, key *keyRecord) error {
+		exported := exportedEntry(offset, entry)
+		if key != nil {
+			exported.Key, exported.Partition, exported.Partitions = key.key, key.partition, key.partitions
+		}
+		if err := exporter.write(exported); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	if err := exporter.close(); err != nil {
+		return n, err
+	}
+	if len(corrupt) > 0 {
+		return n, fmt.Errorf("the entries of %d corrupt ranges of the log are not exported, the first at offset %d", len(corrupt), corrupt[0].Offset)
+	}
+	return n, nil
+}
+
+//exportedEntry returns the entry at the offset as it is exported, without
+//its key
+func exportedEntry(offset uint64, entry model.LogEntry) ExportedEntry {
+	metaData := entry.MetaData()
+	return ExportedEntry{
+		Offset:              offset,
+		ClientID:            metaData.ClientID(),
+		ClientMessageNumber: metaData.ClientMessageNumber(),
+		TransactionID:       metaData.TransactionID(),
+		Time:                metaData.TransactionID().Time(),
+		Payload:             entry.Payload(),
+	}
+}
+
+//ImportOptions decides how entries are imported
+type ImportOptions struct {
+	Format ExportFormat
+	//Restamp gives the entries new MetaData, of a ClientID of the import
+	//and of new TransactionIDs, rather than the MetaData they were exported
+	//with
+	Restamp bool
+}
+
+//Import writes the entries read from r in the format of the options to
+//the log, and returns the number of entries written. Entries exported with
+//a key are written with it, and encrypted if the Logger has a KeyStore.
+//The entries are given the next offsets of the log, not those they were
+//exported with. Should an entry fail to be read the import stops, leaving
+//the entries before it written.
+func (l *Logger) Import(r io.Reader, options ImportOptions) (uint64, error) {
+	importer, err := newExportReader(r, options.Format)
+	if err != nil {
+		return 0, err
+	}
+	defer l.Sync()
+
+	clientID := model.NewUUID()
+	var n uint64
+	for {
+		exported, err := importer.next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, fmt.Errorf("err reading entry %d of the import: %s", n+1, err)
+		}
+
+		metaData := model.NewMetaData(exported.ClientID, exported.ClientMessageNumber, exported.TransactionID)
+		if options.Restamp {
+			metaData = model.NewMetaData(clientID, n+1, model.NewUUID())
+		}
+		entry := model.NewLogEntry(metaData, exported.Payload)
+		if len(exported.Key) > 0 {
+			l.WriteKey(exported.Key, exported.Partition, exported.Partitions, entry)
+		} else {
+			l.Write(entry)
+		}
+		n++
+	}
+}
+
+//exportWriter writes exported entries in a format
+type exportWriter interface {
+	write(entry ExportedEntry) error
+	//close writes what is left of the export
+	close() error
+}
+
+func newExportWriter(w io.Writer, format ExportFormat) (exportWriter, error) {
+	switch format {
+	case JSONLines:
+		buffered := bufio.NewWriter(w)
+		return &jsonLinesWriter{buffered, json.NewEncoder(buffered)}, nil
+	case Archive:
+		if _, err := w.Write(archiveMagic); err != nil {
+			return nil, err
+		}
+		compressed, err := flate.NewWriter(w, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		return &archiveWriter{compressed}, nil
+	}
+	return nil, fmt.Errorf("unknown export format %d", format)
+}
+
+type jsonLinesWriter struct {
+	buffered *bufio.Writer
+	encoder  *json.Encoder
+}
+
+func (w *jsonLinesWriter) write(entry ExportedEntry) error {
+	return w.encoder.Encode(entry)
+}
+
+func (w *jsonLinesWriter) close() error {
+	return w.buffered.Flush()
+}
+
+type archiveWriter struct {
+	compressed *flate.Writer
+}
+
+func (w *archiveWriter) write(entry ExportedEntry) error {
+	header := make([]byte, fb.SizeUint64+fb.SizeUint32*2)
+	fb.WriteUint64(header, entry.Offset)
+	fb.WriteUint32(header[fb.SizeUint64:], entry.Partition)
+	fb.WriteUint32(header[fb.SizeUint64+fb.SizeUint32:], entry.Partitions)
+	frame := append(header, EncodePayload(entry.Key)...)
+	frame = append(frame, model.NewMetaData(entry.ClientID, entry.ClientMessageNumber, entry.TransactionID)...)
+	frame = append(frame, entry.Payload...)
+	_, err := w.compressed.Write(EncodePayload(frame))
+	return err
+}
+
+func (w *archiveWriter) close() error {
+	return w.compressed.Close()
+}
+
+//exportReader reads exported entries in a format
+type exportReader interface {
+	//next returns the next entry, or io.EOF once every entry is read
+	next() (ExportedEntry, error)
+}
+
+func newExportReader(r io.Reader, format ExportFormat) (exportReader, error) {
+	switch format {
+	case JSONLines:
+		return &jsonLinesReader{json.NewDecoder(r)}, nil
+	case Archive:
+		buffered := bufio.NewReader(r)
+		magic := make([]byte, len(archiveMagic))
+		if _, err := io.ReadFull(buffered, magic); err != nil || !bytes.Equal(magic, archiveMagic) {
+			return nil, fmt.Errorf("not an archive of entries")
+		}
+		scanner := bufio.NewScanner(flate.NewReader(buffered))
+		//entries are as large as they were written, the buffer only grows
+		//as long as there is more of the frame to read
+		scanner.Buffer(nil, math.MaxInt32)
+		scanner.Split(ScanFrameSplitFunc)
+		return &archiveReader{scanner}, nil
+	}
+	return nil, fmt.Errorf("unknown export format %d", format)
+}
+
+type jsonLinesReader struct {
+	decoder *json.Decoder
+}
+
+func (r *jsonLinesReader) next() (ExportedEntry, error) {
+	var entry ExportedEntry
+	err := r.decoder.Decode(&entry)
+	return entry, err
+}
+
+type archiveReader struct {
+	scanner *bufio.Scanner
+}
+
+func (r *archiveReader) next() (ExportedEntry, error) {
+	var entry ExportedEntry
+	if !r.scanner.Scan() {
+		if r.scanner.Err() != nil {
+			return entry, r.scanner.Err()
+		}
+		return entry, io.EOF
+	}
+	frame := r.scanner.Bytes()
+	headerSize := fb.SizeUint64 + fb.SizeUint32*2
+	if len(frame) < headerSize {
+		return entry, fmt.Errorf("frame of %d bytes is shorter than its header", len(frame))
+	}
+	entry.Offset = fb.GetUint64(frame)
+	entry.Partition = fb.GetUint32(frame[fb.SizeUint64:])
+	entry.Partitions = fb.GetUint32(frame[fb.SizeUint64+fb.SizeUint32:])
+	frame = frame[headerSize:]
+
+	keyLength, n := binary.Uvarint(frame)
+	if n <= 0 || uint64(len(frame)-n) < keyLength+model.MetaDataSize {
+		return entry, fmt.Errorf("frame is shorter than its key and MetaData")
+	}
+	if keyLength > 0 {
+		entry.Key = append([]byte(nil), frame[n:n+int(keyLength)]...)
+	}
+	logEntry := model.LogEntry(append([]byte(nil), frame[n+int(keyLength):]...))
+	metaData := logEntry.MetaData()
+	entry.ClientID = metaData.ClientID()
+	entry.ClientMessageNumber = metaData.ClientMessageNumber()
+	entry.TransactionID = metaData.TransactionID()
+	entry.Time = entry.TransactionID.Time()
+	entry.Payload = logEntry.Payload()
+	return entry, nil
+}
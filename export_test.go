@@ -0,0 +1,134 @@
+package dlog
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/netbrain/dlog/model"
+	. "github.com/netbrain/dlog/testdata"
+)
+
+func TestExportIsImported(t *testing.T) {
+	logger, _ := NewLogger("")
+	defer logger.Close()
+	for x := 0; x < 10; x++ {
+		entry := NewLogEntryTestData().WithPayload([]byte(fmt.Sprint(x))).Build()
+		if x%2 == 0 {
+			logger.WriteKey([]byte(fmt.Sprint("key-", x%4)), 1, 2, entry)
+		} else {
+			logger.Write(entry)
+		}
+	}
+	logger.Erase(nil, 3)
+	exported := entries(logger)
+
+	for _, format := range []ExportFormat{JSONLines, Archive} {
+		var buf bytes.Buffer
+		if n, err := logger.Export(&buf, ExportOptions{Format: format, From: 1}); err != nil || n != 8 {
+			t.Fatalf("expected the 8 entries from offset 1 which were not erased to be exported, got %d: %v", n, err)
+		}
+		if format == JSONLines && !bytes.Contains(buf.Bytes(), []byte(`"TransactionID":"`)) {
+			t.Fatal("expected the ids to be exported as JSON strings")
+		}
+
+		imported, _ := NewLogger("")
+		if n, err := imported.Import(&buf, ImportOptions{Format: format}); err != nil || n != 8 {
+			t.Fatalf("expected 8 entries to be imported, got %d: %v", n, err)
+		}
+		if !reflect.DeepEqual(entries(imported), exported[1:]) {
+			t.Fatalf("expected the entries and their MetaData to be imported in format %d", format)
+		}
+		if key, partition, partitions, ok := imported.Key(1); !ok || string(key) != "key-2" || partition != 1 || partitions != 2 {
+			t.Fatalf("expected the entry at offset 1 to be written with its key, got %q %d/%d", key, partition, partitions)
+		}
+		imported.Close()
+	}
+}
+
+func TestExportReadsLogFilesOffline(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+
+	logger, _ := NewLoggerWithOptions(filepath.Join(dir, "log"), LoggerOptions{SegmentSize: 128, BlockSize: 1})
+	for x := 0; x < 10; x++ {
+		logger.WriteKey([]byte(fmt.Sprint("key-", x%2)), 1, 2, NewLogEntryTestData().WithPayload([]byte(fmt.Sprint(x))).Build())
+	}
+	logger.Erase(nil, 3)
+	exported := entries(logger)
+	logger.Close()
+
+	var buf bytes.Buffer
+	if n, err := Export(filepath.Join(dir, "log"), &buf, ExportOptions{From: 1, To: 9}, DumpOptions{}); err != nil || n != 7 {
+		t.Fatalf("expected the 7 entries from offset 1 up to 9 which were not erased to be exported, got %d: %v", n, err)
+	}
+	imported, _ := NewLogger("")
+	defer imported.Close()
+	imported.Import(&buf, ImportOptions{})
+	if !reflect.DeepEqual(entries(imported), exported[1:8]) {
+		t.Fatal("expected the entries and their MetaData to be imported")
+	}
+	if key, partition, partitions, ok := imported.Key(0); !ok || string(key) != "key-1" || partition != 1 || partitions != 2 {
+		t.Fatalf("expected the entry at offset 0 to be written with its key, got %q %d/%d", key, partition, partitions)
+	}
+
+	if _, err := Export(filepath.Join(dir, "typo"), &buf, ExportOptions{}, DumpOptions{}); err == nil {
+		t.Fatal("expected a directory which holds no log not to be exported")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "typo")); !os.IsNotExist(err) {
+		t.Fatalf("expected the directory not to be created, got %v", err)
+	}
+}
+
+func TestImportRestampsMetaData(t *testing.T) {
+	logger, _ := NewLogger("")
+	defer logger.Close()
+	for x := 0; x < 3; x++ {
+		logger.Write(NewLogEntryTestData().WithPayload([]byte{byte(x)}).Build())
+	}
+	var buf bytes.Buffer
+	logger.Export(&buf, ExportOptions{})
+
+	imported, _ := NewLogger("")
+	defer imported.Close()
+	if _, err := imported.Import(&buf, ImportOptions{Restamp: true}); err != nil {
+		t.Fatal(err)
+	}
+	original := entries(logger)
+	var clientID model.UUID
+	for i, entry := range entries(imported) {
+		metaData := entry.MetaData()
+		if i == 0 {
+			clientID = metaData.ClientID()
+		}
+		if metaData.ClientID() != clientID || metaData.ClientMessageNumber() != uint64(i+1) || metaData.ClientID() == original[i].MetaData().ClientID() {
+			t.Fatalf("expected entry %d to be restamped, got %v", i, metaData)
+		}
+		if !bytes.Equal(entry.Payload(), original[i].Payload()) {
+			t.Fatalf("expected the payload of entry %d to be kept", i)
+		}
+	}
+}
+
+func TestImportRefusesTruncatedArchive(t *testing.T) {
+	logger, _ := NewLogger("")
+	defer logger.Close()
+	for x := 0; x < 100; x++ {
+		logger.Write(NewLogEntryTestData().WithPayload([]byte(fmt.Sprint(x))).Build())
+	}
+	var buf bytes.Buffer
+	logger.Export(&buf, ExportOptions{Format: Archive})
+
+	imported, _ := NewLogger("")
+	defer imported.Close()
+	if _, err := imported.Import(bytes.NewReader(buf.Bytes()[:buf.Len()-4]), ImportOptions{Format: Archive}); err == nil {
+		t.Fatal("expected the truncated archive not to be imported")
+	}
+	if _, err := imported.Import(bytes.NewReader(buf.Bytes()), ImportOptions{Format: JSONLines}); err == nil {
+		t.Fatal("expected the archive not to be imported as JSON lines")
+	}
+}
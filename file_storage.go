@@ -0,0 +1,451 @@
+package dlog
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	. "github.com/netbrain/dlog/encoder"
+	"github.com/netbrain/dlog/model"
+)
+
+//FileStorage keeps the entries of a log in segment files in a directory,
+//see segment. Entries are appended to the last segment, the active one,
+//until it is full and a new segment is started.
+type FileStorage struct {
+	directory   string
+	format      segmentFormat
+	segmentSize int64
+	tier        *tier
+
+	//wMutex guards the active segment entries are appended to, as its
+	//current block is also written on a timer, see flushStale
+	wMutex        sync.Mutex
+	wFile         *os.File
+	wIndex        *os.File
+	w             *segmentWriter
+	size          *countingWriter
+	flushInterval time.Duration
+	//appended are the entries appended since the last Sync
+	appended []pendingEntry
+
+	//unwritten are the entries synced which are still in the current block,
+	//they are read from memory until the block is written
+	unwritten struct {
+		sync.RWMutex
+		entries []pendingEntry
+	}
+
+	//segments guards next along with the list of segments
+	segments segments
+	next     uint64
+
+	//ages caches when the last entries of sealed segments were written,
+	//see lastWritten
+	ages struct {
+		sync.Mutex
+		times map[segmentVersion]time.Time
+	}
+}
+
+//segmentVersion identifies the contents of a segment file by its path and
+//size, which changes whenever the segment is rewritten
+type segmentVersion struct {
+	path string
+	size int64
+}
+
+//NewFileStorage opens the segments in the directory, which is created if
+//it does not exist. New segments are written in the format the
+//SegmentSize, Codec, BlockSize and SegmentKeys of the options describe, and
+//their blocks are written once full or once their first entry has waited the
+//FlushInterval of the options.
+//Segments are offloaded to the object store of the Tiering of the options,
+//if it has one.
+func NewFileStorage(directory string, options LoggerOptions) (*FileStorage, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+
+	var tier *tier
+	if options.Tiering.enabled() {
+		var err error
+		if tier, err = newTier(directory, options.Tiering); err != nil {
+			return nil, err
+		}
+	}
+	format := segmentFormat{options.SegmentKeys, options.Codec, options.BlockSize}
+	list, err := listSegments(directory, format, tier)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		list = append(list, segment{0, segmentPath(directory, 0), format, tier})
+	}
+
+	s := &FileStorage{
+		directory:     directory,
+		format:        format,
+		segmentSize:   options.SegmentSize,
+		tier:          tier,
+		flushInterval: options.FlushInterval,
+	}
+	if s.flushInterval <= 0 {
+		s.flushInterval = DefaultFlushInterval
+	}
+	s.segments.list = list
+
+	active := list[len(list)-1]
+	s.next = active.base
+	_, err = active.readActive(active.base, func(offset uint64, _ model.LogEntry) bool {
+		s.next = offset + 1
+		return true
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	//entries are appended in blocks, so a segment written before is sealed,
+	//as is one which has been offloaded
+	if active.offloaded() || !active.appendable() {
+		active = s.newSegment(s.next)
+		s.segments.list = append(s.segments.list, active)
+	}
+	if err := s.openActive(active); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//newSegment returns a new segment starting at the offset
+func (s *FileStorage) newSegment(base uint64) segment {
+	return segment{base, segmentPath(s.directory, base), s.format, s.tier}
+}
+
+//openActive opens the segment for appending entries
+func (s *FileStorage) openActive(seg segment) error {
+	file, err := os.OpenFile(seg.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	index, err := os.OpenFile(indexPath(seg.path), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.wFile = file
+	s.wIndex = index
+	s.size = &countingWriter{w: file}
+	if info.Size() > 0 {
+		w, err := appendSegmentWriter(file, s.size, index, seg.format, seg.base)
+		if err != nil {
+			return err
+		}
+		if info, err = file.Stat(); err != nil {
+			return err
+		}
+		s.size.n = info.Size()
+		s.w = w
+		return nil
+	}
+
+	w, err := newSegmentWriter(s.size, index, seg.format, seg.base)
+	if err != nil {
+		return err
+	}
+	s.w = w
+	if _, err := w.Write(EncodePayload(offsetsMarker)); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+//roll seals the active segment and starts a new one at the offset
+func (s *FileStorage) roll(base uint64) error {
+	if err := s.w.seal(); err != nil {
+		return err
+	}
+	sealed, sealedIndex := s.wFile, s.wIndex
+	seg := s.newSegment(base)
+	if err := s.openActive(seg); err != nil {
+		return fmt.Errorf("err starting segment at offset %d: %s", base, err)
+	}
+	closeActive(sealed, sealedIndex)
+
+	s.segments.Lock()
+	defer s.segments.Unlock()
+	s.segments.list = append(s.segments.list, seg)
+	return nil
+}
+
+//seal starts a new segment if the active one holds entries, and returns
+//the segments then. No entry may be appended meanwhile.
+func (s *FileStorage) seal() ([]segment, error) {
+	s.wMutex.Lock()
+	defer s.wMutex.Unlock()
+	list := s.segments.snapshot()
+	_, next := s.Offsets()
+	if next > list[len(list)-1].base {
+		if err := s.roll(next); err != nil {
+			return nil, err
+		}
+		s.prune()
+	}
+	return s.segments.snapshot(), nil
+}
+
+//closeActive closes the files of a segment entries were appended to
+func closeActive(file, index *os.File) {
+	if err := file.Close(); err != nil {
+		log.Println(err)
+	}
+	if err := index.Close(); err != nil {
+		log.Println(err)
+	}
+}
+
+//Offsets implements Storage
+func (s *FileStorage) Offsets() (first, next uint64) {
+	s.segments.Lock()
+	defer s.segments.Unlock()
+	return s.segments.list[0].base, s.next
+}
+
+//Append adds the entry to the current block of the active segment,
+//implementing Storage
+func (s *FileStorage) Append(offset uint64, entry model.LogEntry) error {
+	s.wMutex.Lock()
+	defer s.wMutex.Unlock()
+	s.appended = append(s.appended, pendingEntry{offset, entry})
+	return s.w.writeEntry(offset, entry)
+}
+
+//Sync makes the entries appended readable, and starts a new segment once
+//the active one is full, implementing Storage. The current block is only
+//written once its first entry has waited the flush interval, the entries
+//of the block are read from memory until then. A segment is full only once
+//it holds an entry, as the next one would start at the same offset
+//otherwise.
+func (s *FileStorage) Sync(next uint64) error {
+	s.wMutex.Lock()
+	defer s.wMutex.Unlock()
+	err := s.writeStale()
+	s.segments.Lock()
+	active := s.segments.list[len(s.segments.list)-1]
+	s.segments.Unlock()
+	if s.segmentSize > 0 && s.size.n+int64(s.w.buffered()) >= s.segmentSize && next > active.base {
+		if err := s.roll(next); err != nil {
+			log.Println(err)
+		}
+	}
+	s.publish()
+
+	s.segments.Lock()
+	defer s.segments.Unlock()
+	if next > s.next {
+		s.next = next
+	}
+	return err
+}
+
+//flushStale writes the current block once its first entry has waited the
+//flush interval
+func (s *FileStorage) flushStale() error {
+	s.wMutex.Lock()
+	defer s.wMutex.Unlock()
+	err := s.writeStale()
+	s.prune()
+	return err
+}
+
+//writeStale is flushStale while s.wMutex is held
+func (s *FileStorage) writeStale() error {
+	if !s.w.entries || time.Since(s.w.started) < s.flushInterval {
+		return nil
+	}
+	return s.w.Flush()
+}
+
+//publish makes the entries appended since the last Sync readable, reading
+//those which are not written yet from memory. s.wMutex must be held.
+func (s *FileStorage) publish() {
+	s.unwritten.Lock()
+	s.unwritten.entries = append(s.unwritten.entries, s.appended...)
+	s.unwritten.Unlock()
+	s.appended = s.appended[:0]
+	s.prune()
+}
+
+//prune forgets the unwritten entries which have been written, which are
+//those before the first entry of the current block. s.wMutex must be held.
+func (s *FileStorage) prune() {
+	s.unwritten.Lock()
+	defer s.unwritten.Unlock()
+	entries := s.unwritten.entries
+	i := len(entries)
+	if s.w.entries {
+		i = sort.Search(len(entries), func(i int) bool {
+			return entries[i].offset >= s.w.first
+		})
+	}
+	//readers may still hold the entries, so they are copied
+	if i > 0 {
+		s.unwritten.entries = append([]pendingEntry(nil), entries[i:]...)
+	}
+}
+
+//ReadFrom implements Storage
+func (s *FileStorage) ReadFrom(offset uint64, fn func(offset uint64, entry model.LogEntry) bool) error {
+	//the entries which are not written are taken first, as they may be
+	//written to the segment while it is read
+	s.unwritten.RLock()
+	unwritten := s.unwritten.entries
+	s.unwritten.RUnlock()
+	next := offset
+	read := func(current uint64, entry model.LogEntry) bool {
+		next = current + 1
+		return fn(current, entry)
+	}
+
+	list := s.segments.snapshot()
+	if offset < list[0].base {
+		return ErrOffsetOutOfRange
+	}
+	for i, seg := range list {
+		if i+1 < len(list) && list[i+1].base <= offset {
+			continue
+		}
+		readSegment := seg.read
+		if i == len(list)-1 {
+			readSegment = seg.readActive
+		}
+		more, err := readSegment(offset, read)
+		//the segment has expired since the list was taken
+		if first, _ := s.Offsets(); os.IsNotExist(err) && seg.base < first {
+			return ErrOffsetOutOfRange
+		}
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+	for _, pending := range unwritten {
+		if pending.offset >= next && !fn(pending.offset, pending.entry) {
+			return nil
+		}
+	}
+	return nil
+}
+
+//Truncate removes the segments after the one holding the offset, which is
+//rewritten with the entries before the offset, implementing Storage
+func (s *FileStorage) Truncate(offset uint64) error {
+	s.wMutex.Lock()
+	defer s.wMutex.Unlock()
+	s.segments.Lock()
+	defer s.segments.Unlock()
+	err := s.w.Flush()
+	closeActive(s.wFile, s.wIndex)
+	if err != nil {
+		return err
+	}
+	s.unwritten.Lock()
+	s.unwritten.entries = nil
+	s.unwritten.Unlock()
+
+	list := s.segments.list
+	i := containing(list, offset)
+	for _, seg := range list[i+1:] {
+		if err := seg.remove(); err != nil {
+			return err
+		}
+	}
+	if i < 0 {
+		list = []segment{s.newSegment(offset)}
+	} else {
+		list = list[:i+1]
+		end := list[i].base
+		err := list[i].rewrite(func(current uint64, _ model.LogEntry) bool {
+			if current < offset {
+				end = current + 1
+			}
+			return current < offset
+		})
+		if err != nil {
+			return err
+		}
+		//the entries before the offset may have been purged, a segment
+		//starting at it keeps the offset once the log is opened again
+		if end < offset {
+			list = append(list, s.newSegment(offset))
+		}
+	}
+	s.segments.list = list
+	s.next = offset
+	return s.openActive(list[len(list)-1])
+}
+
+//Close closes the active segment, implementing Storage
+func (s *FileStorage) Close() error {
+	s.wMutex.Lock()
+	defer s.wMutex.Unlock()
+	//the final chunk is stripped again should the segment be appended to
+	err := s.w.seal()
+	if closeErr := s.wFile.Close(); err == nil {
+		err = closeErr
+	}
+	if indexErr := s.wIndex.Close(); err == nil {
+		err = indexErr
+	}
+	return err
+}
+
+//lastWritten returns when the last entry of the sealed segment was
+//written, which is cached until the segment is rewritten. It returns false
+//if the segment has no entries or can not be read.
+func (s *FileStorage) lastWritten(seg segment) (time.Time, bool) {
+	size, _, ok := seg.stat()
+	if !ok {
+		return time.Time{}, false
+	}
+	version := segmentVersion{seg.path, size}
+	s.ages.Lock()
+	written, cached := s.ages.times[version]
+	s.ages.Unlock()
+	if cached {
+		return written, true
+	}
+
+	written, ok, err := seg.lastWritten()
+	if err != nil {
+		log.Printf("err reading the last entry of segment %s: %s", seg.path, err)
+	}
+	if !ok {
+		return written, false
+	}
+	s.ages.Lock()
+	defer s.ages.Unlock()
+	if s.ages.times == nil {
+		s.ages.times = make(map[segmentVersion]time.Time)
+	}
+	s.ages.times[version] = written
+	return written, true
+}
+
+//written returns true if every entry appended has been written, which is
+//the case once a block is full
+func (s *FileStorage) written() bool {
+	s.wMutex.Lock()
+	defer s.wMutex.Unlock()
+	return s.w.buffered() == 0
+}
@@ -0,0 +1,206 @@
+package dlog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	fb "github.com/google/flatbuffers/go"
+	. "github.com/netbrain/dlog/encoder"
+)
+
+/*
+keyIndex records the offsets of entries written with a key. It is kept
+in memory and appended to a file as records of the following layout:
+	|---------------------------------------------------------------|
+	| Offset (64) | Partition (32) | Partitions (32) | Key          |
+	|---------------------------------------------------------------|
+The records of a log without a directory are only kept in memory.
+*/
+type keyIndex struct {
+	file *os.File
+	//memory holds the records if there is no file
+	memory      [][]byte
+	keys        map[string][]uint64
+	byOffset    map[uint64]keyRecord
+	partition   uint32
+	partitions  uint32
+	partitioned bool
+}
+
+type keyRecord struct {
+	key        []byte
+	partition  uint32
+	partitions uint32
+}
+
+var keyRecordHeaderSize = fb.SizeUint64 + fb.SizeUint32*2
+
+//newMemoryKeyIndex returns a key index which is only kept in memory
+func newMemoryKeyIndex() *keyIndex {
+	return &keyIndex{
+		keys:     make(map[string][]uint64),
+		byOffset: make(map[uint64]keyRecord),
+	}
+}
+
+//openKeyIndex loads the key index from the file, truncating a torn record
+//left behind by a crash
+func openKeyIndex(path string) (*keyIndex, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	k := newMemoryKeyIndex()
+	k.file = file
+	size := k.scan(file)
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return k, nil
+}
+
+//loadKeyIndex loads the key index from the file without changing it, a
+//missing file is an empty index
+func loadKeyIndex(path string) (*keyIndex, error) {
+	k := newMemoryKeyIndex()
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	k.scan(file)
+	return k, nil
+}
+
+//scan loads the records read from r up to a torn one, and returns the size
+//of the records loaded
+func (k *keyIndex) scan(r io.Reader) int64 {
+	var size int64
+	scanner := bufio.NewScanner(r)
+	scanner.Split(ScanPayloadSplitFunc)
+	for scanner.Scan() {
+		record := scanner.Bytes()
+		if len(record) < keyRecordHeaderSize {
+			break
+		}
+		k.load(record)
+		size += int64(len(EncodePayload(record)))
+	}
+	return size
+}
+
+func (k *keyIndex) load(record []byte) {
+	offset := fb.GetUint64(record)
+	k.partition = fb.GetUint32(record[fb.SizeUint64:])
+	k.partitions = fb.GetUint32(record[fb.SizeUint64+fb.SizeUint32:])
+	k.partitioned = true
+	key := string(record[keyRecordHeaderSize:])
+	k.keys[key] = append(k.keys[key], offset)
+	k.byOffset[offset] = keyRecord{[]byte(key), k.partition, k.partitions}
+}
+
+//add records that the entry at the offset was written with the key
+func (k *keyIndex) add(offset uint64, partition, partitions uint32, key []byte) error {
+	var mismatch error
+	if k.partitioned && (partition != k.partition || partitions != k.partitions) {
+		mismatch = fmt.Errorf("key %q routed to partition %d/%d, previous keys were routed to %d/%d",
+			key, partition, partitions, k.partition, k.partitions)
+	}
+
+	record := make([]byte, keyRecordHeaderSize, keyRecordHeaderSize+len(key))
+	fb.WriteUint64(record, offset)
+	fb.WriteUint32(record[fb.SizeUint64:], partition)
+	fb.WriteUint32(record[fb.SizeUint64+fb.SizeUint32:], partitions)
+	record = append(record, key...)
+
+	k.load(record)
+	if k.file == nil {
+		k.memory = append(k.memory, record)
+	} else if _, err := k.file.Write(EncodePayload(record)); err != nil {
+		return err
+	}
+	return mismatch
+}
+
+//rewrite drops the records of the entries at the offsets keep returns
+//false for, rewriting the file with the records that are kept
+func (k *keyIndex) rewrite(keep func(offset uint64) bool) error {
+	records, err := k.records()
+	if err != nil {
+		return err
+	}
+	var kept [][]byte
+	for _, record := range records {
+		if len(record) >= keyRecordHeaderSize && keep(fb.GetUint64(record)) {
+			kept = append(kept, record)
+		}
+	}
+
+	file := k.file
+	if file != nil {
+		path := file.Name()
+		if err := writeFrames(path, kept); err != nil {
+			return err
+		}
+		if file, err = os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644); err != nil {
+			return err
+		}
+		k.file.Close()
+	}
+
+	*k = keyIndex{
+		file:     file,
+		keys:     make(map[string][]uint64),
+		byOffset: make(map[uint64]keyRecord),
+	}
+	if file == nil {
+		k.memory = kept
+	}
+	for _, record := range kept {
+		k.load(record)
+	}
+	return nil
+}
+
+//records returns the records of the index
+func (k *keyIndex) records() ([][]byte, error) {
+	if k.file == nil {
+		return append([][]byte(nil), k.memory...), nil
+	}
+	rFile, err := os.Open(k.file.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer rFile.Close()
+
+	var records [][]byte
+	scanner := bufio.NewScanner(rFile)
+	scanner.Split(ScanPayloadSplitFunc)
+	for scanner.Scan() {
+		records = append(records, append([]byte(nil), scanner.Bytes()...))
+	}
+	return records, scanner.Err()
+}
+
+//offsets returns a copy of the offsets written with the key
+func (k *keyIndex) offsets(key []byte) []uint64 {
+	return append([]uint64(nil), k.keys[string(key)]...)
+}
+
+func (k *keyIndex) close() error {
+	if k.file == nil {
+		return nil
+	}
+	return k.file.Close()
+}
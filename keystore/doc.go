@@ -0,0 +1,16 @@
+/*
+Package keystore holds the data keys payloads written with a key are
+encrypted with, so that deleting the data key of a key makes every payload
+written with it unreadable, known as crypto-shredding.
+
+A sealed payload is laid out as follows, where the ciphertext includes the
+AES-GCM authentication tag:
+
+	|---------------------------------------------------------------|
+	| Nonce (96) | Ciphertext                                       |
+	|---------------------------------------------------------------|
+
+It also provides the keys segment files are encrypted with at rest, see
+KeyProvider.
+*/
+package keystore
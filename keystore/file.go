@@ -0,0 +1,159 @@
+package keystore
+
+import (
+	"bufio"
+	"crypto/rand"
+	"io"
+	"os"
+	"sync"
+
+	fb "github.com/google/flatbuffers/go"
+	. "github.com/netbrain/dlog/encoder"
+)
+
+/*
+FileKeyStore is a KeyStore which keeps the data keys in a file, as records
+of the following layout:
+	|---------------------------------------------------------------|
+	| KeyLength (16) | Key | DataKey (256)                          |
+	|---------------------------------------------------------------|
+Deleting a data key rewrites the file without it.
+*/
+type FileKeyStore struct {
+	mutex sync.Mutex
+	file  *os.File
+	keys  map[string][]byte
+}
+
+//NewFileKeyStore opens the key store in the file at the path, creating it
+//if it does not exist
+func NewFileKeyStore(path string) (*FileKeyStore, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FileKeyStore{
+		file: file,
+		keys: make(map[string][]byte),
+	}
+
+	var size int64
+	scanner := bufio.NewScanner(file)
+	scanner.Split(ScanPayloadSplitFunc)
+	for scanner.Scan() {
+		key, dataKey, ok := decodeRecord(scanner.Bytes())
+		if !ok {
+			break
+		}
+		s.keys[string(key)] = dataKey
+		size += int64(len(EncodePayload(scanner.Bytes())))
+	}
+
+	//a torn record left behind by a crash is dropped
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func encodeRecord(key, dataKey []byte) []byte {
+	record := make([]byte, fb.SizeUint16, fb.SizeUint16+len(key)+len(dataKey))
+	fb.WriteUint16(record, uint16(len(key)))
+	record = append(record, key...)
+	return append(record, dataKey...)
+}
+
+func decodeRecord(record []byte) (key, dataKey []byte, ok bool) {
+	if len(record) < fb.SizeUint16 {
+		return nil, nil, false
+	}
+	keyLength := int(fb.GetUint16(record))
+	if len(record) != fb.SizeUint16+keyLength+DataKeySize {
+		return nil, nil, false
+	}
+	key = append([]byte(nil), record[fb.SizeUint16:fb.SizeUint16+keyLength]...)
+	dataKey = append([]byte(nil), record[fb.SizeUint16+keyLength:]...)
+	return key, dataKey, true
+}
+
+//DataKey returns the data key of the key, creating one if there is none
+//and create is true
+func (s *FileKeyStore) DataKey(key []byte, create bool) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if dataKey, ok := s.keys[string(key)]; ok || !create {
+		return dataKey, nil
+	}
+
+	dataKey := make([]byte, DataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	if _, err := s.file.Write(EncodePayload(encodeRecord(key, dataKey))); err != nil {
+		return nil, err
+	}
+	if err := s.file.Sync(); err != nil {
+		return nil, err
+	}
+	s.keys[string(key)] = dataKey
+	return dataKey, nil
+}
+
+//Delete deletes the data key of the key, rewriting the file without it
+func (s *FileKeyStore) Delete(key []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.keys[string(key)]; !ok {
+		return nil
+	}
+
+	path := s.file.Name()
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	for k, dataKey := range s.keys {
+		if k == string(key) {
+			continue
+		}
+		if _, err = file.Write(EncodePayload(encodeRecord([]byte(k), dataKey))); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	reopened, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file = reopened
+	delete(s.keys, string(key))
+	return nil
+}
+
+//Close closes the file of the key store
+func (s *FileKeyStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,79 @@
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+//DataKeySize is the size in bytes of a data key, which selects AES-256
+const DataKeySize = 32
+
+//ErrShredded is returned when opening a payload whose data key has been
+//deleted
+var ErrShredded = errors.New("the data key of the payload has been deleted")
+
+//KeyStore holds a data key for every key payloads are written with
+type KeyStore interface {
+	//DataKey returns the data key of the key, creating one if there is none
+	//and create is true. A nil data key is returned if there is none.
+	DataKey(key []byte, create bool) ([]byte, error)
+	//Delete deletes the data key of the key, for good
+	Delete(key []byte) error
+}
+
+//Seal encrypts the payload with the data key of the key, creating the data
+//key if the key has none
+func Seal(store KeyStore, key, payload []byte) ([]byte, error) {
+	dataKey, err := store.DataKey(key, true)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(payload)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, payload, key), nil
+}
+
+//Open decrypts a payload sealed with the data key of the key. ErrShredded
+//is returned if the key has no data key, or if its data key is not the one
+//the payload was sealed with, as happens once a data key is deleted and a
+//new one created.
+func Open(store KeyStore, key, sealed []byte) ([]byte, error) {
+	dataKey, err := store.DataKey(key, false)
+	if err != nil {
+		return nil, err
+	}
+	if dataKey == nil {
+		return nil, ErrShredded
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed payload is too short")
+	}
+	payload, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], key)
+	if err != nil {
+		return nil, ErrShredded
+	}
+	return payload, nil
+}
+
+func newAEAD(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
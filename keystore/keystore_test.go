@@ -0,0 +1,65 @@
+package keystore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSealedPayloadIsShreddedWithItsDataKey(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys")
+
+	store, err := NewFileKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("payload")
+	sealedA, _ := Seal(store, []byte("a"), payload)
+	sealedB, _ := Seal(store, []byte("b"), payload)
+	if bytes.Contains(sealedA, payload) {
+		t.Fatal("expected the payload to be encrypted")
+	}
+	if opened, err := Open(store, []byte("a"), sealedA); err != nil || !bytes.Equal(opened, payload) {
+		t.Fatalf("expected the payload, got %q: %v", opened, err)
+	}
+	if _, err := Open(store, []byte("b"), sealedA); err != ErrShredded {
+		t.Fatalf("expected a payload not to open with the data key of another key, got %v", err)
+	}
+
+	if err := store.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, _ = NewFileKeyStore(path)
+	defer store.Close()
+	if _, err := Open(store, []byte("a"), sealedA); err != ErrShredded {
+		t.Fatalf("expected the payload to be shredded, got %v", err)
+	}
+	if opened, err := Open(store, []byte("b"), sealedB); err != nil || !bytes.Equal(opened, payload) {
+		t.Fatalf("expected the payload of the other key, got %q: %v", opened, err)
+	}
+}
+
+func TestKeyProviderRotatesKeys(t *testing.T) {
+	os.Setenv("DLOG_TEST_KEYS", "old:"+strings.Repeat("01", 16)+",new:"+strings.Repeat("02", 32))
+	defer os.Unsetenv("DLOG_TEST_KEYS")
+	provider := NewEnvKeyProvider("DLOG_TEST_KEYS")
+
+	if id, key, err := provider.CurrentKey(); err != nil || id != "new" || len(key) != 32 {
+		t.Fatalf("expected the last key to be current, got %s: %v", id, err)
+	}
+	if key, err := provider.Key("old"); err != nil || len(key) != 16 {
+		t.Fatalf("expected the old key, got %x: %v", key, err)
+	}
+
+	os.Setenv("DLOG_TEST_KEYS", "short:0102")
+	if _, _, err := provider.CurrentKey(); err == nil {
+		t.Fatal("expected a key of invalid length to fail")
+	}
+}
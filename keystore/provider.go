@@ -0,0 +1,149 @@
+package keystore
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+//KeyProvider provides the keys segment files are encrypted with. Every key
+//has an id, which encrypted segments record so that they can be decrypted
+//after the key has been rotated.
+type KeyProvider interface {
+	//CurrentKey returns the id and the key new segments are encrypted with
+	CurrentKey() (id string, key []byte, err error)
+	//Key returns the key of the id
+	Key(id string) ([]byte, error)
+}
+
+/*
+FileKeyProvider provides the keys listed in a file, one per line as an id
+and a hex encoded AES key of 16, 24 or 32 bytes separated by a colon:
+	2024-01:7f3c...
+	2024-07:a91e...
+The last key is the current one, so a key is rotated by appending a new
+one. The file is read every time a key is needed, keep the old keys for as
+long as segments encrypted with them exist.
+*/
+type FileKeyProvider struct {
+	path string
+}
+
+//NewFileKeyProvider creates a KeyProvider of the keys in the file at the path
+func NewFileKeyProvider(path string) *FileKeyProvider {
+	return &FileKeyProvider{path: path}
+}
+
+//CurrentKey returns the last key of the file
+func (p *FileKeyProvider) CurrentKey() (string, []byte, error) {
+	keys, err := p.keys()
+	if err != nil {
+		return "", nil, err
+	}
+	return keys.current()
+}
+
+//Key returns the key of the id in the file
+func (p *FileKeyProvider) Key(id string) ([]byte, error) {
+	keys, err := p.keys()
+	if err != nil {
+		return nil, err
+	}
+	return keys.key(id)
+}
+
+func (p *FileKeyProvider) keys() (keyList, error) {
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeys(strings.Split(string(data), "\n"))
+}
+
+//EnvKeyProvider provides the keys listed in an environment variable, comma
+//separated in the format of FileKeyProvider, the last one being current
+type EnvKeyProvider struct {
+	name string
+}
+
+//NewEnvKeyProvider creates a KeyProvider of the keys in the environment
+//variable of the name
+func NewEnvKeyProvider(name string) *EnvKeyProvider {
+	return &EnvKeyProvider{name: name}
+}
+
+//CurrentKey returns the last key of the environment variable
+func (p *EnvKeyProvider) CurrentKey() (string, []byte, error) {
+	keys, err := p.keys()
+	if err != nil {
+		return "", nil, err
+	}
+	return keys.current()
+}
+
+//Key returns the key of the id in the environment variable
+func (p *EnvKeyProvider) Key(id string) ([]byte, error) {
+	keys, err := p.keys()
+	if err != nil {
+		return nil, err
+	}
+	return keys.key(id)
+}
+
+func (p *EnvKeyProvider) keys() (keyList, error) {
+	value, ok := os.LookupEnv(p.name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", p.name)
+	}
+	return parseKeys(strings.Split(value, ","))
+}
+
+type providedKey struct {
+	id  string
+	key []byte
+}
+
+//keyList are the keys of a provider, the last being current
+type keyList []providedKey
+
+func parseKeys(entries []string) (keyList, error) {
+	var keys keyList
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid key entry, expected id:hexkey")
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %s", parts[0], err)
+		}
+		if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+			return nil, fmt.Errorf("invalid key %s, expected 16, 24 or 32 bytes, got %d", parts[0], len(key))
+		}
+		keys = append(keys, providedKey{parts[0], key})
+	}
+	return keys, nil
+}
+
+func (k keyList) current() (string, []byte, error) {
+	if len(k) == 0 {
+		return "", nil, fmt.Errorf("no keys provided")
+	}
+	last := k[len(k)-1]
+	return last.id, last.key, nil
+}
+
+func (k keyList) key(id string) ([]byte, error) {
+	for _, provided := range k {
+		if provided.id == id {
+			return provided.key, nil
+		}
+	}
+	return nil, fmt.Errorf("no key of id %s", id)
+}
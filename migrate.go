@@ -0,0 +1,131 @@
+package dlog
+
+import (
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"math"
+	"os"
+	"time"
+
+	fb "github.com/google/flatbuffers/go"
+	. "github.com/netbrain/dlog/encoder"
+	"github.com/netbrain/dlog/model"
+)
+
+//MigrationReport describes the migration of a legacy log file
+type MigrationReport struct {
+	//Source is the legacy log file migrated
+	Source string
+	//Directory is the directory of the log the entries were written to
+	Directory string
+	//Entries is the number of entries migrated
+	Entries uint64
+	//Checksum is the CRC-32 checksum of the offsets and the entries, which
+	//the legacy file and the log agree on
+	Checksum uint32
+	//Segments is the number of segments the log was written in
+	Segments int
+	//Corrupt is the range of the legacy file which could not be read, if
+	//any, such as an entry the file is truncated within. The entries
+	//before it are migrated.
+	Corrupt *CorruptRange
+	//Duration is how long the migration took
+	Duration time.Duration
+}
+
+func (r MigrationReport) String() string {
+	s := fmt.Sprintf("migrated %d entries from '%s' to %d segments in '%s' in %s, checksum %08x",
+		r.Entries, r.Source, r.Segments, r.Directory, r.Duration, r.Checksum)
+	if r.Corrupt != nil {
+		s += fmt.Sprintf("\ncorrupt %s", r.Corrupt)
+	}
+	return s
+}
+
+//Migrate writes the entries of a log file written before the log was split
+//into segments, such as a dlog.bin, to a new log in the directory which is
+//written with the options. Entries are read from the file as the Logger
+//reads them, and keep their offsets. Should the file be truncated or
+//otherwise corrupt, the entries before the corrupt range are migrated and
+//the range is reported. The entries of the new log are read back, and
+//their number and checksum compared with those of the file. The
+//directory must not hold a log already, and is left as it is should the
+//migration fail.
+func Migrate(path, directory string, options LoggerOptions) (MigrationReport, error) {
+	began := time.Now()
+	report := MigrationReport{Source: path, Directory: directory}
+
+	if holdsLog(directory) {
+		return report, fmt.Errorf("'%s' holds a log already", directory)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return report, err
+	}
+
+	//no entry may be left out of the log before it has been compared
+	options.Retention = RetentionPolicy{}
+	options.Compaction = CompactionPolicy{}
+	logger, err := NewLoggerWithOptions(directory, options)
+	if err != nil {
+		return report, err
+	}
+	defer logger.Close()
+
+	source := newMigrationChecksum()
+	legacy := segment{path: path}
+	check, err := checkLegacySegment(legacy, math.MaxUint64, func(offset uint64, entry model.LogEntry) error {
+		source.add(offset, entry)
+		if written := logger.Write(entry); written != offset {
+			return fmt.Errorf("entry at offset %d of '%s' was written at offset %d", offset, path, written)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	report.Corrupt = check.corrupt
+	logger.Sync()
+
+	migrated := newMigrationChecksum()
+	if err := logger.read(0, func(offset uint64, entry model.LogEntry) bool {
+		migrated.add(offset, entry)
+		return true
+	}); err != nil {
+		return report, err
+	}
+	if migrated.entries != source.entries || migrated.Sum32() != source.Sum32() {
+		return report, fmt.Errorf("the log has %d entries of checksum %08x, '%s' has %d of checksum %08x",
+			migrated.entries, migrated.Sum32(), path, source.entries, source.Sum32())
+	}
+
+	report.Entries = source.entries
+	report.Checksum = source.Sum32()
+	if files, ok := logger.files(); ok {
+		report.Segments = len(files.segments.snapshot())
+	}
+	report.Duration = time.Since(began)
+	return report, nil
+}
+
+//migrationChecksum counts the entries added to it and sums them along with
+//their offsets, like Checksums
+type migrationChecksum struct {
+	hash.Hash32
+	entries     uint64
+	offsetBytes []byte
+}
+
+func newMigrationChecksum() *migrationChecksum {
+	return &migrationChecksum{
+		Hash32:      crc32.New(crc32.MakeTable(crc32.Castagnoli)),
+		offsetBytes: make([]byte, fb.SizeUint64),
+	}
+}
+
+func (c *migrationChecksum) add(offset uint64, entry model.LogEntry) {
+	fb.WriteUint64(c.offsetBytes, offset)
+	c.Write(c.offsetBytes)
+	c.Write(EncodePayload(entry))
+	c.entries++
+}
@@ -0,0 +1,76 @@
+package dlog
+
+import (
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/netbrain/dlog/encoder"
+	. "github.com/netbrain/dlog/testdata"
+)
+
+func TestMigrateWritesLegacyLogFileToSegments(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+
+	legacy := filepath.Join(dir, legacyLogFile)
+	file, _ := os.Create(legacy)
+	w, _ := flate.NewWriter(file, flate.BestSpeed)
+	for x := 0; x < 100; x++ {
+		w.Write(EncodePayload(NewLogEntryTestData().WithPayload([]byte(fmt.Sprint(x))).Build()))
+	}
+	w.Close()
+	file.Close()
+
+	migrated := filepath.Join(dir, "migrated")
+	report, err := Migrate(legacy, migrated, LoggerOptions{SegmentSize: 1024, Codec: LZCodec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Entries != 100 || report.Segments < 2 {
+		t.Fatalf("expected 100 entries in several segments, got %s", report)
+	}
+
+	logger, _ := NewLogger(migrated)
+	defer logger.Close()
+	checksums, _, _ := logger.Checksums(1000, 0, 100)
+	if len(checksums) != 1 || checksums[0] != report.Checksum {
+		t.Fatalf("expected the checksum of the log to be %08x, got %v", report.Checksum, checksums)
+	}
+	for i, entry := range entries(logger) {
+		if string(entry.Payload()) != fmt.Sprint(i) {
+			t.Fatalf("expected payload %d, got %q", i, entry.Payload())
+		}
+	}
+
+	if _, err := Migrate(legacy, migrated, LoggerOptions{}); err == nil {
+		t.Fatal("expected a directory holding a log not to be migrated to")
+	}
+}
+
+func TestMigrateReportsTruncatedLegacyLogFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+
+	legacy := filepath.Join(dir, legacyLogFile)
+	file, _ := os.Create(legacy)
+	w, _ := flate.NewWriter(file, flate.NoCompression)
+	for x := 0; x < 10; x++ {
+		w.Write(EncodePayload(NewLogEntryTestData().WithPayload([]byte(fmt.Sprint(x))).Build()))
+		w.Flush()
+	}
+	info, _ := file.Stat()
+	file.Truncate(info.Size() - 10)
+	file.Close()
+
+	report, err := Migrate(legacy, filepath.Join(dir, "migrated"), LoggerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Corrupt == nil || report.Entries != 9 || report.Corrupt.Offset != 9 {
+		t.Fatalf("expected the 9 entries before the truncated one to be migrated and the truncation reported, got %s", report)
+	}
+}
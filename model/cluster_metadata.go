@@ -0,0 +1,38 @@
+package model
+
+//ClusterMetadata describes the cluster a server is a member of, as far as
+//that server knows. A server outside of a cluster describes itself as the
+//leader and only member of a cluster of its own.
+type ClusterMetadata struct {
+	//Leader is the address of the leader, which writes are sent to.
+	//The whole log has a single leader, which leads every partition.
+	Leader string
+	//Members are the addresses of the members of the cluster
+	Members []string
+	//Term is the election term of the leader
+	Term uint64
+	//Version is the version of the membership
+	Version uint64
+	//Offset is the offset of the next LogEntry the server writes
+	Offset uint64
+	//Partitions is the number of partitions keys have been written with,
+	//zero if no key has been written
+	Partitions uint32
+}
+
+//Epoch returns the term and membership version of the metadata
+func (m ClusterMetadata) Epoch() Epoch {
+	return Epoch{m.Term, m.Version}
+}
+
+//Epoch changes whenever the leader or the members of a cluster change.
+//Epochs are ordered by term and then by membership version.
+type Epoch struct {
+	Term    uint64
+	Version uint64
+}
+
+//After returns true if the epoch is later than the other one
+func (e Epoch) After(other Epoch) bool {
+	return e.Term > other.Term || (e.Term == other.Term && e.Version > other.Version)
+}
@@ -14,5 +14,9 @@ The following is the binary representation of the different entities
 	| Request                                                       |
 	| Type (1) | [LogEntry]                                         |
 	|---------------------------------------------------------------|
+
+Requests sent from the server back to the client, such as heartbeat pongs,
+are called control requests. They are always shorter than a MetaData, which
+is how they are told apart from LogEntries on the same connection.
 */
 package model
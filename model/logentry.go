@@ -1,9 +1,5 @@
 package model
 
-import (
-	fb "github.com/google/flatbuffers/go"
-)
-
 /*
 LogEntry is a byte array which has data ordered in the following sequence:
 	|---------------------------------------------------------------|
@@ -24,5 +20,12 @@ func (l LogEntry) Payload() []byte {
 
 //MetaData returns the MetaData part of the LogEntry byte array
 func (l LogEntry) MetaData() MetaData {
-	return MetaData(l[0 : fb.SizeUint64*3])
+	return MetaData(l[0:MetaDataSize])
+}
+
+//Tombstone returns true if the LogEntry has no payload. Written with a key
+//it marks the key as deleted, and compaction removes the earlier entries
+//of the key.
+func (l LogEntry) Tombstone() bool {
+	return len(l.Payload()) == 0
 }
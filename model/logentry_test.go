@@ -26,3 +26,10 @@ func TestCanCreateLogEntry(t *testing.T) {
 		t.Fatal("Not equal")
 	}
 }
+
+func TestLogEntryWithoutPayloadIsTombstone(t *testing.T) {
+	md := NewMetaData(NewUUID(), 1, NewUUID())
+	if !NewLogEntry(md, nil).Tombstone() || NewLogEntry(md, []byte{1}).Tombstone() {
+		t.Fatal("expected only the entry without payload to be a tombstone")
+	}
+}
@@ -12,9 +12,12 @@ MetaData is a byte array which has data ordered in the following sequence
 */
 type MetaData []byte
 
+//MetaDataSize is the size in bytes of a MetaData, three uint64 values
+const MetaDataSize = 3 * 8
+
 //NewMetaData creates a new MetaData
 func NewMetaData(clientID UUID, clientMessageNumber uint64, transactionID UUID) MetaData {
-	md := make(MetaData, fb.SizeUint64*3)
+	md := make(MetaData, MetaDataSize)
 	fb.WriteUint64(md[0:fb.SizeUint64], uint64(clientID))
 	fb.WriteUint64(md[fb.SizeUint64:fb.SizeUint64*2], clientMessageNumber)
 	fb.WriteUint64(md[fb.SizeUint64*2:fb.SizeUint64*3], uint64(transactionID))
@@ -13,6 +13,67 @@ const (
 	TypeReplayRequest
 	//TypeSubscribeRequest is a flag that signalst a subscription request
 	TypeSubscribeRequest
+	//TypePingRequest is a flag that signals a heartbeat ping
+	TypePingRequest
+	//TypePongRequest is a flag that signals a heartbeat answer to a ping
+	TypePongRequest
+	//TypeAckRequest is a flag that signals that a write has been written to
+	//the log, and replicated to the quorum of servers. The entry may not
+	//have been flushed to disk yet.
+	TypeAckRequest
+	//TypeOffsetRequest is a flag that signals the offset of the next
+	//LogEntry sent on a subscription
+	TypeOffsetRequest
+	//TypeWriteKeyRequest is a flag that signals a write request for a key
+	TypeWriteKeyRequest
+	//TypeReplayKeyRequest is a flag that signals a replay request of
+	//the entries written with a key
+	TypeReplayKeyRequest
+)
+
+//The flag based types above use up every bit of the type byte,
+//further types are numbered sequentially from 128
+const (
+	//TypeFetchRequest signals a follower fetching the log from an offset,
+	//which also tells the leader the follower has every entry before it
+	TypeFetchRequest = iota + 128
+	//TypeVoteRequest signals a candidate asking for a vote in an election
+	TypeVoteRequest
+	//TypeVoteResponse signals the answer to a vote request
+	TypeVoteResponse
+	//TypeHeartbeatRequest signals a leader asserting its leadership and
+	//telling the members of the cluster who the members are
+	TypeHeartbeatRequest
+	//TypeHeartbeatResponse signals the answer to a heartbeat request
+	TypeHeartbeatResponse
+	//TypeMetadataRequest signals a client asking for the ClusterMetadata
+	TypeMetadataRequest
+	//TypeMetadataResponse signals the ClusterMetadata of the server
+	TypeMetadataResponse
+	//TypeMembershipRequest signals a request to add or remove a member
+	//of the cluster
+	TypeMembershipRequest
+	//TypeMembershipResponse signals the answer to a membership request
+	TypeMembershipResponse
+	//TypeChecksumRequest signals a request for the checksums of the log
+	TypeChecksumRequest
+	//TypeChecksumResponse signals the checksums of the log
+	TypeChecksumResponse
+	//TypeAwaitRequest signals a client waiting for the server to catch up
+	//to an offset before reading
+	TypeAwaitRequest
+	//TypeOutOfRangeResponse signals that a request asked for entries which
+	//are not in the log, such as entries which have expired
+	TypeOutOfRangeResponse
+	//TypeEraseRequest signals a request to erase entries from the log
+	TypeEraseRequest
+	//TypeEraseResponse signals the number of entries erased
+	TypeEraseResponse
+	//TypeShredRequest signals a request to delete the data key of a key,
+	//which makes the entries written with the key unreadable
+	TypeShredRequest
+	//TypeShredResponse signals that the data key of a key has been deleted
+	TypeShredResponse
 )
 
 /*
@@ -21,11 +82,57 @@ Request is a byte array which has data ordered in the following sequence:
 	| Type (1) | [LogEntry]                                         |
 	|---------------------------------------------------------------|
 
+or, for requests that refer to a position in the log or to a single write:
+	|---------------------------------------------------------------|
+	| Type (1) | [Offset (64) | ClientMessageNumber (64)]           |
+	|---------------------------------------------------------------|
+	| Type (1) | ClientMessageNumber (64) | Offset (64)             |
+	|---------------------------------------------------------------|
+	| Type (1) | First (64) | Next (64)                             |
+	|---------------------------------------------------------------|
+
+or, for requests about a key:
+	|---------------------------------------------------------------|
+	| Type (1) | Partition (32) | Partitions (32) | KeyLength (16) |  |
+	| Key | LogEntry                                                |
+	|---------------------------------------------------------------|
+	| Type (1) | Key                                                |
+	|---------------------------------------------------------------|
+	| Type (1) | KeyLength (16) | Key | [Offset (64) ...]           |
+	|---------------------------------------------------------------|
+
+or, for requests between the members of a cluster, where every address
+is prefixed by its length (16):
+	|---------------------------------------------------------------|
+	| Type (1) | Term (64) | LogTerm (64) | Offset (64) | Candidate   |
+	|---------------------------------------------------------------|
+	| Type (1) | Term (64) | Version (64) | Leader | [Member ...]     |
+	|---------------------------------------------------------------|
+	| Type (1) | Term (64) | Granted (1)                            |
+	|---------------------------------------------------------------|
+	| Type (1) | Granted (1) | Address                              |
+	|---------------------------------------------------------------|
+	| Type (1) | Term (64) | Version (64) | Offset (64) |           |
+	| Partitions (32) | Leader | [Member ...]                       |
+	|---------------------------------------------------------------|
+
+or, for comparing logs by the checksums of ranges of entries:
+	|---------------------------------------------------------------|
+	| Type (1) | RangeSize (64) | From (64) | Offset (64) |         |
+	| [Checksum (32) ...]                                           |
+	|---------------------------------------------------------------|
+
 a Request is the root type sent over the wire between client/server
 */
 type Request []byte
 
 var errWrongType = errors.New("request is not of correct type")
+var errMalformed = errors.New("request is malformed")
+
+//MaxKeySize is the largest key a request can carry
+const MaxKeySize = 1<<16 - 1
+
+var keyHeaderSize = 1 + fb.SizeUint32*2 + fb.SizeUint16
 
 //NewReplayRequest creates a new replay request
 func NewReplayRequest() Request {
@@ -48,6 +155,99 @@ func NewSubscribeRequest() Request {
 	return req
 }
 
+//NewWriteKeyRequest creates a new write request for a key, which the
+//client has routed to the given partition out of the given number of
+//partitions. The key must be at most MaxKeySize bytes.
+func NewWriteKeyRequest(partition, partitions uint32, key []byte, logEntry LogEntry) Request {
+	req := make(Request, keyHeaderSize, keyHeaderSize+len(key)+len(logEntry))
+	fb.WriteByte(req, TypeWriteKeyRequest)
+	fb.WriteUint32(req[1:], partition)
+	fb.WriteUint32(req[1+fb.SizeUint32:], partitions)
+	fb.WriteUint16(req[1+fb.SizeUint32*2:], uint16(len(key)))
+	req = append(req, key...)
+	return append(req, logEntry...)
+}
+
+//NewReplayKeyRequest creates a new replay request of
+//the entries written with the key
+func NewReplayKeyRequest(key []byte) Request {
+	req := make(Request, 1, 1+len(key))
+	fb.WriteByte(req, TypeReplayKeyRequest)
+	return append(req, key...)
+}
+
+//NewSubscribeFromRequest creates a new subscription request which first
+//receives every LogEntry from the given offset before following the log
+func NewSubscribeFromRequest(offset uint64) Request {
+	return newUint64Request(TypeSubscribeRequest, offset)
+}
+
+//NewReplayFromRequest creates a new replay request of every LogEntry from
+//the given offset
+func NewReplayFromRequest(offset uint64) Request {
+	return newUint64Request(TypeReplayRequest, offset)
+}
+
+//NewFetchRequest creates a new fetch request, sent by a follower which has
+//every LogEntry before the given offset
+func NewFetchRequest(offset uint64) Request {
+	return newUint64Request(TypeFetchRequest, offset)
+}
+
+//NewAckRequest creates an acknowledgement of the write with the given
+//client message number, which was written at the offset
+func NewAckRequest(clientMessageNumber, offset uint64) Request {
+	req := newUint64Request(TypeAckRequest, clientMessageNumber)
+	offsetBytes := make([]byte, fb.SizeUint64)
+	fb.WriteUint64(offsetBytes, offset)
+	return append(req, offsetBytes...)
+}
+
+//NewAwaitRequest creates a request which makes the server wait until it
+//has every LogEntry before the offset, or gives up. The server answers with
+//an offset request of the offset of the next LogEntry it writes.
+func NewAwaitRequest(offset uint64) Request {
+	return newUint64Request(TypeAwaitRequest, offset)
+}
+
+//NewOffsetRequest creates a request telling the subscriber the offset of
+//the next LogEntry it receives
+func NewOffsetRequest(offset uint64) Request {
+	return newUint64Request(TypeOffsetRequest, offset)
+}
+
+func newUint64Request(t byte, n uint64) Request {
+	req := make(Request, 1+fb.SizeUint64)
+	fb.WriteByte(req, t)
+	fb.WriteUint64(req[1:], n)
+	return req
+}
+
+//NewPingRequest creates a new heartbeat ping request
+func NewPingRequest() Request {
+	req := make(Request, 1)
+	fb.WriteByte(req, TypePingRequest)
+	return req
+}
+
+//NewPongRequest creates a new heartbeat pong, sent in return of a ping.
+//It carries the epoch of the ClusterMetadata of the server, so that
+//clients notice when it changes.
+func NewPongRequest(epoch Epoch) Request {
+	req := make(Request, 1+fb.SizeUint64*2)
+	fb.WriteByte(req, TypePongRequest)
+	fb.WriteUint64(req[1:], epoch.Term)
+	fb.WriteUint64(req[1+fb.SizeUint64:], epoch.Version)
+	return req
+}
+
+//IsControl returns true if the frame is a control Request sent from the
+//server to the client rather than a LogEntry. Control requests are always
+//shorter than a MetaData, which every LogEntry begins with.
+func IsControl(frame []byte) bool {
+	return len(frame) > 0 && len(frame) < MetaDataSize
+}
+
 //Type returns the type this reques is,
 //either TypeWriteRequest or TypeReplayRequest
 func (r Request) Type() byte {
@@ -60,9 +260,417 @@ func (r Request) LogEntry() (LogEntry, error) {
 	switch r.Type() {
 	case TypeWriteRequest:
 		return LogEntry(r[1:]), nil
-	case TypeReplayRequest:
+	case TypeWriteKeyRequest:
+		key, err := r.Key()
+		if err != nil {
+			return nil, err
+		}
+		return LogEntry(r[keyHeaderSize+len(key):]), nil
+	case TypeReplayRequest, TypeReplayKeyRequest:
 		return nil, errWrongType
 	default:
 		panic("Unexpected type!")
 	}
 }
+
+//Offset returns the offset part of the Request byte array,
+//the second return value is false if the request carries no offset
+func (r Request) Offset() (uint64, bool) {
+	switch r.Type() {
+	case TypeReplayRequest, TypeSubscribeRequest, TypeOffsetRequest, TypeFetchRequest, TypeAwaitRequest:
+		if len(r) < 1+fb.SizeUint64 {
+			return 0, false
+		}
+		return fb.GetUint64(r[1:]), true
+	case TypeAckRequest:
+		if len(r) < 1+fb.SizeUint64*2 {
+			return 0, false
+		}
+		return fb.GetUint64(r[1+fb.SizeUint64:]), true
+	default:
+		return 0, false
+	}
+}
+
+//ClientMessageNumber returns the client message number
+//an acknowledgement refers to
+func (r Request) ClientMessageNumber() (uint64, error) {
+	if r.Type() != TypeAckRequest {
+		return 0, errWrongType
+	}
+	return fb.GetUint64(r[1:]), nil
+}
+
+//Key returns the key part of the Request byte array
+func (r Request) Key() ([]byte, error) {
+	switch r.Type() {
+	case TypeWriteKeyRequest:
+		if len(r) < keyHeaderSize {
+			return nil, errMalformed
+		}
+		keyLen := int(fb.GetUint16(r[1+fb.SizeUint32*2:]))
+		if len(r) < keyHeaderSize+keyLen {
+			return nil, errMalformed
+		}
+		return r[keyHeaderSize : keyHeaderSize+keyLen], nil
+	case TypeReplayKeyRequest, TypeShredRequest:
+		return r[1:], nil
+	default:
+		return nil, errWrongType
+	}
+}
+
+//Partition returns the partition a write request for a key was routed
+//to, and the number of partitions the client routed it among
+func (r Request) Partition() (partition uint32, partitions uint32, err error) {
+	if r.Type() != TypeWriteKeyRequest {
+		return 0, 0, errWrongType
+	}
+	if len(r) < keyHeaderSize {
+		return 0, 0, errMalformed
+	}
+	return fb.GetUint32(r[1:]), fb.GetUint32(r[1+fb.SizeUint32:]), nil
+}
+
+//NewVoteRequest creates a request for a vote in the election of the given
+//term, by a candidate whose log was last written in logTerm and which has
+//every LogEntry before offset
+func NewVoteRequest(term, logTerm, offset uint64, candidate string) Request {
+	req := make(Request, 1+fb.SizeUint64*3)
+	fb.WriteByte(req, TypeVoteRequest)
+	fb.WriteUint64(req[1:], term)
+	fb.WriteUint64(req[1+fb.SizeUint64:], logTerm)
+	fb.WriteUint64(req[1+fb.SizeUint64*2:], offset)
+	return appendAddress(req, candidate)
+}
+
+//NewVoteResponse creates the answer to a vote request
+func NewVoteResponse(term uint64, granted bool) Request {
+	return newTermResponse(TypeVoteResponse, term, granted)
+}
+
+//NewHeartbeatRequest creates a heartbeat of the leader of the given term,
+//carrying the members of the cluster as of the given membership version
+func NewHeartbeatRequest(term, version uint64, leader string, members []string) Request {
+	req := make(Request, 1+fb.SizeUint64*2)
+	fb.WriteByte(req, TypeHeartbeatRequest)
+	fb.WriteUint64(req[1:], term)
+	fb.WriteUint64(req[1+fb.SizeUint64:], version)
+	req = appendAddress(req, leader)
+	for _, member := range members {
+		req = appendAddress(req, member)
+	}
+	return req
+}
+
+//NewHeartbeatResponse creates the answer to a heartbeat request
+func NewHeartbeatResponse(term uint64, accepted bool) Request {
+	return newTermResponse(TypeHeartbeatResponse, term, accepted)
+}
+
+//NewMetadataRequest creates a request for the ClusterMetadata of a server
+func NewMetadataRequest() Request {
+	req := make(Request, 1)
+	fb.WriteByte(req, TypeMetadataRequest)
+	return req
+}
+
+//NewMetadataResponse creates the answer to a metadata request
+func NewMetadataResponse(metadata ClusterMetadata) Request {
+	req := make(Request, metadataHeaderSize)
+	fb.WriteByte(req, TypeMetadataResponse)
+	fb.WriteUint64(req[1:], metadata.Term)
+	fb.WriteUint64(req[1+fb.SizeUint64:], metadata.Version)
+	fb.WriteUint64(req[1+fb.SizeUint64*2:], metadata.Offset)
+	fb.WriteUint32(req[1+fb.SizeUint64*3:], metadata.Partitions)
+	req = appendAddress(req, metadata.Leader)
+	for _, member := range metadata.Members {
+		req = appendAddress(req, member)
+	}
+	return req
+}
+
+var metadataHeaderSize = 1 + fb.SizeUint64*3 + fb.SizeUint32
+
+//NewMembershipRequest creates a request to add, or remove, the member at
+//the given address
+func NewMembershipRequest(add bool, address string) Request {
+	return newAddressRequest(TypeMembershipRequest, add, address)
+}
+
+//NewMembershipResponse creates the answer to a membership request. If the
+//change was not made the address is that of the leader, which can make it.
+func NewMembershipResponse(changed bool, leader string) Request {
+	return newAddressRequest(TypeMembershipResponse, changed, leader)
+}
+
+func newTermResponse(t byte, term uint64, granted bool) Request {
+	req := make(Request, 1+fb.SizeUint64+1)
+	fb.WriteByte(req, t)
+	fb.WriteUint64(req[1:], term)
+	fb.WriteBool(req[1+fb.SizeUint64:], granted)
+	return req
+}
+
+func newAddressRequest(t byte, granted bool, address string) Request {
+	req := make(Request, 2, 2+len(address))
+	fb.WriteByte(req, t)
+	fb.WriteBool(req[1:], granted)
+	return append(req, address...)
+}
+
+func appendAddress(req Request, address string) Request {
+	size := make([]byte, fb.SizeUint16)
+	fb.WriteUint16(size, uint16(len(address)))
+	req = append(req, size...)
+	return append(req, address...)
+}
+
+//addresses reads the length prefixed addresses in b
+func addresses(b []byte) ([]string, error) {
+	var addresses []string
+	for len(b) > 0 {
+		if len(b) < fb.SizeUint16 {
+			return nil, errMalformed
+		}
+		size := int(fb.GetUint16(b))
+		if len(b) < fb.SizeUint16+size {
+			return nil, errMalformed
+		}
+		addresses = append(addresses, string(b[fb.SizeUint16:fb.SizeUint16+size]))
+		b = b[fb.SizeUint16+size:]
+	}
+	return addresses, nil
+}
+
+//Term returns the term of an election or heartbeat request or response
+func (r Request) Term() (uint64, error) {
+	switch r.Type() {
+	case TypeVoteRequest, TypeVoteResponse, TypeHeartbeatRequest, TypeHeartbeatResponse:
+		if len(r) < 1+fb.SizeUint64 {
+			return 0, errMalformed
+		}
+		return fb.GetUint64(r[1:]), nil
+	default:
+		return 0, errWrongType
+	}
+}
+
+//Granted returns whether a vote was granted, a heartbeat accepted, a
+//membership change made, or whether a membership request adds a member
+func (r Request) Granted() (bool, error) {
+	switch r.Type() {
+	case TypeVoteResponse, TypeHeartbeatResponse:
+		if len(r) < 1+fb.SizeUint64+1 {
+			return false, errMalformed
+		}
+		return fb.GetBool(r[1+fb.SizeUint64:]), nil
+	case TypeMembershipRequest, TypeMembershipResponse:
+		if len(r) < 2 {
+			return false, errMalformed
+		}
+		return fb.GetBool(r[1:]), nil
+	default:
+		return false, errWrongType
+	}
+}
+
+//Candidate returns the candidate of a vote request, the term its log was
+//last written in and the offset of the next LogEntry it would write
+func (r Request) Candidate() (candidate string, logTerm uint64, offset uint64, err error) {
+	if r.Type() != TypeVoteRequest {
+		return "", 0, 0, errWrongType
+	}
+	if len(r) < 1+fb.SizeUint64*3 {
+		return "", 0, 0, errMalformed
+	}
+	candidates, err := addresses(r[1+fb.SizeUint64*3:])
+	if err != nil || len(candidates) != 1 {
+		return "", 0, 0, errMalformed
+	}
+	return candidates[0], fb.GetUint64(r[1+fb.SizeUint64:]), fb.GetUint64(r[1+fb.SizeUint64*2:]), nil
+}
+
+//Membership returns the leader of a heartbeat request, the members of the
+//cluster and the version of the membership
+func (r Request) Membership() (leader string, members []string, version uint64, err error) {
+	if r.Type() != TypeHeartbeatRequest {
+		return "", nil, 0, errWrongType
+	}
+	if len(r) < 1+fb.SizeUint64*2 {
+		return "", nil, 0, errMalformed
+	}
+	all, err := addresses(r[1+fb.SizeUint64*2:])
+	if err != nil || len(all) == 0 {
+		return "", nil, 0, errMalformed
+	}
+	return all[0], all[1:], fb.GetUint64(r[1+fb.SizeUint64:]), nil
+}
+
+//Address returns the address of a membership request or response
+func (r Request) Address() (string, error) {
+	switch r.Type() {
+	case TypeMembershipRequest, TypeMembershipResponse:
+		if len(r) < 2 {
+			return "", errMalformed
+		}
+		return string(r[2:]), nil
+	default:
+		return "", errWrongType
+	}
+}
+
+//ClusterMetadata returns the ClusterMetadata of a metadata response
+func (r Request) ClusterMetadata() (ClusterMetadata, error) {
+	if r.Type() != TypeMetadataResponse {
+		return ClusterMetadata{}, errWrongType
+	}
+	if len(r) < metadataHeaderSize {
+		return ClusterMetadata{}, errMalformed
+	}
+	all, err := addresses(r[metadataHeaderSize:])
+	if err != nil || len(all) == 0 {
+		return ClusterMetadata{}, errMalformed
+	}
+	return ClusterMetadata{
+		Leader:     all[0],
+		Members:    all[1:],
+		Term:       fb.GetUint64(r[1:]),
+		Version:    fb.GetUint64(r[1+fb.SizeUint64:]),
+		Offset:     fb.GetUint64(r[1+fb.SizeUint64*2:]),
+		Partitions: fb.GetUint32(r[1+fb.SizeUint64*3:]),
+	}, nil
+}
+
+//Epoch returns the epoch of the ClusterMetadata a pong carries
+func (r Request) Epoch() (Epoch, bool) {
+	if r.Type() != TypePongRequest || len(r) < 1+fb.SizeUint64*2 {
+		return Epoch{}, false
+	}
+	return Epoch{fb.GetUint64(r[1:]), fb.GetUint64(r[1+fb.SizeUint64:])}, true
+}
+
+//NewChecksumRequest creates a request for the checksums of ranges of
+//rangeSize entries, from the offset from up to the offset upTo
+func NewChecksumRequest(rangeSize, from, upTo uint64) Request {
+	return newChecksumRequest(TypeChecksumRequest, rangeSize, from, upTo, nil)
+}
+
+//NewChecksumResponse creates the answer to a checksum request, with the
+//checksums of the ranges of entries from the offset from up to the offset
+func NewChecksumResponse(rangeSize, from, offset uint64, checksums []uint32) Request {
+	return newChecksumRequest(TypeChecksumResponse, rangeSize, from, offset, checksums)
+}
+
+func newChecksumRequest(t byte, rangeSize, from, offset uint64, checksums []uint32) Request {
+	req := make(Request, 1+fb.SizeUint64*3+fb.SizeUint32*len(checksums))
+	fb.WriteByte(req, t)
+	fb.WriteUint64(req[1:], rangeSize)
+	fb.WriteUint64(req[1+fb.SizeUint64:], from)
+	fb.WriteUint64(req[1+fb.SizeUint64*2:], offset)
+	for i, checksum := range checksums {
+		fb.WriteUint32(req[1+fb.SizeUint64*3+fb.SizeUint32*i:], checksum)
+	}
+	return req
+}
+
+//Checksums returns the size of the ranges of a checksum request or
+//response, the offsets the ranges start and end at and the checksums of
+//a response
+func (r Request) Checksums() (rangeSize, from, offset uint64, checksums []uint32, err error) {
+	if r.Type() != TypeChecksumRequest && r.Type() != TypeChecksumResponse {
+		return 0, 0, 0, nil, errWrongType
+	}
+	if len(r) < 1+fb.SizeUint64*3 || (len(r)-1-fb.SizeUint64*3)%fb.SizeUint32 != 0 {
+		return 0, 0, 0, nil, errMalformed
+	}
+	for b := r[1+fb.SizeUint64*3:]; len(b) > 0; b = b[fb.SizeUint32:] {
+		checksums = append(checksums, fb.GetUint32(b))
+	}
+	return fb.GetUint64(r[1:]), fb.GetUint64(r[1+fb.SizeUint64:]), fb.GetUint64(r[1+fb.SizeUint64*2:]), checksums, nil
+}
+
+//NewOutOfRangeResponse creates the answer to a request for entries which
+//are not in the log, telling the offset of the first LogEntry in the log
+//and of the next LogEntry written
+func NewOutOfRangeResponse(first, next uint64) Request {
+	req := newUint64Request(TypeOutOfRangeResponse, first)
+	nextBytes := make([]byte, fb.SizeUint64)
+	fb.WriteUint64(nextBytes, next)
+	return append(req, nextBytes...)
+}
+
+//OffsetRange returns the offsets of the first LogEntry in the log and of
+//the next LogEntry written, the last return value is false if the request
+//is not an out of range response
+func (r Request) OffsetRange() (first, next uint64, ok bool) {
+	if r.Type() != TypeOutOfRangeResponse || len(r) < 1+fb.SizeUint64*2 {
+		return 0, 0, false
+	}
+	return fb.GetUint64(r[1:]), fb.GetUint64(r[1+fb.SizeUint64:]), true
+}
+
+//NewEraseRequest creates a request to erase the entries at the offsets,
+//and every entry written with the key if it is not empty
+func NewEraseRequest(key []byte, offsets []uint64) Request {
+	req := make(Request, 1+fb.SizeUint16, 1+fb.SizeUint16+len(key)+fb.SizeUint64*len(offsets))
+	fb.WriteByte(req, TypeEraseRequest)
+	fb.WriteUint16(req[1:], uint16(len(key)))
+	req = append(req, key...)
+	for _, offset := range offsets {
+		offsetBytes := make([]byte, fb.SizeUint64)
+		fb.WriteUint64(offsetBytes, offset)
+		req = append(req, offsetBytes...)
+	}
+	return req
+}
+
+//Erasure returns the key, which is nil if there is none, and the offsets
+//of the entries an erase request erases
+func (r Request) Erasure() (key []byte, offsets []uint64, err error) {
+	if r.Type() != TypeEraseRequest {
+		return nil, nil, errWrongType
+	}
+	if len(r) < 1+fb.SizeUint16 {
+		return nil, nil, errMalformed
+	}
+	keyLen := int(fb.GetUint16(r[1:]))
+	b := r[1+fb.SizeUint16:]
+	if len(b) < keyLen || (len(b)-keyLen)%fb.SizeUint64 != 0 {
+		return nil, nil, errMalformed
+	}
+	if keyLen > 0 {
+		key = b[:keyLen]
+	}
+	for b = b[keyLen:]; len(b) > 0; b = b[fb.SizeUint64:] {
+		offsets = append(offsets, fb.GetUint64(b))
+	}
+	return key, offsets, nil
+}
+
+//NewEraseResponse creates the answer to an erase request, with the number
+//of entries erased
+func NewEraseResponse(erased uint64) Request {
+	return newUint64Request(TypeEraseResponse, erased)
+}
+
+//Erased returns the number of entries erased, the last return value is
+//false if the request is not an erase response
+func (r Request) Erased() (uint64, bool) {
+	if r.Type() != TypeEraseResponse || len(r) < 1+fb.SizeUint64 {
+		return 0, false
+	}
+	return fb.GetUint64(r[1:]), true
+}
+
+//NewShredRequest creates a request to delete the data key of the key
+func NewShredRequest(key []byte) Request {
+	req := make(Request, 1, 1+len(key))
+	fb.WriteByte(req, TypeShredRequest)
+	return append(req, key...)
+}
+
+//NewShredResponse creates the answer to a shred request
+func NewShredResponse() Request {
+	return Request{TypeShredResponse}
+}
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -25,3 +26,223 @@ func TestCanCreateSubscribeRequest(t *testing.T) {
 		t.Fatal("Unexpected type")
 	}
 }
+
+func TestCanCreatePingRequest(t *testing.T) {
+	req := NewPingRequest()
+	if req.Type() != TypePingRequest {
+		t.Fatal("Unexpected type")
+	}
+}
+
+func TestPongIsControl(t *testing.T) {
+	if !IsControl(NewPongRequest(Epoch{1, 1})) {
+		t.Fatal("expected pong to be a control request")
+	}
+	if IsControl(NewLogEntry(NewMetaData(NewUUID(), 1, NewUUID()), nil)) {
+		t.Fatal("expected log entry not to be a control request")
+	}
+}
+
+func TestCanCreateSubscribeFromRequest(t *testing.T) {
+	if _, ok := NewSubscribeRequest().Offset(); ok {
+		t.Fatal("expected no offset")
+	}
+
+	req := NewSubscribeFromRequest(42)
+	if req.Type() != TypeSubscribeRequest {
+		t.Fatal("Unexpected type")
+	}
+	if offset, ok := req.Offset(); !ok || offset != 42 {
+		t.Fatalf("expected offset 42, got %d", offset)
+	}
+}
+
+func TestCanCreateAckRequest(t *testing.T) {
+	req := NewAckRequest(7, 42)
+	if !IsControl(req) {
+		t.Fatal("expected ack to be a control request")
+	}
+	if n, err := req.ClientMessageNumber(); err != nil || n != 7 {
+		t.Fatalf("expected 7, got %d (%v)", n, err)
+	}
+	if offset, ok := req.Offset(); !ok || offset != 42 {
+		t.Fatalf("expected offset 42, got %d", offset)
+	}
+}
+
+func TestCanCreateAwaitRequest(t *testing.T) {
+	req := NewAwaitRequest(42)
+	if req.Type() != TypeAwaitRequest {
+		t.Fatal("Unexpected type")
+	}
+	if offset, ok := req.Offset(); !ok || offset != 42 {
+		t.Fatalf("expected offset 42, got %d", offset)
+	}
+}
+
+func TestCanCreateWriteKeyRequest(t *testing.T) {
+	logEntry := NewLogEntry(NewMetaData(NewUUID(), 1, NewUUID()), []byte{1, 2, 3})
+	req := NewWriteKeyRequest(2, 5, []byte("order-1"), logEntry)
+
+	if req.Type() != TypeWriteKeyRequest {
+		t.Fatal("Unexpected type")
+	}
+
+	key, err := req.Key()
+	if err != nil || !reflect.DeepEqual(key, []byte("order-1")) {
+		t.Fatalf("unexpected key %s (%v)", key, err)
+	}
+
+	partition, partitions, err := req.Partition()
+	if err != nil || partition != 2 || partitions != 5 {
+		t.Fatalf("unexpected partition %d/%d (%v)", partition, partitions, err)
+	}
+
+	actual, err := req.LogEntry()
+	if err != nil || !reflect.DeepEqual(actual, logEntry) {
+		t.Fatalf("%v != %v (%v)", actual, logEntry, err)
+	}
+}
+
+func TestMalformedWriteKeyRequest(t *testing.T) {
+	req := NewWriteKeyRequest(0, 1, []byte("order-1"), nil)[:keyHeaderSize+2]
+	if _, err := req.Key(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestCanCreateFetchRequest(t *testing.T) {
+	req := NewFetchRequest(42)
+	if req.Type() != TypeFetchRequest {
+		t.Fatal("Unexpected type")
+	}
+	if offset, ok := req.Offset(); !ok || offset != 42 {
+		t.Fatalf("expected offset 42, got %d", offset)
+	}
+}
+
+func TestCanCreateVoteRequest(t *testing.T) {
+	req := NewVoteRequest(3, 2, 42, "localhost:1234")
+	if term, err := req.Term(); err != nil || term != 3 {
+		t.Fatalf("expected term 3, got %d: %v", term, err)
+	}
+	candidate, logTerm, offset, err := req.Candidate()
+	if err != nil || candidate != "localhost:1234" || logTerm != 2 || offset != 42 {
+		t.Fatalf("unexpected candidate %s, log term %d, offset %d: %v", candidate, logTerm, offset, err)
+	}
+
+	res := NewVoteResponse(3, true)
+	if !IsControl(res) {
+		t.Fatal("expected vote response to be a control request")
+	}
+	if granted, err := res.Granted(); err != nil || !granted {
+		t.Fatal("expected vote to be granted")
+	}
+}
+
+func TestCanCreateHeartbeatRequest(t *testing.T) {
+	members := []string{"localhost:1234", "localhost:1235"}
+	req := NewHeartbeatRequest(3, 7, "localhost:1234", members)
+	if term, err := req.Term(); err != nil || term != 3 {
+		t.Fatalf("expected term 3, got %d: %v", term, err)
+	}
+	leader, m, version, err := req.Membership()
+	if err != nil || leader != "localhost:1234" || version != 7 || !reflect.DeepEqual(m, members) {
+		t.Fatalf("unexpected leader %s, members %v, version %d: %v", leader, m, version, err)
+	}
+
+	if _, _, _, err := req[:len(req)-1].Membership(); err != errMalformed {
+		t.Fatal("expected truncated heartbeat to be malformed")
+	}
+}
+
+func TestCanCreateMembershipRequest(t *testing.T) {
+	req := NewMembershipRequest(false, "localhost:1236")
+	add, _ := req.Granted()
+	address, _ := req.Address()
+	if add || address != "localhost:1236" {
+		t.Fatalf("unexpected membership request %t %s", add, address)
+	}
+}
+
+func TestCanCreateMetadataResponse(t *testing.T) {
+	expected := ClusterMetadata{
+		Leader:     "localhost:1234",
+		Members:    []string{"localhost:1234", "localhost:1235"},
+		Term:       3,
+		Version:    2,
+		Offset:     42,
+		Partitions: 4,
+	}
+	metadata, err := NewMetadataResponse(expected).ClusterMetadata()
+	if err != nil || !reflect.DeepEqual(metadata, expected) {
+		t.Fatalf("expected %v, got %v: %v", expected, metadata, err)
+	}
+	if epoch := metadata.Epoch(); epoch != (Epoch{3, 2}) {
+		t.Fatalf("expected epoch of term 3 and version 2, got %v", epoch)
+	}
+
+	if epoch, ok := NewPongRequest(Epoch{3, 2}).Epoch(); !ok || epoch != (Epoch{3, 2}) {
+		t.Fatalf("expected pong to carry the epoch of term 3 and version 2, got %v", epoch)
+	}
+	//a later term with an earlier version is a later epoch, which a sum of
+	//the two would not tell apart from the epoch it follows
+	if !(Epoch{4, 1}).After(Epoch{3, 2}) || (Epoch{3, 2}).After(Epoch{4, 1}) || (Epoch{3, 2}).After(Epoch{3, 2}) {
+		t.Fatal("expected epochs to be ordered by term and then by version")
+	}
+}
+
+func TestCanCreateChecksumResponse(t *testing.T) {
+	rangeSize, from, offset, checksums, err := NewChecksumResponse(1024, 1024, 3000, []uint32{1, 2}).Checksums()
+	if err != nil || rangeSize != 1024 || from != 1024 || offset != 3000 || !reflect.DeepEqual(checksums, []uint32{1, 2}) {
+		t.Fatalf("unexpected range size %d, from %d, offset %d, checksums %v: %v", rangeSize, from, offset, checksums, err)
+	}
+	if _, _, _, checksums, _ := NewChecksumRequest(1024, 0, 2000).Checksums(); len(checksums) != 0 {
+		t.Fatal("expected a request without checksums")
+	}
+}
+
+func TestCanCreateReplayFromRequest(t *testing.T) {
+	req := NewReplayFromRequest(42)
+	if req.Type() != TypeReplayRequest {
+		t.Fatal("Unexpected type")
+	}
+	if offset, ok := req.Offset(); !ok || offset != 42 {
+		t.Fatalf("expected offset 42, got %d", offset)
+	}
+	if _, ok := NewReplayRequest().Offset(); ok {
+		t.Fatal("expected a replay of the whole log to carry no offset")
+	}
+}
+
+func TestCanCreateOutOfRangeResponse(t *testing.T) {
+	req := NewOutOfRangeResponse(10, 42)
+	if !IsControl(req) {
+		t.Fatal("expected out of range response to be a control request")
+	}
+	if first, next, ok := req.OffsetRange(); !ok || first != 10 || next != 42 {
+		t.Fatalf("expected range 10-42, got %d-%d", first, next)
+	}
+}
+
+func TestCanCreateEraseRequest(t *testing.T) {
+	key, offsets, err := NewEraseRequest([]byte("key"), []uint64{1, 2}).Erasure()
+	if err != nil || string(key) != "key" || !reflect.DeepEqual(offsets, []uint64{1, 2}) {
+		t.Fatalf("unexpected erasure of key %q and offsets %v: %v", key, offsets, err)
+	}
+	if key, _, _ := NewEraseRequest(nil, []uint64{1}).Erasure(); key != nil {
+		t.Fatalf("expected no key, got %q", key)
+	}
+	if erased, ok := NewEraseResponse(3).Erased(); !ok || erased != 3 {
+		t.Fatalf("expected 3 entries erased, got %d", erased)
+	}
+}
+
+func TestCanCreateShredRequest(t *testing.T) {
+	if key, err := NewShredRequest([]byte("key")).Key(); err != nil || string(key) != "key" {
+		t.Fatalf("expected key %q, got %q: %v", "key", key, err)
+	}
+	if !IsControl(NewShredResponse()) {
+		t.Fatal("expected shred response to be a control request")
+	}
+}
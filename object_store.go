@@ -0,0 +1,109 @@
+package dlog
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//ErrObjectNotFound is returned when getting an object an ObjectStore does
+//not have
+var ErrObjectNotFound = errors.New("object not found")
+
+//ObjectStore keeps objects by name, such as the segments a Logger offloads
+//from local disk, see TieringPolicy
+type ObjectStore interface {
+	//Put stores the size bytes read from r as the object of the name,
+	//replacing an object of the same name
+	Put(name string, r io.Reader, size int64) error
+	//Get returns a reader of the object of the name, or ErrObjectNotFound
+	Get(name string) (io.ReadCloser, error)
+	//Delete deletes the object of the name, if there is one
+	Delete(name string) error
+	//List returns every object in the store
+	List() ([]ObjectInfo, error)
+}
+
+//ObjectInfo describes an object of an ObjectStore
+type ObjectInfo struct {
+	Name     string
+	Size     int64
+	Modified time.Time
+}
+
+//DirectoryObjectStore keeps objects as files in a directory, such as one
+//on a network file system or one for tests
+type DirectoryObjectStore struct {
+	directory string
+}
+
+//NewDirectoryObjectStore creates a DirectoryObjectStore in the directory,
+//which is created if it does not exist
+func NewDirectoryObjectStore(directory string) (*DirectoryObjectStore, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+	return &DirectoryObjectStore{directory}, nil
+}
+
+//Put implements ObjectStore, the object only replaces an earlier one once
+//it has been written completely
+func (d *DirectoryObjectStore) Put(name string, r io.Reader, size int64) error {
+	file, err := ioutil.TempFile(d.directory, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(file, r)
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filepath.Join(d.directory, name))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+//Get implements ObjectStore
+func (d *DirectoryObjectStore) Get(name string) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(d.directory, name))
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	return file, err
+}
+
+//Delete implements ObjectStore
+func (d *DirectoryObjectStore) Delete(name string) error {
+	err := os.Remove(filepath.Join(d.directory, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//List implements ObjectStore
+func (d *DirectoryObjectStore) List() ([]ObjectInfo, error) {
+	files, err := ioutil.ReadDir(d.directory)
+	if err != nil {
+		return nil, err
+	}
+	var objects []ObjectInfo
+	for _, file := range files {
+		if !file.IsDir() && filepath.Ext(file.Name()) != ".tmp" {
+			objects = append(objects, ObjectInfo{file.Name(), file.Size(), file.ModTime()})
+		}
+	}
+	return objects, nil
+}
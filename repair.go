@@ -0,0 +1,273 @@
+package dlog
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	. "github.com/netbrain/dlog/encoder"
+	"github.com/netbrain/dlog/model"
+)
+
+//DefaultRepairInterval is the default duration between the comparisons of
+//a follower's log with the log of its leader
+const DefaultRepairInterval = time.Minute
+
+//repairRangeSize is the number of entries covered by a single checksum
+//when logs are compared
+const repairRangeSize = 1024
+
+var errDiverged = errors.New("log diverged")
+
+//RepairReport describes what a repair found and changed in the log
+type RepairReport struct {
+	//Peer is the server the log was compared with and repaired from
+	Peer string
+	//Compared is the number of entries that were compared
+	Compared uint64
+	//Discarded is the number of entries that were removed, from the first
+	//range that differed from the peer's log onwards
+	Discarded uint64
+	//Fetched is the number of entries that were fetched from the peer
+	Fetched uint64
+	//Duration is how long the repair took
+	Duration time.Duration
+}
+
+//Repaired returns true if the repair changed the log
+func (r RepairReport) Repaired() bool {
+	return r.Discarded > 0 || r.Fetched > 0
+}
+
+func (r RepairReport) String() string {
+	return fmt.Sprintf("compared %d entries with '%s', discarded %d and fetched %d in %s",
+		r.Compared, r.Peer, r.Discarded, r.Fetched, r.Duration)
+}
+
+//Repair makes the log converge with the log of the peer, which is taken to
+//be correct, such as the leader of the server. The logs are compared by the
+//checksums of ranges of entries, and everything from the first range that
+//differs onwards is discarded and fetched again. Ranges which have expired
+//on either server are not compared. Entries the peer does not
+//have at all are discarded too. A server following the peer is left to
+//fetch missing entries itself, otherwise they are fetched before returning.
+//Writes are only held up while entries are discarded, not while waiting
+//for the peer.
+func (s *Server) Repair(peer string) (RepairReport, error) {
+	s.repairing.Lock()
+	defer s.repairing.Unlock()
+
+	began := time.Now()
+	report := RepairReport{Peer: peer}
+	conn, err := net.DialTimeout("tcp", peer, s.WriteTimeout)
+	if err != nil {
+		return report, err
+	}
+	rConn := newServerConn(conn, s.WriteTimeout)
+	defer rConn.Close()
+
+	scanner := bufio.NewScanner(rConn)
+	scanner.Split(ScanFrameSplitFunc)
+	request := model.NewChecksumRequest(repairRangeSize, s.logger.FirstOffset(), s.logger.Offset())
+	response, err := roundTrip(rConn, scanner, request, s.ReadTimeout)
+	if err != nil {
+		return report, err
+	}
+	_, start, covered, checksums, err := response.Checksums()
+	if err != nil {
+		return report, err
+	}
+
+	localChecksums, localStart, _ := s.logger.Checksums(repairRangeSize, start, covered)
+	if localStart != start {
+		return report, fmt.Errorf("entries from offset %d have expired, the peer compares from %d", localStart, start)
+	}
+	from := covered
+	for i, checksum := range checksums {
+		if i >= len(localChecksums) || localChecksums[i] != checksum {
+			from = start + uint64(i)*repairRangeSize
+			break
+		}
+	}
+	report.Compared = from - start
+
+	following, err := s.discard(peer, from, &report)
+	if err == nil && following == "" {
+		report.Fetched, err = s.fetchOnce(rConn, scanner)
+	}
+	report.Duration = time.Since(began)
+	return report, err
+}
+
+//discard discards the entries from the offset onwards, and returns the
+//leader the server follows. A follower stops following while the entries
+//are discarded, and carries on from the new end of its log afterwards.
+//The entries held back from subscribers are settled along with the log.
+func (s *Server) discard(peer string, from uint64, report *RepairReport) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	following := ""
+	if s.follower != nil {
+		following = s.follower.leader
+	}
+	if from >= s.logger.Offset() && following == peer {
+		s.settle(from, true)
+		return following, nil
+	}
+
+	if from < s.logger.Offset() {
+		if s.follower != nil {
+			s.follower.stop()
+			s.follower = nil
+		}
+		report.Discarded = s.logger.Offset() - from
+		if err := s.logger.Truncate(from); err != nil {
+			return following, err
+		}
+		s.clients = make(map[model.UUID]clientWrite)
+		if err := s.logger.read(0, func(offset uint64, logEntry model.LogEntry) bool {
+			s.record(logEntry.MetaData(), offset, logEntry.MetaData().TransactionID().Time())
+			return true
+		}); err != nil {
+			return following, err
+		}
+	}
+	s.settle(from, following == peer)
+
+	if following != "" && s.follower == nil && !s.closed.Load().(bool) {
+		s.follow(following)
+	}
+	return following, nil
+}
+
+//checksums answers a request for the checksums of the log
+func (s *Server) checksums(conn *serverConn, request model.Request) {
+	rangeSize, from, upTo, _, err := request.Checksums()
+	if err != nil || rangeSize == 0 {
+		log.Printf("Invalid checksum request: %v", err)
+		return
+	}
+	checksums, start, covered := s.logger.Checksums(rangeSize, from, upTo)
+	response := model.NewChecksumResponse(rangeSize, start, covered, checksums)
+	if err := conn.write(EncodePayload(response)); err != nil {
+		log.Println(err)
+	}
+}
+
+//fetchOnce fetches the entries the peer has beyond the local log, and
+//appends them. s.mutex is held for every entry appended, not while waiting
+//for the next.
+func (s *Server) fetchOnce(conn *serverConn, scanner *bufio.Scanner) (uint64, error) {
+	offset := s.logger.Offset()
+	if err := conn.write(EncodePayload(model.NewFetchRequest(offset))); err != nil {
+		return 0, err
+	}
+
+	var fetched uint64
+	started := false
+	for {
+		if s.ReadTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+		}
+		if !scanner.Scan() {
+			if scanner.Err() != nil {
+				return fetched, scanner.Err()
+			}
+			return fetched, fmt.Errorf("connection closed after fetching %d entries", fetched)
+		}
+
+		frame := scanner.Bytes()
+		switch {
+		case len(frame) == 0:
+			return fetched, nil
+		case erasure(frame):
+			s.mutex.Lock()
+			err := s.erasePassedOn(model.Request(frame))
+			s.mutex.Unlock()
+			if err != nil {
+				return fetched, err
+			}
+		case model.IsControl(frame):
+			if first, _, ok := model.Request(frame).OffsetRange(); ok {
+				return fetched, fmt.Errorf("the peer's log starts at offset %d, the entries from %d have expired", first, offset)
+			}
+			if next, ok := model.Request(frame).Offset(); ok {
+				s.mutex.Lock()
+				local := s.logger.Offset()
+				diverged := next < local || (!started && next != offset)
+				if !diverged {
+					s.logger.Skip(next)
+				}
+				s.mutex.Unlock()
+				if diverged {
+					return fetched, fmt.Errorf("%w, peer continues at offset %d while the local log is at %d", errDiverged, next, local)
+				}
+				started = true
+			}
+		default:
+			request := append(model.Request(nil), frame...)
+			logEntry, err := request.LogEntry()
+			if err != nil || len(logEntry) < model.MetaDataSize {
+				return fetched, fmt.Errorf("invalid write request from peer: %v", err)
+			}
+			s.mutex.Lock()
+			s.append(request, logEntry)
+			s.mutex.Unlock()
+			fetched++
+		}
+	}
+}
+
+//roundTrip sends the request and waits for a response
+func roundTrip(conn *serverConn, scanner *bufio.Scanner, request model.Request, timeout time.Duration) (model.Request, error) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	if err := conn.write(EncodePayload(request)); err != nil {
+		return nil, err
+	}
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			return append(model.Request(nil), scanner.Bytes()...), nil
+		}
+	}
+	if scanner.Err() != nil {
+		return nil, scanner.Err()
+	}
+	return nil, fmt.Errorf("connection closed")
+}
+
+//repairRoutine periodically repairs the log from the leader,
+//until the follower stops
+func (f *follower) repairRoutine() {
+	if f.server.RepairInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(f.server.RepairInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			f.repair()
+		case <-f.done:
+			return
+		}
+	}
+}
+
+//repair repairs the log from the leader and reports what was repaired
+func (f *follower) repair() {
+	report, err := f.server.Repair(f.leader)
+	if err != nil {
+		log.Printf("err repairing from '%s': %s", f.leader, err)
+		return
+	}
+	if report.Repaired() {
+		log.Printf("Repaired log: %s", report)
+	}
+}
@@ -0,0 +1,74 @@
+package dlog
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/netbrain/dlog/model"
+	. "github.com/netbrain/dlog/testdata"
+)
+
+func entries(logger *Logger) []model.LogEntry {
+	logger.Sync()
+	var logEntries []model.LogEntry
+	for logEntry := range logger.Read() {
+		logEntries = append(logEntries, logEntry)
+	}
+	return logEntries
+}
+
+func TestRepairReplacesDivergedRanges(t *testing.T) {
+	peer := startServer()
+	defer peer.Stop()
+	s := startServer()
+	defer s.Stop()
+
+	for x := 0; x < repairRangeSize+100; x++ {
+		logEntry := NewLogEntryTestData().Build()
+		peer.logger.Write(logEntry)
+		s.logger.Write(logEntry)
+	}
+	for x := 0; x < 50; x++ {
+		peer.logger.Write(NewLogEntryTestData().Build())
+		s.logger.Write(NewLogEntryTestData().Build())
+	}
+	peer.logger.Write(NewLogEntryTestData().Build())
+
+	report, err := s.Repair(peer.Address().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Compared != repairRangeSize || report.Discarded != 150 || report.Fetched != 151 {
+		t.Fatalf("unexpected report: %s", report)
+	}
+	if !reflect.DeepEqual(entries(s.logger), entries(peer.logger)) {
+		t.Fatal("expected the logs to have converged")
+	}
+
+	if report, _ := s.Repair(peer.Address().String()); report.Repaired() {
+		t.Fatalf("expected nothing to repair, got %s", report)
+	}
+}
+
+func TestFollowerRepairsDivergedLog(t *testing.T) {
+	leader := startServer()
+	defer leader.Stop()
+	leader.logger.Write(NewLogEntryTestData().Build())
+
+	follower := startServer()
+	defer follower.Stop()
+	follower.logger.Write(NewLogEntryTestData().Build())
+	follower.logger.Write(NewLogEntryTestData().Build())
+	follower.Follow(leader.Address().String())
+
+	waitForEntries(t, follower.logger, entries(leader.logger))
+}
+
+func waitForEntries(t *testing.T, logger *Logger, expected []model.LogEntry) {
+	for start := time.Now(); !reflect.DeepEqual(entries(logger), expected); time.Sleep(time.Millisecond * 10) {
+		if time.Since(start) > time.Second*3 {
+			t.Fatal("timed out waiting for the log to converge")
+		}
+	}
+}
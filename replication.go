@@ -0,0 +1,448 @@
+package dlog
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	. "github.com/netbrain/dlog/encoder"
+	"github.com/netbrain/dlog/model"
+)
+
+//followRetryInterval is how long a follower waits before reconnecting
+//to its leader
+const followRetryInterval = 500 * time.Millisecond
+
+//fetch handles a fetch request from a follower. The first request catches
+//the follower up from its offset and makes it a follower which is sent
+//every write, later requests report how far the follower has come. Writes
+//carry on while the follower is caught up, the entries erased meanwhile
+//are erased on the follower once it has caught up.
+func (s *Server) fetch(conn *serverConn, request model.Request) {
+	offset, _ := request.Offset()
+
+	s.followers.Lock()
+	if _, following := s.followers.progress[conn]; following {
+		s.followers.progress[conn] = offset
+		s.followers.changed.Broadcast()
+		s.followers.Unlock()
+		s.commit(false)
+		return
+	}
+	s.followers.catchingUp[conn] = nil
+	s.followers.Unlock()
+
+	until := func() uint64 {
+		return s.logger.Offset()
+	}
+	registered := s.catchUp(conn, offset, true, until, func() {
+		s.followers.Lock()
+		defer s.followers.Unlock()
+		requests := s.followers.catchingUp[conn]
+		delete(s.followers.catchingUp, conn)
+		queue := &subscriber{conn: conn, queue: make(chan []byte, followerQueueSize+len(requests))}
+		for _, request := range requests {
+			queue.queue <- request
+		}
+		go queue.send()
+		s.followers.queues[conn] = queue
+		s.followers.progress[conn] = offset
+		s.followers.changed.Broadcast()
+	})
+	if !registered {
+		s.followers.Lock()
+		delete(s.followers.catchingUp, conn)
+		s.followers.Unlock()
+		return
+	}
+	s.commit(false)
+}
+
+func (s *Server) removeFollower(conn *serverConn) {
+	s.followers.Lock()
+	defer s.followers.Unlock()
+	delete(s.followers.progress, conn)
+	delete(s.followers.catchingUp, conn)
+	if queue, ok := s.followers.queues[conn]; ok {
+		close(queue.queue)
+		delete(s.followers.queues, conn)
+	}
+	s.followers.changed.Broadcast()
+}
+
+//followerQueueSize is the number of requests which may be queued for a
+//follower before it is dropped
+const followerQueueSize = 1024
+
+//notifyFollowers queues the write, erase or shred request for every
+//follower, which is sent it followed by EOT so that it reports its progress.
+//A follower whose queue is full has fallen too far behind and is dropped,
+//it catches up anew once it reconnects. Erase and shred requests are kept
+//for the followers being caught up.
+func (s *Server) notifyFollowers(request model.Request) {
+	s.followers.Lock()
+	defer s.followers.Unlock()
+
+	if request.Type() == model.TypeEraseRequest || request.Type() == model.TypeShredRequest {
+		for conn, requests := range s.followers.catchingUp {
+			s.followers.catchingUp[conn] = append(requests, request)
+		}
+	}
+
+	for conn, queue := range s.followers.queues {
+		select {
+		case queue.queue <- request:
+		default:
+			log.Printf("Dropping follower %s, it is %d requests behind", conn.RemoteAddr(), len(queue.queue))
+			close(queue.queue)
+			conn.Close()
+			delete(s.followers.queues, conn)
+			delete(s.followers.progress, conn)
+			s.followers.changed.Broadcast()
+		}
+	}
+}
+
+//replicas returns the number of servers, this one included, which have
+//the entry at the offset, s.followers must be held
+func (s *Server) replicas(offset uint64) int {
+	replicas := 1
+	for _, progress := range s.followers.progress {
+		if progress > offset {
+			replicas++
+		}
+	}
+	return replicas
+}
+
+//replicated waits until a quorum of servers have the entry at the offset,
+//returning false if that does not happen within the quorum timeout
+func (s *Server) replicated(offset uint64) bool {
+	quorum := s.quorum()
+	if quorum <= 1 {
+		return true
+	}
+
+	expired := false
+	timer := time.AfterFunc(s.QuorumTimeout, func() {
+		s.followers.Lock()
+		defer s.followers.Unlock()
+		expired = true
+		s.followers.changed.Broadcast()
+	})
+	defer timer.Stop()
+
+	s.followers.Lock()
+	defer s.followers.Unlock()
+	for {
+		if s.replicas(offset) >= quorum {
+			return true
+		}
+		if expired {
+			return false
+		}
+		s.followers.changed.Wait()
+	}
+}
+
+//Follow makes the server a follower of the leader at the given address.
+//The leader's log is replicated into the server's own logger, which must
+//hold a prefix of the leader's log. Writes from clients are refused while
+//following, reads and subscriptions are served from the replicated log.
+func (s *Server) Follow(leader string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.follow(leader)
+}
+
+//follow starts following the leader afresh, s.mutex must be held. The
+//entries still waiting for a quorum are held back from subscribers, until
+//a repair from the leader either confirms or discards them, which is done
+//right away.
+func (s *Server) follow(leader string) {
+	if s.follower != nil {
+		s.follower.stop()
+	}
+	s.follower = &follower{
+		server: s,
+		leader: leader,
+		done:   make(chan struct{}),
+	}
+	go s.follower.run()
+	go s.follower.repairRoutine()
+
+	s.uncommitted.Lock()
+	defer s.uncommitted.Unlock()
+	if n := len(s.uncommitted.entries); n > 0 {
+		s.uncommitted.held = s.uncommitted.entries[n-1].offset + 1
+		go s.follower.repair()
+	}
+}
+
+//settle drops the uncommitted entries from the offset onwards, which have
+//been discarded, and passes those before it on to subscribers if the
+//leader has confirmed them. s.mutex must be held.
+func (s *Server) settle(from uint64, confirmed bool) {
+	s.uncommitted.Lock()
+	entries := s.uncommitted.entries
+	for len(entries) > 0 && entries[len(entries)-1].offset >= from {
+		entries = entries[:len(entries)-1]
+	}
+	s.uncommitted.entries = entries
+	if confirmed || len(entries) == 0 {
+		s.uncommitted.held = 0
+	}
+	s.uncommitted.Unlock()
+
+	if confirmed {
+		s.commit(true)
+	}
+}
+
+//Unfollow stops following the leader, after which the server accepts writes
+func (s *Server) Unfollow() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.follower != nil {
+		s.follower.stop()
+		s.follower = nil
+	}
+	s.uncommitted.Lock()
+	s.uncommitted.held = 0
+	s.uncommitted.Unlock()
+	s.commit(false)
+}
+
+//Leader returns the address of the leader of the cluster, which may be
+//the server itself, or outside of a cluster the address of the leader the
+//server follows. It is empty if there is no such leader.
+func (s *Server) Leader() string {
+	if c := s.clustered(); c != nil {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		return c.leader
+	}
+	return s.following()
+}
+
+//following returns the address of the leader the server follows
+func (s *Server) following() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.follower == nil {
+		return ""
+	}
+	return s.follower.leader
+}
+
+//replicate appends a write request fetched from the leader
+func (s *Server) replicate(f *follower, request model.Request) error {
+	logEntry, err := request.LogEntry()
+	if err != nil || len(logEntry) < model.MetaDataSize {
+		return fmt.Errorf("invalid write request from leader: %v", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.follower != f {
+		return errFollowerStopped
+	}
+	s.append(request, logEntry)
+	return nil
+}
+
+//skip skips the local log ahead to the offset, where the leader continues
+//after offsets which have no entry
+func (s *Server) skip(f *follower, offset uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.follower != f {
+		return errFollowerStopped
+	}
+	s.logger.Skip(offset)
+	return nil
+}
+
+//replicateErasure applies an erase or shred request passed on by the leader
+func (s *Server) replicateErasure(f *follower, request model.Request) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.follower != f {
+		return errFollowerStopped
+	}
+	return s.erasePassedOn(request)
+}
+
+//erasure returns true if the frame is an erase or shred request
+func erasure(frame []byte) bool {
+	return len(frame) > 0 && (frame[0] == model.TypeEraseRequest || frame[0] == model.TypeShredRequest)
+}
+
+//erasePassedOn erases the entries, or shreds the key, of a request passed
+//on by a peer. A log without a key store keeps the entries of the key
+//unencrypted, so they are erased instead of shredded.
+func (s *Server) erasePassedOn(request model.Request) error {
+	if request.Type() == model.TypeShredRequest {
+		key, _ := request.Key()
+		err := s.logger.Shred(key)
+		if err == ErrNoKeyStore {
+			_, err = s.logger.Erase(key)
+		}
+		return err
+	}
+
+	key, offsets, err := request.Erasure()
+	if err != nil {
+		return fmt.Errorf("invalid erase request from peer: %v", err)
+	}
+	_, err = s.logger.Erase(key, offsets...)
+	return err
+}
+
+var errFollowerStopped = fmt.Errorf("follower stopped")
+
+//follower fetches the log of a leader into the log of its server
+type follower struct {
+	server   *Server
+	leader   string
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func (f *follower) stop() {
+	f.stopOnce.Do(func() {
+		close(f.done)
+	})
+}
+
+func (f *follower) stopped() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (f *follower) run() {
+	for !f.stopped() {
+		conn, err := net.DialTimeout("tcp", f.leader, f.server.WriteTimeout)
+		if err == nil {
+			err = f.fetch(conn)
+		}
+		if f.stopped() {
+			return
+		}
+		log.Printf("err following '%s': %s", f.leader, err)
+		if errors.Is(err, errDiverged) {
+			go f.repair()
+		}
+
+		select {
+		case <-time.After(followRetryInterval):
+		case <-f.done:
+			return
+		}
+	}
+}
+
+//fetch fetches the leader's log from the local offset, and keeps on
+//receiving its writes until the connection is lost or the follower stops.
+//After every batch the progress is reported back to the leader.
+func (f *follower) fetch(netConn net.Conn) error {
+	conn := newServerConn(netConn, f.server.WriteTimeout)
+	defer conn.Close()
+	logger := f.server.logger
+
+	fetched := make(chan struct{})
+	defer close(fetched)
+	go f.heartbeat(conn, fetched)
+
+	if err := conn.write(EncodePayload(model.NewFetchRequest(logger.Offset()))); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(ScanFrameSplitFunc)
+	started := false
+	for {
+		if f.server.ReadTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(f.server.ReadTimeout))
+		}
+		if !scanner.Scan() {
+			break
+		}
+
+		frame := scanner.Bytes()
+		switch {
+		case erasure(frame):
+			if err := f.server.replicateErasure(f, model.Request(frame)); err != nil {
+				return err
+			}
+		case len(frame) == 0:
+			f.server.caughtUp(f.leader)
+			logger.Sync()
+			if err := conn.write(EncodePayload(model.NewFetchRequest(logger.Offset()))); err != nil {
+				return err
+			}
+		case model.IsControl(frame):
+			request := model.Request(frame)
+			if first, _, ok := request.OffsetRange(); ok {
+				return fmt.Errorf("the leader's log starts at offset %d, the entries from %d have expired", first, logger.Offset())
+			}
+			if offset, ok := request.Offset(); ok {
+				if offset < logger.Offset() || (!started && offset != logger.Offset()) {
+					return fmt.Errorf("%w, leader continues at offset %d while the local log is at %d", errDiverged, offset, logger.Offset())
+				}
+				if err := f.server.skip(f, offset); err != nil {
+					return err
+				}
+				started = true
+			}
+		default:
+			request := make(model.Request, len(frame))
+			copy(request, frame)
+			if err := f.server.replicate(f, request); err != nil {
+				return err
+			}
+		}
+	}
+
+	if scanner.Err() != nil {
+		return scanner.Err()
+	}
+	return io.EOF
+}
+
+//heartbeat pings the leader, keeping the connection alive while no writes
+//happen, until the fetch is over or the follower stops
+func (f *follower) heartbeat(conn *serverConn, fetched <-chan struct{}) {
+	interval := f.server.ReadTimeout / 3
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ping := EncodePayload(model.NewPingRequest())
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.write(ping); err != nil {
+				return
+			}
+		case <-fetched:
+			return
+		case <-f.done:
+			conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package dlog
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/netbrain/dlog/encoder"
+	"github.com/netbrain/dlog/model"
+	. "github.com/netbrain/dlog/testdata"
+)
+
+func newTestServer() *Server {
+	logger, err := NewLogger("")
+	if err != nil {
+		panic(err)
+	}
+	return NewServer(logger, 0)
+}
+
+func startServer() *Server {
+	s := newTestServer()
+	go s.Start()
+	return s
+}
+
+func waitForOffset(t *testing.T, logger *Logger, offset uint64) {
+	for start := time.Now(); logger.Offset() < offset; {
+		if time.Since(start) > time.Second*2 {
+			t.Fatalf("timed out at offset %d waiting for %d", logger.Offset(), offset)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func writeAndAwaitAck(t *testing.T, conn net.Conn, request model.Request) bool {
+	conn.Write(encoder.EncodePayload(request))
+	return awaitAck(t, conn)
+}
+
+//awaitAck returns true if an ack arrives on the connection within 500ms
+func awaitAck(t *testing.T, conn net.Conn) bool {
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(encoder.ScanPayloadSplitFunc)
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+	defer conn.SetReadDeadline(time.Time{})
+	for scanner.Scan() {
+		if model.Request(scanner.Bytes()).Type() == model.TypeAckRequest {
+			return true
+		}
+	}
+	return false
+}
+
+//subscribe subscribes to the server and returns a scanner of the frames
+//which follow the start of the subscription
+func subscribe(t *testing.T, conn net.Conn) *bufio.Scanner {
+	conn.Write(encoder.EncodePayload(model.NewSubscribeRequest()))
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(encoder.ScanFrameSplitFunc)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if !scanner.Scan() || !scanner.Scan() || len(scanner.Bytes()) != 0 {
+		t.Fatalf("expected the subscription to start, got %v", scanner.Err())
+	}
+	return scanner
+}
+
+func TestFollowersReplicateLeader(t *testing.T) {
+	leader := startServer()
+	defer leader.Stop()
+
+	leader.logger.Write(NewLogEntryTestData().WithPayload([]byte{0}).Build())
+	leader.logger.WriteKey([]byte("order-1"), 0, 1, NewLogEntryTestData().WithPayload([]byte{1}).Build())
+
+	followers := []*Server{startServer(), startServer()}
+	for _, follower := range followers {
+		defer follower.Stop()
+		follower.Follow(leader.Address().String())
+	}
+	for _, follower := range followers {
+		waitForOffset(t, follower.logger, 2)
+	}
+
+	conn, _ := net.Dial("tcp", leader.Address().String())
+	defer conn.Close()
+	request := NewRequestTestData().WithLogEntry(NewLogEntryTestData().WithPayload([]byte{2}).Build()).Build()
+	if !writeAndAwaitAck(t, conn, request) {
+		t.Fatal("write was not acknowledged")
+	}
+
+	leader.logger.Sync()
+	var expected []model.LogEntry
+	for logEntry := range leader.logger.Read() {
+		expected = append(expected, logEntry)
+	}
+
+	for _, follower := range followers {
+		waitForOffset(t, follower.logger, 3)
+		follower.logger.Sync()
+
+		var actual []model.LogEntry
+		for logEntry := range follower.logger.Read() {
+			actual = append(actual, logEntry)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("%v != %v", actual, expected)
+		}
+
+		if key, _, _, ok := follower.logger.Key(1); !ok || string(key) != "order-1" {
+			t.Fatalf("expected key to be replicated, got %q", key)
+		}
+	}
+}
+
+func TestWriteIsAcknowledgedOnceQuorumHasIt(t *testing.T) {
+	leader := newTestServer()
+	leader.Quorum = 2
+	leader.QuorumTimeout = time.Millisecond * 200
+	go leader.Start()
+	defer leader.Stop()
+
+	conn, _ := net.Dial("tcp", leader.Address().String())
+	defer conn.Close()
+
+	if writeAndAwaitAck(t, conn, NewRequestTestData().Build()) {
+		t.Fatal("write was acknowledged without a quorum")
+	}
+
+	follower := startServer()
+	defer follower.Stop()
+	follower.Follow(leader.Address().String())
+
+	//the write is waited for past the quorum timeout
+	if !awaitAck(t, conn) {
+		t.Fatal("write was not acknowledged once the quorum had it")
+	}
+	if !writeAndAwaitAck(t, conn, NewRequestTestData().Build()) {
+		t.Fatal("write was not acknowledged by the quorum")
+	}
+	if offset := follower.logger.Offset(); offset != 2 {
+		t.Fatalf("expected the follower to have both writes, got offset %d", offset)
+	}
+}
+
+func TestSubscribersAreNotifiedOnceQuorumHasWrite(t *testing.T) {
+	leader := newTestServer()
+	leader.Quorum = 2
+	leader.QuorumTimeout = time.Millisecond * 200
+	go leader.Start()
+	defer leader.Stop()
+
+	subscriber, _ := net.Dial("tcp", leader.Address().String())
+	defer subscriber.Close()
+	scanner := subscribe(t, subscriber)
+
+	conn, _ := net.Dial("tcp", leader.Address().String())
+	defer conn.Close()
+	logEntry := NewLogEntryTestData().Build()
+	conn.Write(encoder.EncodePayload(NewRequestTestData().WithLogEntry(logEntry).Build()))
+
+	subscriber.SetReadDeadline(time.Now().Add(time.Millisecond * 300))
+	if scanner.Scan() {
+		t.Fatalf("expected no entry without a quorum, got %v", scanner.Bytes())
+	}
+
+	follower := startServer()
+	defer follower.Stop()
+	follower.Follow(leader.Address().String())
+
+	scanner = bufio.NewScanner(subscriber)
+	scanner.Split(encoder.ScanFrameSplitFunc)
+	subscriber.SetReadDeadline(time.Now().Add(time.Second))
+	if !scanner.Scan() || !reflect.DeepEqual(model.LogEntry(scanner.Bytes()), logEntry) {
+		t.Fatalf("expected the entry once the quorum has it, got %v", scanner.Err())
+	}
+}
+
+func TestWriteWaitingForQuorumDoesNotHoldUpRequests(t *testing.T) {
+	leader := newTestServer()
+	leader.Quorum = 2
+	leader.QuorumTimeout = time.Second * 5
+	go leader.Start()
+	defer leader.Stop()
+
+	conn, _ := net.Dial("tcp", leader.Address().String())
+	defer conn.Close()
+	conn.Write(encoder.EncodePayload(NewRequestTestData().Build()))
+	conn.Write(encoder.EncodePayload(model.NewPingRequest()))
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(encoder.ScanPayloadSplitFunc)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if !scanner.Scan() || model.Request(scanner.Bytes()).Type() != model.TypePongRequest {
+		t.Fatalf("expected a pong while the write waits for the quorum, got %v", scanner.Err())
+	}
+}
+
+func TestFollowerRefusesWrites(t *testing.T) {
+	leader := startServer()
+	defer leader.Stop()
+	follower := startServer()
+	defer follower.Stop()
+	follower.Follow(leader.Address().String())
+
+	conn, _ := net.Dial("tcp", follower.Address().String())
+	defer conn.Close()
+	conn.Write(encoder.EncodePayload(NewRequestTestData().Build()))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the follower to close the connection, so the client finds the leader, got %v", err)
+	}
+	if offset := follower.logger.Offset(); offset != 0 {
+		t.Fatalf("expected the write not to be logged, got offset %d", offset)
+	}
+
+	follower.Unfollow()
+	conn, _ = net.Dial("tcp", follower.Address().String())
+	defer conn.Close()
+	if !writeAndAwaitAck(t, conn, NewRequestTestData().Build()) {
+		t.Fatal("write was not acknowledged after unfollowing")
+	}
+}
+
+func TestLeaderCatchesUpFollowerWithoutHoldingUpWrites(t *testing.T) {
+	leader := startServer()
+	defer leader.Stop()
+	payload := make([]byte, 64*1024)
+	for x := 0; x < 300; x++ {
+		leader.logger.Write(NewLogEntryTestData().WithPayload(payload).Build())
+	}
+
+	//the follower does not read while the leader writes and erases, so
+	//catching it up blocks on its connection
+	follower, _ := net.Dial("tcp", leader.Address().String())
+	defer follower.Close()
+	follower.Write(encoder.EncodePayload(model.NewFetchRequest(0)))
+	time.Sleep(time.Millisecond * 100)
+
+	conn, _ := net.Dial("tcp", leader.Address().String())
+	defer conn.Close()
+	if !writeAndAwaitAck(t, conn, NewRequestTestData().Build()) {
+		t.Fatal("expected the write to be acknowledged while the follower catches up")
+	}
+	conn.Write(encoder.EncodePayload(model.NewEraseRequest(nil, []uint64{0})))
+
+	scanner := bufio.NewScanner(follower)
+	scanner.Buffer(nil, len(payload)*2)
+	scanner.Split(encoder.ScanFrameSplitFunc)
+	follower.SetReadDeadline(time.Now().Add(time.Second * 5))
+	for scanner.Scan() {
+		if erasure(scanner.Bytes()) {
+			return
+		}
+	}
+	t.Fatalf("expected the erasure to be passed on once the follower caught up, got %v", scanner.Err())
+}
+
+func TestSlowFollowerDoesNotHoldUpOthers(t *testing.T) {
+	leader := newTestServer()
+	leader.Quorum = 2
+	go leader.Start()
+	defer leader.Stop()
+
+	//the slow follower never reads what it is passed on
+	slow, _ := net.Dial("tcp", leader.Address().String())
+	defer slow.Close()
+	slow.Write(encoder.EncodePayload(model.NewFetchRequest(0)))
+	follower := startServer()
+	defer follower.Stop()
+	follower.Follow(leader.Address().String())
+
+	conn, _ := net.Dial("tcp", leader.Address().String())
+	defer conn.Close()
+	payload := make([]byte, 32*1024)
+	for x := 0; x < 200; x++ {
+		request := NewRequestTestData().WithLogEntry(NewLogEntryTestData().WithPayload(payload).Build()).Build()
+		if !writeAndAwaitAck(t, conn, request) {
+			t.Fatalf("expected write %d to be acknowledged by the quorum of the other follower", x)
+		}
+	}
+}
+
+func TestSteppingDownHoldsUncommittedEntriesUntilDiscarded(t *testing.T) {
+	server := newTestServer()
+	server.Quorum = 2
+	server.QuorumTimeout = time.Millisecond * 100
+	go server.Start()
+	defer server.Stop()
+	subscriber, _ := net.Dial("tcp", server.Address().String())
+	defer subscriber.Close()
+	scanner := subscribe(t, subscriber)
+
+	conn, _ := net.Dial("tcp", server.Address().String())
+	defer conn.Close()
+	conn.Write(encoder.EncodePayload(NewRequestTestData().Build()))
+	waitForOffset(t, server.logger, 1)
+
+	//the new leader does not have the entry, so it is discarded
+	leader := startServer()
+	defer leader.Stop()
+	server.Follow(leader.Address().String())
+	logEntry := NewLogEntryTestData().Build()
+	leader.logger.Write(logEntry)
+
+	subscriber.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if !scanner.Scan() || !reflect.DeepEqual(model.LogEntry(scanner.Bytes()), logEntry) {
+		t.Fatalf("expected only the entry of the new leader, got %v %v", scanner.Bytes(), scanner.Err())
+	}
+}
+
+func TestSteppingDownPassesOnUncommittedEntriesOnceConfirmed(t *testing.T) {
+	server := newTestServer()
+	server.Quorum = 3
+	server.QuorumTimeout = time.Millisecond * 100
+	go server.Start()
+	defer server.Stop()
+	subscriber, _ := net.Dial("tcp", server.Address().String())
+	defer subscriber.Close()
+	scanner := subscribe(t, subscriber)
+
+	//the follower has the entry, but it falls short of the quorum
+	follower := startServer()
+	defer follower.Stop()
+	follower.Follow(server.Address().String())
+	conn, _ := net.Dial("tcp", server.Address().String())
+	defer conn.Close()
+	logEntry := NewLogEntryTestData().Build()
+	conn.Write(encoder.EncodePayload(NewRequestTestData().WithLogEntry(logEntry).Build()))
+	waitForOffset(t, follower.logger, 1)
+
+	subscriber.SetReadDeadline(time.Now().Add(time.Millisecond * 300))
+	if scanner.Scan() {
+		t.Fatalf("expected no entry without a quorum, got %v", scanner.Bytes())
+	}
+
+	//the follower takes over, and has the entry
+	follower.Unfollow()
+	server.Follow(follower.Address().String())
+
+	scanner = bufio.NewScanner(subscriber)
+	scanner.Split(encoder.ScanFrameSplitFunc)
+	subscriber.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if !scanner.Scan() || !reflect.DeepEqual(model.LogEntry(scanner.Bytes()), logEntry) {
+		t.Fatalf("expected the entry once the leader confirmed it, got %v", scanner.Err())
+	}
+}
@@ -0,0 +1,161 @@
+package dlog
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+//DefaultRetentionInterval is the default duration between the checks for
+//expired segments
+const DefaultRetentionInterval = time.Minute
+
+//RetentionPolicy decides when sealed segments of the log expire. A segment
+//expires once any of the limits expires it, but only ever the oldest
+//segments expire, and never the active one. The zero value keeps the whole
+//log forever.
+type RetentionPolicy struct {
+	//MaxAge expires segments whose last entry was written longer ago, as
+	//told by the time its transaction began
+	MaxAge time.Duration
+	//MaxSize expires the oldest segments while the segment files together
+	//take up more bytes, counting those offloaded to an object store
+	MaxSize int64
+	//MaxEntries expires segments of entries which are all this many
+	//entries or more behind the offset of the next LogEntry
+	MaxEntries uint64
+	//ArchiveDirectory, if set, is where expired segments are moved to
+	//rather than deleted, once the erased entries are purged from them
+	ArchiveDirectory string
+	//Interval is how often the Logger checks for expired segments,
+	//DefaultRetentionInterval if zero
+	Interval time.Duration
+}
+
+func (p RetentionPolicy) enabled() bool {
+	return p.MaxAge > 0 || p.MaxSize > 0 || p.MaxEntries > 0
+}
+
+//expired returns the number of segments, from the start of the list, that
+//the policy expires. next is the offset of the next LogEntry, and
+//lastWritten tells when the last entry of a sealed segment was written.
+func (p RetentionPolicy) expired(list []segment, next uint64, lastWritten func(seg segment) (time.Time, bool)) int {
+	sealed := list[:len(list)-1]
+
+	var total int64
+	sizes := make([]int64, len(list))
+	for i, seg := range list {
+		sizes[i], _, _ = seg.stat()
+		total += sizes[i]
+	}
+
+	n := 0
+	for i, seg := range sealed {
+		expired := p.MaxSize > 0 && total > p.MaxSize
+		if p.MaxEntries > 0 && next >= p.MaxEntries && list[i+1].base <= next-p.MaxEntries {
+			expired = true
+		}
+		if p.MaxAge > 0 && !expired {
+			written, ok := lastWritten(seg)
+			expired = ok && time.Since(written) > p.MaxAge
+		}
+		if !expired {
+			break
+		}
+		total -= sizes[i]
+		n++
+	}
+	return n
+}
+
+//Expire removes the sealed segments the retention policy expires, deleting
+//them or moving them to the archive directory, and returns the number of
+//segments removed. Reading from an offset of a removed segment fails with
+//an offset out of range error. The segments are taken out of the log
+//before their files are removed, so writes and reads carry on meanwhile.
+func (l *Logger) Expire() (int, error) {
+	policy := l.options.Retention
+	files, ok := l.files()
+	if !policy.enabled() || !ok {
+		return 0, nil
+	}
+
+	//segments are only taken off the start of the list while l.maintenance
+	//is held, others only start new segments at its end
+	l.maintenance.Lock()
+	defer l.maintenance.Unlock()
+	list := files.segments.snapshot()
+	n := policy.expired(list, l.Offset(), files.lastWritten)
+	if n == 0 {
+		return 0, nil
+	}
+	if policy.ArchiveDirectory != "" {
+		if err := os.MkdirAll(policy.ArchiveDirectory, 0755); err != nil {
+			return 0, err
+		}
+	}
+
+	files.segments.Lock()
+	files.segments.list = files.segments.list[n:]
+	files.segments.Unlock()
+
+	var err error
+	for i, seg := range list[:n] {
+		if policy.ArchiveDirectory != "" {
+			//erased entries are not to outlive the log in the archive
+			if _, err = l.purge(seg, list[i+1].base); err == nil {
+				err = seg.archive(policy.ArchiveDirectory)
+			}
+		} else {
+			err = seg.remove()
+		}
+		if err != nil {
+			//the segments which are left are part of the log again
+			files.segments.Lock()
+			files.segments.list = append(append([]segment(nil), list[i:n]...), files.segments.list...)
+			files.segments.Unlock()
+			n = i
+			break
+		}
+	}
+	if n == 0 {
+		return 0, err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	first := list[n].base
+	if keysErr := l.keys.rewrite(func(offset uint64) bool {
+		return offset >= first
+	}); err == nil {
+		err = keysErr
+	}
+	return n, err
+}
+
+//retentionRoutine periodically expires segments, until the Logger closes
+func (l *Logger) retentionRoutine() {
+	policy := l.options.Retention
+	if !policy.enabled() {
+		return
+	}
+	interval := policy.Interval
+	if interval <= 0 {
+		interval = DefaultRetentionInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if n, err := l.Expire(); err != nil {
+				log.Printf("err expiring segments: %s", err)
+			} else if n > 0 {
+				log.Printf("Expired %d segments, the log starts at offset %d", n, l.FirstOffset())
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
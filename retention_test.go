@@ -0,0 +1,129 @@
+package dlog
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/netbrain/dlog/model"
+	. "github.com/netbrain/dlog/testdata"
+)
+
+func TestLoggerExpiresSegmentsByEntries(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "archive")
+
+	logger, _ := NewLoggerWithOptions(dir, LoggerOptions{
+		SegmentSize: 1,
+		BlockSize:   1,
+		Retention:   RetentionPolicy{MaxEntries: 2, ArchiveDirectory: archive},
+	})
+	defer logger.Close()
+	for x := 0; x < 5; x++ {
+		logger.WriteKey([]byte{byte(x)}, 0, 1, NewLogEntryTestData().Build())
+	}
+	logger.Sync()
+
+	if n, err := logger.Expire(); err != nil || n != 3 {
+		t.Fatalf("expected 3 segments to expire, got %d: %v", n, err)
+	}
+	if first := logger.FirstOffset(); first != 3 {
+		t.Fatalf("expected the log to start at offset 3, got %d", first)
+	}
+	if n := len(entries(logger)); n != 2 {
+		t.Fatalf("expected 2 entries to be kept, got %d", n)
+	}
+	if err := logger.readAt(2, func(uint64, model.LogEntry) bool { return true }); err != ErrOffsetOutOfRange {
+		t.Fatalf("expected reading the expired offset to be out of range, got %v", err)
+	}
+	if _, _, _, ok := logger.Key(2); ok {
+		t.Fatal("expected the key of the expired entry to be gone")
+	}
+	if _, err := os.Stat(filepath.Join(archive, filepath.Base(segmentPath(dir, 0)))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoggerExpiresSegmentsBySize(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	logger, _ := NewLoggerWithOptions(dir, LoggerOptions{
+		SegmentSize: 1,
+		BlockSize:   1,
+		Retention:   RetentionPolicy{MaxSize: 1},
+	})
+	defer logger.Close()
+	for x := 0; x < 3; x++ {
+		logger.Write(NewLogEntryTestData().Build())
+	}
+	logger.Sync()
+
+	if n, err := logger.Expire(); err != nil || n != 3 {
+		t.Fatalf("expected every sealed segment to expire, got %d: %v", n, err)
+	}
+	if offset := logger.Write(NewLogEntryTestData().Build()); offset != 3 {
+		t.Fatalf("expected offset 3, got %d", offset)
+	}
+}
+
+func TestLoggerExpiresSegmentsByTimeOfLastEntry(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	logger, _ := NewLoggerWithOptions(dir, LoggerOptions{
+		SegmentSize: 1,
+		BlockSize:   1,
+		Retention:   RetentionPolicy{MaxAge: time.Hour},
+	})
+	defer logger.Close()
+	old := model.UUID(time.Now().Add(-2 * time.Hour).Unix())
+	for x := 0; x < 2; x++ {
+		logger.Write(NewLogEntryTestData().WithMetaData(NewMetaDataTestData().WithTransactionID(old).Build()).Build())
+	}
+	for x := 0; x < 2; x++ {
+		logger.Write(NewLogEntryTestData().Build())
+	}
+	logger.Sync()
+
+	//the segment files are all written just now, it is their entries which
+	//are old
+	if n, err := logger.Expire(); err != nil || n != 2 {
+		t.Fatalf("expected the 2 segments of old entries to expire, got %d: %v", n, err)
+	}
+	if first := logger.FirstOffset(); first != 2 {
+		t.Fatalf("expected the log to start at offset 2, got %d", first)
+	}
+}
+
+func TestLoggerPurgesErasedEntriesBeforeArchiving(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "archive")
+
+	logger, _ := NewLoggerWithOptions(dir, LoggerOptions{
+		SegmentSize: 1,
+		BlockSize:   1,
+		Retention:   RetentionPolicy{MaxEntries: 1, ArchiveDirectory: archive},
+	})
+	defer logger.Close()
+	logger.Write(NewLogEntryTestData().WithPayload([]byte("secret")).Build())
+	logger.Write(NewLogEntryTestData().Build())
+	logger.Sync()
+	if _, err := logger.Erase(nil, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := logger.Expire(); err != nil || n != 1 {
+		t.Fatalf("expected 1 segment to expire, got %d: %v", n, err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(archive, filepath.Base(segmentPath(dir, 0))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Fatal("expected the erased entry to be purged from the archived segment")
+	}
+}
@@ -0,0 +1,274 @@
+package dlog
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+//unsignedPayload is the payload hash of requests whose body is not signed,
+//so that segments are uploaded without being read twice
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+//S3ObjectStore keeps objects in a bucket of an object store with the S3
+//API, such as Amazon S3 or a stand-in for it like MinIO. The bucket is
+//addressed by path, as in http://localhost:9000/bucket/name, and requests
+//are signed with AWS Signature Version 4.
+type S3ObjectStore struct {
+	//Endpoint is the URL of the object store, such as
+	//https://s3.eu-west-1.amazonaws.com
+	Endpoint string
+	//Bucket is the bucket objects are kept in
+	Bucket string
+	//Prefix is prepended to the names of objects, so that the logs of
+	//several directories can share a bucket
+	Prefix string
+	//Region is the region of the bucket, us-east-1 if empty
+	Region string
+	//AccessKey and SecretKey are the credentials requests are signed with
+	AccessKey string
+	SecretKey string
+	//Client sends the requests, a client which gives up on requests after
+	//DefaultS3Timeout if nil
+	Client *http.Client
+}
+
+//DefaultS3Timeout is how long a request of a S3ObjectStore without a Client
+//may take, transferring the object included, so that a store which does
+//not answer does not hold up the log
+const DefaultS3Timeout = 5 * time.Minute
+
+var defaultS3Client = &http.Client{Timeout: DefaultS3Timeout}
+
+//NewS3ObjectStore creates a S3ObjectStore of the bucket at the endpoint,
+//which signs requests for the region with the credentials
+func NewS3ObjectStore(endpoint, bucket, region, accessKey, secretKey string) *S3ObjectStore {
+	return &S3ObjectStore{
+		Endpoint:  endpoint,
+		Bucket:    bucket,
+		Region:    region,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+	}
+}
+
+//Put implements ObjectStore
+func (s *S3ObjectStore) Put(name string, r io.Reader, size int64) error {
+	req, err := s.request("PUT", s.Prefix+name, nil, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+//Get implements ObjectStore
+func (s *S3ObjectStore) Get(name string) (io.ReadCloser, error) {
+	req, err := s.request("GET", s.Prefix+name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+//Delete implements ObjectStore
+func (s *S3ObjectStore) Delete(name string) error {
+	req, err := s.request("DELETE", s.Prefix+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req)
+	if err == ErrObjectNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+//listBucketResult is the response to a ListObjectsV2 request
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+//List implements ObjectStore, listing the objects of the prefix
+func (s *S3ObjectStore) List() ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	query := url.Values{"list-type": {"2"}, "prefix": {s.Prefix}}
+	for {
+		req, err := s.request("GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := s.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, s.Prefix)
+			objects = append(objects, ObjectInfo{name, object.Size, object.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+//request returns a signed request of the key in the bucket
+func (s *S3ObjectStore) request(method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + "/" + s.Bucket
+	if key != "" {
+		endpoint.Path += "/" + key
+	}
+	endpoint.RawPath = awsEscape(endpoint.Path, false)
+	endpoint.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, endpoint.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, time.Now().UTC())
+	return req, nil
+}
+
+//do sends the request, returning ErrObjectNotFound or an error of the
+//response if it did not succeed
+func (s *S3ObjectStore) do(req *http.Request) (*http.Response, error) {
+	client := s.Client
+	if client == nil {
+		client = defaultS3Client
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrObjectNotFound
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, res.Status, strings.TrimSpace(string(message)))
+}
+
+//sign adds the headers of AWS Signature Version 4 to the request made at
+//the time
+func (s *S3ObjectStore) sign(req *http.Request, now time.Time) {
+	date := now.Format("20060102")
+	region := s.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + unsignedPayload,
+		"x-amz-date:" + req.Header.Get("X-Amz-Date"),
+		"",
+		strings.Join(signed, ";"),
+		unsignedPayload,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+
+	scope := strings.Join([]string{date, region, "s3", "aws4_request"}, "/")
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		req.Header.Get("X-Amz-Date"),
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, strings.Join(signed, ";"), hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+//canonicalQuery encodes the query sorted by key, as it is signed
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, awsEscape(key, true)+"="+awsEscape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+//awsEscape percent-encodes every byte of s but the unreserved characters,
+//and slashes unless escapeSlash is true
+func awsEscape(s string, escapeSlash bool) string {
+	var escaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !escapeSlash {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
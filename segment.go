@@ -0,0 +1,430 @@
+package dlog
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	fb "github.com/google/flatbuffers/go"
+	. "github.com/netbrain/dlog/encoder"
+	"github.com/netbrain/dlog/model"
+)
+
+//DefaultSegmentSize is the default size in bytes a segment file grows to
+//before a new segment is started
+const DefaultSegmentSize = 64 << 20
+
+//legacyLogFile is the name of the single log file written before the log
+//was split into segments
+const legacyLogFile = "dlog.bin"
+
+//segment is a file of the entries from the offset base up to the base of
+//the next segment, in uvarint framed entries written in blocks, see
+//blockSegmentMagic. Segments written before entries could be left out of
+//the log hold consecutive entries, later ones start with offsetsMarker and
+//prefix every entry with its offset:
+//	|---------------------------------------------------------------|
+//	| Offset (64) | LogEntry                                        |
+//	|---------------------------------------------------------------|
+//
+//Segments written while the log has segment keys are encrypted, see
+//encryptedSegmentMagic. Segments written in blocks have an index of their
+//blocks, see blockIndexRecordSize. The segments of a log with a tier may
+//have been offloaded to its object store, see TieringPolicy.
+type segment struct {
+	base   uint64
+	path   string
+	format segmentFormat
+	tier   *tier
+}
+
+//offsetsMarker is the first frame of a segment whose entries are prefixed
+//by their offsets, it is shorter than any LogEntry
+var offsetsMarker = []byte("dlog.offsets")
+
+//segments are the segments of the log ordered by offset, the last one is
+//the active segment which entries are appended to
+type segments struct {
+	sync.Mutex
+	list []segment
+}
+
+func segmentPath(directory string, base uint64) string {
+	return filepath.Join(directory, fmt.Sprintf("dlog.%020d.bin", base))
+}
+
+//parseSegmentName returns the base offset of the segment file name
+func parseSegmentName(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, "dlog.") || !strings.HasSuffix(name, ".bin") {
+		return 0, false
+	}
+	base, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, "dlog."), ".bin"), 10, 64)
+	return base, err == nil
+}
+
+//listSegments returns the segments in the directory ordered by offset,
+//which are rewritten in the format. A log file written before segments
+//existed becomes the first segment, as it has the same format. The
+//segments offloaded to the tier, if any, are listed along with them.
+func listSegments(directory string, format segmentFormat, tier *tier) ([]segment, error) {
+	legacy := filepath.Join(directory, legacyLogFile)
+	if _, err := os.Stat(legacy); err == nil {
+		if err := os.Rename(legacy, segmentPath(directory, 0)); err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	var list []segment
+	for _, file := range files {
+		if base, ok := parseSegmentName(file.Name()); ok && !file.IsDir() {
+			list = append(list, segment{base, filepath.Join(directory, file.Name()), format, tier})
+		}
+	}
+	if tier != nil {
+		list = append(list, tier.segments(directory, list, format)...)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].base < list[j].base
+	})
+	return list, nil
+}
+
+//snapshot returns a copy of the list of segments
+func (s *segments) snapshot() []segment {
+	s.Lock()
+	defer s.Unlock()
+	return append([]segment(nil), s.list...)
+}
+
+//first returns the offset of the first entry of the log
+func (s *segments) first() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.list[0].base
+}
+
+//containing returns the index of the segment holding the offset,
+//or -1 if the offset is before the first segment
+func containing(list []segment, offset uint64) int {
+	return sort.Search(len(list), func(i int) bool {
+		return list[i].base > offset
+	}) - 1
+}
+
+//read calls fn with every entry of the sealed segment from the given offset,
+//until fn returns false or the segment is exhausted. It returns false if fn
+//did. A torn block at the end of the segment fails the read.
+func (seg segment) read(offset uint64, fn func(offset uint64, entry model.LogEntry) bool) (bool, error) {
+	return seg.readFrom(offset, false, fn)
+}
+
+//readActive is read of the active segment, whose last block may be torn by
+//a crash while it was written, which ends the segment
+func (seg segment) readActive(offset uint64, fn func(offset uint64, entry model.LogEntry) bool) (bool, error) {
+	return seg.readFrom(offset, true, fn)
+}
+
+func (seg segment) readFrom(offset uint64, active bool, fn func(offset uint64, entry model.LogEntry) bool) (bool, error) {
+	reader, offsets, err := seg.openAt(offset)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Split(ScanPayloadSplitFunc)
+	current := seg.base
+	for first := true; scanner.Scan(); first = false {
+		frame := scanner.Bytes()
+		if first && bytes.Equal(frame, offsetsMarker) {
+			offsets = true
+			continue
+		}
+		if offsets {
+			if len(frame) < fb.SizeUint64 {
+				return false, fmt.Errorf("invalid frame in segment %s", seg.path)
+			}
+			current = fb.GetUint64(frame)
+			frame = frame[fb.SizeUint64:]
+		}
+		if current >= offset {
+			entry := make(model.LogEntry, len(frame))
+			copy(entry, frame)
+			if !fn(current, entry) {
+				return false, nil
+			}
+		}
+		current++
+	}
+	err = scanner.Err()
+	if err == io.ErrUnexpectedEOF && !active {
+		return false, fmt.Errorf("sealed segment %s ends in a torn block", seg.path)
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	return true, nil
+}
+
+//open returns a reader of the frames of the segment
+func (seg segment) open() (io.ReadCloser, error) {
+	file, err := seg.openFile()
+	if err != nil {
+		return nil, err
+	}
+	r, err := openSegment(file, seg.format.keys, seg.base)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &segmentReader{r, file}, nil
+}
+
+//openFile opens the segment file, or the cached copy of it if the segment
+//has been offloaded
+func (seg segment) openFile() (*os.File, error) {
+	file, err := os.Open(seg.path)
+	if err == nil || !os.IsNotExist(err) || seg.tier == nil {
+		return file, err
+	}
+	return seg.tier.open(filepath.Base(seg.path))
+}
+
+//blockIndex returns the index of the blocks of the segment, or of the
+//cached copy of it if the segment has been offloaded
+func (seg segment) blockIndex() ([]blockIndexEntry, error) {
+	index, err := readBlockIndex(indexPath(seg.path))
+	if err == nil || !os.IsNotExist(err) || seg.tier == nil {
+		return index, err
+	}
+	if _, statErr := os.Stat(seg.path); statErr == nil {
+		return index, err
+	}
+	return seg.tier.index(filepath.Base(seg.path))
+}
+
+//segmentReader closes the file of a segment read through it
+type segmentReader struct {
+	io.Reader
+	file *os.File
+}
+
+func (r *segmentReader) Close() error {
+	return r.file.Close()
+}
+
+//appendable returns true if entries can be appended to the segment, which
+//is the case for a segment written in blocks or one which is empty
+func (seg segment) appendable() bool {
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return true
+	}
+	defer file.Close()
+
+	reader, err := decryptSegment(bufio.NewReader(file), seg.format.keys, seg.base)
+	if err != nil {
+		return false
+	}
+	if _, err := reader.Peek(1); err == io.EOF {
+		return true
+	}
+	_, ok, _ := readBlockHeader(reader)
+	return ok
+}
+
+//rewrite replaces the segment file with the entries keep returns true for
+func (seg segment) rewrite(keep func(offset uint64, entry model.LogEntry) bool) error {
+	return seg.replace(func(w *segmentWriter) error {
+		var werr error
+		_, err := seg.read(seg.base, func(offset uint64, entry model.LogEntry) bool {
+			if keep(offset, entry) {
+				werr = w.writeEntry(offset, entry)
+			}
+			return werr == nil
+		})
+		if err == nil {
+			err = werr
+		}
+		return err
+	})
+}
+
+//replace replaces the segment file and its index with the entries write
+//writes to the segment writer
+func (seg segment) replace(write func(w *segmentWriter) error) error {
+	tmp := seg.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	tmpIndex := indexPath(seg.path) + ".tmp"
+	index, err := os.OpenFile(tmpIndex, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	w, err := newSegmentWriter(file, index, seg.format, seg.base)
+	if err == nil {
+		_, err = w.Write(EncodePayload(offsetsMarker))
+	}
+	if err == nil {
+		err = write(w)
+	}
+	if err == nil {
+		err = w.seal()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	index.Close()
+	//a stale index is ignored, so the index is replaced first
+	if err == nil {
+		err = os.Rename(tmpIndex, indexPath(seg.path))
+	}
+	if err == nil {
+		err = os.Rename(tmp, seg.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		os.Remove(tmpIndex)
+	}
+	//the segment is on local disk again until it is offloaded again, its
+	//objects are deleted so that what was left out of it does not linger in
+	//the store
+	if err == nil && seg.tier != nil {
+		err = seg.tier.delete(filepath.Base(seg.path))
+	}
+	return err
+}
+
+//remove removes the segment file and its index, along with their objects
+//if the segment has been offloaded
+func (seg segment) remove() error {
+	if err := os.Remove(seg.path); err != nil && (seg.tier == nil || !os.IsNotExist(err)) {
+		return err
+	}
+	if err := os.Remove(indexPath(seg.path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if seg.tier != nil {
+		return seg.tier.delete(filepath.Base(seg.path))
+	}
+	return nil
+}
+
+//archive moves the segment file and its index to the directory, fetching
+//them if the segment has been offloaded
+func (seg segment) archive(directory string) error {
+	if seg.offloaded() {
+		return seg.tier.archive(filepath.Base(seg.path), directory)
+	}
+	if err := os.Rename(seg.path, filepath.Join(directory, filepath.Base(seg.path))); err != nil {
+		return err
+	}
+	index := indexPath(seg.path)
+	if err := os.Rename(index, filepath.Join(directory, filepath.Base(index))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if seg.tier != nil {
+		return seg.tier.delete(filepath.Base(seg.path))
+	}
+	return nil
+}
+
+//compact rewrites the segment without the entries keep returns false for,
+//if there are any, and returns their offsets
+func (seg segment) compact(keep func(offset uint64, entry model.LogEntry) bool) ([]uint64, error) {
+	var removed []uint64
+	_, err := seg.read(seg.base, func(offset uint64, entry model.LogEntry) bool {
+		if !keep(offset, entry) {
+			removed = append(removed, offset)
+		}
+		return true
+	})
+	if err == nil && len(removed) > 0 {
+		err = seg.rewrite(keep)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+//encodeSegmentEntry frames the entry prefixed by its offset
+func encodeSegmentEntry(offset uint64, entry model.LogEntry) []byte {
+	frame := make([]byte, fb.SizeUint64, fb.SizeUint64+len(entry))
+	fb.WriteUint64(frame, offset)
+	return EncodePayload(append(frame, entry...))
+}
+
+//stat returns the size of the segment file and when it was last written,
+//or those of its object if the segment has been offloaded. It returns
+//false if there is neither.
+func (seg segment) stat() (int64, time.Time, bool) {
+	info, err := os.Stat(seg.path)
+	if err == nil {
+		return info.Size(), info.ModTime(), true
+	}
+	if seg.tier != nil {
+		if object, ok := seg.tier.stat(filepath.Base(seg.path)); ok {
+			return object.Size, object.Modified, true
+		}
+	}
+	return 0, time.Time{}, false
+}
+
+//lastWritten returns when the transaction of the last entry of the segment
+//began, reading only the last block if the segment has an index. It returns
+//false if the segment has no entries.
+func (seg segment) lastWritten() (time.Time, bool, error) {
+	offset := seg.base
+	if index, err := seg.blockIndex(); err == nil && len(index) > 0 {
+		offset = index[len(index)-1].first
+	}
+	var written time.Time
+	found := false
+	_, err := seg.read(offset, func(_ uint64, entry model.LogEntry) bool {
+		written, found = entry.MetaData().TransactionID().Time(), true
+		return true
+	})
+	return written, found, err
+}
+
+//countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+//countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
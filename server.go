@@ -4,51 +4,173 @@ import (
 	"bufio"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	. "github.com/netbrain/dlog/encoder"
 
 	"github.com/netbrain/dlog/model"
 )
 
+const (
+	//DefaultReadTimeout is the default duration a connection may stay silent
+	//before the server considers the client dead
+	DefaultReadTimeout = 15 * time.Second
+	//DefaultWriteTimeout is the default duration a single write to a client may take
+	DefaultWriteTimeout = 5 * time.Second
+	//DefaultQuorumTimeout is the default duration a write waits to be
+	//replicated to a quorum
+	DefaultQuorumTimeout = 5 * time.Second
+	//DefaultConsistencyTimeout is the default duration a read waits for
+	//the server to catch up to the writes of the client
+	DefaultConsistencyTimeout = 5 * time.Second
+	//DefaultClientRetention is the default duration the last write of a
+	//client is remembered after it was written
+	DefaultClientRetention = time.Hour
+)
+
 //Server handles the server side functionality
 type Server struct {
 	listener    net.Listener
 	subscribers struct {
 		sync.Mutex
-		subChan chan net.Conn
-		conns   []net.Conn
+		list []*subscriber
+	}
+	//uncommitted holds the entries written which have not been replicated
+	//to a quorum yet, subscribers are notified of them once they are
+	uncommitted struct {
+		sync.Mutex
+		entries []uncommittedEntry
+		//held is the offset below which the entries wait for the leader
+		//to confirm them, they were written before the server followed it
+		held uint64
+	}
+	connections struct {
+		sync.Mutex
+		conns map[*serverConn]struct{}
+	}
+	followers struct {
+		sync.Mutex
+		changed  *sync.Cond
+		progress map[*serverConn]uint64
+		//queues hold the requests passed on to every follower, so that
+		//a slow follower does not hold up the others
+		queues map[*serverConn]*subscriber
+		//catchingUp holds the erase and shred requests passed on while
+		//a follower is caught up, which it is sent once it has caught up
+		catchingUp map[*serverConn][]model.Request
 	}
-	logger *Logger
-	closed atomic.Value
-	port   int
+	//mutex serializes writes and subscriptions, so that every subscriber
+	//receives entries in the order of their offsets
+	mutex    sync.Mutex
+	clients  map[model.UUID]clientWrite
+	//swept is when idle clients were last forgotten
+	swept    time.Time
+	follower *follower
+	cluster  atomic.Value
+	logger   *Logger
+	closed   atomic.Value
+	port     int
+
+	//repairing serializes repairs of the log
+	repairing sync.Mutex
+
+	//ReadTimeout is the maximum duration a connection may be idle before it
+	//is closed. Clients are expected to send pings well within this duration.
+	ReadTimeout time.Duration
+	//WriteTimeout is the maximum duration a write to a connection may take
+	//before the client is considered dead
+	WriteTimeout time.Duration
+	//Quorum is the number of servers, this one included, that must have a
+	//write before it is acknowledged. Followers count towards the quorum.
+	Quorum int
+	//QuorumTimeout is how long a write waits for the quorum before the
+	//delay is logged. It is waited for on, unless the server stops taking
+	//writes meanwhile.
+	QuorumTimeout time.Duration
+	//ElectionTimeout is the minimum duration a member of a cluster waits to
+	//hear from the leader before it starts an election. It is read when
+	//joining the cluster.
+	ElectionTimeout time.Duration
+	//ConsistencyTimeout is the maximum duration a read waits for the server
+	//to catch up to the offset the client requires
+	ConsistencyTimeout time.Duration
+	//RepairInterval is how often a follower compares its log with that of
+	//the leader and repairs it, zero disables the repairs. It is read when
+	//starting to follow.
+	RepairInterval time.Duration
+	//ClientRetention is how long the last write of a client is remembered
+	//to deduplicate the writes it resends. Clients resend their writes as
+	//soon as they reconnect, a client which has not written for longer is
+	//forgotten.
+	ClientRetention time.Duration
+}
+
+//uncommittedEntry is an entry waiting for the quorum, at its offset
+type uncommittedEntry struct {
+	offset   uint64
+	logEntry model.LogEntry
+}
+
+//pendingAck is a write waiting for the quorum before it is acknowledged
+type pendingAck struct {
+	clientMessageNumber uint64
+	offset              uint64
+}
+
+//ackQueueSize is the number of writes of a connection which may wait for
+//the quorum before the server stops reading further requests from it
+const ackQueueSize = 1000
+
+//clientWrite is the last write of a client
+type clientWrite struct {
+	clientMessageNumber uint64
+	offset              uint64
+	//written is when the client last wrote
+	written time.Time
 }
 
 //NewServer creates a new Server instance
 func NewServer(logger *Logger, port int) *Server {
 	s := &Server{
-		logger: logger,
-		port:   port,
-		subscribers: struct {
-			sync.Mutex
-			subChan chan net.Conn
-			conns   []net.Conn
-		}{
-			subChan: make(chan net.Conn),
-			conns:   make([]net.Conn, 0),
-		},
+		logger:             logger,
+		port:               port,
+		ReadTimeout:        DefaultReadTimeout,
+		WriteTimeout:       DefaultWriteTimeout,
+		Quorum:             1,
+		QuorumTimeout:      DefaultQuorumTimeout,
+		ElectionTimeout:    DefaultElectionTimeout,
+		ConsistencyTimeout: DefaultConsistencyTimeout,
+		RepairInterval:     DefaultRepairInterval,
+		ClientRetention:    DefaultClientRetention,
 	}
+	s.subscribers.list = make([]*subscriber, 0)
+	s.connections.conns = make(map[*serverConn]struct{})
+	s.followers.changed = sync.NewCond(&s.followers.Mutex)
+	s.followers.progress = make(map[*serverConn]uint64)
+	s.followers.catchingUp = make(map[*serverConn][]model.Request)
+	s.followers.queues = make(map[*serverConn]*subscriber)
+	s.clients = make(map[model.UUID]clientWrite)
 	s.closed.Store(false)
 
+	logger.Sync()
+	err := logger.read(0, func(offset uint64, logEntry model.LogEntry) bool {
+		s.record(logEntry.MetaData(), offset, logEntry.MetaData().TransactionID().Time())
+		return true
+	})
+	if err != nil {
+		log.Println(err)
+	}
+
 	l, e := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
 	if e != nil {
 		log.Println("listen error:", e)
 	}
 
 	s.listener = l
-	go s.subscriptionRoutine()
 	return s
 }
 
@@ -67,26 +189,67 @@ func (s *Server) listen() {
 
 		if err != nil {
 			log.Printf("Error when accepting connection: %s", err)
+			continue
 		}
-		go s.handleConnection(conn)
+		go s.handleConnection(newServerConn(conn, s.WriteTimeout))
 	}
 }
 
-func (s *Server) handleConnection(conn net.Conn) {
+func (s *Server) handleConnection(conn *serverConn) {
+	s.connections.Lock()
+	s.connections.conns[conn] = struct{}{}
+	s.connections.Unlock()
+
+	defer func() {
+		s.connections.Lock()
+		delete(s.connections.conns, conn)
+		s.connections.Unlock()
+	}()
 	defer conn.Close()
+	defer s.unsubscribe(conn)
+	defer s.removeFollower(conn)
+	acks := make(chan pendingAck, ackQueueSize)
+	defer close(acks)
+	go s.acknowledge(conn, acks)
 	scanner := bufio.NewScanner(conn)
 	scanner.Split(ScanPayloadSplitFunc)
 
-	for scanner.Scan() {
+	for {
+		if s.ReadTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+		}
+		if !scanner.Scan() {
+			break
+		}
 		request := model.Request(make([]byte, len(scanner.Bytes())))
 		copy(request, scanner.Bytes())
 		switch request.Type() {
-		case model.TypeWriteRequest:
-			s.write(request)
-		case model.TypeReplayRequest:
-			s.replay(conn)
+		case model.TypeWriteRequest, model.TypeWriteKeyRequest:
+			s.write(conn, acks, request)
+		case model.TypeReplayRequest, model.TypeReplayKeyRequest:
+			s.replay(conn, request)
 		case model.TypeSubscribeRequest:
-			s.subscribe(conn)
+			s.subscribe(conn, request)
+		case model.TypeFetchRequest:
+			s.fetch(conn, request)
+		case model.TypePingRequest:
+			s.pong(conn)
+		case model.TypeVoteRequest:
+			s.vote(conn, request)
+		case model.TypeHeartbeatRequest:
+			s.heartbeat(conn, request)
+		case model.TypeMetadataRequest:
+			s.metadata(conn)
+		case model.TypeMembershipRequest:
+			s.membership(conn, request)
+		case model.TypeChecksumRequest:
+			s.checksums(conn, request)
+		case model.TypeAwaitRequest:
+			s.await(conn, request)
+		case model.TypeEraseRequest:
+			s.erase(conn, request)
+		case model.TypeShredRequest:
+			s.shred(conn, request)
 		default:
 			log.Printf("Unknown request type: %b", request.Type())
 		}
@@ -98,53 +261,519 @@ func (s *Server) handleConnection(conn net.Conn) {
 
 }
 
-func (s *Server) write(request model.Request) {
+//write appends the entry of a write request to the log, unless it is a
+//duplicate, and queues it to be acknowledged once it is replicated
+func (s *Server) write(conn *serverConn, acks chan<- pendingAck, request model.Request) {
 	logEntry, err := request.LogEntry()
+	if err != nil || len(logEntry) < model.MetaDataSize {
+		log.Printf("Invalid write request: %v", err)
+		return
+	}
+
+	md := logEntry.MetaData()
+	s.mutex.Lock()
+	if c := s.clustered(); c != nil && !c.leading() {
+		s.mutex.Unlock()
+		//the client reconnects and finds the leader
+		log.Printf("Refusing write from %s, not the leader of the cluster", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	if s.follower != nil {
+		leader := s.follower.leader
+		s.mutex.Unlock()
+		//the client reconnects and finds the leader
+		log.Printf("Refusing write from %s while following '%s'", conn.RemoteAddr(), leader)
+		conn.Close()
+		return
+	}
+	offset, duplicate := s.duplicate(md)
+	if !duplicate {
+		offset = s.append(request, logEntry)
+	}
+	s.mutex.Unlock()
+
+	acks <- pendingAck{md.ClientMessageNumber(), offset}
+}
+
+//acknowledge acknowledges the writes of a connection in order, each once
+//it has been replicated to the quorum, so that waiting for the quorum does
+//not hold up reading the requests which follow. A write not replicated in
+//time is waited for on, unless the server no longer takes writes, in which
+//case the connection is closed so that the client resends its writes to
+//the leader.
+func (s *Server) acknowledge(conn *serverConn, acks <-chan pendingAck) {
+	dropped := false
+	for pending := range acks {
+		for !dropped && !s.replicated(pending.offset) {
+			log.Printf("Write at offset %d not replicated to a quorum of %d within %s", pending.offset, s.quorum(), s.QuorumTimeout)
+			if !s.connected(conn) {
+				dropped = true
+			} else if !s.writable() {
+				log.Printf("Closing %s, the server no longer takes writes", conn.RemoteAddr())
+				conn.Close()
+				dropped = true
+			}
+		}
+		if dropped {
+			continue
+		}
+		ack := model.NewAckRequest(pending.clientMessageNumber, pending.offset)
+		if err := conn.write(EncodePayload(ack)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+//connected returns true while the connection is handled
+func (s *Server) connected(conn *serverConn) bool {
+	s.connections.Lock()
+	defer s.connections.Unlock()
+	_, ok := s.connections.conns[conn]
+	return ok
+}
+
+//writable returns true if the server takes writes from clients, which it
+//does unless it follows a leader
+func (s *Server) writable() bool {
+	if c := s.clustered(); c != nil {
+		return c.leading()
+	}
+	return s.following() == ""
+}
+
+//append writes the entry of a write request to the log and passes it on to
+//followers, and to subscribers once it is replicated to a quorum. The
+//entries a follower replicates are passed on at once. s.mutex must be held.
+func (s *Server) append(request model.Request, logEntry model.LogEntry) uint64 {
+	var offset uint64
+	if request.Type() == model.TypeWriteKeyRequest {
+		key, _ := request.Key()
+		partition, partitions, _ := request.Partition()
+		offset = s.logger.WriteKey(key, partition, partitions, logEntry)
+	} else {
+		offset = s.logger.Write(logEntry)
+	}
+	s.record(logEntry.MetaData(), offset, time.Now())
+	s.notifyFollowers(request)
+
+	s.uncommitted.Lock()
+	s.uncommitted.entries = append(s.uncommitted.entries, uncommittedEntry{offset, logEntry})
+	s.uncommitted.Unlock()
+	s.commit(s.follower != nil)
+	return offset
+}
+
+//commit notifies subscribers of the uncommitted entries which have been
+//replicated to a quorum, in the order of their offsets, or of every one of
+//them if all is true. None are while the first is held.
+func (s *Server) commit(all bool) {
+	s.uncommitted.Lock()
+	defer s.uncommitted.Unlock()
+
+	committed := len(s.uncommitted.entries)
+	if committed > 0 && s.uncommitted.entries[0].offset < s.uncommitted.held {
+		return
+	}
+	if !all && committed > 0 {
+		quorum := s.quorum()
+		s.followers.Lock()
+		for i, entry := range s.uncommitted.entries {
+			if s.replicas(entry.offset) < quorum {
+				committed = i
+				break
+			}
+		}
+		s.followers.Unlock()
+	}
+
+	for _, entry := range s.uncommitted.entries[:committed] {
+		s.notify(entry.logEntry)
+	}
+	s.uncommitted.entries = s.uncommitted.entries[committed:]
+}
+
+//duplicate returns the offset of the last write of the client if the write
+//is a duplicate. Clients resend unacknowledged writes after reconnecting,
+//in order, so anything at or below the last seen number is a duplicate.
+func (s *Server) duplicate(md model.MetaData) (uint64, bool) {
+	last, seen := s.clients[md.ClientID()]
+	if seen && md.ClientMessageNumber() <= last.clientMessageNumber {
+		return last.offset, true
+	}
+	return 0, false
+}
+
+//record records the write for deduplication, written at the given time.
+//Now and then the clients which have not written within the client
+//retention are forgotten.
+func (s *Server) record(md model.MetaData, offset uint64, written time.Time) {
+	last, seen := s.clients[md.ClientID()]
+	if !seen || md.ClientMessageNumber() > last.clientMessageNumber {
+		s.clients[md.ClientID()] = clientWrite{md.ClientMessageNumber(), offset, written}
+	}
+
+	if written.Sub(s.swept) < s.ClientRetention/2 {
+		return
+	}
+	for clientID, last := range s.clients {
+		if written.Sub(last.written) > s.ClientRetention {
+			delete(s.clients, clientID)
+		}
+	}
+	s.swept = written
+}
+
+//replay sends the whole log, the log from an offset or only the entries
+//written with a key, followed by EOT. Replaying from an offset which has
+//expired, or expires while it is replayed, is answered with an out of range
+//response instead.
+func (s *Server) replay(conn *serverConn, request model.Request) {
+	s.logger.Sync()
+	var err error
+	if request.Type() == model.TypeReplayKeyRequest {
+		key, _ := request.Key()
+		for logEntry := range s.logger.ReadKey(key) {
+			if err == nil {
+				err = conn.write(EncodePayload(logEntry))
+			}
+		}
+	} else if from, ok := request.Offset(); ok {
+		readErr := s.logger.readAt(from, func(_ uint64, logEntry model.LogEntry) bool {
+			err = conn.write(EncodePayload(logEntry))
+			return err == nil
+		})
+		if readErr == ErrOffsetOutOfRange {
+			s.outOfRange(conn)
+			return
+		}
+		if err == nil {
+			err = readErr
+		}
+	} else {
+		for logEntry := range s.logger.Read() {
+			if err == nil {
+				err = conn.write(EncodePayload(logEntry))
+			}
+		}
+	}
 	if err != nil {
 		log.Println(err)
+		conn.Close()
+		return
 	}
+	conn.write(EOT)
+}
 
-	s.logger.Write(logEntry)
-	s.notify(logEntry)
+//await waits until the log has every entry before the offset of the
+//request readable, or the consistency timeout expires, and answers with
+//the offset following the last readable entry so that the client knows
+//whether it has caught up
+func (s *Server) await(conn *serverConn, request model.Request) {
+	offset, _ := request.Offset()
+	if !s.logger.Await(offset, s.ConsistencyTimeout) {
+		log.Printf("Timed out waiting for offset %d, the log is readable up to %d", offset, s.logger.readable())
+	}
+	if err := conn.write(EncodePayload(model.NewOffsetRequest(s.logger.readable()))); err != nil {
+		log.Println(err)
+	}
 }
 
-func (s *Server) replay(conn net.Conn) {
-	for logEntry := range s.logger.Read() {
-		conn.Write(EncodePayload(logEntry))
+//erase erases entries from the log, and passes the request on to every
+//follower, answering with the number of entries erased
+func (s *Server) erase(conn *serverConn, request model.Request) {
+	key, offsets, err := request.Erasure()
+	if err != nil {
+		log.Printf("Invalid erase request: %v", err)
+		return
+	}
+
+	s.mutex.Lock()
+	if c := s.clustered(); c != nil && !c.leading() {
+		s.mutex.Unlock()
+		log.Printf("Refusing erasure from %s, not the leader of the cluster", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	if s.follower != nil {
+		leader := s.follower.leader
+		s.mutex.Unlock()
+		//the client reconnects and finds the leader
+		log.Printf("Refusing erasure from %s while following '%s'", conn.RemoteAddr(), leader)
+		conn.Close()
+		return
+	}
+	erased, err := s.logger.Erase(key, offsets...)
+	if err == nil {
+		s.notifyFollowers(request)
+	}
+	s.mutex.Unlock()
+
+	if err != nil {
+		log.Printf("err erasing entries: %s", err)
+		conn.Close()
+		return
+	}
+	log.Printf("Erased %d entries on request of %s", erased, conn.RemoteAddr())
+	if err := conn.write(EncodePayload(model.NewEraseResponse(erased))); err != nil {
+		log.Println(err)
+	}
+}
+
+//shred deletes the data key of the key of the request, and passes the
+//request on to every follower
+func (s *Server) shred(conn *serverConn, request model.Request) {
+	key, _ := request.Key()
+
+	s.mutex.Lock()
+	if c := s.clustered(); c != nil && !c.leading() {
+		s.mutex.Unlock()
+		log.Printf("Refusing to shred a key for %s, not the leader of the cluster", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	if s.follower != nil {
+		leader := s.follower.leader
+		s.mutex.Unlock()
+		//the client reconnects and finds the leader
+		log.Printf("Refusing to shred a key from %s while following '%s'", conn.RemoteAddr(), leader)
+		conn.Close()
+		return
+	}
+	err := s.logger.Shred(key)
+	if err == nil {
+		s.notifyFollowers(request)
+	}
+	s.mutex.Unlock()
+
+	if err != nil {
+		log.Printf("err shredding key %q: %s", key, err)
+		conn.Close()
+		return
+	}
+	if err := conn.write(EncodePayload(model.NewShredResponse())); err != nil {
+		log.Println(err)
 	}
-	WriteEOT(conn)
 }
 
-func (s *Server) subscriptionRoutine() {
-	for subscriber := range s.subscribers.subChan {
+func (s *Server) pong(conn *serverConn) {
+	if err := conn.write(EncodePayload(model.NewPongRequest(s.epoch()))); err != nil {
+		log.Println(err)
+	}
+}
+
+//subscribe catches the subscriber up from the requested offset, if it is
+//resuming, and then adds it to the subscribers notified of every write
+func (s *Server) subscribe(conn *serverConn, request model.Request) {
+	//the subscriber catches up to the first uncommitted entry, it is
+	//notified of that one on, once they are committed
+	until := func() uint64 {
+		if len(s.uncommitted.entries) > 0 {
+			return s.uncommitted.entries[0].offset
+		}
+		return s.logger.Offset()
+	}
+	from, resume := request.Offset()
+	if !resume {
+		from = math.MaxUint64
+	}
+	s.catchUp(conn, from, false, until, func() {
+		sub := &subscriber{conn: conn, queue: make(chan []byte, subscriberQueueSize)}
+		go sub.send()
+
 		s.subscribers.Lock()
-		s.subscribers.conns = append(s.subscribers.conns, subscriber)
-		s.subscribers.Unlock()
+		defer s.subscribers.Unlock()
+		s.subscribers.list = append(s.subscribers.list, sub)
+	})
+}
+
+//outOfRange tells the connection that the offset it reads from is not in
+//the log, by the range of offsets the log has
+func (s *Server) outOfRange(conn *serverConn) {
+	first, next := s.logger.FirstOffset(), s.logger.Offset()
+	if err := conn.write(EncodePayload(model.NewOutOfRangeResponse(first, next))); err != nil {
+		log.Println(err)
 	}
 }
 
-func (s *Server) subscribe(conn net.Conn) {
-	s.subscribers.subChan <- conn
-	select {} //block forever
+//catchUp tells the connection which offset it starts at and sends every
+//entry from it up to the offset until returns, as write requests if it is
+//a follower, followed by EOT, and calls register.
+//Offsets without an entry are skipped by telling the offset of the next
+//entry sent.
+//The entries are sent without holding s.mutex, so that writes carry on,
+//up to those written meanwhile, which are sent holding s.mutex and
+//s.uncommitted along with the call of register, so that no write is missed
+//between catching up and being notified. until is called holding them as
+//well. Should the entries have expired the connection is sent an out of
+//range response instead.
+func (s *Server) catchUp(conn *serverConn, from uint64, follower bool, until func() uint64, register func()) bool {
+	s.mutex.Lock()
+	s.uncommitted.Lock()
+	next := until()
+	s.uncommitted.Unlock()
+	s.mutex.Unlock()
+
+	if from > next {
+		from = next
+	}
+	if from < s.logger.FirstOffset() {
+		s.outOfRange(conn)
+		return false
+	}
+	err := conn.write(EncodePayload(model.NewOffsetRequest(from)))
+	expected := from
+	if err == nil {
+		err = s.sendEntries(conn, &expected, next, follower)
+	}
+	if err == nil {
+		s.mutex.Lock()
+		s.uncommitted.Lock()
+		err = s.sendEntries(conn, &expected, until(), follower)
+		if err == nil {
+			err = conn.write(EOT)
+		}
+		if err == nil {
+			register()
+		}
+		s.uncommitted.Unlock()
+		s.mutex.Unlock()
+	}
+
+	if err == ErrOffsetOutOfRange {
+		s.outOfRange(conn)
+		return false
+	}
+	if err != nil {
+		log.Println(err)
+		conn.Close()
+		return false
+	}
+	return true
+}
+
+//sendEntries sends the entries from the offset expected up to the offset
+//next, as write requests if the connection is a follower, telling the
+//offset of an entry which does not follow the one before, and of next if
+//the last entries are missing. expected is moved on to next.
+func (s *Server) sendEntries(conn *serverConn, expected *uint64, next uint64, follower bool) error {
+	if *expected >= next {
+		return nil
+	}
+	s.logger.Sync()
+	var err error
+	readErr := s.logger.readAt(*expected, func(offset uint64, logEntry model.LogEntry) bool {
+		if offset >= next {
+			return false
+		}
+		frames := [][]byte{logEntry}
+		if follower {
+			frames[0] = s.writeRequest(offset, logEntry)
+		}
+		if offset != *expected {
+			frames = append([][]byte{model.NewOffsetRequest(offset)}, frames...)
+		}
+		*expected = offset + 1
+		for _, frame := range frames {
+			if err == nil {
+				err = conn.write(EncodePayload(frame))
+			}
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	if readErr != nil {
+		return readErr
+	}
+	if *expected < next {
+		*expected = next
+		return conn.write(EncodePayload(model.NewOffsetRequest(next)))
+	}
+	return nil
+}
+
+//writeRequest recreates the write request of the entry at the offset
+func (s *Server) writeRequest(offset uint64, logEntry model.LogEntry) model.Request {
+	if key, partition, partitions, ok := s.logger.Key(offset); ok {
+		return model.NewWriteKeyRequest(partition, partitions, key, logEntry)
+	}
+	return model.NewWriteRequest(logEntry)
+}
+
+func (s *Server) unsubscribe(conn *serverConn) {
+	s.subscribers.Lock()
+	defer s.subscribers.Unlock()
+	for i, sub := range s.subscribers.list {
+		if sub.conn == conn {
+			close(sub.queue)
+			s.subscribers.list = append(s.subscribers.list[:i], s.subscribers.list[i+1:]...)
+			return
+		}
+	}
 }
 
-func (s *Server) notify(logEntries ...model.LogEntry) {
+//notify queues the entry for every subscriber. A subscriber whose queue
+//is full has fallen too far behind and is dropped, rather than holding up
+//the writes.
+func (s *Server) notify(logEntry model.LogEntry) {
 	s.subscribers.Lock()
 	defer s.subscribers.Unlock()
 
-	for _, conn := range s.subscribers.conns {
-		for _, logEntry := range logEntries {
-			conn.Write(EncodePayload(logEntry))
+	alive := s.subscribers.list[:0]
+	for _, sub := range s.subscribers.list {
+		select {
+		case sub.queue <- logEntry:
+			alive = append(alive, sub)
+		default:
+			log.Printf("Dropping subscriber %s, it is %d entries behind", sub.conn.RemoteAddr(), len(sub.queue))
+			close(sub.queue)
+			sub.conn.Close()
 		}
-		WriteEOT(conn)
 	}
+	s.subscribers.list = alive
 }
 
-//Stop stops the server
+//subscriberQueueSize is the number of entries which may be queued for a
+//subscriber before it is dropped
+const subscriberQueueSize = 1024
+
+//subscriber sends the entries queued for it to its connection, each
+//followed by EOT, until the queue is closed. Followers are sent the requests
+//passed on to them by a subscriber of their own.
+type subscriber struct {
+	conn  *serverConn
+	queue chan []byte
+}
+
+func (sub *subscriber) send() {
+	var err error
+	for frame := range sub.queue {
+		if err != nil {
+			continue
+		}
+		if err = sub.conn.write(EncodePayload(frame), EOT); err != nil {
+			log.Printf("Dropping %s: %s", sub.conn.RemoteAddr(), err)
+			sub.conn.Close()
+		}
+	}
+}
+
+//Stop stops the server and closes all client connections
 func (s *Server) Stop() {
-	close(s.subscribers.subChan)
-	s.listener.Close()
 	s.closed.Store(true)
+	s.listener.Close()
+	if c := s.clustered(); c != nil {
+		c.stop()
+	}
+	s.Unfollow()
+
+	s.connections.Lock()
+	defer s.connections.Unlock()
+	for conn := range s.connections.conns {
+		conn.Close()
+	}
 }
 
 //Address returns the servers address the server is listening on
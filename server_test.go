@@ -3,8 +3,10 @@ package dlog
 import (
 	"bufio"
 	"bytes"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
 	"time"
 
 	"github.com/netbrain/dlog/model"
@@ -84,6 +86,9 @@ func TestCanSendReplayRequest(t *testing.T) {
 	scanner.Split(encoder.ScanPayloadSplitFunc)
 	actual := 0
 	for scanner.Scan() {
+		if model.IsControl(scanner.Bytes()) {
+			continue
+		}
 		logEntry := model.LogEntry(scanner.Bytes())
 		payload := logEntry.Payload()
 		if byte(actual) != payload[0] {
@@ -101,3 +106,224 @@ func TestCanSendReplayRequest(t *testing.T) {
 	}
 
 }
+
+func TestServerRespondsToPing(t *testing.T) {
+	setup()
+	defer teardown()
+
+	conn := dial()
+	conn.Write(encoder.EncodePayload(model.NewPingRequest()))
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(encoder.ScanPayloadSplitFunc)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if !scanner.Scan() {
+		t.Fatalf("expected pong, got %v", scanner.Err())
+	}
+
+	if model.Request(scanner.Bytes()).Type() != model.TypePongRequest {
+		t.Fatalf("expected pong, got %v", scanner.Bytes())
+	}
+}
+
+func TestServerReapsSilentSubscriber(t *testing.T) {
+	logger, _ := NewLogger("")
+	server := NewServer(logger, 0)
+	server.ReadTimeout = time.Millisecond * 100
+	go server.Start()
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", server.Address().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(encoder.EncodePayload(model.NewSubscribeRequest()))
+
+	time.Sleep(time.Millisecond * 300)
+
+	server.subscribers.Lock()
+	numSubscribers := len(server.subscribers.list)
+	server.subscribers.Unlock()
+
+	if numSubscribers != 0 {
+		t.Fatalf("expected silent subscriber to be reaped, %d left", numSubscribers)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatalf("expected connection to be closed by the server, got %s", err)
+	}
+}
+
+func TestServerDropsSubscriberFallingBehind(t *testing.T) {
+	setup()
+	defer teardown()
+
+	conn := dial()
+	defer conn.Close()
+	conn.Write(encoder.EncodePayload(model.NewSubscribeRequest()))
+	for x := 0; x < 100; x++ {
+		server.subscribers.Lock()
+		subscribed := len(server.subscribers.list) == 1
+		server.subscribers.Unlock()
+		if subscribed {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	//the subscriber never reads, so its connection fills up and the entries
+	//queue up for it, which must not hold up the writes
+	payload := make([]byte, 64*1024)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for x := 0; x < subscriberQueueSize*2; x++ {
+			request := NewRequestTestData().WithLogEntry(NewLogEntryTestData().WithPayload(payload).Build()).Build()
+			logEntry, _ := request.LogEntry()
+			server.mutex.Lock()
+			server.append(request, logEntry)
+			server.mutex.Unlock()
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(server.WriteTimeout):
+		t.Fatal("expected writes not to wait for the subscriber")
+	}
+
+	server.subscribers.Lock()
+	numSubscribers := len(server.subscribers.list)
+	server.subscribers.Unlock()
+	if numSubscribers != 0 {
+		t.Fatalf("expected the subscriber to be dropped, %d left", numSubscribers)
+	}
+}
+
+func TestServerCatchesUpSubscriberWithoutHoldingUpWrites(t *testing.T) {
+	setup()
+	defer teardown()
+	payload := make([]byte, 64*1024)
+	for x := 0; x < 300; x++ {
+		logger.Write(NewLogEntryTestData().WithPayload(payload).Build())
+	}
+
+	//the subscriber never reads, so catching it up blocks on its connection
+	subscriber := dial()
+	defer subscriber.Close()
+	subscriber.Write(encoder.EncodePayload(model.NewSubscribeFromRequest(0)))
+	time.Sleep(time.Millisecond * 100)
+
+	conn := dial()
+	defer conn.Close()
+	if !writeAndAwaitAck(t, conn, NewRequestTestData().Build()) {
+		t.Fatal("expected the write to be acknowledged while the subscriber catches up")
+	}
+}
+
+func TestServerDeduplicatesWrites(t *testing.T) {
+	setup()
+	defer teardown()
+
+	conn := dial()
+	request := encoder.EncodePayload(NewRequestTestData().Build())
+	conn.Write(request)
+	conn.Write(request)
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(encoder.ScanPayloadSplitFunc)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for x := 0; x < 2; x++ {
+		if !scanner.Scan() {
+			t.Fatalf("expected ack, got %v", scanner.Err())
+		}
+		if model.Request(scanner.Bytes()).Type() != model.TypeAckRequest {
+			t.Fatalf("expected ack, got %v", scanner.Bytes())
+		}
+	}
+
+	if offset := logger.Offset(); offset != 1 {
+		t.Fatalf("expected a single entry, got %d", offset)
+	}
+}
+
+func TestServerForgetsIdleClients(t *testing.T) {
+	s := &Server{clients: make(map[model.UUID]clientWrite), ClientRetention: time.Hour}
+	idle, active := model.NewUUID(), model.NewUUID()
+	now := time.Now()
+
+	s.record(model.NewMetaData(idle, 1, model.NewUUID()), 0, now)
+	s.record(model.NewMetaData(active, 1, model.NewUUID()), 1, now.Add(time.Minute*50))
+	s.record(model.NewMetaData(active, 2, model.NewUUID()), 2, now.Add(time.Minute*100))
+
+	if _, duplicate := s.duplicate(model.NewMetaData(idle, 1, model.NewUUID())); duplicate {
+		t.Fatal("expected the idle client to be forgotten")
+	}
+	if offset, duplicate := s.duplicate(model.NewMetaData(active, 2, model.NewUUID())); !duplicate || offset != 2 {
+		t.Fatalf("expected the write of the active client at offset 2 to be remembered, got %d", offset)
+	}
+}
+
+func TestServerAnswersAwaitWithReadableOffset(t *testing.T) {
+	setup()
+	defer teardown()
+	server.ConsistencyTimeout = time.Millisecond * 50
+
+	logger.Write(NewLogEntryTestData().Build())
+	logger.Sync()
+	//an entry which has been given an offset, but is not readable yet
+	logger.mutex.Lock()
+	logger.offset++
+	logger.mutex.Unlock()
+
+	conn := dial()
+	defer conn.Close()
+	conn.Write(encoder.EncodePayload(model.NewAwaitRequest(2)))
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(encoder.ScanPayloadSplitFunc)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if !scanner.Scan() {
+		t.Fatal(scanner.Err())
+	}
+	if offset, ok := model.Request(scanner.Bytes()).Offset(); !ok || offset != 1 {
+		t.Fatalf("expected the offset following the readable entry, got %d", offset)
+	}
+}
+
+func TestServerRefusesReplayOfExpiredEntries(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	logger, _ := NewLoggerWithOptions(dir, LoggerOptions{
+		SegmentSize: 1,
+		BlockSize:   1,
+		Retention:   RetentionPolicy{MaxEntries: 1},
+	})
+	s := NewServer(logger, 0)
+	go s.Start()
+	defer s.Stop()
+
+	for x := 0; x < 3; x++ {
+		logger.Write(NewLogEntryTestData().Build())
+	}
+	logger.Sync()
+	logger.Expire()
+
+	conn, _ := net.Dial("tcp", s.Address().String())
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(encoder.ScanFrameSplitFunc)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	conn.Write(encoder.EncodePayload(model.NewReplayFromRequest(0)))
+	if !scanner.Scan() {
+		t.Fatal(scanner.Err())
+	}
+	if first, next, ok := model.Request(scanner.Bytes()).OffsetRange(); !ok || first != 2 || next != 3 {
+		t.Fatalf("expected the log to range from 2 to 3, got %v", scanner.Bytes())
+	}
+
+	conn.Write(encoder.EncodePayload(model.NewReplayFromRequest(2)))
+	if !scanner.Scan() || model.IsControl(scanner.Bytes()) || len(scanner.Bytes()) == 0 {
+		t.Fatalf("expected the entry at offset 2, got %v", scanner.Bytes())
+	}
+}
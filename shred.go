@@ -0,0 +1,49 @@
+package dlog
+
+import (
+	"errors"
+	"log"
+
+	"github.com/netbrain/dlog/keystore"
+	"github.com/netbrain/dlog/model"
+)
+
+//ErrNoKeyStore is returned when shredding a key of a Logger without a
+//KeyStore
+var ErrNoKeyStore = errors.New("the log has no key store")
+
+//Shred deletes the data key of the key from the KeyStore, which makes every
+//entry written with the key before unreadable. The entries are skipped when
+//the log is read, while they stay in the segment files until they are
+//removed like any other entry. Entries written with the key afterwards are
+//encrypted with a new data key.
+func (l *Logger) Shred(key []byte) error {
+	if l.options.KeyStore == nil {
+		return ErrNoKeyStore
+	}
+	defer l.checksums.clear()
+	return l.options.KeyStore.Delete(key)
+}
+
+//decrypt decrypts the entry at the offset if it was written with a key and
+//the Logger has a KeyStore. The last return value is false if the entry can
+//not be read, such as when its key has been shredded.
+func (l *Logger) decrypt(offset uint64, entry model.LogEntry) (model.LogEntry, bool) {
+	store := l.options.KeyStore
+	if store == nil || entry.Tombstone() {
+		return entry, true
+	}
+	key, _, _, ok := l.Key(offset)
+	if !ok {
+		return entry, true
+	}
+
+	payload, err := keystore.Open(store, key, entry.Payload())
+	if err != nil {
+		if err != keystore.ErrShredded {
+			log.Printf("err decrypting entry at offset %d: %s", offset, err)
+		}
+		return nil, false
+	}
+	return model.NewLogEntry(entry.MetaData(), payload), true
+}
@@ -0,0 +1,63 @@
+package dlog
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/netbrain/dlog/keystore"
+	"github.com/netbrain/dlog/model"
+	. "github.com/netbrain/dlog/testdata"
+)
+
+func TestLoggerShredsKey(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	store, _ := keystore.NewFileKeyStore(filepath.Join(dir, "datakeys"))
+	defer store.Close()
+
+	logger, _ := NewLoggerWithOptions(dir, LoggerOptions{KeyStore: store, BlockSize: 1})
+	defer logger.Close()
+	payload := []byte("secret")
+	logger.WriteKey([]byte("a"), 0, 1, NewLogEntryTestData().WithPayload(payload).Build())
+	logger.WriteKey([]byte("b"), 0, 1, NewLogEntryTestData().WithPayload(payload).Build())
+	logger.Write(NewLogEntryTestData().WithPayload(payload).Build())
+	logger.Sync()
+
+	var stored [][]byte
+	for _, seg := range segmentsOf(logger) {
+		seg.read(seg.base, func(_ uint64, entry model.LogEntry) bool {
+			stored = append(stored, entry.Payload())
+			return true
+		})
+	}
+	if bytes.Equal(stored[0], payload) || bytes.Equal(stored[1], payload) || !bytes.Equal(stored[2], payload) {
+		t.Fatalf("expected only the entries of keys to be stored encrypted, got %q", stored)
+	}
+	for logEntry := range logger.ReadKey([]byte("a")) {
+		if !bytes.Equal(logEntry.Payload(), payload) {
+			t.Fatalf("expected the decrypted payload, got %q", logEntry.Payload())
+		}
+	}
+
+	if err := logger.Shred([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []uint64{1, 2}; !reflect.DeepEqual(offsets(logger), expected) {
+		t.Fatalf("expected offsets %v, got %v", expected, offsets(logger))
+	}
+	for range logger.ReadKey([]byte("a")) {
+		t.Fatal("expected the entries of the key to be unreadable")
+	}
+}
+
+func TestLoggerWithoutKeyStoreCanNotShred(t *testing.T) {
+	logger, _ := NewLogger("")
+	defer logger.Close()
+	if err := logger.Shred([]byte("a")); err != ErrNoKeyStore {
+		t.Fatalf("expected %v, got %v", ErrNoKeyStore, err)
+	}
+}
@@ -0,0 +1,338 @@
+package dlog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/netbrain/dlog/model"
+)
+
+//manifestFile is the name of the manifest of a snapshot, which is written
+//last so that only complete snapshots have one
+const manifestFile = "dlog.manifest"
+
+//Manifest describes a snapshot of a log, see Snapshot
+type Manifest struct {
+	//Created is when the snapshot was taken, once the log was sealed
+	Created time.Time
+	//FirstOffset and NextOffset are the offset of the first entry of the
+	//snapshot and the offset following its last entry
+	FirstOffset uint64
+	NextOffset  uint64
+	//Files are the files of the snapshot
+	Files []ManifestFile
+}
+
+//ManifestFile is a file of a snapshot, along with its checksum
+type ManifestFile struct {
+	Name string
+	Size int64
+	//SHA256 is the hex encoded SHA-256 checksum of the file
+	SHA256 string
+	//Modified is when a segment file was last written to
+	Modified time.Time
+}
+
+//ReadManifest reads the manifest of the snapshot in the directory
+func ReadManifest(directory string) (Manifest, error) {
+	var manifest Manifest
+	data, err := ioutil.ReadFile(filepath.Join(directory, manifestFile))
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("invalid manifest in '%s': %s", directory, err)
+	}
+	return manifest, nil
+}
+
+//Snapshot copies a consistent snapshot of the log to the directory, along
+//with a manifest of its files and their checksums, and returns the
+//manifest. Writes only block while the active segment is sealed, so that
+//every entry written before the call is in the snapshot. The segments are
+//copied while no segment is rewritten or removed, and offloaded segments
+//are fetched. Erased entries are purged from the segments before they are
+//copied. Encrypted segments are copied as they are, so the snapshot
+//can only be read with the segment keys of the log. Only logs kept in
+//segment files can be snapshot.
+func (l *Logger) Snapshot(directory string) (Manifest, error) {
+	var manifest Manifest
+	files, ok := l.files()
+	if !ok {
+		return manifest, fmt.Errorf("only a log kept in segment files can be snapshot")
+	}
+	if _, err := os.Stat(filepath.Join(directory, manifestFile)); err == nil {
+		return manifest, fmt.Errorf("'%s' holds a snapshot already", directory)
+	}
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return manifest, err
+	}
+
+	l.maintenance.Lock()
+	defer l.maintenance.Unlock()
+	list, keys, erasures, err := l.seal(files)
+	if err != nil {
+		return manifest, err
+	}
+	//erased entries are not to outlive the log in the snapshot
+	for i, seg := range list[:len(list)-1] {
+		if _, err := l.purge(seg, list[i+1].base); err != nil {
+			return manifest, err
+		}
+	}
+	manifest.Created = time.Now()
+	manifest.FirstOffset = list[0].base
+	manifest.NextOffset = list[len(list)-1].base
+
+	for _, seg := range list[:len(list)-1] {
+		file, err := snapshotSegment(seg, directory)
+		if err != nil {
+			return manifest, err
+		}
+		manifest.Files = append(manifest.Files, file)
+
+		index, err := os.Open(indexPath(seg.path))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return manifest, err
+		}
+		file, err = copyFile(index, filepath.Join(directory, filepath.Base(index.Name())))
+		index.Close()
+		if err != nil {
+			return manifest, err
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	for name, frames := range map[string][][]byte{"dlog.keys": keys, "dlog.erasures": erasures} {
+		path := filepath.Join(directory, name)
+		if err := writeFrames(path, frames); err != nil {
+			return manifest, err
+		}
+		file, err := checksumFile(path)
+		if err != nil {
+			return manifest, err
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Name < manifest.Files[j].Name
+	})
+
+	data, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return manifest, err
+	}
+	return manifest, writeFile(filepath.Join(directory, manifestFile), data)
+}
+
+//seal seals the active segment once every entry written has been appended
+//to it, and returns the segments then along with the records of the key
+//index and of the erasures. Writes block meanwhile.
+func (l *Logger) seal(files *FileStorage) ([]segment, [][]byte, [][]byte, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.written.L.Lock()
+	for l.flushed < l.offset {
+		l.written.Wait()
+	}
+	l.written.L.Unlock()
+
+	list, err := files.seal()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keys, err := l.keys.records()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	l.erasures.RLock()
+	records, err := l.erasures.records()
+	l.erasures.RUnlock()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	erasures := make([][]byte, len(records))
+	for i, erasure := range records {
+		erasures[i] = encodeErasure(erasure)
+	}
+	return list, keys, erasures, nil
+}
+
+//snapshotSegment copies the segment file to the directory, keeping the time
+//it was last written to
+func snapshotSegment(seg segment, directory string) (ManifestFile, error) {
+	_, modified, _ := seg.stat()
+	file, err := seg.openFile()
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	defer file.Close()
+
+	path := filepath.Join(directory, filepath.Base(seg.path))
+	copied, err := copyFile(file, path)
+	if err != nil {
+		return copied, err
+	}
+	copied.Modified = modified
+	return copied, os.Chtimes(path, modified, modified)
+}
+
+//copyFile writes what is read from r to the file of the path, and returns
+//the file along with its checksum
+func copyFile(r io.Reader, path string) (ManifestFile, error) {
+	copied := ManifestFile{Name: filepath.Base(path)}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return copied, err
+	}
+	hash := sha256.New()
+	copied.Size, err = io.Copy(io.MultiWriter(file, hash), r)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	copied.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return copied, err
+}
+
+//checksumFile returns the file of the path along with its checksum
+func checksumFile(path string) (ManifestFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	return ManifestFile{Name: filepath.Base(path), Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, err
+}
+
+//writeFile atomically replaces the file with the data
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+//RestoreOptions decides which entries of a snapshot are restored
+type RestoreOptions struct {
+	//Offset, if not zero, restores only the entries before the offset
+	Offset uint64
+	//Time, if not zero, restores only the entries before the first entry
+	//whose transaction began after the time
+	Time time.Time
+	//Logger are the options the restored log is read and truncated with,
+	//which need the SegmentKeys of a log of encrypted segments
+	Logger LoggerOptions
+}
+
+//Restore rebuilds a log in the directory from the snapshot in the
+//directory snapshot, see Snapshot, and returns the offset following the
+//last entry restored. Every file of the snapshot is checked against its
+//checksum as it is copied. The log is then truncated to the offset or time
+//of the options. The directory must not hold a log already, and the files
+//copied are removed should the restore fail.
+func Restore(snapshot, directory string, options RestoreOptions) (uint64, error) {
+	manifest, err := ReadManifest(snapshot)
+	if err != nil {
+		return 0, err
+	}
+	if holdsLog(directory) {
+		return 0, fmt.Errorf("'%s' holds a log already", directory)
+	}
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return 0, err
+	}
+
+	var copied []string
+	next, err := restore(snapshot, directory, manifest, options, &copied)
+	if err != nil {
+		for _, path := range copied {
+			os.Remove(path)
+		}
+		return 0, err
+	}
+	return next, nil
+}
+
+func restore(snapshot, directory string, manifest Manifest, options RestoreOptions, copied *[]string) (uint64, error) {
+	next := manifest.NextOffset
+	if options.Offset > 0 && options.Offset < next {
+		next = options.Offset
+	}
+	for _, file := range manifest.Files {
+		source, err := os.Open(filepath.Join(snapshot, file.Name))
+		if err != nil {
+			return 0, err
+		}
+		path := filepath.Join(directory, file.Name)
+		*copied = append(*copied, path)
+		restored, err := copyFile(source, path)
+		source.Close()
+		if err != nil {
+			return 0, err
+		}
+		if restored.Size != file.Size || restored.SHA256 != file.SHA256 {
+			return 0, fmt.Errorf("'%s' of the snapshot does not match its checksum", file.Name)
+		}
+
+		if _, ok := parseSegmentName(file.Name); !ok {
+			continue
+		}
+		if err := os.Chtimes(path, file.Modified, file.Modified); err != nil {
+			return 0, err
+		}
+	}
+	if !options.Time.IsZero() && next > manifest.FirstOffset {
+		_, err := Dump(directory, DumpOptions{SegmentKeys: options.Logger.SegmentKeys, To: next}, func(offset uint64, entry model.LogEntry) error {
+			if entry.MetaData().TransactionID().Time().After(options.Time) {
+				next = offset
+				return errDumped
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	if next >= manifest.NextOffset {
+		return next, nil
+	}
+
+	//no entry before the offset may be left out of the log
+	options.Logger.Retention = RetentionPolicy{}
+	options.Logger.Compaction = CompactionPolicy{}
+	options.Logger.Tiering = TieringPolicy{}
+	logger, err := NewLoggerWithOptions(directory, options.Logger)
+	if err != nil {
+		return 0, err
+	}
+	defer logger.Close()
+	return next, logger.Truncate(next)
+}
+
+//holdsLog returns true if the directory holds the files of a log
+func holdsLog(directory string) bool {
+	if _, err := os.Stat(filepath.Join(directory, legacyLogFile)); err == nil {
+		return true
+	}
+	list, err := listSegments(directory, segmentFormat{}, nil)
+	return err == nil && len(list) > 0
+}
@@ -0,0 +1,128 @@
+package dlog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/netbrain/dlog/model"
+	. "github.com/netbrain/dlog/testdata"
+)
+
+func TestSnapshotIsRestored(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	options := LoggerOptions{SegmentSize: 512, BlockSize: 1}
+
+	logger, _ := NewLoggerWithOptions(filepath.Join(dir, "log"), options)
+	for x := 0; x < 10; x++ {
+		logger.WriteKey([]byte(fmt.Sprint(x%2)), 0, 1, NewLogEntryTestData().WithPayload([]byte(fmt.Sprint(x))).Build())
+	}
+	logger.Erase(nil, 3)
+	manifest, err := logger.Snapshot(filepath.Join(dir, "snapshot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Write(NewLogEntryTestData().Build())
+	logger.Close()
+	if manifest.FirstOffset != 0 || manifest.NextOffset != 10 {
+		t.Fatalf("expected the snapshot to hold offsets 0 up to 10, got %d up to %d", manifest.FirstOffset, manifest.NextOffset)
+	}
+	if read, err := ReadManifest(filepath.Join(dir, "snapshot")); err != nil || len(read.Files) != len(manifest.Files) {
+		t.Fatalf("expected the manifest to be read back, got %v: %v", read, err)
+	}
+
+	next, err := Restore(filepath.Join(dir, "snapshot"), filepath.Join(dir, "restored"), RestoreOptions{})
+	if err != nil || next != 10 {
+		t.Fatalf("expected the entries up to offset 10 to be restored, got %d: %v", next, err)
+	}
+	restored, _ := NewLoggerWithOptions(filepath.Join(dir, "restored"), options)
+	if offset := restored.Offset(); offset != 10 {
+		t.Fatalf("expected the restored log to continue at offset 10, got %d", offset)
+	}
+	if n := len(entries(restored)); n != 9 {
+		t.Fatalf("expected the 9 entries which were not erased, got %d", n)
+	}
+	n := 0
+	for range restored.ReadKey([]byte("0")) {
+		n++
+	}
+	if n != 5 {
+		t.Fatalf("expected the 5 entries of the key, got %d", n)
+	}
+	restored.Close()
+
+	if _, err := Restore(filepath.Join(dir, "snapshot"), filepath.Join(dir, "restored"), RestoreOptions{}); err == nil {
+		t.Fatal("expected a directory holding a log not to be restored to")
+	}
+
+	for _, c := range []struct {
+		options RestoreOptions
+		next    uint64
+	}{
+		{RestoreOptions{Offset: 4}, 4},
+		{RestoreOptions{Time: manifest.Created}, 10},
+		{RestoreOptions{Time: time.Unix(1, 0)}, 0},
+	} {
+		os.RemoveAll(filepath.Join(dir, "restored"))
+		if next, err := Restore(filepath.Join(dir, "snapshot"), filepath.Join(dir, "restored"), c.options); err != nil || next != c.next {
+			t.Fatalf("expected the entries up to offset %d to be restored, got %d: %v", c.next, next, err)
+		}
+		restored, _ := NewLogger(filepath.Join(dir, "restored"))
+		if offset := restored.Offset(); offset != c.next {
+			t.Fatalf("expected the restored log to continue at offset %d, got %d", c.next, offset)
+		}
+		restored.Close()
+	}
+}
+
+func TestRestoreTruncatesAtFirstEntryAfterTime(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+
+	logger, _ := NewLoggerWithOptions(filepath.Join(dir, "log"), LoggerOptions{SegmentSize: 1 << 20, BlockSize: 1})
+	began := time.Now().Add(-10 * time.Hour).Truncate(time.Second)
+	for x := 0; x < 10; x++ {
+		id := model.UUID(began.Add(time.Duration(x) * time.Hour).Unix())
+		logger.Write(NewLogEntryTestData().WithMetaData(NewMetaDataTestData().WithTransactionID(id).Build()).Build())
+	}
+	if _, err := logger.Snapshot(filepath.Join(dir, "snapshot")); err != nil {
+		t.Fatal(err)
+	}
+	logger.Close()
+
+	next, err := Restore(filepath.Join(dir, "snapshot"), filepath.Join(dir, "restored"), RestoreOptions{Time: began.Add(4 * time.Hour)})
+	if err != nil || next != 5 {
+		t.Fatalf("expected the entries up to the one which began after the time to be restored, got %d: %v", next, err)
+	}
+	restored, _ := NewLogger(filepath.Join(dir, "restored"))
+	defer restored.Close()
+	if n := len(entries(restored)); n != 5 {
+		t.Fatalf("expected 5 entries, got %d", n)
+	}
+}
+
+func TestRestoreRefusesCorruptSnapshot(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+
+	logger, _ := NewLoggerWithOptions(filepath.Join(dir, "log"), LoggerOptions{BlockSize: 1})
+	logger.Write(NewLogEntryTestData().Build())
+	manifest, _ := logger.Snapshot(filepath.Join(dir, "snapshot"))
+	logger.Close()
+
+	segment := filepath.Join(dir, "snapshot", manifest.Files[0].Name)
+	data, _ := ioutil.ReadFile(segment)
+	data[len(data)-1] ^= 0xff
+	ioutil.WriteFile(segment, data, 0644)
+
+	if _, err := Restore(filepath.Join(dir, "snapshot"), filepath.Join(dir, "restored"), RestoreOptions{}); err == nil {
+		t.Fatal("expected the corrupt snapshot not to be restored")
+	}
+	if holdsLog(filepath.Join(dir, "restored")) {
+		t.Fatal("expected the files of the failed restore to be removed")
+	}
+}
@@ -0,0 +1,129 @@
+package dlog
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/netbrain/dlog/model"
+)
+
+//ErrOffsetOutOfRange is returned when reading from an offset before the
+//first entry kept, such as an offset of entries which have expired
+var ErrOffsetOutOfRange = errors.New("offset out of range")
+
+//Storage keeps the entries of a log in the order of their offsets. The
+//Logger appends entries and syncs them from a single routine, while they
+//are read concurrently. Retention, compaction and purging rewrite the
+//segments of a FileStorage, and leave other storages as they are.
+type Storage interface {
+	//Offsets returns the offset of the first entry kept and the offset
+	//following the last entry appended
+	Offsets() (first, next uint64)
+	//Append appends the entry at the offset, which follows the offsets of
+	//the entries appended before. The entry need not be readable until
+	//the next Sync.
+	Append(offset uint64, entry model.LogEntry) error
+	//Sync makes every entry appended readable. next is the offset the next
+	//entry will be appended at, which is ahead of the last entry appended
+	//if offsets have been skipped.
+	Sync(next uint64) error
+	//ReadFrom calls fn with every entry from the offset onwards, in the
+	//order of their offsets, until fn returns false or the entries are
+	//exhausted. Should the offset be before the first entry kept, or the
+	//entries expire before they are read, ErrOffsetOutOfRange is returned.
+	ReadFrom(offset uint64, fn func(offset uint64, entry model.LogEntry) bool) error
+	//Truncate discards every entry from the offset onwards, every entry
+	//appended has been synced. Discarding every entry kept makes the
+	//offset the first one.
+	Truncate(offset uint64) error
+	//Close closes the storage after the last Sync
+	Close() error
+}
+
+//MemoryStorage keeps the entries of a log in memory, which suits logs that
+//need not outlive the process, such as those of tests
+type MemoryStorage struct {
+	mutex   sync.RWMutex
+	first   uint64
+	next    uint64
+	offsets []uint64
+	entries []model.LogEntry
+	//pending are the entries appended since the last Sync
+	pending []pendingEntry
+}
+
+//NewMemoryStorage creates an empty MemoryStorage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+//Offsets implements Storage
+func (m *MemoryStorage) Offsets() (first, next uint64) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.first, m.next
+}
+
+//Append implements Storage
+func (m *MemoryStorage) Append(offset uint64, entry model.LogEntry) error {
+	m.pending = append(m.pending, pendingEntry{offset, entry})
+	return nil
+}
+
+//Sync implements Storage
+func (m *MemoryStorage) Sync(next uint64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, pending := range m.pending {
+		m.offsets = append(m.offsets, pending.offset)
+		m.entries = append(m.entries, pending.entry)
+	}
+	m.pending = m.pending[:0]
+	if next > m.next {
+		m.next = next
+	}
+	return nil
+}
+
+//ReadFrom implements Storage
+func (m *MemoryStorage) ReadFrom(offset uint64, fn func(offset uint64, entry model.LogEntry) bool) error {
+	m.mutex.RLock()
+	if offset < m.first {
+		m.mutex.RUnlock()
+		return ErrOffsetOutOfRange
+	}
+	i := sort.Search(len(m.offsets), func(i int) bool {
+		return m.offsets[i] >= offset
+	})
+	offsets, entries := m.offsets[i:], m.entries[i:]
+	m.mutex.RUnlock()
+
+	for i, offset := range offsets {
+		if !fn(offset, entries[i]) {
+			return nil
+		}
+	}
+	return nil
+}
+
+//Truncate implements Storage
+func (m *MemoryStorage) Truncate(offset uint64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	i := sort.Search(len(m.offsets), func(i int) bool {
+		return m.offsets[i] >= offset
+	})
+	//readers may still hold the slices, so they are not appended to again
+	m.offsets, m.entries = m.offsets[:i:i], m.entries[:i:i]
+	m.next = offset
+	if offset < m.first {
+		m.first = offset
+	}
+	return nil
+}
+
+//Close implements Storage
+func (m *MemoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,177 @@
+package dlog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/netbrain/dlog/model"
+	. "github.com/netbrain/dlog/testdata"
+)
+
+//stored returns the offsets and payloads of the entries of the storage
+//from the offset
+func stored(t *testing.T, storage Storage, offset uint64) map[uint64]string {
+	payloads := make(map[uint64]string)
+	err := storage.ReadFrom(offset, func(offset uint64, entry model.LogEntry) bool {
+		payloads[offset] = string(entry.Payload())
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payloads
+}
+
+func TestStoragesKeepEntries(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	files, err := NewFileStorage(dir, LoggerOptions{SegmentSize: 1, BlockSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, storage := range []Storage{NewMemoryStorage(), files} {
+		for _, offset := range []uint64{0, 1, 2, 5} {
+			storage.Append(offset, NewLogEntryTestData().WithPayload([]byte(fmt.Sprint(offset))).Build())
+			storage.Sync(offset + 1)
+		}
+		storage.Sync(7)
+
+		if first, next := storage.Offsets(); first != 0 || next != 7 {
+			t.Fatalf("%T: expected offsets 0 and 7, got %d and %d", storage, first, next)
+		}
+		if payloads := stored(t, storage, 2); len(payloads) != 2 || payloads[2] != "2" || payloads[5] != "5" {
+			t.Fatalf("%T: expected the entries at offsets 2 and 5, got %v", storage, payloads)
+		}
+
+		if err := storage.Truncate(2); err != nil {
+			t.Fatal(err)
+		}
+		if first, next := storage.Offsets(); first != 0 || next != 2 {
+			t.Fatalf("%T: expected offsets 0 and 2 once truncated, got %d and %d", storage, first, next)
+		}
+		storage.Append(2, NewLogEntryTestData().WithPayload([]byte("again")).Build())
+		storage.Sync(3)
+		if payloads := stored(t, storage, 0); len(payloads) != 3 || payloads[2] != "again" {
+			t.Fatalf("%T: expected the entry appended after truncating, got %v", storage, payloads)
+		}
+		if err := storage.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, _ = NewFileStorage(dir, LoggerOptions{})
+	defer files.Close()
+	if _, next := files.Offsets(); next != 3 {
+		t.Fatalf("expected the files to continue at offset 3, got %d", next)
+	}
+}
+
+func TestLoggerWithoutDirectoryIsKeptInMemory(t *testing.T) {
+	logger, _ := NewLogger("")
+	defer logger.Close()
+	if _, ok := logger.storage.(*MemoryStorage); !ok {
+		t.Fatalf("expected the log to be kept in memory, got %T", logger.storage)
+	}
+
+	logger.WriteKey([]byte("a"), 0, 1, NewLogEntryTestData().Build())
+	logger.Write(NewLogEntryTestData().Build())
+	if erased, err := logger.Erase([]byte("a")); err != nil || erased != 1 {
+		t.Fatalf("expected the entry of the key to be erased, got %d: %v", erased, err)
+	}
+	if n := len(entries(logger)); n != 1 {
+		t.Fatalf("expected 1 entry, got %d", n)
+	}
+	if erasures, _ := logger.Erasures(); len(erasures) != 1 {
+		t.Fatalf("expected the erasure to be recorded, got %v", erasures)
+	}
+}
+
+func TestFileStorageOnlyToleratesTornActiveSegment(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	files, err := NewFileStorage(dir, LoggerOptions{SegmentSize: 1, BlockSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer files.Close()
+	for offset := uint64(0); offset < 3; offset++ {
+		files.Append(offset, NewLogEntryTestData().Build())
+		files.Sync(offset + 1)
+	}
+	files.Append(3, NewLogEntryTestData().Build())
+	files.Sync(3)
+
+	for _, base := range []uint64{0, 3} {
+		info, _ := os.Stat(segmentPath(dir, base))
+		os.Truncate(segmentPath(dir, base), info.Size()-1)
+	}
+	if err := files.ReadFrom(3, func(uint64, model.LogEntry) bool { return true }); err != nil {
+		t.Fatalf("expected the torn block of the active segment to end it, got %v", err)
+	}
+	if err := files.ReadFrom(0, func(uint64, model.LogEntry) bool { return true }); err == nil {
+		t.Fatal("expected the torn block of a sealed segment to fail the read")
+	}
+}
+
+func TestFileStorageReadsBlockOfCorruptLengthAsTorn(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	files, err := NewFileStorage(dir, LoggerOptions{BlockSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer files.Close()
+	files.Append(0, NewLogEntryTestData().Build())
+	files.Sync(1)
+
+	//the length of the block appended claims almost 4 GiB
+	file, _ := os.OpenFile(segmentPath(dir, 0), os.O_APPEND|os.O_WRONLY, 0)
+	file.Write([]byte{0xff, 0xff, 0xff, 0xf0, 1, 2, 3})
+	file.Close()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if err := files.ReadFrom(0, func(uint64, model.LogEntry) bool { return true }); err != nil {
+		t.Fatalf("expected the block to read as torn, got %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64<<20 {
+		t.Fatalf("expected the length of the block not to be allocated, %d bytes were", allocated)
+	}
+}
+
+func TestFileStorageReadsEntriesOfUnwrittenBlockFromMemory(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	logger, _ := NewLoggerWithOptions(dir, LoggerOptions{FlushInterval: time.Millisecond * 50})
+	defer logger.Close()
+
+	info, _ := os.Stat(segmentPath(dir, 0))
+	for x := 0; x < 3; x++ {
+		logger.Write(NewLogEntryTestData().WithPayload([]byte(fmt.Sprint(x))).Build())
+		logger.Sync()
+	}
+	if written, _ := os.Stat(segmentPath(dir, 0)); written.Size() != info.Size() {
+		t.Fatalf("expected the block not to be written yet, the segment grew from %d to %d bytes", info.Size(), written.Size())
+	}
+	if n := len(entries(logger)); n != 3 {
+		t.Fatalf("expected the 3 entries to be read from memory, got %d", n)
+	}
+
+	for start := time.Now(); ; time.Sleep(time.Millisecond * 10) {
+		if written, _ := os.Stat(segmentPath(dir, 0)); written.Size() > info.Size() {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("expected the block to be written once it waited the flush interval")
+		}
+	}
+	if n := len(entries(logger)); n != 3 {
+		t.Fatalf("expected the 3 entries to be read once, got %d", n)
+	}
+}
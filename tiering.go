@@ -0,0 +1,446 @@
+package dlog
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//DefaultTieringInterval is the default duration between the checks for
+//segments to offload
+const DefaultTieringInterval = time.Minute
+
+//DefaultCacheSegments is the default number of offloaded segments kept in
+//the cache once read
+const DefaultCacheSegments = 4
+
+//TieringPolicy decides when sealed segments of the log are offloaded to an
+//object store. Offloaded segments are evicted from the directory of the
+//log, and are fetched into a cache when read, so reading them is only
+//slower. The active segment is never offloaded. The zero value keeps every
+//segment on local disk.
+type TieringPolicy struct {
+	//Store is the object store segments are offloaded to
+	Store ObjectStore
+	//LocalSegments is the number of the latest sealed segments which are
+	//kept on local disk
+	LocalSegments int
+	//CacheDirectory is where offloaded segments are cached once read, the
+	//cache directory in the directory of the log if empty. It is cleared
+	//when the log is opened.
+	CacheDirectory string
+	//CacheSegments is the number of offloaded segments cached, the least
+	//recently read are evicted first. DefaultCacheSegments if zero.
+	CacheSegments int
+	//Interval is how often the Logger checks for segments to offload,
+	//DefaultTieringInterval if zero
+	Interval time.Duration
+}
+
+func (p TieringPolicy) enabled() bool {
+	return p.Store != nil
+}
+
+//tier is the object store the segments of a FileStorage are offloaded to,
+//along with the cache of the offloaded segments read
+type tier struct {
+	store         ObjectStore
+	cache         string
+	cacheSegments int
+
+	mutex sync.Mutex
+	//objects are the objects in the store by name
+	objects map[string]ObjectInfo
+	//cached are the names of the cached segments, least recently read first
+	cached []string
+}
+
+//newTier lists the objects in the store of the policy and clears the cache
+func newTier(directory string, policy TieringPolicy) (*tier, error) {
+	t := &tier{
+		store:         policy.Store,
+		cache:         policy.CacheDirectory,
+		cacheSegments: policy.CacheSegments,
+		objects:       make(map[string]ObjectInfo),
+	}
+	if t.cache == "" {
+		t.cache = filepath.Join(directory, "cache")
+	}
+	if t.cacheSegments <= 0 {
+		t.cacheSegments = DefaultCacheSegments
+	}
+	//a segment cached before may have been rewritten since
+	if err := os.RemoveAll(t.cache); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(t.cache, 0755); err != nil {
+		return nil, err
+	}
+
+	objects, err := t.store.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range objects {
+		t.objects[object.Name] = object
+	}
+	return t, nil
+}
+
+//segments returns the offloaded segments of the directory which are not in
+//the list
+func (t *tier) segments(directory string, list []segment, format segmentFormat) []segment {
+	local := make(map[uint64]bool)
+	for _, seg := range list {
+		local[seg.base] = true
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var offloaded []segment
+	for name := range t.objects {
+		if base, ok := parseSegmentName(name); ok && !local[base] {
+			offloaded = append(offloaded, segment{base, filepath.Join(directory, name), format, t})
+		}
+	}
+	return offloaded
+}
+
+//stat returns the object of the name
+func (t *tier) stat(name string) (ObjectInfo, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	object, ok := t.objects[name]
+	return object, ok
+}
+
+//put uploads the file to the store as the object of its name, it returns
+//false if there is no such file
+func (t *tier) put(path string) (bool, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	name := filepath.Base(path)
+	if err := t.store.Put(name, file, info.Size()); err != nil {
+		return false, err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.objects[name] = ObjectInfo{name, info.Size(), info.ModTime()}
+	return true, nil
+}
+
+//open opens the cached copy of the segment of the name, which is fetched
+//from the store if it is not cached
+func (t *tier) open(name string) (*os.File, error) {
+	var file *os.File
+	err := t.fetch(name, func(path string) (err error) {
+		file, err = os.Open(path)
+		return err
+	})
+	return file, err
+}
+
+//index returns the block index of the cached copy of the segment of the
+//name, which is fetched from the store if it is not cached
+func (t *tier) index(name string) ([]blockIndexEntry, error) {
+	var entries []blockIndexEntry
+	err := t.fetch(name, func(path string) (err error) {
+		entries, err = readBlockIndex(indexPath(path))
+		return err
+	})
+	return entries, err
+}
+
+//fetch calls use with the path of the cached copy of the segment of the
+//name, downloading the segment and its index if it is not cached. The
+//download does not hold up the other segments, t.mutex is only held to
+//install it in the cache and while use is called, so that the copy is not
+//evicted meanwhile. It evicts the least recently read segments beyond the
+//size of the cache.
+func (t *tier) fetch(name string, use func(path string) error) error {
+	path := filepath.Join(t.cache, name)
+	index := filepath.Base(indexPath(path))
+	for {
+		t.mutex.Lock()
+		if t.touch(name) {
+			defer t.mutex.Unlock()
+			return use(path)
+		}
+		object, ok := t.objects[name]
+		indexObject, indexed := t.objects[index]
+		t.mutex.Unlock()
+		if !ok {
+			return &os.PathError{Op: "fetch", Path: name, Err: os.ErrNotExist}
+		}
+
+		tmp, err := t.download(name)
+		if err != nil {
+			return err
+		}
+		tmpIndex := ""
+		if indexed {
+			if tmpIndex, err = t.download(index); err != nil {
+				log.Printf("err fetching the index of segment %s: %s", name, err)
+			}
+		}
+
+		t.mutex.Lock()
+		installed, err := t.install(name, object, indexObject, tmp, tmpIndex)
+		if err != nil || installed {
+			defer t.mutex.Unlock()
+			if err != nil {
+				return err
+			}
+			return use(path)
+		}
+		//the segment was rewritten while it was downloaded
+		t.mutex.Unlock()
+	}
+}
+
+//touch marks the segment of the name as the most recently read, it returns
+//false if it is not cached. t.mutex must be held.
+func (t *tier) touch(name string) bool {
+	for i, cached := range t.cached {
+		if cached == name {
+			t.cached = append(append(t.cached[:i:i], t.cached[i+1:]...), name)
+			return true
+		}
+	}
+	return false
+}
+
+//install moves the downloaded copies of the segment of the name and its
+//index into the cache, unless the segment has been cached or changed in
+//the store since the download started, in which case the copies are
+//removed. It returns false if the segment has changed. t.mutex must be
+//held.
+func (t *tier) install(name string, object, indexObject ObjectInfo, tmp, tmpIndex string) (bool, error) {
+	discard := func() {
+		os.Remove(tmp)
+		if tmpIndex != "" {
+			os.Remove(tmpIndex)
+		}
+	}
+	path := filepath.Join(t.cache, name)
+	current, ok := t.objects[name]
+	switch {
+	case !ok:
+		discard()
+		return false, &os.PathError{Op: "fetch", Path: name, Err: os.ErrNotExist}
+	case current != object || t.objects[filepath.Base(indexPath(path))] != indexObject:
+		discard()
+		return false, nil
+	case t.touch(name):
+		discard()
+		return true, nil
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		discard()
+		return false, err
+	}
+	if tmpIndex != "" {
+		if err := os.Rename(tmpIndex, indexPath(path)); err != nil {
+			log.Printf("err fetching the index of segment %s: %s", name, err)
+			os.Remove(tmpIndex)
+		}
+	}
+	t.cached = append(t.cached, name)
+	for len(t.cached) > t.cacheSegments {
+		t.evict(t.cached[0])
+	}
+	return true, nil
+}
+
+//download writes the object of the name to a temporary file in the cache,
+//and returns its path
+func (t *tier) download(name string) (string, error) {
+	object, err := t.store.Get(name)
+	if err != nil {
+		return "", err
+	}
+	defer object.Close()
+
+	file, err := ioutil.TempFile(t.cache, name+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(file, object)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+//evict removes the cached copy of the segment of the name, readers which
+//opened it before keep reading it
+func (t *tier) evict(name string) {
+	for i, cached := range t.cached {
+		if cached == name {
+			t.cached = append(t.cached[:i:i], t.cached[i+1:]...)
+			break
+		}
+	}
+	path := filepath.Join(t.cache, name)
+	for _, path := range []string{path, indexPath(path)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+	}
+}
+
+//forget evicts the cached copy of the segment of the name, once the
+//segment has been rewritten
+func (t *tier) forget(name string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.evict(name)
+}
+
+//delete deletes the segment of the name and its index from the store
+func (t *tier) delete(name string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.evict(name)
+	for _, name := range []string{name, filepath.Base(indexPath(name))} {
+		if _, ok := t.objects[name]; !ok {
+			continue
+		}
+		if err := t.store.Delete(name); err != nil {
+			return err
+		}
+		delete(t.objects, name)
+	}
+	return nil
+}
+
+//archive moves the segment of the name and its index from the store to
+//the directory
+func (t *tier) archive(name, directory string) error {
+	err := t.fetch(name, func(path string) error {
+		if err := os.Rename(path, filepath.Join(directory, name)); err != nil {
+			return err
+		}
+		index := indexPath(path)
+		if err := os.Rename(index, filepath.Join(directory, filepath.Base(index))); !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return t.delete(name)
+}
+
+//offloaded returns true if the segment is kept in the object store of its
+//tier rather than on local disk
+func (seg segment) offloaded() bool {
+	if seg.tier == nil {
+		return false
+	}
+	if _, err := os.Stat(seg.path); !os.IsNotExist(err) {
+		return false
+	}
+	_, ok := seg.tier.stat(filepath.Base(seg.path))
+	return ok
+}
+
+//offload uploads the segment and its index to the store and removes them
+//from local disk, it returns false if the segment was offloaded before
+func (seg segment) offload() (bool, error) {
+	index := indexPath(seg.path)
+	if _, err := seg.tier.put(index); err != nil {
+		return false, err
+	}
+	ok, err := seg.tier.put(seg.path)
+	if err != nil || !ok {
+		return false, err
+	}
+	seg.tier.forget(filepath.Base(seg.path))
+	if err := os.Remove(seg.path); err != nil {
+		return false, err
+	}
+	if err := os.Remove(index); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, nil
+}
+
+//Offload uploads the sealed segments the tiering policy offloads to its
+//object store, evicting them from local disk, and returns the number of
+//segments offloaded. Segments are offloaded oldest first, and reading an
+//offloaded segment fetches it back into the cache.
+func (l *Logger) Offload() (int, error) {
+	policy := l.options.Tiering
+	files, ok := l.files()
+	if !policy.enabled() || !ok {
+		return 0, nil
+	}
+
+	l.maintenance.Lock()
+	defer l.maintenance.Unlock()
+	list := files.segments.snapshot()
+	sealed := list[:len(list)-1]
+	if policy.LocalSegments >= len(sealed) {
+		return 0, nil
+	}
+
+	n := 0
+	for _, seg := range sealed[:len(sealed)-policy.LocalSegments] {
+		offloaded, err := seg.offload()
+		if err != nil {
+			return n, err
+		}
+		if offloaded {
+			n++
+		}
+	}
+	return n, nil
+}
+
+//tieringRoutine periodically offloads segments, until the Logger closes
+func (l *Logger) tieringRoutine() {
+	policy := l.options.Tiering
+	if !policy.enabled() {
+		return
+	}
+	interval := policy.Interval
+	if interval <= 0 {
+		interval = DefaultTieringInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if n, err := l.Offload(); err != nil {
+				log.Printf("err offloading segments: %s", err)
+			} else if n > 0 {
+				log.Printf("Offloaded %d segments", n)
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
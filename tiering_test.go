@@ -0,0 +1,278 @@
+package dlog
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netbrain/dlog/model"
+	. "github.com/netbrain/dlog/testdata"
+)
+
+//s3StandIn serves the objects of a bucket through the part of the S3 API
+//the S3ObjectStore uses, listing two objects a page. It refuses requests
+//not signed as the store signs them.
+func s3StandIn(t *testing.T, store *S3ObjectStore) *httptest.Server {
+	var mutex sync.Mutex
+	objects := make(map[string][]byte)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		date, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+		url := *r.URL
+		url.Host = r.Host
+		signed := &http.Request{Method: r.Method, URL: &url, Header: http.Header{}}
+		store.sign(signed, date)
+		if err != nil || signed.Header.Get("Authorization") != r.Header.Get("Authorization") {
+			http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+			return
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		bucket := "/" + store.Bucket
+		key := strings.TrimPrefix(r.URL.Path, bucket+"/")
+		switch {
+		case r.Method == "GET" && r.URL.Path == bucket:
+			var keys []string
+			for key := range objects {
+				if strings.HasPrefix(key, r.URL.Query().Get("prefix")) && key > r.URL.Query().Get("continuation-token") {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			var result listBucketResult
+			for i, key := range keys {
+				if i == 2 {
+					result.IsTruncated = true
+					result.NextContinuationToken = keys[1]
+					break
+				}
+				result.Contents = append(result.Contents, struct {
+					Key          string
+					Size         int64
+					LastModified time.Time
+				}{key, int64(len(objects[key])), time.Now()})
+			}
+			xml.NewEncoder(w).Encode(result)
+		case r.Method == "PUT":
+			objects[key], _ = ioutil.ReadAll(r.Body)
+		case r.Method == "GET":
+			object, ok := objects[key]
+			if !ok {
+				http.Error(w, "NoSuchKey", http.StatusNotFound)
+				return
+			}
+			w.Write(object)
+		case r.Method == "DELETE":
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+}
+
+func TestObjectStoresKeepObjects(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	directory, _ := NewDirectoryObjectStore(dir)
+	s3 := NewS3ObjectStore("", "bucket", "eu-west-1", "access", "secret")
+	s3.Prefix = "logs/a b/"
+	server := s3StandIn(t, s3)
+	defer server.Close()
+	s3.Endpoint = server.URL
+
+	for _, store := range []ObjectStore{directory, s3} {
+		for _, name := range []string{"a", "b", "c", "empty"} {
+			object := strings.Repeat(name, 3)
+			if name == "empty" {
+				object = ""
+			}
+			if err := store.Put(name, strings.NewReader(object), int64(len(object))); err != nil {
+				t.Fatalf("%T: %s", store, err)
+			}
+		}
+		store.Put("b", strings.NewReader("again"), 5)
+
+		object, err := store.Get("b")
+		if err != nil {
+			t.Fatalf("%T: %s", store, err)
+		}
+		read, _ := ioutil.ReadAll(object)
+		object.Close()
+		if string(read) != "again" {
+			t.Fatalf("%T: expected the object put last, got '%s'", store, read)
+		}
+
+		if err := store.Delete("a"); err != nil {
+			t.Fatalf("%T: %s", store, err)
+		}
+		if _, err := store.Get("a"); err != ErrObjectNotFound {
+			t.Fatalf("%T: expected the object to be deleted, got %v", store, err)
+		}
+		if err := store.Delete("a"); err != nil {
+			t.Fatalf("%T: expected deleting a deleted object to succeed, got %s", store, err)
+		}
+
+		objects, err := store.List()
+		if err != nil {
+			t.Fatalf("%T: %s", store, err)
+		}
+		var names []string
+		for _, object := range objects {
+			names = append(names, fmt.Sprintf("%s:%d", object.Name, object.Size))
+		}
+		sort.Strings(names)
+		if fmt.Sprint(names) != "[b:5 c:3 empty:0]" {
+			t.Fatalf("%T: expected objects b, c and empty, got %v", store, names)
+		}
+	}
+}
+
+func TestS3ObjectStoreFailsWithWrongCredentials(t *testing.T) {
+	s3 := NewS3ObjectStore("", "bucket", "", "access", "secret")
+	server := s3StandIn(t, s3)
+	defer server.Close()
+
+	wrong := NewS3ObjectStore(server.URL, "bucket", "", "access", "wrong")
+	if err := wrong.Put("a", strings.NewReader("a"), 1); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("expected the request to be refused, got %v", err)
+	}
+}
+
+func TestLoggerOffloadsSealedSegments(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	store, _ := NewDirectoryObjectStore(filepath.Join(dir, "store"))
+	options := LoggerOptions{
+		SegmentSize: 1,
+		BlockSize:   1,
+		Tiering:     TieringPolicy{Store: store, LocalSegments: 1, CacheSegments: 1},
+	}
+
+	logger, _ := NewLoggerWithOptions(filepath.Join(dir, "log"), options)
+	for x := 0; x < 5; x++ {
+		logger.Write(NewLogEntryTestData().WithPayload([]byte(fmt.Sprint(x))).Build())
+		logger.Sync()
+	}
+	list := segmentsOf(logger)
+	if n, err := logger.Offload(); err != nil || n != len(list)-2 {
+		t.Fatalf("expected %d segments to be offloaded, got %d: %v", len(list)-2, n, err)
+	}
+	for i, seg := range list {
+		if offloaded := seg.offloaded(); offloaded != (i < len(list)-2) {
+			t.Fatalf("expected all but the latest sealed and the active segment to be offloaded, segment %d is offloaded: %v", i, offloaded)
+		}
+	}
+	if n, _ := logger.Offload(); n != 0 {
+		t.Fatalf("expected no segment to be offloaded again, got %d", n)
+	}
+
+	if payload := string(readOne(t, logger, 1).Payload()); payload != "1" {
+		t.Fatalf("expected the entry at offset 1 to be fetched, got '%s'", payload)
+	}
+	if n := len(entries(logger)); n != 5 {
+		t.Fatalf("expected 5 entries, got %d", n)
+	}
+	cached, _ := filepath.Glob(filepath.Join(dir, "log", "cache", "*.bin"))
+	if len(cached) != 1 {
+		t.Fatalf("expected one segment to be cached, got %v", cached)
+	}
+	logger.Close()
+
+	options.Retention = RetentionPolicy{MaxEntries: 3}
+	logger, _ = NewLoggerWithOptions(filepath.Join(dir, "log"), options)
+	defer logger.Close()
+	if n := len(segmentsOf(logger)); n != len(list) {
+		t.Fatalf("expected the offloaded segments to be listed, got %d segments", n)
+	}
+	if payload := string(readOne(t, logger, 0).Payload()); payload != "0" {
+		t.Fatalf("expected the entry at offset 0 to be fetched, got '%s'", payload)
+	}
+
+	if n, err := logger.Expire(); err != nil || n == 0 {
+		t.Fatalf("expected segments to expire, got %d: %v", n, err)
+	}
+	if _, err := store.Get(filepath.Base(segmentPath("", 0))); err != ErrObjectNotFound {
+		t.Fatalf("expected the expired segment to be deleted from the store, got %v", err)
+	}
+	if n := len(entries(logger)); n != int(5-logger.FirstOffset()) {
+		t.Fatalf("expected the entries from offset %d, got %d", logger.FirstOffset(), n)
+	}
+
+	seg := segmentsOf(logger)[0]
+	if !seg.offloaded() {
+		t.Fatal("expected the first segment left to be offloaded")
+	}
+	logger.Erase(nil, seg.base)
+	if n, err := logger.Purge(); err != nil || n != 1 {
+		t.Fatalf("expected the erased entry to be purged, got %d: %v", n, err)
+	}
+	if _, err := store.Get(filepath.Base(seg.path)); err != ErrObjectNotFound {
+		t.Fatalf("expected the purged segment to be deleted from the store, got %v", err)
+	}
+	if n := len(entries(logger)); n != int(4-logger.FirstOffset()) {
+		t.Fatalf("expected the entries from offset %d but the erased one, got %d", logger.FirstOffset(), n)
+	}
+}
+
+//blockingStore holds up getting the object of the blocked name until it
+//is released
+type blockingStore struct {
+	ObjectStore
+	blocked  string
+	released chan struct{}
+}
+
+func (b blockingStore) Get(name string) (io.ReadCloser, error) {
+	if name == b.blocked {
+		<-b.released
+	}
+	return b.ObjectStore.Get(name)
+}
+
+func TestFetchingSegmentDoesNotHoldUpCachedSegments(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	directory, _ := NewDirectoryObjectStore(filepath.Join(dir, "store"))
+	store := blockingStore{directory, filepath.Base(segmentPath("", 0)), make(chan struct{})}
+	logger, _ := NewLoggerWithOptions(filepath.Join(dir, "log"), LoggerOptions{
+		SegmentSize: 1,
+		BlockSize:   1,
+		Tiering:     TieringPolicy{Store: store, LocalSegments: 1, CacheSegments: 2},
+	})
+	defer logger.Close()
+	defer close(store.released)
+	for x := 0; x < 4; x++ {
+		logger.Write(NewLogEntryTestData().WithPayload([]byte(fmt.Sprint(x))).Build())
+		logger.Sync()
+	}
+	if n, err := logger.Offload(); err != nil || n < 2 {
+		t.Fatalf("expected the segments of offsets 0 and 1 to be offloaded, got %d: %v", n, err)
+	}
+	readOne(t, logger, 1)
+
+	go logger.read(0, func(uint64, model.LogEntry) bool { return false })
+	time.Sleep(time.Millisecond * 50)
+	read := make(chan model.LogEntry)
+	go logger.read(1, func(_ uint64, entry model.LogEntry) bool {
+		read <- entry
+		return false
+	})
+	select {
+	case entry := <-read:
+		if payload := string(entry.Payload()); payload != "1" {
+			t.Fatalf("expected the cached entry at offset 1, got '%s'", payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the cached segment to be read while another is fetched")
+	}
+}
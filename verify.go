@@ -0,0 +1,427 @@
+package dlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	fb "github.com/google/flatbuffers/go"
+	. "github.com/netbrain/dlog/encoder"
+	"github.com/netbrain/dlog/keystore"
+	"github.com/netbrain/dlog/model"
+)
+
+//VerifyOptions configures how Verify checks a log
+type VerifyOptions struct {
+	//SegmentKeys provides the keys of the encrypted segments of the log
+	SegmentKeys keystore.KeyProvider
+	//Repair truncates every segment at its corrupt range, so that the
+	//entries before it can be read, and rewrites stale block indexes
+	Repair bool
+	//QuarantineDirectory, if set, is where the corrupt range of a segment
+	//is copied to before it is truncated
+	QuarantineDirectory string
+}
+
+//CorruptRange is the part of a segment which could not be read, from the
+//offset following the last entry which could be read up to the end of the
+//segment
+type CorruptRange struct {
+	//Segment is the path of the segment file
+	Segment string
+	//Offset is the first offset the entries of which could not be read
+	Offset uint64
+	//Position is the position in the segment file where the corrupt range
+	//starts, or -1 if the segment is a single deflate stream
+	Position int64
+	//Reason is why the range could not be read
+	Reason string
+}
+
+func (c CorruptRange) String() string {
+	return fmt.Sprintf("%s: unreadable from offset %d at byte %d: %s", c.Segment, c.Offset, c.Position, c.Reason)
+}
+
+//VerifyReport describes the log Verify checked
+type VerifyReport struct {
+	//Directory is the directory of the log
+	Directory string
+	//Segments is the number of segments checked
+	Segments int
+	//Entries is the number of entries which could be read
+	Entries uint64
+	//FirstOffset and NextOffset are the offset of the first entry and the
+	//offset following the last one
+	FirstOffset uint64
+	NextOffset  uint64
+	//Gaps is the number of offsets between them without an entry, which
+	//compaction, purging and skipped offsets leave behind
+	Gaps uint64
+	//Checksum is the CRC-32 checksum of the offsets and the entries, as
+	//the one Migrate reports
+	Checksum uint32
+	//Corrupt are the corrupt ranges found
+	Corrupt []CorruptRange
+	//StaleIndexes are the segments whose block index does not match them
+	StaleIndexes []string
+	//Repaired is true if the corrupt ranges and stale indexes were repaired
+	Repaired bool
+}
+
+func (r VerifyReport) String() string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "verified %d entries from offset %d up to %d in %d segments in '%s', %d gaps, checksum %08x",
+		r.Entries, r.FirstOffset, r.NextOffset, r.Segments, r.Directory, r.Gaps, r.Checksum)
+	for _, corrupt := range r.Corrupt {
+		fmt.Fprintf(&s, "\ncorrupt %s", corrupt)
+	}
+	for _, stale := range r.StaleIndexes {
+		fmt.Fprintf(&s, "\nstale block index of %s", stale)
+	}
+	if r.Repaired {
+		fmt.Fprint(&s, "\nrepaired")
+	}
+	return s.String()
+}
+
+//Ok returns true if no corrupt range or stale index was found
+func (r VerifyReport) Ok() bool {
+	return len(r.Corrupt) == 0 && len(r.StaleIndexes) == 0
+}
+
+//Verify checks every segment of the log in the directory, which no Logger
+//may have open. It reads every block, checking its length, its checksum,
+//its authentication tag if the segment is encrypted, and that it decodes.
+//The frames of a block must fit it, and hold entries of a MetaData at
+//least, whose offsets increase within the range of their segment. A block
+//which fails any check and the rest of its segment are reported as a
+//corrupt range, as is a torn block at the end, or the end of an encrypted
+//segment other than the last one which is not sealed by its final chunk. A
+//log file written before the log was split into segments is checked as one
+//segment, without renaming it.
+func Verify(directory string, options VerifyOptions) (VerifyReport, error) {
+	report := VerifyReport{Directory: directory}
+	format := segmentFormat{keys: options.SegmentKeys}
+	var list []segment
+	if legacy := filepath.Join(directory, legacyLogFile); fileExists(legacy) {
+		list = []segment{{path: legacy, format: format}}
+	} else {
+		var err error
+		if list, err = listSegments(directory, format, nil); err != nil {
+			return report, err
+		}
+	}
+	if options.QuarantineDirectory != "" && options.Repair {
+		if err := os.MkdirAll(options.QuarantineDirectory, 0755); err != nil {
+			return report, err
+		}
+	}
+
+	checksum := newMigrationChecksum()
+	read := false
+	add := func(offset uint64, entry model.LogEntry) error {
+		if !read {
+			report.FirstOffset = offset
+		} else {
+			report.Gaps += offset - report.NextOffset
+		}
+		read = true
+		report.NextOffset = offset + 1
+		checksum.add(offset, entry)
+		return nil
+	}
+
+	for i, seg := range list {
+		limit := uint64(math.MaxUint64)
+		if i+1 < len(list) {
+			limit = list[i+1].base
+		}
+		check, err := checkSegment(seg, limit, add)
+		if err != nil {
+			return report, err
+		}
+		report.Segments++
+		if check.corrupt != nil {
+			report.Corrupt = append(report.Corrupt, *check.corrupt)
+		}
+		if check.staleIndex {
+			report.StaleIndexes = append(report.StaleIndexes, seg.path)
+		}
+		if options.Repair {
+			if err := repairSegment(seg, limit, check, options.QuarantineDirectory); err != nil {
+				return report, err
+			}
+		}
+	}
+	report.Entries = checksum.entries
+	report.Checksum = checksum.Sum32()
+	report.Repaired = options.Repair && !report.Ok()
+	return report, nil
+}
+
+//segmentCheck is the outcome of checking a segment
+type segmentCheck struct {
+	//blocks are the blocks of entries which could be read
+	blocks []blockIndexEntry
+	//inBlocks is true if the segment is written in blocks, and encrypted
+	//if they are sealed in chunks
+	inBlocks   bool
+	encrypted  bool
+	corrupt    *CorruptRange
+	staleIndex bool
+}
+
+//checkSegment calls fn with every entry of the segment which can be read,
+//which must be before the offset limit, and returns what it found. Should
+//fn fail the check stops with its error.
+func checkSegment(seg segment, limit uint64, fn func(offset uint64, entry model.LogEntry) error) (segmentCheck, error) {
+	var check segmentCheck
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return check, err
+	}
+	defer file.Close()
+
+	next := seg.base
+	corrupt := func(position int64, format string, args ...interface{}) (segmentCheck, error) {
+		check.corrupt = &CorruptRange{seg.path, next, position, fmt.Sprintf(format, args...)}
+		return check, nil
+	}
+
+	//a segment of a key which is not provided is not corrupt
+	reader := bufio.NewReader(file)
+	if id, _, encrypted, err := readEncryptionHeader(reader); err == nil && encrypted {
+		if _, err := segmentAEAD(id, seg.format.keys); err != nil {
+			return check, fmt.Errorf("segment %s: %s", seg.path, err)
+		}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return check, err
+	}
+	reader.Reset(file)
+	source, ok, err := readSegmentHeaders(reader, seg.format.keys, seg.base)
+	if err != nil {
+		return corrupt(0, "invalid headers: %s", err)
+	}
+	if !ok {
+		return checkLegacySegment(seg, limit, fn)
+	}
+	check.inBlocks = true
+	check.encrypted = source.cipher != nil
+
+	position := source.size
+	seq := source.chunks
+	final := false
+	for first := true; ; first = false {
+		unit, err := readUnit(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return corrupt(position, "torn block")
+		}
+		if final {
+			return corrupt(position, "chunk after the final chunk")
+		}
+		block, isFinal, err := source.block(unit, seq)
+		if err == errBlockChecksum {
+			return corrupt(position, "block does not match its checksum")
+		}
+		if err != nil {
+			return corrupt(position, "block does not decode: %s", err)
+		}
+		seq++
+		if final = isFinal; final {
+			position += int64(fb.SizeUint32 + len(unit))
+			continue
+		}
+
+		var offsets []uint64
+		var entries []model.LogEntry
+		for marker := first; len(block) > 0; marker = false {
+			length, n := binary.Uvarint(block)
+			if n <= 0 || uint64(len(block)-n) < length {
+				return corrupt(position, "frame longer than its block")
+			}
+			frame := block[n : n+int(length)]
+			block = block[n+int(length):]
+			if marker && bytes.Equal(frame, offsetsMarker) {
+				continue
+			}
+			if len(frame) < fb.SizeUint64+model.MetaDataSize {
+				return corrupt(position, "frame of %d bytes is shorter than an entry", len(frame))
+			}
+			offset := fb.GetUint64(frame)
+			previous := next
+			if len(offsets) > 0 {
+				previous = offsets[len(offsets)-1] + 1
+			}
+			if offset < previous || offset >= limit {
+				return corrupt(position, "entry at offset %d is out of order", offset)
+			}
+			offsets = append(offsets, offset)
+			entries = append(entries, model.LogEntry(frame[fb.SizeUint64:]))
+		}
+
+		if len(offsets) > 0 {
+			check.blocks = append(check.blocks, blockIndexEntry{offsets[0], position})
+			next = offsets[len(offsets)-1] + 1
+		}
+		for i, offset := range offsets {
+			if err := fn(offset, entries[i]); err != nil {
+				return check, err
+			}
+		}
+		position += int64(fb.SizeUint32 + len(unit))
+	}
+	//only the last segment may still be appended to
+	if check.encrypted && !final && limit != math.MaxUint64 {
+		return corrupt(position, "sealed segment ends without its final chunk")
+	}
+
+	if index, err := readBlockIndex(indexPath(seg.path)); err == nil {
+		check.staleIndex = len(index) != len(check.blocks)
+		for i := 0; i < len(index) && !check.staleIndex; i++ {
+			check.staleIndex = index[i] != check.blocks[i]
+		}
+	}
+	return check, nil
+}
+
+//checkLegacySegment checks a segment which is a single deflate stream,
+//which ends torn as it was never closed. As the stream was flushed after
+//every write, it is truncated if it ends within an entry.
+func checkLegacySegment(seg segment, limit uint64, fn func(offset uint64, entry model.LogEntry) error) (segmentCheck, error) {
+	var check segmentCheck
+	reader, err := seg.open()
+	if err != nil {
+		return check, err
+	}
+	defer reader.Close()
+
+	next := seg.base
+	offsets := false
+	counter := &countingReader{r: reader}
+	var scanned int64
+	scanner := bufio.NewScanner(counter)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := ScanPayloadSplitFunc(data, atEOF)
+		scanned += int64(advance)
+		return advance, token, err
+	})
+	for first := true; scanner.Scan(); first = false {
+		frame := scanner.Bytes()
+		if first && bytes.Equal(frame, offsetsMarker) {
+			offsets = true
+			continue
+		}
+		offset := next
+		if offsets {
+			if len(frame) < fb.SizeUint64 {
+				check.corrupt = &CorruptRange{seg.path, next, -1, "frame shorter than its offset"}
+				return check, nil
+			}
+			offset = fb.GetUint64(frame)
+			frame = frame[fb.SizeUint64:]
+		}
+		if offset < next || offset >= limit {
+			check.corrupt = &CorruptRange{seg.path, next, -1, fmt.Sprintf("entry at offset %d is out of order", offset)}
+			return check, nil
+		}
+		if len(frame) < model.MetaDataSize {
+			check.corrupt = &CorruptRange{seg.path, next, -1, fmt.Sprintf("entry at offset %d is shorter than its MetaData", offset)}
+			return check, nil
+		}
+		if err := fn(offset, append(model.LogEntry(nil), frame...)); err != nil {
+			return check, err
+		}
+		next = offset + 1
+	}
+	if err := scanner.Err(); err != nil && err != io.ErrUnexpectedEOF {
+		check.corrupt = &CorruptRange{seg.path, next, -1, err.Error()}
+	} else if torn := counter.n - scanned; torn > 0 {
+		check.corrupt = &CorruptRange{seg.path, next, -1, fmt.Sprintf("stream is truncated within an entry, %d bytes of which are left", torn)}
+	}
+	return check, nil
+}
+
+//repairSegment truncates the segment at its corrupt range, copying the
+//range to the quarantine directory first if there is one, and rewrites its
+//block index if it is stale. A segment which is a single deflate stream is
+//rewritten in blocks with the entries which could be read, as is an
+//encrypted segment so that it ends in its final chunk.
+func repairSegment(seg segment, limit uint64, check segmentCheck, quarantine string) error {
+	if check.corrupt == nil {
+		return repairIndex(seg, check)
+	}
+	if quarantine != "" {
+		position := check.corrupt.Position
+		if position < 0 {
+			position = 0
+		}
+		if err := quarantineRange(seg.path, position, quarantine); err != nil {
+			return err
+		}
+	}
+
+	if !check.inBlocks || check.encrypted {
+		err := seg.replace(func(w *segmentWriter) error {
+			_, err := checkSegment(seg, limit, func(offset uint64, entry model.LogEntry) error {
+				if offset < check.corrupt.Offset {
+					return w.writeEntry(offset, entry)
+				}
+				return nil
+			})
+			return err
+		})
+		//a log file which is not a segment yet gets its index once it is
+		if err == nil && filepath.Base(seg.path) == legacyLogFile {
+			err = os.Remove(indexPath(seg.path))
+		}
+		return err
+	}
+
+	if err := os.Truncate(seg.path, check.corrupt.Position); err != nil {
+		return err
+	}
+	return repairIndex(seg, check)
+}
+
+//repairIndex writes the block index of the segment afresh if it is stale or
+//the segment has been truncated
+func repairIndex(seg segment, check segmentCheck) error {
+	if check.corrupt != nil || check.staleIndex {
+		var index []byte
+		for _, block := range check.blocks {
+			index = append(index, encodeBlockIndexEntry(block)...)
+		}
+		return writeFile(indexPath(seg.path), index)
+	}
+	return nil
+}
+
+//quarantineRange copies the file from the position onwards to the
+//directory
+func quarantineRange(path string, position int64, directory string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(position, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = copyFile(file, filepath.Join(directory, fmt.Sprintf("%s.%d.corrupt", filepath.Base(path), position)))
+	return err
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
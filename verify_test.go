@@ -0,0 +1,86 @@
+package dlog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/netbrain/dlog/testdata"
+)
+
+func TestVerifyFindsAndRepairsCorruptRange(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+	log := filepath.Join(dir, "log")
+
+	logger, _ := NewLoggerWithOptions(log, LoggerOptions{Codec: NoCodec, BlockSize: 1})
+	for x := 0; x < 10; x++ {
+		logger.Write(NewLogEntryTestData().WithPayload([]byte(fmt.Sprint(x))).Build())
+	}
+	logger.Sync()
+	checksums, _, _ := logger.Checksums(1000, 0, 10)
+	seg := segmentsOf(logger)[0]
+	logger.Close()
+
+	report, err := Verify(log, VerifyOptions{})
+	if err != nil || !report.Ok() || report.Entries != 10 || report.NextOffset != 10 || report.Checksum != checksums[0] {
+		t.Fatalf("expected 10 entries of checksum %08x, got %s: %v", checksums[0], report, err)
+	}
+
+	//the payload of the entry at offset 5 is changed, its block still
+	//decodes to valid frames
+	index, _ := readBlockIndex(indexPath(seg.path))
+	data, _ := ioutil.ReadFile(seg.path)
+	data[index[6].position-1] = 'x'
+	ioutil.WriteFile(seg.path, data, 0644)
+
+	report, _ = Verify(log, VerifyOptions{})
+	if len(report.Corrupt) != 1 || report.Corrupt[0].Offset != 5 || report.Corrupt[0].Position != index[5].position || report.Entries != 5 {
+		t.Fatalf("expected the range from offset 5 to be corrupt, got %s", report)
+	}
+	if reason := report.Corrupt[0].Reason; reason != errBlockChecksum.Error() {
+		t.Fatalf("expected the block not to match its checksum, got '%s'", reason)
+	}
+
+	quarantine := filepath.Join(dir, "quarantine")
+	if report, err = Verify(log, VerifyOptions{Repair: true, QuarantineDirectory: quarantine}); err != nil || !report.Repaired {
+		t.Fatalf("expected the corrupt range to be repaired, got %s: %v", report, err)
+	}
+	quarantined, _ := ioutil.ReadFile(filepath.Join(quarantine, fmt.Sprintf("%s.%d.corrupt", filepath.Base(seg.path), index[5].position)))
+	if len(quarantined) != len(data)-int(index[5].position) {
+		t.Fatalf("expected the corrupt range of %d bytes to be quarantined, got %d", len(data)-int(index[5].position), len(quarantined))
+	}
+	if report, _ = Verify(log, VerifyOptions{}); !report.Ok() || report.Entries != 5 {
+		t.Fatalf("expected the 5 entries before the corrupt range to be left, got %s", report)
+	}
+
+	logger, _ = NewLoggerWithOptions(log, LoggerOptions{Codec: NoCodec, BlockSize: 1})
+	defer logger.Close()
+	if offset := logger.Offset(); offset != 5 {
+		t.Fatalf("expected the log to continue at offset 5, got %d", offset)
+	}
+}
+
+func TestVerifyRewritesStaleBlockIndex(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dlog")
+	defer os.RemoveAll(dir)
+
+	logger, _ := NewLoggerWithOptions(dir, LoggerOptions{SegmentSize: 1, BlockSize: 1})
+	for x := 0; x < 3; x++ {
+		logger.Write(NewLogEntryTestData().Build())
+		logger.Sync()
+	}
+	seg := segmentsOf(logger)[1]
+	logger.Close()
+	ioutil.WriteFile(indexPath(seg.path), encodeBlockIndexEntry(blockIndexEntry{7, 100}), 0644)
+
+	report, err := Verify(dir, VerifyOptions{Repair: true})
+	if err != nil || len(report.StaleIndexes) != 1 || report.StaleIndexes[0] != seg.path || !report.Repaired {
+		t.Fatalf("expected the stale index of %s to be repaired, got %s: %v", seg.path, report, err)
+	}
+	if report, _ = Verify(dir, VerifyOptions{}); !report.Ok() || report.Entries != 3 {
+		t.Fatalf("expected the index to match its segment, got %s", report)
+	}
+}